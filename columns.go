@@ -0,0 +1,430 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// The per-process columns shown by both text mode and termui, selected with -o.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/codahale/hdrhistogram"
+	lib "github.com/uber-common/cpustat/lib"
+)
+
+const defaultColumns = "name,pid,min,max,usr,sys,runq,iow,swap,vcx,icx,ctime,rss,nice,thrd,sam"
+
+// the flexible width column never gets narrower than this
+const minFlexWidth = 20
+
+// procRow is everything a column might want to know about one process in a summary
+type procRow struct {
+	pid      int
+	info     *lib.ProcInfo
+	sum      *lib.ProcSample
+	proc     *lib.ProcStatsHist
+	task     *lib.TaskStatsHist // nil if taskstats never answered for this pid
+	count    int64
+	jiffy    int
+	interval int
+}
+
+// newProcRow gathers the summary data for pid, which is false if some of it is missing
+func newProcRow(pid int, infoMap lib.ProcInfoMap, procSum lib.ProcSampleMap,
+	procHist lib.ProcStatsHistMap, taskHist lib.TaskStatsHistMap, jiffy, interval int) (*procRow, bool) {
+
+	row := procRow{pid: pid, task: taskHist[pid], jiffy: jiffy, interval: interval}
+	var ok bool
+	if row.info, ok = infoMap[pid]; ok == false {
+		return nil, false
+	}
+	if row.sum, ok = procSum[pid]; ok == false {
+		return nil, false
+	}
+	if row.proc, ok = procHist[pid]; ok == false {
+		return nil, false
+	}
+	row.count = row.proc.Ustime.TotalCount()
+	return &row, true
+}
+
+// percent of a CPU for a single sample measured in clock ticks
+func (r *procRow) tickPct(val float64) float64 {
+	return lib.TicksPct(val, r.jiffy, float64(r.interval))
+}
+
+// percent of a CPU over the whole summary for a total measured in clock ticks
+func (r *procRow) tickAvg(total uint64) float64 {
+	return lib.TicksPct(float64(total), r.jiffy, r.windowSec()*1000)
+}
+
+// percent of a CPU for a single sample measured in ns
+func (r *procRow) nsPct(val float64) float64 {
+	return lib.NsPct(val, float64(r.interval))
+}
+
+// percent of a CPU over the whole summary for a total measured in ns
+func (r *procRow) nsAvg(total uint64) float64 {
+	return lib.NsPct(float64(total), r.windowSec()*1000)
+}
+
+func (r *procRow) perSec(total uint64) float64 {
+	return float64(total) / r.windowSec()
+}
+
+func (r *procRow) windowSec() float64 {
+	return float64(r.interval) * float64(r.count) / 1000
+}
+
+type column struct {
+	name  string
+	desc  string
+	width int  // 0 for the column that takes up whatever width is left
+	left  bool // left align, otherwise right
+	text  bool // truncate to width, numbers are already trimmed to fit
+	ident bool // highlighted with the process color in termui
+	value func(r *procRow) string
+}
+
+func (c *column) flex() bool {
+	return c.width == 0
+}
+
+var policyNames = []string{"other", "fifo", "rr", "batch", "iso", "idle", "dl"}
+
+var userNames = make(map[uint32]string)
+
+func userName(uid uint32) string {
+	if name, ok := userNames[uid]; ok {
+		return name
+	}
+	name := fmt.Sprint(uid)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	userNames[uid] = name
+	return name
+}
+
+func cmdline(info *lib.ProcInfo) string {
+	if len(info.Cmdline) == 0 {
+		return info.Comm
+	}
+	return strings.Join(info.Cmdline, " ")
+}
+
+var columnList = []*column{
+	{name: "name", desc: "friendly name", width: 26, text: true, ident: true,
+		value: func(r *procRow) string { return r.info.Friendly }},
+	{name: "comm", desc: "short name from /proc/pid/stat", width: 16, text: true, ident: true,
+		value: func(r *procRow) string { return r.info.Comm }},
+	{name: "pid", desc: "process id", width: 6, ident: true,
+		value: func(r *procRow) string { return fmt.Sprint(r.pid) }},
+	{name: "ppid", desc: "parent process id", width: 6,
+		value: func(r *procRow) string { return fmt.Sprint(r.info.Ppid) }},
+	{name: "pgrp", desc: "process group id", width: 6,
+		value: func(r *procRow) string { return fmt.Sprint(r.info.Pgrp) }},
+	{name: "sid", desc: "session id", width: 6,
+		value: func(r *procRow) string { return fmt.Sprint(r.info.Session) }},
+	{name: "tty", desc: "controlling terminal device number", width: 6,
+		value: func(r *procRow) string { return fmt.Sprint(r.info.Ttynr) }},
+	{name: "tpgid", desc: "foreground process group of the terminal", width: 6,
+		value: func(r *procRow) string { return fmt.Sprint(r.info.Tpgid) }},
+	{name: "flags", desc: "kernel flags word, in hex", width: 8,
+		value: func(r *procRow) string { return strconv.FormatUint(r.info.Flags, 16) }},
+	{name: "start", desc: "start time in clock ticks after boot", width: 10,
+		value: func(r *procRow) string { return fmt.Sprint(r.info.Starttime) }},
+	{name: "nice", desc: "nice value", width: 4,
+		value: func(r *procRow) string { return fmt.Sprint(r.info.Nice) }},
+	{name: "rtprio", desc: "real time priority", width: 6,
+		value: func(r *procRow) string { return fmt.Sprint(r.info.Rtpriority) }},
+	{name: "policy", desc: "scheduling policy", width: 6,
+		value: func(r *procRow) string {
+			if r.info.Policy < uint64(len(policyNames)) {
+				return policyNames[r.info.Policy]
+			}
+			return fmt.Sprint(r.info.Policy)
+		}},
+	{name: "uid", desc: "user id", width: 6,
+		value: func(r *procRow) string { return fmt.Sprint(r.info.UID) }},
+	{name: "user", desc: "user name", width: 8, text: true,
+		value: func(r *procRow) string { return userName(r.info.UID) }},
+	{name: "min", desc: "lowest usr+sys sample, percent of a CPU", width: 7,
+		value: func(r *procRow) string { return trim(r.tickPct(float64(r.proc.Ustime.Min())), 7) }},
+	{name: "max", desc: "highest usr+sys sample, percent of a CPU", width: 7,
+		value: func(r *procRow) string { return trim(r.tickPct(float64(r.proc.Ustime.Max())), 7) }},
+	{name: "usr", desc: "average user time, percent of a CPU", width: 7,
+		value: func(r *procRow) string { return trim(r.tickAvg(r.sum.Proc.Utime), 7) }},
+	{name: "sys", desc: "average system time, percent of a CPU", width: 7,
+		value: func(r *procRow) string { return trim(r.tickAvg(r.sum.Proc.Stime), 7) }},
+	{name: "runq", desc: "average time waiting for a CPU, percent of a CPU", width: 7,
+		value: func(r *procRow) string { return trim(r.nsAvg(r.sum.Task.Cpudelaytotal), 7) }},
+	{name: "iow", desc: "average time blocked on disk IO, percent of a CPU", width: 7,
+		value: func(r *procRow) string { return trim(r.nsAvg(r.sum.Task.Blkiodelaytotal), 7) }},
+	{name: "swap", desc: "average time waiting for swap in, percent of a CPU", width: 7,
+		value: func(r *procRow) string { return trim(r.nsAvg(r.sum.Task.Swapindelaytotal), 7) }},
+	{name: "vcx", desc: "voluntary context switches", width: 5,
+		value: func(r *procRow) string { return formatNum(r.sum.Task.Nvcsw) }},
+	{name: "icx", desc: "involuntary context switches", width: 5,
+		value: func(r *procRow) string { return formatNum(r.sum.Task.Nivcsw) }},
+	{name: "ctime", desc: "average usr+sys time of exited children, percent of a CPU", width: 7,
+		value: func(r *procRow) string { return trim(r.tickAvg(r.sum.Proc.Cutime+r.sum.Proc.Cstime), 7) }},
+	{name: "rss", desc: "resident memory", width: 5,
+		value: func(r *procRow) string { return formatMem(r.sum.Proc.Rss) }},
+	{name: "thrd", desc: "thread count", width: 4,
+		value: func(r *procRow) string { return fmt.Sprint(r.sum.Proc.Numthreads) }},
+	{name: "rbytes", desc: "storage bytes read per second", width: 6,
+		value: func(r *procRow) string { return formatNum(uint64(r.perSec(r.sum.Task.Readbytes))) }},
+	{name: "wbytes", desc: "storage bytes written per second", width: 6,
+		value: func(r *procRow) string { return formatNum(uint64(r.perSec(r.sum.Task.Writebytes))) }},
+	{name: "sam", desc: "samples in this summary", width: 4,
+		value: func(r *procRow) string { return fmt.Sprint(r.count) }},
+	{name: "cmdline", desc: "full command line, fills the rest of the line", left: true, text: true,
+		value: func(r *procRow) string { return cmdline(r.info) }},
+}
+
+// histogram metrics get a column for each per-sample statistic, like usr.max or runq.p95
+var histMetrics = []struct {
+	name string
+	desc string
+	ns   bool
+	hist func(r *procRow) *hdrhistogram.Histogram
+}{
+	{"usr", "user time", false, func(r *procRow) *hdrhistogram.Histogram { return r.proc.Utime }},
+	{"sys", "system time", false, func(r *procRow) *hdrhistogram.Histogram { return r.proc.Stime }},
+	{"cpu", "usr+sys time", false, func(r *procRow) *hdrhistogram.Histogram { return r.proc.Ustime }},
+	{"cusr", "user time of exited children", false, func(r *procRow) *hdrhistogram.Histogram { return r.proc.Cutime }},
+	{"csys", "system time of exited children", false, func(r *procRow) *hdrhistogram.Histogram { return r.proc.Cstime }},
+	{"ctime", "usr+sys time of exited children", false, func(r *procRow) *hdrhistogram.Histogram { return r.proc.Custime }},
+	{"runq", "time waiting for a CPU", true, taskHist(func(h *lib.TaskStatsHist) *hdrhistogram.Histogram { return h.Cpudelay })},
+	{"iow", "time blocked on disk IO", true, taskHist(func(h *lib.TaskStatsHist) *hdrhistogram.Histogram { return h.Iowait })},
+	{"swap", "time waiting for swap in", true, taskHist(func(h *lib.TaskStatsHist) *hdrhistogram.Histogram { return h.Swap })},
+}
+
+func taskHist(fn func(*lib.TaskStatsHist) *hdrhistogram.Histogram) func(*procRow) *hdrhistogram.Histogram {
+	return func(r *procRow) *hdrhistogram.Histogram {
+		if r.task == nil {
+			return nil
+		}
+		return fn(r.task)
+	}
+}
+
+var histStats = []struct {
+	name  string
+	desc  string
+	value func(h *hdrhistogram.Histogram) float64
+}{
+	{"min", "lowest sample", func(h *hdrhistogram.Histogram) float64 { return float64(h.Min()) }},
+	{"avg", "average sample", func(h *hdrhistogram.Histogram) float64 { return h.Mean() }},
+	{"max", "highest sample", func(h *hdrhistogram.Histogram) float64 { return float64(h.Max()) }},
+	{"p95", "95th percentile sample", func(h *hdrhistogram.Histogram) float64 { return float64(h.ValueAtQuantile(95)) }},
+}
+
+var columnsByName = make(map[string]*column)
+
+func init() {
+	for _, metric := range histMetrics {
+		for _, stat := range histStats {
+			metric, stat := metric, stat
+			name := metric.name + "." + stat.name
+			width := 7
+			if len(name) > width {
+				width = len(name)
+			}
+			columnList = append(columnList, &column{
+				name:  name,
+				desc:  fmt.Sprintf("%s of %s, percent of a CPU", stat.desc, metric.desc),
+				width: width,
+				value: func(r *procRow) string {
+					hist := metric.hist(r)
+					if hist == nil {
+						return ""
+					}
+					val := stat.value(hist)
+					if metric.ns {
+						return trim(r.nsPct(val), width)
+					}
+					return trim(r.tickPct(val), width)
+				},
+			})
+		}
+	}
+	for _, col := range columnList {
+		columnsByName[col.name] = col
+	}
+}
+
+// parseColumns turns a list like "name,pid,usr.max" into columns
+func parseColumns(spec string) ([]*column, error) {
+	var cols []*column
+	flex := 0
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		col, ok := columnsByName[name]
+		if ok == false {
+			return nil, fmt.Errorf("unknown column %q, use -o help to list them", name)
+		}
+		if col.flex() {
+			flex++
+		}
+		cols = append(cols, col)
+	}
+	if flex > 1 {
+		return nil, fmt.Errorf("only one cmdline column is allowed")
+	}
+	return cols, nil
+}
+
+func printColumnHelp() {
+	for _, col := range columnList {
+		fmt.Printf("%-12s %s\n", col.name, col.desc)
+	}
+}
+
+// layout figures out how wide each column is for a screen that is totalWidth wide.
+// A totalWidth of 0 means unknown, and the flexible column is never truncated.
+func layout(cols []*column, totalWidth int) []int {
+	widths := make([]int, len(cols))
+	used := 0
+	flexPos := -1
+	for i, col := range cols {
+		if col.flex() {
+			flexPos = i
+			continue
+		}
+		widths[i] = col.width
+		if n := utf8.RuneCountInString(col.name); n > widths[i] {
+			widths[i] = n
+		}
+		used += widths[i] + 1
+	}
+	if flexPos >= 0 && totalWidth > 0 {
+		widths[flexPos] = totalWidth - used
+		if widths[flexPos] < minFlexWidth {
+			widths[flexPos] = minFlexWidth
+		}
+	}
+	return widths
+}
+
+func pad(str string, width int, left bool) string {
+	if width == 0 {
+		return str
+	}
+	if left {
+		return fmt.Sprintf("%-*s", width, str)
+	}
+	return fmt.Sprintf("%*s", width, str)
+}
+
+func formatHeader(cols []*column, widths []int) []string {
+	cells := make([]string, len(cols))
+	for i, col := range cols {
+		cells[i] = pad(col.name, widths[i], col.left)
+	}
+	return cells
+}
+
+// formatCells formats each column of one row, with the raw value of the flexible column
+// left untruncated so the caller can choose how to fit it.
+func formatCells(cols []*column, widths []int, row *procRow) []string {
+	cells := make([]string, len(cols))
+	for i, col := range cols {
+		val := col.value(row)
+		if col.text && col.flex() == false {
+			val = trunc(val, widths[i])
+		}
+		if col.flex() {
+			cells[i] = val
+		} else {
+			cells[i] = pad(val, widths[i], col.left)
+		}
+	}
+	return cells
+}
+
+// fitFlex truncates the flexible column to its width and returns the part that was cut off
+func fitFlex(cols []*column, widths []int, cells []string) string {
+	for i, col := range cols {
+		if col.flex() && widths[i] > 0 {
+			var rest string
+			cells[i], rest = cutRunes(cells[i], widths[i])
+			return rest
+		}
+	}
+	return ""
+}
+
+// cutRunes splits str after n runes, since a terminal column fits a rune, not a byte
+func cutRunes(str string, n int) (string, string) {
+	for i := range str {
+		if n == 0 {
+			return str[:i], str[i:]
+		}
+		n--
+	}
+	return str, ""
+}
+
+// fitLines joins cells into lines of text. The flexible column is truncated to its width,
+// unless wrap is set and it is the last column, in which case it continues on more lines
+// indented to where it starts.
+func fitLines(cols []*column, widths []int, cells []string, wrap bool) []string {
+	rest := fitFlex(cols, widths, cells)
+	lines := []string{strings.TrimRight(strings.Join(cells, " "), " ")}
+
+	last := len(cols) - 1
+	if wrap == false || last < 0 || cols[last].flex() == false {
+		return lines
+	}
+	indent := strings.Repeat(" ", utf8.RuneCountInString(lines[0])-utf8.RuneCountInString(cells[last]))
+	for len(rest) > 0 {
+		var line string
+		line, rest = cutRunes(rest, widths[last])
+		lines = append(lines, indent+line)
+	}
+	return lines
+}
+
+type winsize struct {
+	Row, Col, Xpixel, Ypixel uint16
+}
+
+// termWidth returns the width of the terminal on stdout, or 0 if it isn't a terminal
+func termWidth() int {
+	var ws winsize
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdout.Fd(),
+		uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	if errno == 0 && ws.Col > 0 {
+		return int(ws.Col)
+	}
+	if cols, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil {
+		return cols
+	}
+	return 0
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uber-common/cpustat/lib"
+)
+
+// burstLog keeps the most recent bursts for /bursts, and writes each one to out
+type burstLog struct {
+	sync.Mutex
+	bursts []cpustat.Burst
+	keep   int
+	out    *json.Encoder
+}
+
+func newBurstLog(keep int, out io.Writer) *burstLog {
+	l := burstLog{keep: keep}
+	if out != nil {
+		l.out = json.NewEncoder(out)
+		l.out.SetEscapeHTML(false)
+	}
+	return &l
+}
+
+func (l *burstLog) add(bursts []cpustat.Burst) {
+	l.Lock()
+	defer l.Unlock()
+	for _, b := range bursts {
+		if l.out != nil {
+			if err := l.out.Encode(b); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	l.bursts = append(l.bursts, bursts...)
+	if extra := len(l.bursts) - l.keep; extra > 0 {
+		l.bursts = append(l.bursts[:0], l.bursts[extra:]...)
+	}
+}
+
+// ServeHTTP lists the bursts that ended recently, oldest first. The since parameter is
+// an RFC3339 time or a duration like 5m, and pid and name pick out one process.
+func (l *burstLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var since time.Time
+	if str := query.Get("since"); str != "" {
+		if ago, err := time.ParseDuration(str); err == nil {
+			since = time.Now().Add(-ago)
+		} else if since, err = time.Parse(time.RFC3339, str); err != nil {
+			http.Error(w, "since must be a duration or RFC3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	pid := -1
+	if str := query.Get("pid"); str != "" {
+		var err error
+		if pid, err = strconv.Atoi(str); err != nil {
+			http.Error(w, "pid must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	name := query.Get("name")
+
+	matched := []cpustat.Burst{}
+	l.Lock()
+	for _, b := range l.bursts {
+		if b.End.Before(since) || (pid >= 0 && b.Pid != pid) || (name != "" && b.Name != name) {
+			continue
+		}
+		matched = append(matched, b)
+	}
+	l.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(matched)
+}
+
+// runBursts feeds every new sample to the detector about once a second
+func runBursts(detector *cpustat.BurstDetector, bursts *burstLog, memdb *MemDB, infoMap cpustat.ProcInfoMap) {
+	period := time.Second
+	// read twice as many samples as a period has, so none are missed when a tick is late
+	samples := uint32(2 * period / (time.Duration(intervalms) * time.Millisecond))
+	var last time.Time
+	for range time.Tick(period) {
+		win := readWindow(memdb, samples)
+		var ended []cpustat.Burst
+		infolock.Lock()
+		for i, sysDelta := range win.sysDeltas {
+			if sysDelta.CaptureTime.After(last) == false {
+				continue
+			}
+			ended = append(ended, detector.Add(win.procDeltas[i], win.carried[i], sysDelta, infoMap)...)
+			last = sysDelta.CaptureTime
+		}
+		infolock.Unlock()
+		if len(ended) > 0 {
+			bursts.add(ended)
+		}
+	}
+}
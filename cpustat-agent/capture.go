@@ -0,0 +1,117 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// The whole buffer as a cpustat capture file, served at /capture, so anything that reads
+// captures can read from a running agent too. The high resolution buffer is at /hires.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/uber-common/cpustat/lib"
+)
+
+type captureHandler struct {
+	memdb   *MemDB
+	infoMap cpustat.ProcInfoMap
+	jiffy   int
+	filters string // the -p and -u options
+	name    string // time format of the file name
+}
+
+func (h *captureHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	file := captureFile{out: w, infoMap: h.infoMap, jiffy: h.jiffy, filters: h.filters}
+	err := h.memdb.Range(h.memdb.DBCount(), func(e *dbEntry, follows bool) error {
+		if file.writer == nil {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+				e.Sys.CaptureTime.Format(h.name)))
+		}
+		return file.write(e)
+	})
+	if err == nil && file.writer == nil {
+		http.Error(w, "no samples yet", http.StatusServiceUnavailable)
+		return
+	}
+	if err == nil {
+		err = file.close()
+	}
+	if err != nil {
+		log.Println("writing capture:", err)
+	}
+}
+
+// captureFile writes entries, which all have the same interval, as a capture file, one at a
+// time, so the buffer doesn't have to be copied all at once to send it to a slow client
+type captureFile struct {
+	out     io.Writer
+	infoMap cpustat.ProcInfoMap
+	jiffy   int
+	filters string
+	writer  *cpustat.CaptureWriter
+	infos   cpustat.ProcInfoMap // copied from infoMap, for the processes written so far
+}
+
+func (c *captureFile) write(e *dbEntry) error {
+	if c.writer == nil {
+		header := cpustat.CaptureHeader{
+			Interval: int(e.Interval),
+			Jiffy:    c.jiffy,
+			Filters:  c.filters,
+			Start:    e.Sys.CaptureTime,
+		}
+		var err error
+		if c.writer, err = cpustat.NewCaptureWriter(c.out, header); err != nil {
+			return err
+		}
+		c.infos = make(cpustat.ProcInfoMap)
+	}
+	c.copyInfos(&e.Proc)
+	return c.writer.WriteSample(&e.Proc, &e.Sys, c.infos)
+}
+
+// close finishes the file, if anything was written to it
+func (c *captureFile) close() error {
+	if c.writer == nil {
+		return nil
+	}
+	return c.writer.Close()
+}
+
+// copyInfos copies what infoMap has about procs, so the capture can be written to a slow
+// client without holding infolock, which sampling needs every interval
+func (c *captureFile) copyInfos(procs *cpustat.ProcSampleList) {
+	infolock.Lock()
+	defer infolock.Unlock()
+	for i := uint32(0); i < procs.Len; i++ {
+		pid := procs.Samples[i].Pid
+		if _, ok := c.infos[pid]; ok {
+			continue
+		}
+		if info, ok := c.infoMap[pid]; ok {
+			copied := *info
+			c.infos[pid] = &copied
+		}
+	}
+}
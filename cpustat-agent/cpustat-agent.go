@@ -24,8 +24,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"os"
@@ -33,7 +35,6 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"sync"
-	"syscall"
 	"time"
 
 	"net/http"
@@ -57,6 +58,42 @@ func main() {
 	var pidOnly = flag.String("p", "", "only show procs in this list of pids")
 	var statsInterval = flag.String("statsinterval", "1s", "print usage statistics to stdout, 0s to disable")
 	var pruneChance = flag.Float64("prunechance", 0.001, "percentage of intervals to also prune old cmdline data")
+	var nameRules = flag.String("names", "", "load friendly name rules from this JSON file")
+	var jiffy = flag.Int("jiffy", 100, "length of a jiffy")
+	var metricsWindow = flag.Duration("metricswindow", 10*time.Second, "length of the window summarized by each /metrics scrape")
+	var metricsTopK = flag.Int("metricstopk", 20, "limit on process groups with their own /metrics series")
+	var metricsSort = flag.String("metricssort", "cpuavg", "rank processes for /metrics by this cpustat -sort key")
+	var metricsLabels = flag.String("metricslabels", "name,user,cgroup", "label /metrics process groups with pid, name, comm, user and cgroup")
+	var otlpEndpoint = flag.String("otlp", "", "export to an OpenTelemetry collector at this host:port")
+	var otlpProtocol = flag.String("otlpprotocol", "grpc", "OTLP protocol, grpc or http")
+	var otlpInterval = flag.Duration("otlpinterval", 10*time.Second, "time between OTLP exports")
+	var otlpTopK = flag.Int("otlptopk", 20, "export this many of the top processes over OTLP")
+	var otlpSort = flag.String("otlpsort", "cpuavg", "rank processes for OTLP by this cpustat -sort key")
+	var triggerFile = flag.String("triggers", "", "run commands when processes match the rules in this JSON file")
+	var triggerLog = flag.String("triggerlog", "", "append trigger firings to this file instead of stderr")
+	var triggerWindow = flag.Duration("triggerwindow", 2*time.Second, "length of the window that triggers check")
+	var burstPct = flag.Float64("burst", 0, "find bursts of samples above this CPU percent, 0 to disable")
+	var burstSigma = flag.Float64("burstsigma", 0, "also find samples this many standard deviations over baseline")
+	var burstFile = flag.String("burstlog", "", "append bursts to this file as JSON lines")
+	var burstKeep = flag.Int("burstkeep", 1000, "recent bursts to keep for /bursts")
+	var slowEvery = flag.Int("slow", 0, "read processes that have been idle only every this many samples, 0 to read all of them every sample")
+	var slowAfter = flag.Int("slowafter", 25, "with -slow, samples without any CPU or delay before a process is read less often")
+	var fastTop = flag.Int("fasttop", 10, "with -slow, always read the processes that were busiest lately every sample")
+	var fastPct = flag.Float64("fastpct", 1, "with -slow, always read processes that lately used more than this percent of a CPU every sample")
+	var fastSpike = flag.Float64("fastspike", 80, "with -slow, read every process while all CPUs are busier than this percent, 0 to disable")
+	var hiresInterval = flag.Int("hires", 0, "when the system is busy, also sample every this many ms into a separate buffer, 0 to disable")
+	var hiresPeriod = flag.Duration("hiresfor", 10*time.Second, "keep up -hires sampling this long after the system was last busy")
+	var hiresCPU = flag.Float64("hirescpu", 90, "start -hires sampling when all CPUs are busier than this percent, 0 to disable")
+	var hiresRunq = flag.Int("hiresrunq", 0, "start -hires sampling when this many processes are running, 0 to disable")
+	var hiresPSI = flag.Float64("hirespsi", 0, "start -hires sampling when tasks wait for a CPU this percent of the time, 0 to disable")
+	var hiresSize = flag.Int("hiressize", 1000, "high resolution samples to keep in memory")
+	var hiresDir = flag.String("hiresdir", "", "also write each period of -hires sampling to a capture file in this directory")
+	var nice = flag.Int("nice", 0, "nice level of the sampling thread, negative to keep sampling on a saturated machine")
+	var rtPrio = flag.Int("rtprio", 0, "run the sampling thread with this SCHED_FIFO priority, 0 to disable")
+	var cgroup = flag.String("cgroup", "", "move the agent to this cgroup, created if needed")
+	var cpuWeight = flag.Int("cpuweight", 0, "CPU weight of -cgroup, where 100 is the default")
+	var mlock = flag.Bool("mlock", false, "lock the agent's memory in RAM as it is used")
+	var align = flag.Bool("align", false, "align samples to multiples of the interval on the wall clock")
 
 	if os.Geteuid() != 0 {
 		fmt.Println("This program uses the netlink taskstats inteface, so it must be run as root.")
@@ -70,6 +107,99 @@ func main() {
 		os.Exit(1)
 	}
 	intervalms = uint32(*interval)
+	if *slowEvery < 0 || *slowEvery == 1 || *slowAfter < 1 {
+		fmt.Println("The -slow option must be 0 or at least 2, and -slowafter at least 1")
+		os.Exit(1)
+	}
+	if *hiresInterval != 0 {
+		if *hiresInterval < 10 || *hiresInterval >= *interval {
+			fmt.Println("The -hires interval must be at least 10ms and less than -i")
+			os.Exit(1)
+		}
+		if *hiresCPU <= 0 && *hiresRunq <= 0 && *hiresPSI <= 0 {
+			fmt.Println("The -hires option needs one of -hirescpu, -hiresrunq or -hirespsi")
+			os.Exit(1)
+		}
+		if *slowEvery > 0 {
+			fmt.Println("The -hires and -slow options can't be used together")
+			os.Exit(1)
+		}
+	}
+
+	if *nameRules != "" {
+		if err := cpustat.LoadNameRules(*nameRules); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	metricsConf := metricsConfig{
+		samples: uint32(*metricsWindow / (time.Duration(*interval) * time.Millisecond)),
+		topK:    *metricsTopK,
+		jiffy:   *jiffy,
+	}
+	var err error
+	if metricsConf.sortKey, err = cpustat.ParseSortKey(*metricsSort); err != nil {
+		log.Fatal(err)
+	}
+	if metricsConf.labels, err = parseMetricLabels(*metricsLabels); err != nil {
+		log.Fatal(err)
+	}
+	if metricsConf.samples < 1 || metricsConf.samples >= uint32(*dbSize) {
+		log.Fatal("the metrics window must be at least one interval and less than the db size")
+	}
+
+	var exporter *cpustat.OTLPExporter
+	otlpConf := otlpConfig{
+		samples: uint32(*otlpInterval / (time.Duration(*interval) * time.Millisecond)),
+		topK:    *otlpTopK,
+		jiffy:   *jiffy,
+	}
+	if *otlpEndpoint != "" {
+		if exporter, err = cpustat.NewOTLPExporter(*otlpEndpoint, *otlpProtocol); err != nil {
+			log.Fatal(err)
+		}
+		if otlpConf.sortKey, err = cpustat.ParseSortKey(*otlpSort); err != nil {
+			log.Fatal(err)
+		}
+		if otlpConf.samples < 1 || otlpConf.samples >= uint32(*dbSize) {
+			log.Fatal("the OTLP interval must be at least one sampling interval and less than the db size")
+		}
+	}
+
+	var triggers *cpustat.TriggerEngine
+	triggerSamples := uint32(*triggerWindow / (time.Duration(*interval) * time.Millisecond))
+	if *triggerFile != "" {
+		rules, err := cpustat.LoadTriggers(*triggerFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var logOut io.Writer = os.Stderr
+		if *triggerLog != "" {
+			if logOut, err = os.OpenFile(*triggerLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if triggerSamples < 1 || triggerSamples >= uint32(*dbSize) {
+			log.Fatal("the trigger window must be at least one interval and less than the db size")
+		}
+		triggers = cpustat.NewTriggerEngine(rules, logOut, *jiffy, *interval)
+	}
+
+	var bursts *burstLog
+	var detector *cpustat.BurstDetector
+	if *burstPct > 0 || *burstSigma > 0 {
+		detector = cpustat.NewBurstDetector(cpustat.BurstConfig{Threshold: *burstPct, Sigma: *burstSigma},
+			*jiffy, *interval)
+		var logOut io.Writer
+		if *burstFile != "" {
+			if logOut, err = os.OpenFile(*burstFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+				log.Fatal(err)
+			}
+		}
+		bursts = newBurstLog(*burstKeep, logOut)
+	} else if *burstFile != "" {
+		log.Fatal("the -burstlog option needs -burst or -burstsigma")
+	}
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -110,87 +240,149 @@ func main() {
 
 	filters := cpustat.FiltersInit(*usrOnly, *pidOnly)
 
-	nlConn := cpustat.NLInit()
-
 	rand.Seed(time.Now().UnixNano())
 
-	var t1, t2 time.Time
-
-	pids := make(cpustat.Pidlist, 0, *maxProcsToScan)
 	infoMap := make(cpustat.ProcInfoMap, *maxProcsToScan)
 
-	sample := memdb.ReserveSample()
+	// the main goroutine does the sampling from here on
+	protection := cpustat.Protection{Nice: *nice, RTPrio: *rtPrio, Cgroup: *cgroup, CPUWeight: *cpuWeight, Mlock: *mlock}
+	if err = cpustat.Protect(protection); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-	t1 = time.Now()
-	cpustat.GetPidList(&pids, *maxProcsToScan)
-	cpustat.ProcStatsReader(pids, filters, &sample.Proc, infoMap)
-	cpustat.TaskStatsReader(nlConn, pids, &sample.Proc)
-	cpustat.SystemStatsReader(&sample.Sys)
-	memdb.ReleaseSample()
+	var hr *hires
+	if *hiresInterval > 0 {
+		hiresdb := MemDB{}
+		hiresdb.Init(uint32(*hiresSize), uint32(*maxProcsToScan))
+		hr = newHires(hiresConfig{interval: uint32(*hiresInterval), period: *hiresPeriod, cpuPct: *hiresCPU,
+			runq: uint64(*hiresRunq), psi: *hiresPSI, dir: *hiresDir, jiffy: *jiffy,
+			filters: cpustat.CaptureFilters(*pidOnly, *usrOnly), every: *interval, align: *align}, &hiresdb, infoMap)
+		http.Handle("/hires", &captureHandler{memdb: &hiresdb, infoMap: infoMap, jiffy: *jiffy,
+			filters: cpustat.CaptureFilters(*pidOnly, *usrOnly), name: "cpustat-hires-20060102-150405.cps"})
+	}
 
-	go runServer(&memdb, infoMap)
+	// the buffer keeps raw samples, and the windows served from it are diffed when needed. With
+	// -hires, the sampler runs at the -hires interval during a period.
+	var sampler *cpustat.Sampler
+	var lastSys cpustat.SystemStats // of the main buffer
+	sampled := func(snap *cpustat.Snapshot) error {
+		procs, sys := sampler.Raw()
+		infolock.Lock()
+		infoMap.MaybePrune(*pruneChance, sampler.Live().Pids(), expiry)
+		infolock.Unlock()
+		if hr != nil && hr.store(sampler, procs, sys) == false {
+			return nil
+		}
+		memdb.WriteSample(procs, sys, intervalms)
 
-	go printStats(*statsInterval, &memdb)
+		missed := cpustat.MissedSamples(lastSys.CaptureTime, sys.CaptureTime, *interval)
+		if missed > 0 {
+			fmt.Fprintf(os.Stderr, "warning: fell behind and missed %d samples\n", missed)
+		}
+		schedule.add(missed, snap.Late)
+		if hr != nil && lastSys.CaptureTime.IsZero() == false {
+			hr.check(sampler, &lastSys, sys)
+		}
+		lastSys = *sys
+		return nil
+	}
 
-	go func() {
-		log.Println(http.ListenAndServe("0.0.0.0:6060", nil))
-	}()
+	overhead := cpustat.NewOverhead()
+	opts := []cpustat.SamplerOption{cpustat.WithInterval(*interval), cpustat.WithAlign(*align),
+		cpustat.WithMaxProcs(*maxProcsToScan), cpustat.WithJiffy(*jiffy), cpustat.WithFilters(filters),
+		cpustat.WithInfoMap(infoMap, &infolock), cpustat.WithoutProcDeltas(), cpustat.WithOverhead(overhead),
+		cpustat.WithCallback(sampled)}
+	// with tiers, idle processes are only read every few samples
+	if *slowEvery > 0 {
+		opts = append(opts, cpustat.WithTiers(cpustat.TierConfig{Every: *slowEvery, IdleAfter: *slowAfter,
+			TopN: *fastTop, MinPct: *fastPct, SpikePct: *fastSpike}))
+	}
+	if sampler, err = cpustat.NewSampler(opts...); err != nil {
+		log.Fatal(err)
+	}
 
-	t2 = time.Now()
+	go runServer(&memdb, infoMap)
 
-	targetSleep := time.Duration(*interval) * time.Millisecond
-	adjustedSleep := adjustSleep(targetSleep, t1, t2)
+	go printStats(*statsInterval, &memdb, overhead)
 
-	for {
-		time.Sleep(adjustedSleep)
+	http.Handle("/metrics", &metricsHandler{memdb: &memdb, infoMap: infoMap, config: metricsConf,
+		tiers: sampler.Tiers(), overhead: overhead})
+	http.Handle("/heatmap", &heatmapHandler{memdb: &memdb, infoMap: infoMap, jiffy: *jiffy})
+	http.Handle("/capture", &captureHandler{memdb: &memdb, infoMap: infoMap, jiffy: *jiffy,
+		filters: cpustat.CaptureFilters(*pidOnly, *usrOnly), name: "cpustat-20060102-150405.cps"})
 
-		// the time it takes to do all of the work will vary, so measure it each time and sleep for remainder
-		t1 = time.Now()
+	if triggers != nil {
+		go runTriggers(triggers, &memdb, infoMap, triggerSamples)
+	}
+	if bursts != nil {
+		http.Handle("/bursts", bursts)
+		go runBursts(detector, bursts, &memdb, infoMap)
+	}
+	if exporter != nil {
+		go runOTLPExport(exporter, &memdb, infoMap, otlpConf)
+	}
 
-		sample := memdb.ReserveSample()
-		cur := &sample.Proc
+	go func() {
+		log.Println(http.ListenAndServe("0.0.0.0:6060", nil))
+	}()
 
-		cpustat.GetPidList(&pids, *maxProcsToScan)
-		infolock.Lock()
-		cpustat.ProcStatsReader(pids, filters, cur, infoMap)
-		cpustat.TaskStatsReader(nlConn, pids, cur)
-		infoMap.MaybePrune(*pruneChance, pids, expiry)
-		infolock.Unlock()
-		cpustat.SystemStatsReader(&sample.Sys)
-		memdb.ReleaseSample()
+	log.Fatal(sampler.Start(context.Background()))
+}
 
-		t2 = time.Now()
-		adjustedSleep = adjustSleep(targetSleep, t1, t2)
-	}
+// scheduleStats counts samples that were missed or taken late since the agent started
+type scheduleStats struct {
+	sync.Mutex
+	timing *cpustat.SampleTiming
 }
 
-func adjustSleep(target time.Duration, t1, t2 time.Time) time.Duration {
-	adjustedSleep := target - t2.Sub(t1)
+var schedule = scheduleStats{timing: cpustat.NewSampleTiming()}
 
-	// If we can't keep up, try to buy ourselves a little headroom by sleeping for a magic number of extra ms
-	if adjustedSleep <= 0 {
-		fmt.Fprintf(os.Stderr, "warning: work cycle took longer than sampling interval by %s\n", adjustedSleep)
-		adjustedSleep = target + (time.Duration(100) * time.Millisecond)
-	}
-	return adjustedSleep
+func (s *scheduleStats) add(missed int, late time.Duration) {
+	s.Lock()
+	s.timing.Add(missed, late)
+	s.Unlock()
 }
 
-func printStats(s string, memdb *MemDB) {
+// read returns a copy of the timing so far
+func (s *scheduleStats) read() *cpustat.SampleTiming {
+	s.Lock()
+	defer s.Unlock()
+	timing := cpustat.NewSampleTiming()
+	timing.Merge(s.timing)
+	return timing
+}
+
+func printStats(s string, memdb *MemDB, overhead *cpustat.Overhead) {
 	dur, err := time.ParseDuration(s)
 	if err != nil {
 		panic(err)
 	}
+	if dur <= 0 {
+		return
+	}
 
 	start := time.Now()
+	var prev cpustat.OverheadStats
 	for {
-		var curUsage syscall.Rusage
-		err = syscall.Getrusage(syscall.RUSAGE_SELF, &curUsage)
+		stats, err := overhead.Stats()
 		if err != nil {
 			panic(err)
 		}
 		pcount, scount := memdb.DBStats()
-		fmt.Printf("dur: %s rss: %.2fMB db entries: %d procs: %d sys: %d\n",
-			time.Now().Sub(start), float64(curUsage.Maxrss)/1024, memdb.DBCount(), pcount, scount)
+		fmt.Printf("dur: %s rss: %.2fMB db entries: %d procs: %d sys: %d",
+			time.Now().Sub(start), float64(stats.MaxRSS)/(1024*1024), memdb.DBCount(), pcount, scount)
+
+		// what each collection cycle cost since the last line
+		if cycles := stats.Cycles - prev.Cycles; cycles > 0 {
+			fmt.Printf(" cycles: %d cpu/cycle: %s took/cycle: %s max: %s allocs/cycle: %d (%dKB)",
+				cycles, ((stats.CPU - prev.CPU) / time.Duration(cycles)).Round(time.Microsecond),
+				((stats.CycleTime - prev.CycleTime) / time.Duration(cycles)).Round(time.Microsecond),
+				time.Duration(stats.Cycle.Max())*time.Microsecond,
+				(stats.Mallocs-prev.Mallocs)/uint64(cycles), (stats.AllocBytes-prev.AllocBytes)/uint64(cycles)/1024)
+		}
+		fmt.Println()
+		prev = stats
 		time.Sleep(dur)
 	}
 }
@@ -0,0 +1,84 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Subsecond offset heatmaps of everything in the db, served at /heatmap
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+
+	"github.com/uber-common/cpustat/lib"
+)
+
+type heatmapHandler struct {
+	memdb   *MemDB
+	infoMap cpustat.ProcInfoMap
+	jiffy   int
+}
+
+// ServeHTTP draws the system, or the processes picked by the pid, name and cgroup query
+// parameters. It's SVG unless format=ansi, which is for curl in a terminal.
+func (h *heatmapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var match cpustat.ProcMatch
+	if pid := query.Get("pid"); pid != "" {
+		var err error
+		if match.Pid, err = strconv.Atoi(pid); err != nil {
+			http.Error(w, "pid must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	match.Name = query.Get("name")
+	match.Cgroup = query.Get("cgroup")
+	width, err := strconv.Atoi(query.Get("width"))
+	if err != nil {
+		width = 100
+	}
+
+	win := readWindow(h.memdb, h.memdb.DBCount())
+	heatmap := cpustat.NewHeatmap(int(intervalms))
+	infolock.Lock()
+	for i, sysDelta := range win.sysDeltas {
+		value := cpustat.HeatmapValue(win.procDeltas[i], sysDelta, h.infoMap, match, h.jiffy, int(intervalms))
+		heatmap.Add(sysDelta.CaptureTime, value)
+	}
+	infolock.Unlock()
+	if heatmap.Columns() == 0 {
+		http.Error(w, "not enough samples yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	title := match.String() + " busy, percent of all CPUs"
+	if match.Any() {
+		title = match.String() + " CPU, percent of one CPU"
+	}
+	var buf bytes.Buffer
+	if query.Get("format") == "ansi" {
+		heatmap.WriteANSI(&buf, title, width, 20)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		heatmap.WriteSVG(&buf, title)
+		w.Header().Set("Content-Type", "image/svg+xml")
+	}
+	w.Write(buf.Bytes())
+}
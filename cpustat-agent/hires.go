@@ -0,0 +1,184 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// High resolution sampling for when something interesting is happening. The agent normally
+// samples at a cheap interval, and when the system gets busy, it also samples every -hires
+// ms for -hiresfor into a separate buffer, served at /hires as a capture file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/uber-common/cpustat/lib"
+)
+
+type hiresConfig struct {
+	interval uint32        // ms
+	period   time.Duration // how long to keep going after the last sample over a threshold
+	cpuPct   float64       // busy percent of all CPUs, 0 to turn off
+	runq     uint64        // processes running or runnable, 0 to turn off
+	psi      float64       // percent of the time some task waited for a CPU, 0 to turn off
+	dir      string        // if set, each period is also written to a capture file here
+	jiffy    int
+	filters  string
+	every    int  // ms, of the main buffer
+	align    bool // of the main buffer's samples
+}
+
+type hires struct {
+	conf     hiresConfig
+	memdb    *MemDB
+	infoMap  cpustat.ProcInfoMap
+	start    time.Time // of the current period
+	until    time.Time // zero when not sampling
+	taken    uint32    // samples in the current period
+	pressure uint64    // CPU pressure total at the last check
+
+	// during a period, when the main buffer gets its next sample
+	main *cpustat.Scheduler
+}
+
+func newHires(conf hiresConfig, memdb *MemDB, infoMap cpustat.ProcInfoMap) *hires {
+	h := hires{conf: conf, memdb: memdb, infoMap: infoMap}
+	if conf.psi > 0 {
+		var err error
+		if h.pressure, err = cpustat.CPUPressure(); err != nil {
+			log.Println("hires: can't use -hirespsi:", err)
+			h.conf.psi = 0
+		}
+	}
+	return &h
+}
+
+// store puts a sample in the high resolution buffer during a period, and says if it's also
+// due in the main buffer, which still gets one each -i. It ends a period that is over, and
+// puts sampler back on the main interval.
+func (h *hires) store(sampler *cpustat.Sampler, procs *cpustat.ProcSampleList, sys *cpustat.SystemStats) bool {
+	if h.until.IsZero() {
+		return true
+	}
+	now := time.Now()
+	if now.Before(h.until) == false {
+		h.finish()
+		sampler.SetInterval(h.conf.every)
+		return true
+	}
+
+	h.memdb.WriteSample(procs, sys, h.conf.interval)
+	h.taken++
+	if h.main.Sleep() > 0 {
+		return false
+	}
+	h.main.Sampled(now)
+	return true
+}
+
+// check looks at the last two samples of the main buffer, which are -i apart, and starts a period, or makes the
+// current one longer, if any threshold was crossed
+func (h *hires) check(sampler *cpustat.Sampler, prev, cur *cpustat.SystemStats) {
+	reason := h.crossed(prev, cur)
+	if reason == "" {
+		return
+	}
+	now := time.Now()
+	if h.until.IsZero() {
+		log.Printf("hires: %s, sampling every %dms\n", reason, h.conf.interval)
+		h.start, h.taken = now, 0
+		sampler.SetInterval(int(h.conf.interval))
+		h.main = cpustat.NewScheduler(time.Duration(h.conf.every)*time.Millisecond, h.conf.align)
+	}
+	h.until = now.Add(h.conf.period)
+}
+
+func (h *hires) crossed(prev, cur *cpustat.SystemStats) string {
+	// the pressure total is kept up to date even when something else crossed first
+	waitPct := 0.0
+	if h.conf.psi > 0 {
+		if total, err := cpustat.CPUPressure(); err == nil {
+			waited := float64(cpustat.SafeSub(total, h.pressure))
+			waitPct = waited / float64(cur.CaptureTime.Sub(prev.CaptureTime)/time.Microsecond) * 100
+			h.pressure = total
+		}
+	}
+
+	if h.conf.cpuPct > 0 {
+		var sum cpustat.SystemStats
+		busy := cpustat.BusyPct(cpustat.SystemStatsRecord(uint32(h.conf.every), cur, prev, &sum))
+		if busy >= h.conf.cpuPct {
+			return fmt.Sprintf("system %.0f%% busy", busy)
+		}
+	}
+	if h.conf.runq > 0 && cur.ProcsRunning >= h.conf.runq {
+		return fmt.Sprintf("%d processes running", cur.ProcsRunning)
+	}
+	if h.conf.psi > 0 && waitPct >= h.conf.psi {
+		return fmt.Sprintf("tasks waited for a CPU %.0f%% of the time", waitPct)
+	}
+	return ""
+}
+
+// finish ends a period, and writes it to -hiresdir
+func (h *hires) finish() {
+	log.Printf("hires: done after %s, %d samples\n", time.Since(h.start).Round(time.Millisecond), h.taken)
+	h.until = time.Time{}
+	if h.conf.dir == "" {
+		return
+	}
+	// a period can take more samples than the buffer holds, and the next one overwrites it,
+	// so the file gets a copy
+	taken := h.taken
+	if count := h.memdb.DBCount(); taken > count {
+		taken = count
+	}
+	entries := h.memdb.ReadSamples(taken)
+	if len(entries) == 0 {
+		return
+	}
+	name := filepath.Join(h.conf.dir, h.start.Format("cpustat-hires-20060102-150405.cps"))
+	go func() {
+		if err := h.write(name, entries); err != nil {
+			log.Println("hires:", err)
+		}
+	}()
+}
+
+func (h *hires) write(name string, entries []dbEntry) error {
+	out, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	// closing the capture closes out
+	file := captureFile{out: out, infoMap: h.infoMap, jiffy: h.conf.jiffy, filters: h.conf.filters}
+	for i := range entries {
+		if err = file.write(&entries[i]); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err = file.close(); err != nil {
+		out.Close()
+	}
+	return err
+}
@@ -2,13 +2,15 @@ package main
 
 import (
 	"sync"
+	"time"
 
 	"github.com/uber-common/cpustat/lib"
 )
 
 type dbEntry struct {
-	Proc cpustat.ProcSampleList
-	Sys  cpustat.SystemStats
+	Proc     cpustat.ProcSampleList
+	Sys      cpustat.SystemStats
+	Interval uint32 // ms, -i in the main buffer and -hires in the high resolution one
 }
 
 type MemDB struct {
@@ -17,6 +19,7 @@ type MemDB struct {
 	dbMaxSize uint32
 	writePos  uint32
 	dbEntries uint32
+	written   uint64 // samples ever written, which numbers them for Range
 }
 
 func (m *MemDB) Init(newSize, maxProcsToScan uint32) {
@@ -29,6 +32,7 @@ func (m *MemDB) Init(newSize, maxProcsToScan uint32) {
 		m.dbData[pos] = dbEntry{
 			cpustat.ProcSampleList{},
 			cpustat.SystemStats{},
+			0,
 		}
 		m.dbData[pos].Proc.Samples = make([]cpustat.ProcSample, maxProcsToScan)
 	}
@@ -44,8 +48,8 @@ func (m *MemDB) DBCount() uint32 {
 func (m *MemDB) DBStats() (uint32, uint32) {
 	var pcount, scount uint32
 
-	readPos := int(m.writePos) - 1
 	m.dbLock.RLock()
+	readPos := int(m.writePos) - 1
 	for i := uint32(0); i < m.dbEntries; i++ {
 		if readPos < 0 {
 			readPos = int(m.dbMaxSize) - 1
@@ -58,20 +62,21 @@ func (m *MemDB) DBStats() (uint32, uint32) {
 	return pcount, scount
 }
 
-func (m *MemDB) WriteSample(procList cpustat.ProcSampleList, sys *cpustat.SystemStats) {
-	sample := dbEntry{procList, *sys}
+// WriteSample copies a sample, which was taken interval ms after the one before it, into the db
+func (m *MemDB) WriteSample(procList *cpustat.ProcSampleList, sys *cpustat.SystemStats, interval uint32) {
+	e := m.ReserveSample()
+	e.Proc.Len = uint32(copy(e.Proc.Samples, procList.Samples[:procList.Len]))
+	e.Sys = *sys
+	e.Interval = interval
+	m.ReleaseSample()
+}
 
-	m.dbLock.Lock()
-	m.dbData[m.writePos] = sample
-	m.writePos++
-	if m.writePos >= m.dbMaxSize {
-		m.writePos = 0
-	}
-	m.dbEntries++
-	if m.dbEntries > m.dbMaxSize {
-		m.dbEntries = m.dbMaxSize
-	}
-	m.dbLock.Unlock()
+// copyEntry copies src into dst, reusing the samples dst already has room for
+func copyEntry(dst, src *dbEntry) {
+	dst.Proc.Samples = append(dst.Proc.Samples[:0], src.Proc.Samples[:src.Proc.Len]...)
+	dst.Proc.Len = src.Proc.Len
+	dst.Sys = src.Sys
+	dst.Interval = src.Interval
 }
 
 func (m *MemDB) ReserveSample() *dbEntry {
@@ -85,6 +90,7 @@ func (m *MemDB) ReleaseSample() {
 	if m.writePos >= m.dbMaxSize {
 		m.writePos = 0
 	}
+	m.written++
 	m.dbEntries++
 	if m.dbEntries > m.dbMaxSize {
 		m.dbEntries = m.dbMaxSize
@@ -93,23 +99,79 @@ func (m *MemDB) ReleaseSample() {
 	m.dbLock.Unlock()
 }
 
-// TODO - figure out how expensive copying this is, because if the buffer wraps around
-//        on us while the caller is holding these results, they could get overwritten.
+// ReadSamples copies the last n samples, so they stay the same while the buffer keeps being
+// written. For more than a few, Range doesn't need room for all of them at once.
 func (m *MemDB) ReadSamples(n uint32) []dbEntry {
+	m.dbLock.RLock()
+	defer m.dbLock.RUnlock()
 	if n > m.dbEntries {
 		n = m.dbEntries
 	}
 	ret := make([]dbEntry, n)
-	readPos := int(m.writePos) - 1
+	for i := range ret {
+		copyEntry(&ret[i], m.entry(m.written-uint64(n)+uint64(i)))
+	}
+	return ret
+}
+
+// Range calls fn with a copy of each of the last n samples, oldest first. Only the copy
+// passed to fn and the one before it stay the same, so fn can diff the two, and the buffer
+// can be written while fn runs. If it's written faster than fn reads, the samples that were
+// written over are skipped, and follows is false for the next one, which isn't the sample
+// after the one before it. Range returns what fn returned, if that wasn't nil.
+func (m *MemDB) Range(n uint32, fn func(e *dbEntry, follows bool) error) error {
 	m.dbLock.RLock()
-	for i := int(n) - 1; i >= 0; i-- {
-		if readPos < 0 {
-			readPos = int(m.dbMaxSize) - 1
+	if n > m.dbEntries {
+		n = m.dbEntries
+	}
+	end := m.written
+	m.dbLock.RUnlock()
+	return m.rangeFrom(end-uint64(n), end, fn)
+}
+
+// RangeSince is Range for the samples taken after since, and the last one taken at or before
+// it to diff the first of them against
+func (m *MemDB) RangeSince(since time.Time, fn func(e *dbEntry, follows bool) error) error {
+	m.dbLock.RLock()
+	end := m.written
+	next := end
+	for next > end-uint64(m.dbEntries) {
+		next--
+		if m.entry(next).Sys.CaptureTime.After(since) == false {
+			break
 		}
-		ret[i] = m.dbData[readPos]
-		readPos--
 	}
 	m.dbLock.RUnlock()
+	return m.rangeFrom(next, end, fn)
+}
 
-	return ret
+// rangeFrom copies the samples from the next-th one written up to the end-th, one at a time
+func (m *MemDB) rangeFrom(next, end uint64, fn func(e *dbEntry, follows bool) error) error {
+	var copies [2]dbEntry
+	follows := false
+	for i := 0; next < end; i++ {
+		e := &copies[i%2]
+		m.dbLock.RLock()
+		if oldest := m.written - uint64(m.dbEntries); next < oldest {
+			next, follows = oldest, false
+		}
+		if next >= end {
+			m.dbLock.RUnlock()
+			return nil
+		}
+		copyEntry(e, m.entry(next))
+		m.dbLock.RUnlock()
+
+		if err := fn(e, follows); err != nil {
+			return err
+		}
+		next++
+		follows = true
+	}
+	return nil
+}
+
+// entry is the seq-th sample written, which has to be one of the last dbEntries
+func (m *MemDB) entry(seq uint64) *dbEntry {
+	return &m.dbData[seq%uint64(m.dbMaxSize)]
 }
@@ -0,0 +1,356 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Prometheus text format /metrics endpoint. Each scrape summarizes the most recent window
+// of samples in the db. Per-sample distributions are exported as summaries, so the
+// min/max/percentile view that cpustat gives survives the scrape interval.
+//
+// To keep the number of series bounded, processes are grouped by the configured labels,
+// and only the groups of the top processes get their own series. Everything else is
+// added up into a group where every label is "other".
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os/user"
+	"strings"
+	"sync"
+
+	"github.com/codahale/hdrhistogram"
+	"github.com/uber-common/cpustat/lib"
+)
+
+// per-sample values are recorded in hundredths of a percent of a CPU
+const pctScale = 100
+
+var summaryQuantiles = []float64{0, 0.5, 0.9, 0.99, 1}
+
+type metricsConfig struct {
+	samples uint32 // samples in each window
+	topK    int    // limit on process groups, not counting other
+	sortKey cpustat.SortKey
+	labels  []string
+	jiffy   int
+}
+
+var metricLabels = map[string]func(pid int, info *cpustat.ProcInfo) string{
+	"pid":    func(pid int, info *cpustat.ProcInfo) string { return fmt.Sprint(pid) },
+	"name":   func(pid int, info *cpustat.ProcInfo) string { return info.Friendly },
+	"comm":   func(pid int, info *cpustat.ProcInfo) string { return info.Comm },
+	"user":   func(pid int, info *cpustat.ProcInfo) string { return userName(info.UID) },
+	"cgroup": func(pid int, info *cpustat.ProcInfo) string { return info.Cgroup },
+}
+
+// parseMetricLabels checks a list like "name,user,cgroup"
+func parseMetricLabels(spec string) ([]string, error) {
+	var labels []string
+	if spec == "" {
+		return labels, nil
+	}
+	for _, label := range strings.Split(spec, ",") {
+		if _, ok := metricLabels[label]; ok == false {
+			return nil, fmt.Errorf("unknown metrics label %q, must be pid, name, comm, user or cgroup", label)
+		}
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+var userNames = make(map[uint32]string)
+
+// only called with infolock held
+func userName(uid uint32) string {
+	if name, ok := userNames[uid]; ok {
+		return name
+	}
+	name := fmt.Sprint(uid)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	userNames[uid] = name
+	return name
+}
+
+// procGroup is the processes that share one set of label values
+type procGroup struct {
+	values []string
+	procs  int
+	rss    uint64 // bytes, at the end of the window
+	cpu    *hdrhistogram.Histogram
+	runq   *hdrhistogram.Histogram
+	blkio  *hdrhistogram.Histogram
+}
+
+func newPctHist() *hdrhistogram.Histogram {
+	return hdrhistogram.New(0, 100000000, 2)
+}
+
+func newProcGroup(values []string) *procGroup {
+	return &procGroup{values: values, cpu: newPctHist(), runq: newPctHist(), blkio: newPctHist()}
+}
+
+type metricsHandler struct {
+	memdb    *MemDB
+	infoMap  cpustat.ProcInfoMap
+	config   metricsConfig
+	tiers    *cpustat.TieredReader // nil without -slow
+	overhead *cpustat.Overhead
+	lock     sync.Mutex // one scrape at a time
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var buf bytes.Buffer
+	h.writeMetrics(&buf, readWindow(h.memdb, h.config.samples))
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// groupProcs assigns processes to groups in ranked order until there are topK groups
+func (h *metricsHandler) groupProcs(win *window) ([]*procGroup, map[int]*procGroup) {
+	ranker := cpustat.NewRanker(h.config.sortKey, 0, h.config.jiffy, int(intervalms))
+	ranked := ranker.Rank(win.ProcHist, win.ProcSum, len(win.ProcHist))
+
+	other := make([]string, len(h.config.labels))
+	for i := range other {
+		other[i] = "other"
+	}
+	otherGroup := newProcGroup(other)
+
+	var groups []*procGroup
+	byValues := make(map[string]*procGroup)
+	byPid := make(map[int]*procGroup, len(ranked))
+
+	infolock.Lock()
+	for _, pid := range ranked {
+		group := otherGroup
+		if info, ok := h.infoMap[pid]; ok {
+			values := make([]string, len(h.config.labels))
+			for i, label := range h.config.labels {
+				values[i] = metricLabels[label](pid, info)
+			}
+			key := strings.Join(values, "\x00")
+			if existing, ok := byValues[key]; ok {
+				group = existing
+			} else if len(groups) < h.config.topK {
+				group = newProcGroup(values)
+				byValues[key] = group
+				groups = append(groups, group)
+			}
+		}
+		group.procs++
+		group.rss += win.ProcSum[pid].Proc.Rss * cpustat.PageSize
+		byPid[pid] = group
+	}
+	infolock.Unlock()
+
+	if otherGroup.procs > 0 {
+		groups = append(groups, otherGroup)
+	}
+	return groups, byPid
+}
+
+func (h *metricsHandler) writeMetrics(out io.Writer, win *window) {
+	tickVal := func(ticks uint64, interval uint32) int64 {
+		return int64(cpustat.TicksPct(float64(ticks), h.config.jiffy, float64(interval))*pctScale + 0.5)
+	}
+	nsVal := func(ns uint64, interval uint32) int64 {
+		return int64(cpustat.NsPct(float64(ns), float64(interval))*pctScale + 0.5)
+	}
+
+	groups, byPid := h.groupProcs(win)
+
+	sysCPU := map[string]*hdrhistogram.Histogram{}
+	cpuModes := []string{"usr", "nice", "sys", "idle", "iowait"}
+	for _, mode := range cpuModes {
+		sysCPU[mode] = newPctHist()
+	}
+	sysRunq := newPctHist()
+	sysBlkio := newPctHist()
+
+	for i, procDelta := range win.procDeltas {
+		sys, interval, weight := win.sysDeltas[i], win.intervals[i], win.weights[i]
+		sysCPU["usr"].RecordValues(tickVal(sys.Usr, interval), weight)
+		sysCPU["nice"].RecordValues(tickVal(sys.Nice, interval), weight)
+		sysCPU["sys"].RecordValues(tickVal(sys.Sys, interval), weight)
+		sysCPU["idle"].RecordValues(tickVal(sys.Idle, interval), weight)
+		sysCPU["iowait"].RecordValues(tickVal(sys.Iowait, interval), weight)
+
+		// each group gets one value per sample, the total of all of its processes
+		cpu := make(map[*procGroup]uint64, len(groups))
+		runq := make(map[*procGroup]uint64, len(groups))
+		blkio := make(map[*procGroup]uint64, len(groups))
+		var runqTotal, blkioTotal uint64
+		for pid, delta := range procDelta {
+			group := byPid[pid]
+			cpu[group] += delta.Proc.Utime + delta.Proc.Stime
+			runq[group] += delta.Task.Cpudelaytotal
+			blkio[group] += delta.Task.Blkiodelaytotal
+			runqTotal += delta.Task.Cpudelaytotal
+			blkioTotal += delta.Task.Blkiodelaytotal
+		}
+		for _, group := range groups {
+			group.cpu.RecordValues(tickVal(cpu[group], interval), weight)
+			group.runq.RecordValues(nsVal(runq[group], interval), weight)
+			group.blkio.RecordValues(nsVal(blkio[group], interval), weight)
+		}
+		sysRunq.RecordValues(nsVal(runqTotal, interval), weight)
+		sysBlkio.RecordValues(nsVal(blkioTotal, interval), weight)
+	}
+
+	writeHeader(out, "cpustat_window_seconds", "gauge", "Length of the window that the other metrics summarize.")
+	writeSample(out, "cpustat_window_seconds", "", win.seconds())
+	writeHeader(out, "cpustat_window_missed_samples", "gauge",
+		"Samples in the window that weren't taken because sampling fell behind.")
+	writeSample(out, "cpustat_window_missed_samples", "", float64(win.Timing.Missed))
+
+	timing := schedule.read()
+	late := timing.Late
+	writeHeader(out, "cpustat_missed_samples_total", "counter", "Samples that weren't taken because sampling fell behind.")
+	writeSample(out, "cpustat_missed_samples_total", "", float64(timing.Missed))
+	writeHeader(out, "cpustat_sample_late_seconds", "summary", "How late each sample was taken.")
+	for _, q := range summaryQuantiles {
+		writeSample(out, "cpustat_sample_late_seconds", formatLabels([]string{"quantile"}, []string{fmt.Sprint(q)}),
+			float64(late.ValueAtQuantile(q*100))/1e6)
+	}
+	writeSample(out, "cpustat_sample_late_seconds_sum", "", late.Mean()*float64(late.TotalCount())/1e6)
+	writeSample(out, "cpustat_sample_late_seconds_count", "", float64(late.TotalCount()))
+
+	if h.tiers != nil {
+		writeTierMetrics(out, h.tiers.Stats())
+	}
+	if stats, err := h.overhead.Stats(); err == nil {
+		writeOverheadMetrics(out, stats)
+	}
+
+	writeHeader(out, "cpustat_system_cpu_percent", "summary", "System CPU time in each sample by mode, percent of a CPU.")
+	for _, mode := range cpuModes {
+		writePctSummary(out, "cpustat_system_cpu_percent", []string{"mode"}, []string{mode}, sysCPU[mode])
+	}
+	writeHeader(out, "cpustat_system_runq_delay_percent", "summary",
+		"Time all processes spent runnable but waiting for a CPU in each sample, percent of a CPU.")
+	writePctSummary(out, "cpustat_system_runq_delay_percent", nil, nil, sysRunq)
+	writeHeader(out, "cpustat_system_blkio_delay_percent", "summary",
+		"Time all processes spent blocked on disk IO in each sample, percent of a CPU.")
+	writePctSummary(out, "cpustat_system_blkio_delay_percent", nil, nil, sysBlkio)
+
+	labels := h.config.labels
+	writeHeader(out, "cpustat_process_cpu_percent", "summary", "usr+sys time of each process group in each sample, percent of a CPU.")
+	for _, group := range groups {
+		writePctSummary(out, "cpustat_process_cpu_percent", labels, group.values, group.cpu)
+	}
+	writeHeader(out, "cpustat_process_runq_delay_percent", "summary",
+		"Time each process group spent runnable but waiting for a CPU in each sample, percent of a CPU.")
+	for _, group := range groups {
+		writePctSummary(out, "cpustat_process_runq_delay_percent", labels, group.values, group.runq)
+	}
+	writeHeader(out, "cpustat_process_blkio_delay_percent", "summary",
+		"Time each process group spent blocked on disk IO in each sample, percent of a CPU.")
+	for _, group := range groups {
+		writePctSummary(out, "cpustat_process_blkio_delay_percent", labels, group.values, group.blkio)
+	}
+	writeHeader(out, "cpustat_process_rss_bytes", "gauge", "Resident memory of each process group.")
+	for _, group := range groups {
+		writeSample(out, "cpustat_process_rss_bytes", formatLabels(labels, group.values), float64(group.rss))
+	}
+	writeHeader(out, "cpustat_process_count", "gauge", "Number of processes in each process group.")
+	for _, group := range groups {
+		writeSample(out, "cpustat_process_count", formatLabels(labels, group.values), float64(group.procs))
+	}
+}
+
+func writeOverheadMetrics(out io.Writer, stats cpustat.OverheadStats) {
+	writeHeader(out, "cpustat_self_cpu_seconds_total", "counter", "usr+sys time of the agent itself.")
+	writeSample(out, "cpustat_self_cpu_seconds_total", "", stats.CPU.Seconds())
+	writeHeader(out, "cpustat_self_alloc_bytes_total", "counter", "Bytes allocated by the agent.")
+	writeSample(out, "cpustat_self_alloc_bytes_total", "", float64(stats.AllocBytes))
+	writeHeader(out, "cpustat_self_mallocs_total", "counter", "Allocations made by the agent.")
+	writeSample(out, "cpustat_self_mallocs_total", "", float64(stats.Mallocs))
+	writeHeader(out, "cpustat_self_max_rss_bytes", "gauge", "Largest resident memory of the agent.")
+	writeSample(out, "cpustat_self_max_rss_bytes", "", float64(stats.MaxRSS))
+	writeHeader(out, "cpustat_self_cycle_seconds", "summary", "How long each collection cycle took.")
+	for _, q := range summaryQuantiles {
+		writeSample(out, "cpustat_self_cycle_seconds", formatLabels([]string{"quantile"}, []string{fmt.Sprint(q)}),
+			float64(stats.Cycle.ValueAtQuantile(q*100))/1e6)
+	}
+	writeSample(out, "cpustat_self_cycle_seconds_sum", "", stats.CycleTime.Seconds())
+	writeSample(out, "cpustat_self_cycle_seconds_count", "", float64(stats.Cycles))
+}
+
+func writeTierMetrics(out io.Writer, stats cpustat.TierStats) {
+	tiers := []string{"fast", "slow"}
+	byTier := []cpustat.TierStat{stats.Fast, stats.Slow}
+	writeHeader(out, "cpustat_tier_processes", "gauge", "Processes in each sampling tier.")
+	for i, tier := range tiers {
+		writeSample(out, "cpustat_tier_processes", formatLabels([]string{"tier"}, []string{tier}), float64(byTier[i].Procs))
+	}
+	writeHeader(out, "cpustat_tier_reads_total", "counter", "Processes read in each sampling tier.")
+	for i, tier := range tiers {
+		writeSample(out, "cpustat_tier_reads_total", formatLabels([]string{"tier"}, []string{tier}), float64(byTier[i].Reads))
+	}
+	writeHeader(out, "cpustat_tier_read_seconds_total", "counter", "Time spent reading the processes in each sampling tier.")
+	for i, tier := range tiers {
+		writeSample(out, "cpustat_tier_read_seconds_total", formatLabels([]string{"tier"}, []string{tier}),
+			byTier[i].ReadMs/1000)
+	}
+	writeHeader(out, "cpustat_tier_skipped_total", "counter", "Reads of slow tier processes that were skipped.")
+	writeSample(out, "cpustat_tier_skipped_total", "", float64(stats.Skipped))
+}
+
+func writeHeader(out io.Writer, name, kind, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(out io.Writer, name, labels string, val float64) {
+	fmt.Fprintf(out, "%s%s %g\n", name, labels, val)
+}
+
+// writePctSummary writes a histogram of values recorded in pctScale units as a summary in percent
+func writePctSummary(out io.Writer, name string, labels, values []string, hist *hdrhistogram.Histogram) {
+	qLabels := append(append([]string{}, labels...), "quantile")
+	qValues := append(append([]string{}, values...), "")
+	for _, q := range summaryQuantiles {
+		qValues[len(qValues)-1] = fmt.Sprint(q)
+		val := float64(hist.ValueAtQuantile(q*100)) / pctScale
+		writeSample(out, name, formatLabels(qLabels, qValues), val)
+	}
+	count := hist.TotalCount()
+	writeSample(out, name+"_sum", formatLabels(labels, values), hist.Mean()*float64(count)/pctScale)
+	writeSample(out, name+"_count", formatLabels(labels, values), float64(count))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
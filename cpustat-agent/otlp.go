@@ -0,0 +1,228 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// OpenTelemetry export. Every -otlpinterval, the window since the last export is sent to a
+// collector, with the host as one resource and each of the top processes as another.
+// Per-sample values are sent as exponential histograms, so the min, max and percentiles
+// of the window survive instead of being averaged away.
+
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/uber-common/cpustat/lib"
+)
+
+// starting resolution of the histograms, about 9% between bucket boundaries
+const otlpHistScale = 3
+
+type otlpConfig struct {
+	samples uint32 // samples in each window
+	topK    int
+	sortKey cpustat.SortKey
+	jiffy   int
+}
+
+func newHist() *cpustat.ExpHistogram {
+	return cpustat.NewExpHistogram(otlpHistScale)
+}
+
+func histMetric(name, desc, unit string, win *window, hist *cpustat.ExpHistogram, attrs ...cpustat.OTLPAttribute) cpustat.OTLPMetric {
+	return cpustat.OTLPMetric{Name: name, Description: desc, Unit: unit, Histogram: []cpustat.OTLPHistogramPoint{
+		{Attributes: attrs, Start: win.Start, Time: win.End, Hist: hist},
+	}}
+}
+
+func gaugeMetric(name, desc, unit string, win *window, val float64) cpustat.OTLPMetric {
+	return cpustat.OTLPMetric{Name: name, Description: desc, Unit: unit, Gauge: []cpustat.OTLPGaugePoint{
+		{Time: win.End, Value: val},
+	}}
+}
+
+func hostAttributes() []cpustat.OTLPAttribute {
+	hostname, _ := os.Hostname()
+	return []cpustat.OTLPAttribute{
+		{Key: "host.name", Value: hostname},
+		{Key: "os.type", Value: "linux"},
+		{Key: "service.name", Value: "cpustat-agent"},
+	}
+}
+
+// systemResource has the system wide metrics
+func systemResource(win *window, hostAttrs []cpustat.OTLPAttribute, jiffy int) cpustat.OTLPResource {
+	modes := []string{"usr", "nice", "sys", "idle", "iowait"}
+	cpu := make(map[string]*cpustat.ExpHistogram)
+	for _, mode := range modes {
+		cpu[mode] = newHist()
+	}
+	runq, blkio := newHist(), newHist()
+	running, blocked := newHist(), newHist()
+
+	for i, procDelta := range win.procDeltas {
+		sys, interval := win.sysDeltas[i], float64(win.intervals[i])
+		weight := uint64(win.weights[i])
+		cpu["usr"].RecordN(cpustat.TicksPct(float64(sys.Usr), jiffy, interval), weight)
+		cpu["nice"].RecordN(cpustat.TicksPct(float64(sys.Nice), jiffy, interval), weight)
+		cpu["sys"].RecordN(cpustat.TicksPct(float64(sys.Sys), jiffy, interval), weight)
+		cpu["idle"].RecordN(cpustat.TicksPct(float64(sys.Idle), jiffy, interval), weight)
+		cpu["iowait"].RecordN(cpustat.TicksPct(float64(sys.Iowait), jiffy, interval), weight)
+		running.RecordN(float64(sys.ProcsRunning), weight)
+		blocked.RecordN(float64(sys.ProcsBlocked), weight)
+
+		var runqTotal, blkioTotal uint64
+		for _, delta := range procDelta {
+			runqTotal += delta.Task.Cpudelaytotal
+			blkioTotal += delta.Task.Blkiodelaytotal
+		}
+		runq.RecordN(cpustat.NsPct(float64(runqTotal), interval), weight)
+		blkio.RecordN(cpustat.NsPct(float64(blkioTotal), interval), weight)
+	}
+
+	cpuMetric := cpustat.OTLPMetric{
+		Name:        "cpustat.system.cpu",
+		Description: "System CPU time in each sample by mode, percent of a CPU",
+		Unit:        "%",
+	}
+	for _, mode := range modes {
+		cpuMetric.Histogram = append(cpuMetric.Histogram, cpustat.OTLPHistogramPoint{
+			Attributes: []cpustat.OTLPAttribute{{Key: "cpu.mode", Value: mode}},
+			Start:      win.Start,
+			Time:       win.End,
+			Hist:       cpu[mode],
+		})
+	}
+	return cpustat.OTLPResource{
+		Attributes: hostAttrs,
+		Metrics: []cpustat.OTLPMetric{
+			cpuMetric,
+			histMetric("cpustat.system.runq.delay", "Time all processes spent waiting for a CPU in each sample, percent of a CPU",
+				"%", win, runq),
+			histMetric("cpustat.system.blkio.delay", "Time all processes spent blocked on disk IO in each sample, percent of a CPU",
+				"%", win, blkio),
+			histMetric("cpustat.system.procs.running", "Runnable processes in each sample", "{process}", win, running),
+			histMetric("cpustat.system.procs.blocked", "Processes blocked on IO in each sample", "{process}", win, blocked),
+		},
+	}
+}
+
+// processAttributes describes a process with the OpenTelemetry process and container
+// resource conventions, plus our friendly name and cgroup
+func processAttributes(pid int, info *cpustat.ProcInfo, hostAttrs []cpustat.OTLPAttribute) []cpustat.OTLPAttribute {
+	attrs := append([]cpustat.OTLPAttribute{}, hostAttrs...)
+	attrs = append(attrs,
+		cpustat.OTLPAttribute{Key: "process.pid", Value: int64(pid)},
+		cpustat.OTLPAttribute{Key: "process.parent_pid", Value: int64(info.Ppid)},
+		cpustat.OTLPAttribute{Key: "process.executable.name", Value: info.Comm},
+		cpustat.OTLPAttribute{Key: "process.command_line", Value: strings.Join(info.Cmdline, " ")},
+		cpustat.OTLPAttribute{Key: "process.owner", Value: userName(info.UID)},
+		cpustat.OTLPAttribute{Key: "cpustat.name", Value: info.Friendly},
+	)
+	if info.Cgroup != "" {
+		attrs = append(attrs, cpustat.OTLPAttribute{Key: "cpustat.cgroup", Value: info.Cgroup})
+	}
+	if id := cpustat.ContainerID(info.Cgroup); id != "" {
+		attrs = append(attrs, cpustat.OTLPAttribute{Key: "container.id", Value: id})
+	}
+	return attrs
+}
+
+// processResources has a resource for each of the top processes
+func processResources(win *window, infoMap cpustat.ProcInfoMap, hostAttrs []cpustat.OTLPAttribute,
+	conf otlpConfig) []cpustat.OTLPResource {
+
+	ranker := cpustat.NewRanker(conf.sortKey, 0, conf.jiffy, int(intervalms))
+	top := ranker.Rank(win.ProcHist, win.ProcSum, conf.topK)
+
+	type procHists struct {
+		cpu, runq, blkio *cpustat.ExpHistogram
+	}
+	hists := make(map[int]*procHists, len(top))
+	for _, pid := range top {
+		hists[pid] = &procHists{newHist(), newHist(), newHist()}
+	}
+	for i, procDelta := range win.procDeltas {
+		interval := float64(win.intervals[i])
+		for pid, h := range hists {
+			// processes that weren't around for the whole window just have fewer samples
+			if delta, ok := procDelta[pid]; ok {
+				weight := uint64(procWeight(delta))
+				h.cpu.RecordN(cpustat.TicksPct(float64(delta.Proc.Utime+delta.Proc.Stime), conf.jiffy, interval), weight)
+				h.runq.RecordN(cpustat.NsPct(float64(delta.Task.Cpudelaytotal), interval), weight)
+				h.blkio.RecordN(cpustat.NsPct(float64(delta.Task.Blkiodelaytotal), interval), weight)
+			}
+		}
+	}
+
+	var resources []cpustat.OTLPResource
+	infolock.Lock()
+	defer infolock.Unlock()
+	for _, pid := range top {
+		info, ok := infoMap[pid]
+		if ok == false {
+			continue
+		}
+		sum := win.ProcSum[pid]
+		h := hists[pid]
+		resources = append(resources, cpustat.OTLPResource{
+			Attributes: processAttributes(pid, info, hostAttrs),
+			Metrics: []cpustat.OTLPMetric{
+				histMetric("cpustat.process.cpu", "usr+sys time in each sample, percent of a CPU", "%", win, h.cpu),
+				histMetric("cpustat.process.runq.delay", "Time spent waiting for a CPU in each sample, percent of a CPU",
+					"%", win, h.runq),
+				histMetric("cpustat.process.blkio.delay", "Time spent blocked on disk IO in each sample, percent of a CPU",
+					"%", win, h.blkio),
+				gaugeMetric("cpustat.process.memory.rss", "Resident memory at the end of the window", "By",
+					win, float64(sum.Proc.Rss*cpustat.PageSize)),
+				gaugeMetric("cpustat.process.threads", "Threads at the end of the window", "{thread}",
+					win, float64(sum.Proc.Numthreads)),
+			},
+		})
+	}
+	return resources
+}
+
+// runOTLPExport exports a window every conf.samples intervals, forever. Each window starts
+// where the last one ended, since delta histograms that overlap would be counted twice.
+func runOTLPExport(exporter *cpustat.OTLPExporter, memdb *MemDB, infoMap cpustat.ProcInfoMap, conf otlpConfig) {
+	hostAttrs := hostAttributes()
+	period := time.Duration(conf.samples) * time.Duration(intervalms) * time.Millisecond
+	var last time.Time
+	for range time.Tick(period) {
+		var win *window
+		if last.IsZero() {
+			win = readWindow(memdb, conf.samples)
+		} else {
+			win = readWindowSince(memdb, last)
+		}
+		if win.Samples == 0 {
+			continue
+		}
+		last = win.End
+		resources := []cpustat.OTLPResource{systemResource(win, hostAttrs, conf.jiffy)}
+		resources = append(resources, processResources(win, infoMap, hostAttrs, conf)...)
+		if err := exporter.Export(resources); err != nil {
+			log.Println("otlp:", err)
+		}
+	}
+}
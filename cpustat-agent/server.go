@@ -27,6 +27,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -45,23 +46,49 @@ type rawHandler struct {
 func (r rawHandler) Handle(ctx context.Context, args *raw.Args) (*raw.Res, error) {
 	switch args.Method {
 	case "readSamples":
+		samples, err := gobEncodeSamples(args.Arg3, r)
+		if err != nil {
+			return nil, err
+		}
 		return &raw.Res{
 			Arg2: []byte{},
-			Arg3: gobEncodeSamples(args.Arg3, r),
+			Arg3: samples,
 		}, nil
 	case "readSys":
+		sys, err := gobEncodeSys(args.Arg3, r)
+		if err != nil {
+			return nil, err
+		}
 		return &raw.Res{
 			Arg2: []byte{},
-			Arg3: gobEncodeSys(args.Arg3, r),
+			Arg3: sys,
 		}, nil
 	}
 	return nil, fmt.Errorf("unhandled: (%s)", args.Method)
 }
 
-func gobEncodeSys(countBytes []byte, r rawHandler) []byte {
+// errLapped is when the samples being sent were written over before they could be
+var errLapped = errors.New("samples were written over while they were read")
+
+// inOrder wraps fn for Range, to send samples only if none were skipped
+func inOrder(fn func(e *dbEntry)) func(e *dbEntry, follows bool) error {
+	first := true
+	return func(e *dbEntry, follows bool) error {
+		if follows == false && first == false {
+			return errLapped
+		}
+		first = false
+		fn(e)
+		return nil
+	}
+}
+
+func gobEncodeSys(countBytes []byte, r rawHandler) ([]byte, error) {
 	count := binary.LittleEndian.Uint32(countBytes)
+	if dbCount := r.memdb.DBCount(); count > dbCount {
+		count = dbCount
+	}
 
-	samples := r.memdb.ReadSamples(count)
 	var valBuf bytes.Buffer
 	enc := gob.NewEncoder(&valBuf)
 
@@ -69,24 +96,24 @@ func gobEncodeSys(countBytes []byte, r rawHandler) []byte {
 		panic(err)
 	}
 
-	sendCount := uint32(len(samples))
-
-	if err := enc.Encode(sendCount); err != nil {
+	if err := enc.Encode(count); err != nil {
 		panic(err)
 	}
 
-	for _, sample := range samples {
+	err := r.memdb.Range(count, inOrder(func(sample *dbEntry) {
 		if err := enc.Encode(sample.Sys); err != nil {
 			panic(err)
 		}
-	}
-	return valBuf.Bytes()
+	}))
+	return valBuf.Bytes(), err
 }
 
-func gobEncodeSamples(countBytes []byte, r rawHandler) []byte {
+func gobEncodeSamples(countBytes []byte, r rawHandler) ([]byte, error) {
 	count := binary.LittleEndian.Uint32(countBytes)
+	if dbCount := r.memdb.DBCount(); count > dbCount {
+		count = dbCount
+	}
 
-	samples := r.memdb.ReadSamples(count)
 	var valBuf bytes.Buffer
 	enc := gob.NewEncoder(&valBuf)
 
@@ -104,21 +131,19 @@ func gobEncodeSamples(countBytes []byte, r rawHandler) []byte {
 		panic(err)
 	}
 
-	sendCount := uint32(len(samples))
-
-	if err := enc.Encode(sendCount); err != nil {
+	if err := enc.Encode(count); err != nil {
 		panic(err)
 	}
 
-	for _, sample := range samples {
+	err := r.memdb.Range(count, inOrder(func(sample *dbEntry) {
 		if err := enc.Encode(sample.Proc.Samples[0:sample.Proc.Len]); err != nil {
 			panic(err)
 		}
 		if err := enc.Encode(sample.Sys); err != nil {
 			panic(err)
 		}
-	}
-	return valBuf.Bytes()
+	}))
+	return valBuf.Bytes(), err
 }
 
 func (rawHandler) OnError(ctx context.Context, err error) {
@@ -0,0 +1,41 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"time"
+
+	"github.com/uber-common/cpustat/lib"
+)
+
+// runTriggers checks the last window of samples against the triggers every window
+func runTriggers(triggers *cpustat.TriggerEngine, memdb *MemDB, infoMap cpustat.ProcInfoMap, samples uint32) {
+	period := time.Duration(samples) * time.Duration(intervalms) * time.Millisecond
+	for range time.Tick(period) {
+		win := readWindow(memdb, samples)
+		if win.Samples == 0 {
+			continue
+		}
+		infolock.Lock()
+		triggers.Check(win.Start, win.End, infoMap, win.ProcSum, win.ProcHist, win.TaskHist, win.SysSum, win.SysHist)
+		infolock.Unlock()
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Summaries of the most recent samples in the db, for the exporters that push or serve
+// windows of data instead of raw samples.
+
+package main
+
+import (
+	"time"
+
+	"github.com/uber-common/cpustat/lib"
+)
+
+// window is a cpustat.Window of the most recent samples, which also keeps the per-sample
+// deltas
+type window struct {
+	*cpustat.Window
+	procDeltas []cpustat.ProcSampleMap
+	sysDeltas  []*cpustat.SystemStats
+	intervals  []uint32 // ms, that each of the deltas is scaled to
+	weights    []int64  // intervals that each of the deltas covers
+	carried    []cpustat.Pidlist
+	prev       *dbEntry
+}
+
+// readWindow summarizes up to the last count intervals in memdb
+func readWindow(memdb *MemDB, count uint32) *window {
+	w := window{Window: cpustat.NewWindow()}
+	memdb.Range(count+1, w.add)
+	w.prev = nil
+	return &w
+}
+
+// readWindowSince summarizes the intervals that ended after since, which is the end of the
+// window before, so that windows in a row neither overlap nor leave gaps
+func readWindowSince(memdb *MemDB, since time.Time) *window {
+	w := window{Window: cpustat.NewWindow()}
+	memdb.RangeSince(since, w.add)
+	w.prev = nil
+	return &w
+}
+
+// add summarizes the interval between the entry before and e, unless samples were skipped
+// between them
+func (w *window) add(e *dbEntry, follows bool) error {
+	if prev := w.prev; prev != nil && follows {
+		snap := cpustat.NewSnapshot(e.Interval, e.Proc, prev.Proc, &e.Sys, &prev.Sys)
+		w.Add(snap)
+		w.procDeltas = append(w.procDeltas, snap.Procs)
+		w.sysDeltas = append(w.sysDeltas, snap.Sys)
+		w.intervals = append(w.intervals, e.Interval)
+		w.weights = append(w.weights, snap.Weight())
+		w.carried = append(w.carried, snap.Carried)
+	}
+	w.prev = e
+	return nil
+}
+
+// procWeight is how many intervals a process delta covers
+func procWeight(delta *cpustat.ProcSample) int64 {
+	if delta.Weight > 1 {
+		return delta.Weight
+	}
+	return 1
+}
+
+// seconds is how long the intervals in the window add up to
+func (w *window) seconds() float64 {
+	total := uint64(0)
+	for i, interval := range w.intervals {
+		total += uint64(interval) * uint64(w.weights[i])
+	}
+	return float64(total) / 1000
+}
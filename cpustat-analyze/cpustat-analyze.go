@@ -0,0 +1,191 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Answer questions about a capture written with cpustat -w, without replaying it
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	lib "github.com/uber-common/cpustat/lib"
+)
+
+const usage = `usage: cpustat-analyze [flags] query capture.cps
+       cpustat-analyze [flags] diff before.cps [after.cps]
+
+Queries:
+  top      rank processes over the whole time range by -sort
+  busy     list the periods when the machine was at least -threshold percent busy
+  series   show the CPU use of process -p in each -bucket of time
+  worst    find the busiest -window of time and rank the processes in it
+  pprof    write a pprof profile of cpu, runq and iowait time, with process ancestry as stacks
+  folded   write -value time in the folded stack format of flamegraph.pl
+  trace    write a Chrome trace JSON timeline of the system and every process, for Perfetto
+  heatmap  draw a subsecond offset heatmap of system CPU, or of -p, -name or -cgroup,
+           in the terminal, or as SVG with -format svg
+  diff     compare processes grouped -by name or cgroup between -from and -to of the
+           first capture, and -afterfrom and -afterto of the second, or of the same one
+
+Flags:
+`
+
+func main() {
+	var from = flag.String("from", "", "start at this offset into the capture like 90s, or RFC3339 time")
+	var to = flag.String("to", "", "stop at this offset into the capture like 5m, or RFC3339 time")
+	var format = flag.String("format", "text", "output format, text, json or csv, or svg for heatmap")
+	var topN = flag.Int("n", 10, "show top N processes")
+	var sortBy = flag.String("sort", "cpuavg", "rank processes by cpumax, cpuavg, cpup95, runq, iowait, swap, rss, ctxsw or io")
+	var threshold = flag.Float64("threshold", 90, "busy percentage of all CPUs for the busy query")
+	var pid = flag.Int("p", 0, "process for the series and heatmap queries")
+	var name = flag.String("name", "", "processes with this friendly name for the heatmap query")
+	var cgroup = flag.String("cgroup", "", "processes in this cgroup for the heatmap query")
+	var width = flag.Int("width", 100, "width of the heatmap in the terminal")
+	var bucket = flag.Duration("bucket", time.Second, "time covered by each point of the series query")
+	var length = flag.Duration("window", 10*time.Second, "length of time the worst query looks for")
+	var nameRules = flag.String("names", "", "load friendly name rules from this JSON file")
+	var value = flag.String("value", "cpu", "time the folded query adds up, cpu, runq or iowait")
+	var cgroups = flag.Bool("cgroups", false, "start pprof and folded stacks with the cgroup of each process")
+	var pids = flag.Bool("pids", false, "add the pid to each process in pprof and folded stacks")
+	var groupBy = flag.String("by", "name", "line up processes by name or cgroup for the diff query")
+	var afterFrom = flag.String("afterfrom", "", "start the after side of a diff at this offset or time")
+	var afterTo = flag.String("afterto", "", "stop the after side of a diff at this offset or time")
+
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	isDiff := strings.ToLower(flag.Arg(0)) == "diff"
+	if flag.NArg() != 2 && (isDiff == false || flag.NArg() != 3) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch *format {
+	case "text", "json", "csv":
+	case "svg":
+		if flag.Arg(0) != "heatmap" {
+			fmt.Println("The svg format is only for the heatmap query")
+			os.Exit(1)
+		}
+	default:
+		fmt.Println("The output format must be text, json, csv or svg")
+		os.Exit(1)
+	}
+	sortKey, err := lib.ParseSortKey(*sortBy)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *bucket <= 0 || *length <= 0 {
+		fmt.Println("The -bucket and -window lengths must be positive")
+		os.Exit(1)
+	}
+	groupKey, err := lib.ParseGroupKey(*groupBy)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *nameRules != "" {
+		if err = lib.LoadNameRules(*nameRules); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	capture, err := lib.OpenCapture(flag.Arg(1))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer capture.Close()
+
+	q := query{
+		capture:   capture,
+		infoMap:   make(lib.ProcInfoMap),
+		format:    *format,
+		topN:      *topN,
+		sortKey:   sortKey,
+		threshold: *threshold,
+		pid:       *pid,
+		bucket:    *bucket,
+		length:    *length,
+		value:     *value,
+		cgroups:   *cgroups,
+		pids:      *pids,
+		match:     lib.ProcMatch{Pid: *pid, Name: *name, Cgroup: *cgroup},
+		width:     *width,
+		groupKey:  groupKey,
+	}
+	if q.from, err = capture.ParseTime(*from); err == nil {
+		q.to, err = capture.ParseTime(*to)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if isDiff {
+		q.after = capture
+		if flag.NArg() == 3 {
+			if q.after, err = lib.OpenCapture(flag.Arg(2)); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			defer q.after.Close()
+		} else if *afterFrom == "" && *afterTo == "" {
+			fmt.Println("Comparing a capture with itself needs -afterfrom or -afterto")
+			os.Exit(1)
+		}
+		if q.afterFrom, err = q.after.ParseTime(*afterFrom); err == nil {
+			q.afterTo, err = q.after.ParseTime(*afterTo)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	queries := map[string]func() error{
+		"top":     q.top,
+		"busy":    q.busy,
+		"series":  q.series,
+		"worst":   q.worst,
+		"pprof":   q.pprof,
+		"folded":  q.folded,
+		"trace":   q.trace,
+		"heatmap": q.heatmap,
+		"diff":    q.diff,
+	}
+	run, ok := queries[strings.ToLower(flag.Arg(0))]
+	if ok == false {
+		fmt.Printf("unknown query %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err = run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
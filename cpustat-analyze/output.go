@@ -0,0 +1,105 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	lib "github.com/uber-common/cpustat/lib"
+)
+
+// output prints the result of a query. json prints doc, and text and csv print one line
+// for each row, which are flattened with lib.Fields. Text only shows textCols, if set,
+// since some fields are too wide for a table.
+func output(format string, doc interface{}, rows []interface{}, textCols []string) error {
+	switch format {
+	case "json":
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		return out.Encode(doc)
+	case "csv":
+		out := csv.NewWriter(os.Stdout)
+		for i, row := range rows {
+			fields := lib.Fields(row)
+			if i == 0 {
+				out.Write(fieldNames(fields))
+			}
+			vals := make([]string, len(fields))
+			for j, field := range fields {
+				vals[j] = formatValue(field.Value, 3)
+			}
+			out.Write(vals)
+		}
+		out.Flush()
+		return out.Error()
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for i, row := range rows {
+		fields := selectFields(lib.Fields(row), textCols)
+		if i == 0 {
+			fmt.Fprintln(out, strings.Join(fieldNames(fields), "\t")+"\t")
+		}
+		for _, field := range fields {
+			fmt.Fprint(out, formatValue(field.Value, 1), "\t")
+		}
+		fmt.Fprintln(out)
+	}
+	return out.Flush()
+}
+
+func fieldNames(fields []lib.Field) []string {
+	names := make([]string, len(fields))
+	for i, field := range fields {
+		names[i] = field.Name
+	}
+	return names
+}
+
+func selectFields(fields []lib.Field, names []string) []lib.Field {
+	if len(names) == 0 {
+		return fields
+	}
+	byName := make(map[string]lib.Field, len(fields))
+	for _, field := range fields {
+		byName[field.Name] = field
+	}
+	var ret []lib.Field
+	for _, name := range names {
+		if field, ok := byName[name]; ok {
+			ret = append(ret, field)
+		}
+	}
+	return ret
+}
+
+func formatValue(val interface{}, precision int) string {
+	if f, ok := val.(float64); ok {
+		return strconv.FormatFloat(f, 'f', precision, 64)
+	}
+	return fmt.Sprint(val)
+}
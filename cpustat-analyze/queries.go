@@ -0,0 +1,473 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	lib "github.com/uber-common/cpustat/lib"
+)
+
+type query struct {
+	capture   *lib.CaptureReader
+	infoMap   lib.ProcInfoMap
+	from, to  time.Time
+	format    string
+	topN      int
+	sortKey   lib.SortKey
+	threshold float64
+	pid       int
+	bucket    time.Duration
+	length    time.Duration
+	value     string // cpu, runq or iowait, for folded
+	cgroups   bool   // start stacks with the cgroup
+	pids      bool   // add the pid to each frame
+	match     lib.ProcMatch
+	width     int // of the text heatmap
+	groupKey  lib.GroupKey
+	after     *lib.CaptureReader // the other side of a diff, which can be capture
+	afterFrom time.Time
+	afterTo   time.Time
+}
+
+// columns of a ProcSummary that fit in a text table
+var procTextCols = []string{"pid", "name", "samples", "cpu_pct.avg", "cpu_pct.max", "cpu_p95_pct", "usr_pct",
+	"sys_pct", "runq_pct", "iowait_pct", "swap_pct", "rss_bytes", "threads"}
+
+func (q *query) interval() uint32 {
+	return uint32(q.capture.Interval)
+}
+
+// rankedSummary summarizes w with the top processes by -sort
+func (q *query) rankedSummary(w *window) *lib.Summary {
+	ranker := lib.NewRanker(q.sortKey, 0, q.capture.Jiffy, q.capture.Interval)
+	return w.summary(q.infoMap, ranker.Rank(w.procHist, w.procSum, q.topN), q.capture)
+}
+
+func procRows(s *lib.Summary) []interface{} {
+	rows := make([]interface{}, len(s.Procs))
+	for i, proc := range s.Procs {
+		rows[i] = proc
+	}
+	return rows
+}
+
+// top ranks the processes over the whole range
+func (q *query) top() error {
+	w := newWindow()
+	err := walk(q.capture, q.from, q.to, q.infoMap, func(s *step) {
+		w.add(q.interval(), s)
+	})
+	if err != nil {
+		return err
+	}
+	if w.start.IsZero() {
+		return errors.New("there are no samples in that time range")
+	}
+	summary := q.rankedSummary(w)
+	if q.format == "text" {
+		fmt.Printf("%s to %s, top %d procs by %s\n", formatTime(w.start), formatTime(w.end), q.topN, q.sortKey)
+	}
+	return output(q.format, summary, procRows(summary), procTextCols)
+}
+
+type busyPeriod struct {
+	Start   string  `json:"start"`
+	End     string  `json:"end"`
+	Seconds float64 `json:"seconds"`
+	Avg     float64 `json:"avg_busy_pct"`
+	Peak    float64 `json:"peak_busy_pct"`
+}
+
+// busy finds the periods where the machine was busier than -threshold
+func (q *query) busy() error {
+	var periods []busyPeriod
+	var start, end time.Time
+	var total, peak float64
+	var count int
+	finish := func() {
+		if count > 0 {
+			periods = append(periods, busyPeriod{formatTime(start), formatTime(end), end.Sub(start).Seconds(),
+				total / float64(count), peak})
+		}
+		count, total, peak = 0, 0, 0
+	}
+
+	err := walk(q.capture, q.from, q.to, q.infoMap, func(s *step) {
+		pct := busyPct(q.interval(), s)
+		if pct < q.threshold {
+			finish()
+			return
+		}
+		if count == 0 {
+			start = s.sysPrev.CaptureTime
+		}
+		end = s.sysCur.CaptureTime
+		total += pct
+		if pct > peak {
+			peak = pct
+		}
+		count++
+	})
+	if err != nil {
+		return err
+	}
+	finish()
+
+	rows := make([]interface{}, len(periods))
+	for i := range periods {
+		rows[i] = periods[i]
+	}
+	if periods == nil {
+		if q.format == "text" {
+			fmt.Printf("never %.0f%% busy or more\n", q.threshold)
+			return nil
+		}
+		periods = []busyPeriod{}
+	}
+	return output(q.format, periods, rows, nil)
+}
+
+type seriesPoint struct {
+	Time    string  `json:"time"`
+	CPU     float64 `json:"cpu_pct"`
+	Usr     float64 `json:"usr_pct"`
+	Sys     float64 `json:"sys_pct"`
+	Runq    float64 `json:"runq_pct"`
+	Iowait  float64 `json:"iowait_pct"`
+	RSS     uint64  `json:"rss_bytes"`
+	Threads uint64  `json:"threads"`
+}
+
+// series shows how one process did over time, in -bucket chunks
+func (q *query) series() error {
+	if q.pid == 0 {
+		return errors.New("series needs a pid, with -p")
+	}
+	var points []seriesPoint
+	var w *window
+	var origin, bucketStart time.Time
+	finish := func() {
+		if w == nil {
+			return
+		}
+		summary := w.summary(q.infoMap, lib.Pidlist{q.pid}, q.capture)
+		if len(summary.Procs) > 0 {
+			p := summary.Procs[0]
+			points = append(points, seriesPoint{formatTime(bucketStart), p.Usr + p.Sys, p.Usr, p.Sys, p.Runq,
+				p.Iowait, p.RSS, p.Threads})
+		}
+		w = nil
+	}
+
+	// each step goes in the bucket it started in, counting from the first one
+	err := walk(q.capture, q.from, q.to, q.infoMap, func(s *step) {
+		if origin.IsZero() {
+			origin = s.sysPrev.CaptureTime
+		}
+		start := origin.Add(s.sysPrev.CaptureTime.Sub(origin) / q.bucket * q.bucket)
+		if w != nil && start.Equal(bucketStart) == false {
+			finish()
+		}
+		if w == nil {
+			w = newWindow()
+			bucketStart = start
+		}
+		w.add(q.interval(), s)
+	})
+	if err != nil {
+		return err
+	}
+	finish()
+
+	rows := make([]interface{}, len(points))
+	for i := range points {
+		rows[i] = points[i]
+	}
+	if points == nil {
+		return fmt.Errorf("pid %d is not in the capture in that time range", q.pid)
+	}
+	return output(q.format, points, rows, nil)
+}
+
+type worstWindow struct {
+	Start   string       `json:"start"`
+	End     string       `json:"end"`
+	Busy    float64      `json:"busy_pct"`
+	Summary *lib.Summary `json:"summary"`
+}
+
+// worst finds the busiest -window of time, and ranks the processes that were running then
+func (q *query) worst() error {
+	type busyStep struct {
+		start, end time.Time
+		busy       float64
+	}
+	var steps []busyStep
+	err := walk(q.capture, q.from, q.to, q.infoMap, func(s *step) {
+		steps = append(steps, busyStep{s.sysPrev.CaptureTime, s.sysCur.CaptureTime, busyPct(q.interval(), s)})
+	})
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		return errors.New("there are no samples in that time range")
+	}
+
+	// slide a window across the steps, weighting each by how long it was
+	slack := time.Duration(q.capture.Interval) * time.Millisecond / 2
+	first, bestFirst, bestLast := 0, 0, len(steps)-1
+	best, sum := -1.0, 0.0
+	for last := range steps {
+		sum += steps[last].busy * steps[last].end.Sub(steps[last].start).Seconds()
+		for steps[last].end.Sub(steps[first].start) > q.length+slack {
+			sum -= steps[first].busy * steps[first].end.Sub(steps[first].start).Seconds()
+			first++
+		}
+		span := steps[last].end.Sub(steps[first].start)
+		if span < q.length-slack {
+			continue
+		}
+		if avg := sum / span.Seconds(); avg > best {
+			best, bestFirst, bestLast = avg, first, last
+		}
+	}
+	if best < 0 {
+		// the range is shorter than the window, so it's all of it
+		sum = 0
+		for _, s := range steps {
+			sum += s.busy * s.end.Sub(s.start).Seconds()
+		}
+		best = sum / steps[len(steps)-1].end.Sub(steps[0].start).Seconds()
+	}
+
+	w := newWindow()
+	err = walk(q.capture, steps[bestFirst].start, steps[bestLast].end, q.infoMap, func(s *step) {
+		w.add(q.interval(), s)
+	})
+	if err != nil {
+		return err
+	}
+	summary := q.rankedSummary(w)
+	if q.format == "text" {
+		fmt.Printf("busiest %s: %s to %s, %.1f%% busy, top %d procs by %s\n", q.length, formatTime(w.start),
+			formatTime(w.end), best, q.topN, q.sortKey)
+	}
+	doc := worstWindow{formatTime(w.start), formatTime(w.end), best, summary}
+	return output(q.format, doc, procRows(summary), procTextCols)
+}
+
+// profileTypes are the values in a stack profile, in the order profile adds them
+var profileTypes = []string{"cpu", "runq", "iowait"}
+
+// profile adds up the time each process spent on CPU and waiting, with stacks made of
+// its cgroup and ancestors
+func (q *query) profile() (*lib.StackProfile, *window, error) {
+	w := newWindow()
+	err := walk(q.capture, q.from, q.to, q.infoMap, func(s *step) {
+		w.add(q.interval(), s)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if w.start.IsZero() {
+		return nil, nil, errors.New("there are no samples in that time range")
+	}
+
+	tickNs := int64(time.Second) / int64(q.capture.Jiffy)
+	p := lib.NewStackProfile(profileTypes...)
+	for pid, sum := range w.procSum {
+		p.Add(q.stack(pid), int64(sum.Proc.Utime+sum.Proc.Stime)*tickNs, int64(sum.Task.Cpudelaytotal),
+			int64(sum.Task.Blkiodelaytotal))
+	}
+	return p, w, nil
+}
+
+func (q *query) stack(pid int) []string {
+	var frames []string
+	info, ok := q.infoMap[pid]
+	if ok == false {
+		return []string{fmt.Sprint(pid)}
+	}
+	if cgroup := strings.Trim(info.Cgroup, "/"); q.cgroups && cgroup != "" {
+		frames = append(frames, strings.Split(cgroup, "/")...)
+	}
+	for _, ancestor := range q.infoMap.Ancestry(pid) {
+		a := q.infoMap[ancestor]
+		name := a.Friendly
+		if name == "" {
+			name = a.Comm
+		}
+		if q.pids {
+			name = fmt.Sprintf("%s %d", name, ancestor)
+		}
+		frames = append(frames, name)
+	}
+	return frames
+}
+
+// pprof writes a gzipped pprof profile with cpu, runq and iowait values
+func (q *query) pprof() error {
+	p, w, err := q.profile()
+	if err != nil {
+		return err
+	}
+	return p.WritePprof(os.Stdout, w.start, w.end.Sub(w.start))
+}
+
+// folded writes -value in milliseconds for flamegraph.pl
+func (q *query) folded() error {
+	index := -1
+	for i, name := range profileTypes {
+		if name == q.value {
+			index = i
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("-value must be %s", strings.Join(profileTypes, ", "))
+	}
+	p, _, err := q.profile()
+	if err != nil {
+		return err
+	}
+	return p.WriteFolded(os.Stdout, index, int64(time.Millisecond))
+}
+
+// trace writes a Chrome trace of every sample
+func (q *query) trace() error {
+	t := lib.NewTraceWriter(os.Stdout, q.capture.Jiffy, q.capture.Interval)
+	var err error
+	werr := walk(q.capture, q.from, q.to, q.infoMap, func(s *step) {
+		// a new window each time, since the sums aren't needed
+		procDelta, sysDelta := newWindow().add(q.interval(), s)
+		if err == nil {
+			err = t.WriteSample(procDelta, sysDelta, q.infoMap)
+		}
+	})
+	if werr != nil {
+		return werr
+	}
+	if err != nil {
+		return err
+	}
+	return t.Close()
+}
+
+// heatmap draws a subsecond offset heatmap of the system, or of the processes in -p,
+// -name or -cgroup, as SVG or in the terminal
+func (q *query) heatmap() error {
+	h := lib.NewHeatmap(q.capture.Interval)
+	err := walk(q.capture, q.from, q.to, q.infoMap, func(s *step) {
+		procDelta, sysDelta := newWindow().add(q.interval(), s)
+		value := lib.HeatmapValue(procDelta, sysDelta, q.infoMap, q.match, q.capture.Jiffy, q.capture.Interval)
+		h.Add(s.sysCur.CaptureTime, value)
+	})
+	if err != nil {
+		return err
+	}
+	if h.Columns() == 0 {
+		return errors.New("there are no samples in that time range")
+	}
+
+	title := fmt.Sprintf("%s busy, percent of all CPUs", q.match)
+	if q.match.Any() {
+		title = fmt.Sprintf("%s CPU, percent of one CPU", q.match)
+	}
+	title += ", on " + q.capture.Host
+	if q.format == "svg" {
+		return h.WriteSVG(os.Stdout, title)
+	}
+	return h.WriteANSI(os.Stdout, title, q.width, 20)
+}
+
+// columns of a GroupDiff that fit in a text table
+var diffTextCols = []string{"name", "status", "changed", "procs_before", "procs_after", "cpu_pct.before.avg",
+	"cpu_pct.after.avg", "cpu_pct.p95_before", "cpu_pct.p95_after", "cpu_pct.before.max", "cpu_pct.after.max",
+	"runq_pct.change", "iowait_pct.change", "ctxsw_per_sec.change", "rss_bytes.change"}
+
+type diffSide struct {
+	Start   string `json:"start"`
+	End     string `json:"end"`
+	Samples int64  `json:"samples"`
+}
+
+type diffDoc struct {
+	Before diffSide        `json:"before"`
+	After  diffSide        `json:"after"`
+	Groups []lib.GroupDiff `json:"groups"`
+}
+
+// groupStats adds up the processes of each group between from and to
+func (q *query) groupStats(capture *lib.CaptureReader, infoMap lib.ProcInfoMap, from,
+	to time.Time) (lib.GroupStatsMap, diffSide, error) {
+
+	w := newWindow()
+	groups := make(lib.GroupStatsMap)
+	err := walk(capture, from, to, infoMap, func(s *step) {
+		procDelta, _ := w.add(uint32(capture.Interval), s)
+		lib.UpdateGroupStats(groups, q.groupKey, procDelta, w.procSum, infoMap, capture.Jiffy, capture.Interval)
+	})
+	if err == nil && w.start.IsZero() {
+		err = errors.New("there are no samples in that time range")
+	}
+	if err != nil {
+		return nil, diffSide{}, err
+	}
+	return groups, diffSide{formatTime(w.start), formatTime(w.end), w.sysHist.Usr.TotalCount()}, nil
+}
+
+// diff compares the groups before and after, with the biggest changes in CPU first
+func (q *query) diff() error {
+	before, beforeSide, err := q.groupStats(q.capture, q.infoMap, q.from, q.to)
+	if err != nil {
+		return fmt.Errorf("before: %s", err)
+	}
+	infoMap := q.infoMap
+	if q.after != q.capture {
+		infoMap = make(lib.ProcInfoMap)
+	}
+	after, afterSide, err := q.groupStats(q.after, infoMap, q.afterFrom, q.afterTo)
+	if err != nil {
+		return fmt.Errorf("after: %s", err)
+	}
+
+	doc := diffDoc{Before: beforeSide, After: afterSide, Groups: lib.DiffGroups(before, after)}
+	if q.topN > 0 && len(doc.Groups) > q.topN {
+		doc.Groups = doc.Groups[:q.topN]
+	}
+	rows := make([]interface{}, len(doc.Groups))
+	for i := range doc.Groups {
+		rows[i] = doc.Groups[i]
+	}
+	if q.format == "text" {
+		fmt.Printf("before %s to %s, %d samples\n", beforeSide.Start, beforeSide.End, beforeSide.Samples)
+		fmt.Printf("after  %s to %s, %d samples\n", afterSide.Start, afterSide.End, afterSide.Samples)
+	}
+	return output(q.format, doc, rows, diffTextCols)
+}
+
+func formatTime(t time.Time) string {
+	return t.Format(time.RFC3339Nano)
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"io"
+	"time"
+
+	lib "github.com/uber-common/cpustat/lib"
+)
+
+// step is a pair of consecutive samples from a capture
+type step struct {
+	cur, prev       lib.ProcSampleList
+	sysCur, sysPrev *lib.SystemStats
+}
+
+// walk calls fn with every step between from and to. The first sample at or after from
+// is the baseline, so the first step ends at the sample after it.
+func walk(capture *lib.CaptureReader, from, to time.Time, infoMap lib.ProcInfoMap, fn func(s *step)) error {
+	if err := capture.Seek(from, infoMap); err != nil {
+		return err
+	}
+	procCur := lib.NewProcSampleList(2048)
+	procPrev := lib.NewProcSampleList(2048)
+	var sysCur, sysPrev lib.SystemStats
+
+	baseline := false
+	for {
+		err := capture.Next(&procCur, &sysCur, infoMap)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if sysCur.CaptureTime.Before(from) {
+			continue
+		}
+		if to.IsZero() == false && sysCur.CaptureTime.After(to) {
+			return nil
+		}
+		if baseline {
+			fn(&step{procCur, procPrev, &sysCur, &sysPrev})
+		}
+		baseline = true
+		procPrev, procCur = procCur, procPrev
+		sysPrev = sysCur
+	}
+}
+
+// window adds up steps the same way cpustat does for a summary
+type window struct {
+	start, end time.Time
+	procSum    lib.ProcSampleMap
+	procHist   lib.ProcStatsHistMap
+	taskHist   lib.TaskStatsHistMap
+	sysSum     *lib.SystemStats
+	sysHist    *lib.SystemStatsHist
+}
+
+func newWindow() *window {
+	return &window{
+		procSum:  make(lib.ProcSampleMap),
+		procHist: make(lib.ProcStatsHistMap),
+		taskHist: make(lib.TaskStatsHistMap),
+		sysSum:   &lib.SystemStats{},
+		sysHist:  lib.NewSysStatsHist(),
+	}
+}
+
+// add records a step, and returns its deltas
+func (w *window) add(interval uint32, s *step) (lib.ProcSampleMap, *lib.SystemStats) {
+	procDelta := make(lib.ProcSampleMap, s.cur.Len)
+	lib.ProcStatsRecord(interval, s.cur, s.prev, w.procSum, procDelta)
+	lib.UpdateProcStatsHist(w.procHist, procDelta)
+	lib.TaskStatsRecord(interval, s.cur, s.prev, w.procSum, procDelta)
+	lib.UpdateTaskStatsHist(w.taskHist, procDelta)
+
+	sysDelta := lib.SystemStatsRecord(interval, s.sysCur, s.sysPrev, w.sysSum)
+	lib.UpdateSysStatsHist(w.sysHist, sysDelta)
+
+	if w.start.IsZero() {
+		w.start = s.sysPrev.CaptureTime
+	}
+	w.end = s.sysCur.CaptureTime
+	return procDelta, sysDelta
+}
+
+func (w *window) summary(infoMap lib.ProcInfoMap, list lib.Pidlist, capture *lib.CaptureReader) *lib.Summary {
+	return lib.NewSummary(w.start, w.end, infoMap, list, w.procSum, w.procHist, w.taskHist, w.sysSum, w.sysHist,
+		capture.Jiffy, capture.Interval)
+}
+
+// busyPct is lib.BusyPct for a step, without adding it to a window
+func busyPct(interval uint32, s *step) float64 {
+	return lib.BusyPct(lib.SystemStatsRecord(interval, s.sysCur, s.sysPrev, &lib.SystemStats{}))
+}
@@ -0,0 +1,319 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Charts are drawn as SVG strings with fixed sizes, so the report needs no scripts
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"math"
+	"time"
+
+	lib "github.com/uber-common/cpustat/lib"
+)
+
+const (
+	chartWidth  = 1000
+	chartLeft   = 50
+	chartRight  = 10
+	chartTop    = 22
+	chartBottom = 22
+	plotWidth   = chartWidth - chartLeft - chartRight
+)
+
+var seriesColors = []string{"#1f77b4", "#d62728", "#ff7f0e", "#2ca02c", "#9467bd"}
+
+// timeline averages values into buckets spread across the report's time range, so a day
+// long capture makes the same size charts as a minute long one
+type timeline struct {
+	start  time.Time
+	bucket time.Duration
+	sums   [][]float64 // by bucket, then series
+	counts []int
+}
+
+func newTimeline(start, end time.Time, points, interval int) *timeline {
+	if end.Before(start) {
+		end = start
+	}
+	bucket := end.Sub(start) / time.Duration(points)
+	if min := time.Duration(interval) * time.Millisecond; bucket < min {
+		bucket = min
+	}
+	n := int(end.Sub(start)/bucket) + 1
+	return &timeline{start: start, bucket: bucket, sums: make([][]float64, n), counts: make([]int, n)}
+}
+
+func (t *timeline) add(at time.Time, vals ...float64) {
+	i := int(at.Sub(t.start) / t.bucket)
+	if i < 0 || i >= len(t.counts) {
+		return
+	}
+	for len(t.sums[i]) < len(vals) {
+		t.sums[i] = append(t.sums[i], 0)
+	}
+	for j, val := range vals {
+		t.sums[i][j] += val
+	}
+	t.counts[i]++
+}
+
+// value is the average of one series in bucket i, if there were any samples in it
+func (t *timeline) value(i, series int) (float64, bool) {
+	if t.counts[i] == 0 || series >= len(t.sums[i]) {
+		return 0, false
+	}
+	return t.sums[i][series] / float64(t.counts[i]), true
+}
+
+// width is the most series any bucket has
+func (t *timeline) width() int {
+	max := 0
+	for _, sums := range t.sums {
+		if len(sums) > max {
+			max = len(sums)
+		}
+	}
+	return max
+}
+
+func (t *timeline) empty() bool {
+	return t.width() == 0
+}
+
+func (t *timeline) x(i int) float64 {
+	return chartLeft + plotWidth*(float64(i)+0.5)/float64(len(t.counts))
+}
+
+// timeLabels puts about 6 times along the bottom of a chart
+func (t *timeline) timeLabels(out *bytes.Buffer, y float64) {
+	n := len(t.counts)
+	for k := 0; k < 6; k++ {
+		i := k * (n - 1) / 5
+		anchor := "middle"
+		if k == 0 {
+			anchor = "start"
+		} else if k == 5 {
+			anchor = "end"
+		}
+		fmt.Fprintf(out, `<text x="%.1f" y="%.1f" text-anchor="%s">%s</text>`+"\n", t.x(i), y, anchor,
+			t.start.Add(time.Duration(i)*t.bucket).Format("15:04:05"))
+		if n < 6 {
+			break
+		}
+	}
+}
+
+// niceCeil rounds up to 1, 2 or 5 times a power of 10
+func niceCeil(v float64) float64 {
+	if v <= 0 {
+		return 1
+	}
+	pow := math.Pow(10, math.Floor(math.Log10(v)))
+	for _, step := range []float64{1, 2, 5, 10} {
+		if v <= step*pow {
+			return step * pow
+		}
+	}
+	return 10 * pow
+}
+
+func svgStart(out *bytes.Buffer, width, height float64) {
+	fmt.Fprintf(out, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" font-family="sans-serif" font-size="11">`+"\n",
+		width, height)
+}
+
+// lineChart draws each series of t as a line, with a gap where there are no samples. If
+// max is 0, the scale fits the data.
+func lineChart(t *timeline, unit string, max float64, names []string) template.HTML {
+	const height = 200
+	plotHeight := float64(height - chartTop - chartBottom)
+	n := len(t.counts)
+	if max == 0 {
+		for i := 0; i < n; i++ {
+			for j := range names {
+				if val, ok := t.value(i, j); ok && val > max {
+					max = val
+				}
+			}
+		}
+		max = niceCeil(max)
+	}
+	y := func(val float64) float64 {
+		return chartTop + plotHeight*(1-math.Min(val, max)/max)
+	}
+
+	var out bytes.Buffer
+	svgStart(&out, chartWidth, height)
+	for k := 0; k <= 4; k++ {
+		val := max * float64(k) / 4
+		fmt.Fprintf(&out, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#dddddd"/>`+"\n",
+			chartLeft, y(val), chartWidth-chartRight, y(val))
+		fmt.Fprintf(&out, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`+"\n", chartLeft-4, y(val)+4,
+			formatValue(val))
+	}
+	fmt.Fprintf(&out, `<text x="%d" y="12">%s</text>`+"\n", chartLeft, template.HTMLEscapeString(unit))
+	for j, name := range names {
+		color := seriesColors[j%len(seriesColors)]
+		x := chartWidth - chartRight - 90*(len(names)-j)
+		fmt.Fprintf(&out, `<rect x="%d" y="4" width="10" height="10" fill="%s"/><text x="%d" y="13">%s</text>`+"\n",
+			x, color, x+14, template.HTMLEscapeString(name))
+	}
+
+	for j := range names {
+		var path bytes.Buffer
+		move := true
+		for i := 0; i < n; i++ {
+			val, ok := t.value(i, j)
+			if ok == false {
+				move = true
+				continue
+			}
+			cmd := "L"
+			if move {
+				cmd = "M"
+			}
+			fmt.Fprintf(&path, "%s%.1f %.1f ", cmd, t.x(i), y(val))
+			move = false
+		}
+		fmt.Fprintf(&out, `<path d="%s" fill="none" stroke="%s" stroke-width="1.5"/>`+"\n", path.String(),
+			seriesColors[j%len(seriesColors)])
+	}
+
+	// invisible columns for tooltips with the values
+	colWidth := float64(plotWidth) / float64(n)
+	for i := 0; i < n; i++ {
+		if t.counts[i] == 0 {
+			continue
+		}
+		var tip bytes.Buffer
+		tip.WriteString(t.start.Add(time.Duration(i) * t.bucket).Format("15:04:05.000"))
+		for j, name := range names {
+			if val, ok := t.value(i, j); ok {
+				fmt.Fprintf(&tip, " %s %s", name, formatValue(val))
+			}
+		}
+		fmt.Fprintf(&out, `<rect x="%.1f" y="%d" width="%.2f" height="%.0f" fill-opacity="0"><title>%s</title></rect>`+"\n",
+			t.x(i)-colWidth/2, chartTop, colWidth, plotHeight, template.HTMLEscapeString(tip.String()))
+	}
+	t.timeLabels(&out, height-6)
+	out.WriteString("</svg>\n")
+	return template.HTML(out.String())
+}
+
+// cpuStrip draws how busy each CPU was as a row of colored cells
+func cpuStrip(t *timeline) template.HTML {
+	cpus := t.width()
+	rowHeight := math.Max(3, math.Min(14, 320/float64(cpus)))
+	height := chartTop + rowHeight*float64(cpus) + chartBottom
+	n := len(t.counts)
+	colWidth := float64(plotWidth) / float64(n)
+
+	var out bytes.Buffer
+	svgStart(&out, chartWidth, height)
+	fmt.Fprintf(&out, `<text x="%d" y="12">%% busy of each CPU, white is idle and red is 100%%</text>`+"\n", chartLeft)
+	fmt.Fprintf(&out, `<rect x="%d" y="%d" width="%d" height="%.1f" fill="#eeeeee"/>`+"\n",
+		chartLeft, chartTop, plotWidth, rowHeight*float64(cpus))
+	for cpu := 0; cpu < cpus; cpu++ {
+		y := chartTop + rowHeight*float64(cpu)
+		// label about every 14 pixels
+		if every := int(math.Ceil(14 / rowHeight)); cpu%every == 0 {
+			fmt.Fprintf(&out, `<text x="%d" y="%.1f" text-anchor="end">cpu%d</text>`+"\n", chartLeft-4,
+				y+math.Min(rowHeight, 11), cpu)
+		}
+		for i := 0; i < n; i++ {
+			val, ok := t.value(i, cpu)
+			if ok == false {
+				continue
+			}
+			r, g, b := lib.HeatColor(val / 100)
+			fmt.Fprintf(&out, `<rect x="%.1f" y="%.1f" width="%.2f" height="%.1f" fill="rgb(%d,%d,%d)"/>`+"\n",
+				t.x(i)-colWidth/2, y, colWidth, rowHeight, r, g, b)
+		}
+	}
+	t.timeLabels(&out, height-6)
+	out.WriteString("</svg>\n")
+	return template.HTML(out.String())
+}
+
+// histChart draws the distribution of a process's usr+sys CPU per sample, with each bar
+// a whole number of clock ticks wide, since that's all the resolution there is
+func histChart(hist *lib.ProcStatsHist, jiffy, interval int) template.HTML {
+	const maxBins, width, height, left, bottom = 20, 420, 130, 40, 20
+	tickPct := func(ticks int64) float64 {
+		return lib.TicksPct(float64(ticks), jiffy, float64(interval))
+	}
+	total := hist.Ustime.TotalCount()
+	if total == 0 {
+		return ""
+	}
+	perBin := hist.Ustime.Max()/maxBins + 1
+	counts := make([]int64, hist.Ustime.Max()/perBin+1)
+	for _, bar := range hist.Ustime.Distribution() {
+		if bar.Count == 0 {
+			continue
+		}
+		bin := bar.From / perBin
+		if bin >= int64(len(counts)) {
+			bin = int64(len(counts)) - 1
+		}
+		counts[bin] += bar.Count
+	}
+	var most int64
+	for _, count := range counts {
+		if count > most {
+			most = count
+		}
+	}
+
+	plotHeight := float64(height - bottom - 10)
+	barWidth := math.Min(40, float64(width-left-10)/float64(len(counts)))
+	var out bytes.Buffer
+	svgStart(&out, width, height)
+	for bin, count := range counts {
+		label := formatValue(tickPct(int64(bin) * perBin))
+		if perBin > 1 {
+			label += "-" + formatValue(tickPct(int64(bin+1)*perBin-1))
+		}
+		h := plotHeight * float64(count) / float64(most)
+		fmt.Fprintf(&out, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s%%: %d samples, %.1f%%</title></rect>`+"\n",
+			left+barWidth*float64(bin)+1, 10+plotHeight-h, barWidth-2, h, seriesColors[0],
+			label, count, float64(count)/float64(total)*100)
+	}
+	fmt.Fprintf(&out, `<text x="%d" y="20" text-anchor="end">%.0f%%</text>`+"\n", left-4,
+		float64(most)/float64(total)*100)
+	fmt.Fprintf(&out, `<text x="%d" y="%.1f" text-anchor="end">0</text>`+"\n", left-4, 10+plotHeight)
+	fmt.Fprintf(&out, `<text x="%d" y="%d">0%%</text>`+"\n", left, height-5)
+	fmt.Fprintf(&out, `<text x="%.1f" y="%d" text-anchor="end">%s%% of a CPU per sample</text>`+"\n",
+		left+barWidth*float64(len(counts)), height-5, formatValue(tickPct(int64(len(counts)-1)*perBin)))
+	out.WriteString("</svg>\n")
+	return template.HTML(out.String())
+}
+
+// formatValue drops the decimals from big numbers
+func formatValue(v float64) string {
+	if v >= 10 || v == math.Trunc(v) {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%.1f", v)
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Turn a capture, or the buffer of a running cpustat-agent, into a single HTML file that
+// can be attached to an incident and opened anywhere, since the charts are inline SVG and
+// there are no scripts or other files.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	lib "github.com/uber-common/cpustat/lib"
+)
+
+const usage = `usage: cpustat-report [flags] capture.cps|http://host:6060/capture
+
+Writes an HTML report of a capture written with cpustat -w, or of everything in the buffer
+of a cpustat-agent.
+
+Flags:
+`
+
+func main() {
+	var outFile = flag.String("o", "cpustat-report.html", "write the report to this file, or - for stdout")
+	var from = flag.String("from", "", "start at this offset into the capture like 90s, or RFC3339 time")
+	var to = flag.String("to", "", "stop at this offset into the capture like 5m, or RFC3339 time")
+	var topN = flag.Int("n", 10, "show top N processes for each metric")
+	var points = flag.Int("points", 600, "most points in each timeline, longer captures are averaged to fit")
+	var maxEvents = flag.Int("events", 1000, "most process start and exit events to list")
+	var title = flag.String("title", "", "title of the report, instead of the host and time")
+	var nameRules = flag.String("names", "", "load friendly name rules from this JSON file")
+
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *topN <= 0 || *points <= 0 {
+		fmt.Println("The -n and -points options must be positive")
+		os.Exit(1)
+	}
+	if *nameRules != "" {
+		if err := lib.LoadNameRules(*nameRules); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	source := flag.Arg(0)
+	filename := source
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		var err error
+		if filename, err = download(source); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer os.Remove(filename)
+	}
+
+	capture, err := lib.OpenCapture(filename)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer capture.Close()
+
+	r := reporter{
+		capture:   capture,
+		infoMap:   make(lib.ProcInfoMap),
+		topN:      *topN,
+		points:    *points,
+		maxEvents: *maxEvents,
+	}
+	if r.from, err = capture.ParseTime(*from); err == nil {
+		r.to, err = capture.ParseTime(*to)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	rep, err := r.run()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	rep.Source = source
+	if *title != "" {
+		rep.Title = *title
+	}
+
+	var out io.WriteCloser = os.Stdout
+	if *outFile != "-" {
+		if out, err = os.Create(*outFile); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if err = writeReport(out, rep); err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// download saves the capture an agent serves to a temp file, since reading a capture
+// needs to seek. A URL with no path gets the agent's /capture.
+func download(source string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", err
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/capture"
+	}
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("%s: %s %s", u, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	f, err := ioutil.TempFile("", "cpustat-report-*.cps")
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(f, resp.Body); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,308 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	lib "github.com/uber-common/cpustat/lib"
+)
+
+type reporter struct {
+	capture   *lib.CaptureReader
+	infoMap   lib.ProcInfoMap
+	from, to  time.Time
+	topN      int
+	points    int
+	maxEvents int
+}
+
+type setting struct {
+	Name, Value string
+}
+
+// topTable is the top processes by one metric
+type topTable struct {
+	Key   lib.SortKey
+	Procs []lib.ProcSummary
+}
+
+// procDetail is a process that made it into any of the top tables
+type procDetail struct {
+	lib.ProcSummary
+	Cgroup string
+	Hist   template.HTML
+}
+
+type event struct {
+	Time    string
+	Kind    string // start or exit
+	Pid     int
+	Ppid    uint64
+	Name    string
+	Cmdline string
+}
+
+// report is everything the template shows
+type report struct {
+	Title     string
+	Source    string
+	Generated string
+	Settings  []setting
+	System    lib.SystemSummary
+	CPU       template.HTML
+	PerCPU    template.HTML
+	Runq      template.HTML
+	Procs     template.HTML
+	Tops      []topTable
+	Details   []procDetail
+	Events    []event
+	Dropped   int // events past -events
+}
+
+// the metrics that get a top table, in order
+var reportKeys = []lib.SortKey{lib.SortCPUAvg, lib.SortCPUMax, lib.SortRunq, lib.SortIowait, lib.SortRSS}
+
+// run reads the capture once, adding up every step into the sums and histograms that
+// the tables come from, and into the timelines
+func (r *reporter) run() (*report, error) {
+	c := r.capture
+	start, end := r.from, r.to
+	if start.IsZero() {
+		start = c.Start
+	}
+	if end.IsZero() || end.After(c.End) {
+		end = c.End
+	}
+	interval := uint32(c.Interval)
+	sampleNs := float64(c.Interval) * float64(time.Millisecond)
+
+	cpu := newTimeline(start, end, r.points, c.Interval)
+	perCPU := newTimeline(start, end, r.points, c.Interval)
+	runq := newTimeline(start, end, r.points, c.Interval)
+	procs := newTimeline(start, end, r.points, c.Interval)
+
+	procSum := make(lib.ProcSampleMap)
+	procHist := make(lib.ProcStatsHistMap)
+	taskHist := make(lib.TaskStatsHistMap)
+	sysSum := &lib.SystemStats{}
+	sysHist := lib.NewSysStatsHist()
+	var first, last time.Time
+
+	rep := report{}
+	live := make(map[int]bool)
+	var prevCPUs lib.PerCPUStats
+
+	if err := c.Seek(r.from, r.infoMap); err != nil {
+		return nil, err
+	}
+	procCur := lib.NewProcSampleList(2048)
+	procPrev := lib.NewProcSampleList(2048)
+	var sysCur, sysPrev lib.SystemStats
+	baseline := false
+	for {
+		err := c.Next(&procCur, &sysCur, r.infoMap)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if sysCur.CaptureTime.Before(r.from) {
+			continue
+		}
+		if r.to.IsZero() == false && sysCur.CaptureTime.After(r.to) {
+			break
+		}
+		cpus := c.PerCPU()
+		if baseline {
+			now := sysCur.CaptureTime
+			procDelta := make(lib.ProcSampleMap, procCur.Len)
+			lib.ProcStatsRecord(interval, procCur, procPrev, procSum, procDelta)
+			lib.UpdateProcStatsHist(procHist, procDelta)
+			lib.TaskStatsRecord(interval, procCur, procPrev, procSum, procDelta)
+			lib.UpdateTaskStatsHist(taskHist, procDelta)
+			sysDelta := lib.SystemStatsRecord(interval, &sysCur, &sysPrev, sysSum)
+			lib.UpdateSysStatsHist(sysHist, sysDelta)
+			if first.IsZero() {
+				first = sysPrev.CaptureTime
+			}
+			last = now
+
+			total := float64(sysDelta.Usr + sysDelta.Nice + sysDelta.Sys + sysDelta.Idle + sysDelta.Iowait +
+				sysDelta.Irq + sysDelta.Softirq + sysDelta.Steal)
+			if total > 0 {
+				cpu.add(now, float64(sysDelta.Usr+sysDelta.Nice)/total*100, float64(sysDelta.Sys)/total*100,
+					float64(sysDelta.Iowait)/total*100)
+			}
+			procs.add(now, float64(sysDelta.ProcsRunning), float64(sysDelta.ProcsBlocked))
+			var delay uint64
+			for _, delta := range procDelta {
+				delay += delta.Task.Cpudelaytotal
+			}
+			runq.add(now, float64(delay)/sampleNs*100)
+
+			if len(cpus) > 0 && len(cpus) == len(prevCPUs) {
+				busy := make([]float64, len(cpus))
+				for i := range cpus {
+					busy[i] = cpus[i].BusyPct(&prevCPUs[i])
+				}
+				perCPU.add(now, busy...)
+			}
+
+			r.events(&rep, live, procDelta, sysPrev.CaptureTime, now)
+		} else {
+			// processes in the first sample were already running
+			for i := uint32(0); i < procCur.Len; i++ {
+				live[procCur.Samples[i].Pid] = true
+			}
+		}
+		baseline = true
+		procPrev, procCur = procCur, procPrev
+		sysPrev = sysCur
+		prevCPUs = append(prevCPUs[:0], cpus...)
+	}
+	if first.IsZero() {
+		return nil, errors.New("there are no samples in that time range")
+	}
+
+	summary := func(list lib.Pidlist) *lib.Summary {
+		return lib.NewSummary(first, last, r.infoMap, list, procSum, procHist, taskHist, sysSum, sysHist,
+			c.Jiffy, c.Interval)
+	}
+	seen := make(map[int]bool)
+	for _, key := range reportKeys {
+		ranker := lib.NewRanker(key, 0, c.Jiffy, c.Interval)
+		s := summary(ranker.Rank(procHist, procSum, r.topN))
+		rep.Tops = append(rep.Tops, topTable{key, s.Procs})
+		for _, proc := range s.Procs {
+			if seen[proc.Pid] {
+				continue
+			}
+			seen[proc.Pid] = true
+			rep.Details = append(rep.Details, r.detail(proc, procHist[proc.Pid]))
+		}
+	}
+	rep.System = summary(nil).System
+
+	if rep.Title == "" {
+		rep.Title = fmt.Sprintf("cpustat report for %s", c.Host)
+	}
+	rep.Generated = formatTime(time.Now())
+	rep.Settings = r.settings(first, last, summary(nil).Samples)
+	rep.CPU = lineChart(cpu, "% of all CPUs", 100, []string{"usr", "sys", "iowait"})
+	rep.Procs = lineChart(procs, "processes", 0, []string{"running", "blocked"})
+	rep.Runq = lineChart(runq, "% of a CPU", 0, []string{"waiting for a CPU"})
+	if perCPU.empty() == false {
+		rep.PerCPU = cpuStrip(perCPU)
+	}
+	return &rep, nil
+}
+
+// events notes the processes that started and exited during a step
+func (r *reporter) events(rep *report, live map[int]bool, procDelta lib.ProcSampleMap, prev, now time.Time) {
+	var started, exited lib.Pidlist
+	for pid := range procDelta {
+		if live[pid] == false {
+			started = append(started, pid)
+			live[pid] = true
+		}
+	}
+	for pid := range live {
+		if _, ok := procDelta[pid]; ok == false {
+			exited = append(exited, pid)
+			delete(live, pid)
+		}
+	}
+	sort.Ints(exited)
+	sort.Ints(started)
+	// a process that exited was last seen at the previous sample
+	for _, pid := range exited {
+		r.event(rep, "exit", pid, prev)
+	}
+	for _, pid := range started {
+		r.event(rep, "start", pid, now)
+	}
+}
+
+func (r *reporter) event(rep *report, kind string, pid int, t time.Time) {
+	if len(rep.Events) >= r.maxEvents {
+		rep.Dropped++
+		return
+	}
+	e := event{Time: formatTime(t), Kind: kind, Pid: pid}
+	if info, ok := r.infoMap[pid]; ok {
+		e.Ppid = info.Ppid
+		e.Name = info.Friendly
+		e.Cmdline = strings.Join(info.Cmdline, " ")
+	}
+	rep.Events = append(rep.Events, e)
+}
+
+func (r *reporter) detail(proc lib.ProcSummary, hist *lib.ProcStatsHist) procDetail {
+	d := procDetail{ProcSummary: proc}
+	if info, ok := r.infoMap[proc.Pid]; ok {
+		d.Cgroup = info.Cgroup
+	}
+	if hist != nil {
+		d.Hist = histChart(hist, r.capture.Jiffy, r.capture.Interval)
+	}
+	return d
+}
+
+func (r *reporter) settings(first, last time.Time, samples int64) []setting {
+	c := r.capture
+	orNone := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	cpus := "unknown"
+	if c.CPUs > 0 {
+		cpus = fmt.Sprint(c.CPUs)
+	}
+	filters := c.Filters
+	if filters == "" {
+		filters = "none, all processes"
+	}
+	return []setting{
+		{"Host", orNone(c.Host)},
+		{"Kernel", orNone(c.Kernel)},
+		{"CPUs", cpus},
+		{"Interval", fmt.Sprintf("%dms", c.Interval)},
+		{"Clock ticks", fmt.Sprintf("%d per second", c.Jiffy)},
+		{"Filters", filters},
+		{"Capture", fmt.Sprintf("%s to %s, %d samples", formatTime(c.Start), formatTime(c.End), c.Samples)},
+		{"Report", fmt.Sprintf("%s to %s, %d samples, %s", formatTime(first), formatTime(last), samples,
+			last.Sub(first).Round(time.Second))},
+	}
+}
+
+func formatTime(t time.Time) string {
+	return t.Format("2006-01-02 15:04:05.000 MST")
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+)
+
+var reportFuncs = template.FuncMap{
+	"pct": func(v float64) string {
+		return fmt.Sprintf("%.1f", v)
+	},
+	"mb": func(v uint64) string {
+		return fmt.Sprintf("%.1f", float64(v)/1024/1024)
+	},
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(reportFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 20px 40px; color: #222222; }
+h1 { font-size: 22px; }
+h2 { font-size: 18px; margin-top: 32px; border-bottom: 1px solid #cccccc; }
+h3 { font-size: 15px; margin-bottom: 4px; }
+table { border-collapse: collapse; margin: 8px 0; }
+th, td { padding: 3px 10px; text-align: left; border-bottom: 1px solid #eeeeee; }
+td.n, th.n { text-align: right; font-variant-numeric: tabular-nums; }
+th.key { background: #fff3cd; }
+.small { color: #666666; font-size: 12px; }
+.cmd { font-family: monospace; font-size: 12px; max-width: 600px; overflow-wrap: anywhere; }
+.proc { display: inline-block; vertical-align: top; margin: 0 24px 16px 0; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="small">From {{.Source}}, generated {{.Generated}}. Percentages are of a single CPU unless they say otherwise.</p>
+
+<h2>Collection</h2>
+<table>
+{{range .Settings}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>
+{{end}}</table>
+
+<h2>System</h2>
+<table>
+<tr><th></th><th class="n">min</th><th class="n">avg</th><th class="n">max</th></tr>
+<tr><th>usr %</th><td class="n">{{pct .System.Usr.Min}}</td><td class="n">{{pct .System.Usr.Avg}}</td><td class="n">{{pct .System.Usr.Max}}</td></tr>
+<tr><th>sys %</th><td class="n">{{pct .System.Sys.Min}}</td><td class="n">{{pct .System.Sys.Avg}}</td><td class="n">{{pct .System.Sys.Max}}</td></tr>
+<tr><th>iowait %</th><td class="n">{{pct .System.Iowait.Min}}</td><td class="n">{{pct .System.Iowait.Avg}}</td><td class="n">{{pct .System.Iowait.Max}}</td></tr>
+<tr><th>idle %</th><td class="n">{{pct .System.Idle.Min}}</td><td class="n">{{pct .System.Idle.Avg}}</td><td class="n">{{pct .System.Idle.Max}}</td></tr>
+<tr><th>running</th><td class="n">{{pct .System.ProcsRunning.Min}}</td><td class="n">{{pct .System.ProcsRunning.Avg}}</td><td class="n">{{pct .System.ProcsRunning.Max}}</td></tr>
+<tr><th>blocked</th><td class="n">{{pct .System.ProcsBlocked.Min}}</td><td class="n">{{pct .System.ProcsBlocked.Avg}}</td><td class="n">{{pct .System.ProcsBlocked.Max}}</td></tr>
+</table>
+<p class="small">{{printf "%.0f" .System.Ctxsw}} context switches per second, {{.System.ProcsStarted}} processes started.</p>
+<h3>CPU</h3>
+{{.CPU}}
+<h3>Per CPU</h3>
+{{if .PerCPU}}{{.PerCPU}}{{else}}<p class="small">This capture has no per-CPU times. Captures from cpustat -w have them, agent buffers don't.</p>{{end}}
+<h3>Run queue</h3>
+{{.Procs}}
+{{.Runq}}
+
+<h2>Top processes</h2>
+{{range .Tops}}
+<h3>By {{.Key}}</h3>
+<table>
+<tr><th class="n">pid</th><th>name</th><th class="n">samples</th>
+<th class="n{{if eq .Key.String "cpuavg"}} key{{end}}">cpu avg</th>
+<th class="n{{if eq .Key.String "cpumax"}} key{{end}}">cpu max</th>
+<th class="n">cpu p95</th><th class="n">usr</th><th class="n">sys</th>
+<th class="n{{if eq .Key.String "runq"}} key{{end}}">runq</th>
+<th class="n{{if eq .Key.String "iowait"}} key{{end}}">iowait</th>
+<th class="n{{if eq .Key.String "rss"}} key{{end}}">rss MB</th>
+<th class="n">threads</th></tr>
+{{range .Procs}}<tr><td class="n"><a href="#pid{{.Pid}}">{{.Pid}}</a></td><td>{{.Name}}</td><td class="n">{{.Samples}}</td>
+<td class="n">{{pct .CPU.Avg}}</td><td class="n">{{pct .CPU.Max}}</td><td class="n">{{pct .CPUP95}}</td>
+<td class="n">{{pct .Usr}}</td><td class="n">{{pct .Sys}}</td><td class="n">{{pct .Runq}}</td><td class="n">{{pct .Iowait}}</td>
+<td class="n">{{mb .RSS}}</td><td class="n">{{.Threads}}</td></tr>
+{{end}}</table>
+{{end}}
+
+<h2>CPU distribution of top processes</h2>
+<p class="small">How many samples each process spent at each level of usr+sys CPU.</p>
+{{range .Details}}<div class="proc" id="pid{{.Pid}}">
+<h3>{{.Name}} ({{.Pid}})</h3>
+<div class="cmd">{{.Cmdline}}</div>
+<div class="small">ppid {{.Ppid}}, uid {{.UID}}{{if .Cgroup}}, cgroup {{.Cgroup}}{{end}}</div>
+{{.Hist}}
+</div>
+{{end}}
+
+<h2>Process starts and exits</h2>
+{{if .Events}}<table>
+<tr><th>time</th><th>event</th><th class="n">pid</th><th class="n">ppid</th><th>name</th><th>command</th></tr>
+{{range .Events}}<tr><td>{{.Time}}</td><td>{{.Kind}}</td><td class="n">{{.Pid}}</td><td class="n">{{.Ppid}}</td><td>{{.Name}}</td><td class="cmd">{{.Cmdline}}</td></tr>
+{{end}}</table>
+{{if .Dropped}}<p class="small">{{.Dropped}} more events were left out.</p>{{end}}
+{{else}}<p class="small">No processes started or exited.</p>{{end}}
+</body>
+</html>
+`))
+
+func writeReport(w io.Writer, rep *report) error {
+	return reportTemplate.Execute(w, rep)
+}
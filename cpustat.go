@@ -30,13 +30,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
 	"runtime/pprof"
-	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	lib "github.com/uber-common/cpustat/lib"
@@ -61,33 +66,75 @@ func maybeStartProfile(argStr string) {
 	}
 }
 
-func waitForExit(memprofile string) chan string {
+var cleanupOnce sync.Once
+
+// cleanup closes the output files in closers and writes the profiles, once, since a second
+// signal can race with the main loop finishing
+func cleanup(memprofile string, closers []io.Closer) {
+	cleanupOnce.Do(func() { doCleanup(memprofile, closers) })
+}
+
+func doCleanup(memprofile string, closers []io.Closer) {
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	pprof.StopCPUProfile()
+
+	if memprofile != "" {
+		f, err := os.Create(memprofile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pprof.WriteHeapProfile(f)
+		f.Close()
+	}
+}
+
+// waitForExit cleans up and exits on a message from the UI. If signals is set, the first
+// SIGINT or SIGTERM closes stop instead, so the main loop can finish up, and a second one
+// exits right away.
+func waitForExit(memprofile string, closers []io.Closer, signals bool) (chan string, chan struct{}) {
 	uiQuitChan := make(chan string)
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
+	stop := make(chan struct{})
+	sigChan := make(chan os.Signal, 2)
+	if signals {
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	}
 
 	go func() {
 		select {
 		case <-sigChan:
-			fmt.Fprintln(os.Stderr, "quitting on signal")
+			fmt.Fprintln(os.Stderr, "stopping on signal")
+			close(stop)
+			// timeout(1) and some shells signal the whole process group, so a quick
+			// repeat is the same signal
+			first := time.Now()
+			for range sigChan {
+				if time.Since(first) > time.Second {
+					break
+				}
+			}
+			fmt.Fprintln(os.Stderr, "quitting on second signal")
 		case msg := <-uiQuitChan:
 			fmt.Fprintln(os.Stderr, msg)
 		}
-		pprof.StopCPUProfile()
-
-		if memprofile != "" {
-			f, err := os.Create(memprofile)
-			if err != nil {
-				log.Fatal(err)
-			}
-			pprof.WriteHeapProfile(f)
-			f.Close()
-		}
-
+		cleanup(memprofile, closers)
 		os.Exit(0)
 	}()
 
-	return uiQuitChan
+	return uiQuitChan, stop
+}
+
+// stopped is whether stop has been closed
+func stopped(stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
 }
 
 func main() {
@@ -101,10 +148,130 @@ func main() {
 	var memprofile = flag.String("memprofile", "", "write memory profile to this file")
 	var jiffy = flag.Int("jiffy", 100, "length of a jiffy")
 	var useTui = flag.Bool("t", false, "use fancy terminal mode")
+	var nameRules = flag.String("names", "", "load friendly name rules from this JSON file")
+	var sortBy = flag.String("sort", "cpumax", "rank top N by cpumax, cpuavg, cpup95, runq, iowait, swap, rss, ctxsw or io")
+	var ewma = flag.Float64("ewma", 0, "smooth ranking across summaries with this weight for the newest, 0 to disable")
+	var colSpec = flag.String("o", defaultColumns, "comma separated list of columns to show, or help to list them")
+	var wrap = flag.Bool("wrap", false, "wrap the last column onto more lines instead of truncating it, text mode only")
+	var format = flag.String("format", "text", "output format, text, jsonl or csv")
+	var statsd = flag.String("statsd", "", "also send each summary to this StatsD host:port")
+	var dogstatsd = flag.Bool("dogstatsd", false, "use DogStatsD tags for -statsd")
+	var influx = flag.String("influx", "", "also send each summary to InfluxDB at this udp:// or http:// URL, or file")
+	var sinkTags = flag.String("sinktags", "", "extra tags for -statsd and -influx, like host=web01,env=prod")
+	var sinkBuffer = flag.Int("sinkbuffer", 1024*1024, "bytes to buffer for -statsd and -influx while they are failing")
+	var writeFile = flag.String("w", "", "record every sample to this capture file")
+	var readFile = flag.String("r", "", "replay samples from this capture file instead of measuring")
+	var speed = flag.Float64("speed", 1, "replay speed for -r, 1 for the original speed or 0 for as fast as possible")
+	var step = flag.Bool("step", false, "with -r, wait for enter (or n in -t mode) before each summary")
+	var from = flag.String("from", "", "with -r, start at this offset into the capture like 90s, or RFC3339 time")
+	var to = flag.String("to", "", "with -r, stop at this offset into the capture like 5m, or RFC3339 time")
+	var traceFile = flag.String("trace", "", "write a timeline of every sample to this Chrome trace JSON file")
+	var triggerFile = flag.String("triggers", "", "run commands when processes match the rules in this JSON file")
+	var triggerLog = flag.String("triggerlog", "", "append trigger firings to this file instead of stderr")
+	var burstPct = flag.Float64("burst", 0, "report bursts of samples above this CPU percent, 0 to disable")
+	var burstSigma = flag.Float64("burstsigma", 0, "also report samples this many standard deviations over baseline")
+	var burstLog = flag.String("burstlog", "", "append bursts to this file as JSON lines")
+	var runCmd = flag.String("run", "", "run this shell command, and only measure it and its children")
+	var duration = flag.Duration("duration", 0, "stop after this long, like 30s, 0 to run until stopped")
+	var maxCount = flag.Int("count", 0, "stop after this many summaries, 0 to run until stopped")
+	var align = flag.Bool("align", false, "take samples on multiples of the interval on the wall clock, to line up with other hosts")
+	var slowEvery = flag.Int("slow", 0, "read processes that have been idle only every this many samples, 0 to read all of them every sample")
+	var slowAfter = flag.Int("slowafter", 25, "with -slow, samples without any CPU or delay before a process is read less often")
+	var fastTop = flag.Int("fasttop", 10, "with -slow, always read the processes that were busiest lately every sample")
+	var fastPct = flag.Float64("fastpct", 1, "with -slow, always read processes that lately used more than this percent of a CPU every sample")
+	var fastSpike = flag.Float64("fastspike", 80, "with -slow, read every process while all CPUs are busier than this percent, 0 to disable")
+	var nice = flag.Int("nice", 0, "nice level of the sampling thread, negative to keep sampling on a saturated machine")
+	var rtPrio = flag.Int("rtprio", 0, "run the sampling thread with this SCHED_FIFO priority, 0 to disable")
+	var cgroup = flag.String("cgroup", "", "move cpustat to this cgroup, created if needed")
+	var cpuWeight = flag.Int("cpuweight", 0, "CPU weight of -cgroup, where 100 is the default")
+	var mlock = flag.Bool("mlock", false, "lock cpustat's memory in RAM as it is used")
+	var finalSum = flag.Bool("final", false, "print a summary of the whole run at the end, on by default with -duration or -count")
 
 	flag.Parse()
 
-	checkPrivs()
+	if *colSpec == "help" {
+		printColumnHelp()
+		os.Exit(0)
+	}
+	cols, err := parseColumns(*colSpec)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	switch *format {
+	case "text", "jsonl", "csv":
+	default:
+		fmt.Println("The output format must be text, jsonl or csv")
+		os.Exit(1)
+	}
+	if *useTui && *format != "text" {
+		fmt.Println("The -format option can't be used with -t")
+		os.Exit(1)
+	}
+
+	// cpustat -- cmd args, or -run "cmd args"
+	var cmd *command
+	if *runCmd != "" || flag.NArg() > 0 {
+		if *runCmd != "" && flag.NArg() > 0 {
+			fmt.Println("Use either -run or a command after --, not both")
+			os.Exit(1)
+		}
+		if *useTui || *readFile != "" || *pidOnly != "" {
+			fmt.Println("The -t, -r and -p options can't be used when running a command")
+			os.Exit(1)
+		}
+		cmd = newCommand(*runCmd, flag.Args())
+	}
+	// a wrapped command has the terminal to itself until it exits
+	textOut := *format == "text" && *useTui == false && cmd == nil
+
+	if *duration < 0 || *maxCount < 0 {
+		fmt.Println("The -duration and -count options can't be negative")
+		os.Exit(1)
+	}
+	if cmd != nil && (*duration > 0 || *maxCount > 0) {
+		fmt.Println("The -duration and -count options can't be used when running a command")
+		os.Exit(1)
+	}
+	var run *runTotals
+	if (*finalSum || *duration > 0 || *maxCount > 0) && *useTui == false && cmd == nil {
+		run = newRunTotals()
+	}
+
+	sinks, err := initSinks(sinkConfig{*format, *statsd, *dogstatsd, *influx, *sinkTags, *sinkBuffer})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var capture *lib.CaptureReader
+	if *readFile != "" {
+		if capture, err = lib.OpenCapture(*readFile); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		// the capture's timing wins over the flags
+		*interval, *jiffy = capture.Interval, capture.Jiffy
+	} else {
+		if *step || *from != "" || *to != "" {
+			fmt.Println("The -step, -from and -to options only work with -r")
+			os.Exit(1)
+		}
+		checkPrivs()
+	}
+	if *speed < 0 {
+		fmt.Println("The replay speed can't be negative")
+		os.Exit(1)
+	}
+	if *slowEvery < 0 || *slowEvery == 1 || *slowAfter < 1 {
+		fmt.Println("The -slow option must be 0 or at least 2, and -slowafter at least 1")
+		os.Exit(1)
+	}
+	if *slowEvery > 0 && capture != nil {
+		fmt.Println("The -slow option can't be used with -r")
+		os.Exit(1)
+	}
 
 	if *interval < 10 {
 		fmt.Println("The minimum sampling interval is 10ms")
@@ -112,180 +279,327 @@ func main() {
 	}
 	intervalms := uint32(*interval)
 
-	maybeStartProfile(*cpuprofile)
-	uiQuitChan := waitForExit(*memprofile)
-	filters := lib.FiltersInit(*usrOnly, *pidOnly)
-	nlConn := lib.NLInit()
+	if *nameRules != "" {
+		if err := lib.LoadNameRules(*nameRules); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	if *useTui {
-		go tuiInit(uiQuitChan, *interval)
-	} else {
-		textInit(*interval, *samples, *topN, filters)
+	sortKey, err := lib.ParseSortKey(*sortBy)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
+	if *ewma < 0 || *ewma > 1 {
+		fmt.Println("The ewma weight must be between 0 and 1")
+		os.Exit(1)
+	}
+	ranker := lib.NewRanker(sortKey, *ewma, *jiffy, *interval)
+	sortChan := make(chan lib.SortKey, 1)
 
+	filters := lib.FiltersInit(*usrOnly, *pidOnly)
 	infoMap := make(lib.ProcInfoMap)
 
-	procCur := lib.NewProcSampleList(*maxProcsToScan)
-	procPrev := lib.NewProcSampleList(*maxProcsToScan)
-	procSum := make(lib.ProcSampleMap)
-	procHist := make(lib.ProcStatsHistMap)
-	taskHist := make(lib.TaskStatsHistMap)
-
-	var sysCur lib.SystemStats
-	var sysPrev lib.SystemStats
-	var sysSum *lib.SystemStats
-	var sysHist *lib.SystemStatsHist
+	opts := []lib.SamplerOption{lib.WithInterval(*interval), lib.WithAlign(*align), lib.WithMaxProcs(*maxProcsToScan),
+		lib.WithJiffy(*jiffy), lib.WithFilters(filters), lib.WithInfoMap(infoMap, nil)}
+	var stepChan chan string
+	if capture != nil {
+		fromTime, err := capture.ParseTime(*from)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		toTime, err := capture.ParseTime(*to)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if *step {
+			stepChan = make(chan string)
+			if *useTui == false {
+				go stepLines(stepChan)
+			}
+		}
+		replay, err := newReplaySource(capture, filters, fromTime, toTime, *speed, stepChan, *samples, infoMap)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		opts = append(opts, lib.WithSource(replay))
+	} else if *slowEvery > 0 {
+		opts = append(opts, lib.WithTiers(lib.TierConfig{Every: *slowEvery, IdleAfter: *slowAfter, TopN: *fastTop,
+			MinPct: *fastPct, SpikePct: *fastSpike}))
+	}
 
-	var t1, t2 time.Time
-	var err error
+	var closers []io.Closer
+	if *writeFile != "" {
+		header := lib.CaptureHeader{Interval: *interval, Jiffy: *jiffy, Filters: lib.CaptureFilters(*pidOnly, *usrOnly)}
+		if capture != nil {
+			// recording a replay describes where the samples were really taken
+			header.Host, header.Kernel, header.CPUs = capture.Host, capture.Kernel, capture.CPUs
+			header.Filters = strings.TrimSpace(capture.Filters + " " + header.Filters)
+		}
+		writer, err := lib.CreateCapture(*writeFile, header)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		recorder := &recordingSource{capture: writer}
+		opts = append(opts, lib.WithSourceWrapper(recorder.wrap))
+		closers = append(closers, recorder)
+	}
+	var trace *lib.TraceWriter
+	if *traceFile != "" {
+		f, err := os.Create(*traceFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		trace = lib.NewTraceWriter(f, *jiffy, *interval)
+		closers = append(closers, trace)
+	}
 
-	// run all scans one time to establish a baseline
-	pids := make(lib.Pidlist, 0, *maxProcsToScan)
+	var triggers *lib.TriggerEngine
+	if *triggerFile != "" {
+		rules, err := lib.LoadTriggers(*triggerFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		var logOut io.Writer = os.Stderr
+		if *triggerLog != "" {
+			if logOut, err = os.OpenFile(*triggerLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		} else if *useTui {
+			fmt.Println("The -triggers option needs -triggerlog with -t")
+			os.Exit(1)
+		}
+		triggers = lib.NewTriggerEngine(rules, logOut, *jiffy, *interval)
+	}
 
-	t1 = time.Now()
-	lib.GetPidList(&pids, *maxProcsToScan)
-	lib.ProcStatsReader(pids, filters, &procPrev, infoMap)
-	lib.TaskStatsReader(nlConn, pids, &procPrev)
-	err = lib.SystemStatsReader(&sysPrev)
-	if err != nil {
-		panic(err)
+	var bursts *lib.BurstDetector
+	var burstOut *json.Encoder
+	if *burstPct > 0 || *burstSigma > 0 {
+		bursts = lib.NewBurstDetector(lib.BurstConfig{Threshold: *burstPct, Sigma: *burstSigma}, *jiffy, *interval)
+		if *burstLog != "" {
+			f, err := os.OpenFile(*burstLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			burstOut = json.NewEncoder(f)
+			burstOut.SetEscapeHTML(false)
+			closers = append(closers, f)
+		} else if textOut == false {
+			fmt.Println("The -burst and -burstsigma options need -burstlog with -t, -format or a command")
+			os.Exit(1)
+		}
+	} else if *burstLog != "" {
+		fmt.Println("The -burstlog option needs -burst or -burstsigma")
+		os.Exit(1)
+	}
+	logBursts := func(ended []lib.Burst) {
+		if burstOut == nil {
+			return
+		}
+		for _, b := range ended {
+			if err := burstOut.Encode(b); err != nil {
+				log.Println(err)
+			}
+		}
 	}
 
-	sysSum = &lib.SystemStats{}
-	sysHist = lib.NewSysStatsHist()
-	t2 = time.Now()
+	maybeStartProfile(*cpuprofile)
+	uiQuitChan, stop := waitForExit(*memprofile, closers, cmd == nil)
 
-	targetSleep := time.Duration(*interval) * time.Millisecond
-	adjustedSleep := targetSleep - t2.Sub(t1)
+	if *useTui {
+		go tuiInit(uiQuitChan, *interval, sortKey, sortChan, stepChan)
+	} else if textOut {
+		textInit(*interval, *samples, *topN, sortKey, filters)
+	}
 
-	topPids := make(lib.Pidlist, *topN)
-	for {
-		for count := 0; count < *samples; count++ {
-			time.Sleep(adjustedSleep)
+	var tree *lib.TreeStats
+	if cmd != nil {
+		tree = lib.NewTreeStats(*jiffy, *interval)
+		if err = cmd.start(); err != nil {
+			fmt.Println(err)
+			os.Exit(127)
+		}
+		opts = append(opts, lib.WithProcTree(lib.NewProcTree(cmd.cmd.Process.Pid)),
+			lib.WithSourceWrapper(func(src lib.Source) lib.Source { return newCommandSource(src, cmd) }))
+	}
 
-			t1 = time.Now()
-			lib.GetPidList(&pids, *maxProcsToScan)
+	// the main goroutine samples. This is after starting a command so it doesn't inherit any of it.
+	if capture == nil {
+		protection := lib.Protection{Nice: *nice, RTPrio: *rtPrio, Cgroup: *cgroup, CPUWeight: *cpuWeight, Mlock: *mlock}
+		if err = lib.Protect(protection); err != nil {
+			fmt.Println(err)
+			if cmd != nil {
+				cmd.cmd.Process.Kill()
+			}
+			os.Exit(1)
+		}
+	}
 
-			lib.ProcStatsReader(pids, filters, &procCur, infoMap)
-			lib.TaskStatsReader(nlConn, pids, &procCur)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
 
-			procDelta := make(lib.ProcSampleMap, len(pids))
-			lib.ProcStatsRecord(intervalms, procCur, procPrev, procSum, procDelta)
-			lib.UpdateProcStatsHist(procHist, procDelta)
-			lib.TaskStatsRecord(intervalms, procCur, procPrev, procSum, procDelta)
-			lib.UpdateTaskStatsHist(taskHist, procDelta)
+	summarizer := lib.NewSummarizer(*samples)
+	var runStart time.Time
+	var tierStats lib.TierStats // totals at the end of the last window
+	var topPids lib.Pidlist
+	var windowBursts []lib.Burst
+	var tiers *lib.TieredReader
+	summaries := 0
+	errors := 0 // a script running cpustat needs to know if some of the data is missing
 
-			procPrev, procCur = procCur, procPrev
+	summarize := func(w *lib.Window) {
+		logBursts(windowBursts)
 
-			if err = lib.SystemStatsReader(&sysCur); err != nil {
-				log.Fatal(err)
-			}
-			sysDelta := lib.SystemStatsRecord(intervalms, &sysCur, &sysPrev, sysSum)
-			lib.UpdateSysStatsHist(sysHist, sysDelta)
-			sysPrev = sysCur
+		select {
+		case key := <-sortChan:
+			ranker.SetKey(key)
+		default:
+		}
+		topPids = ranker.Rank(w.ProcHist, w.ProcSum, *topN)
 
-			if *useTui {
-				tuiGraphUpdate(procDelta, sysDelta, topPids, uint32(*jiffy), intervalms)
+		if *useTui {
+			tuiListUpdate(infoMap, topPids, w.ProcSum, w.ProcHist, w.TaskHist, w.SysSum, w.SysHist, cols, ranker.Key,
+				*jiffy, *interval, w.Samples)
+		} else if textOut {
+			dumpStats(infoMap, topPids, w.ProcSum, w.ProcHist, w.TaskHist, w.SysSum, w.SysHist, cols, *wrap, *jiffy,
+				*interval, w.Samples)
+			dumpTiming(w.Timing)
+			dumpBursts(windowBursts)
+		}
+		windowBursts = nil
+		var windowTiers *lib.TierStats
+		if tiers != nil {
+			stats := tiers.Stats()
+			since := stats.Since(tierStats)
+			windowTiers, tierStats = &since, stats
+			if textOut {
+				dumpTiers(since)
 			}
-
-			t2 = time.Now()
-			adjustedSleep = targetSleep - t2.Sub(t1)
 		}
-
-		topHist := sortList(procHist, taskHist, *topN)
-		topPids = topPids[:len(topHist)]
-		for i := 0; i < len(topHist) && i < *topN; i++ {
-			topPids[i] = topHist[i].pid
+		if triggers != nil {
+			triggers.Check(w.Start, w.End, infoMap, w.ProcSum, w.ProcHist, w.TaskHist, w.SysSum, w.SysHist)
+		}
+		if len(sinks) > 0 {
+			summary := w.Summary(infoMap, topPids, *jiffy, *interval)
+			summary.Tiers = windowTiers
+			for _, sink := range sinks {
+				if err := sink.Write(summary); err != nil {
+					log.Println(err)
+					errors++
+				}
+			}
 		}
+		if run != nil {
+			run.add(w.Start, w.End, w.ProcSum, w.ProcHist, w.TaskHist, w.SysSum, w.SysHist, w.Timing)
+		}
+		summaries++
+		if *maxCount > 0 && summaries >= *maxCount {
+			cancel()
+		}
+	}
 
+	sampled := func(snap *lib.Snapshot) error {
+		if runStart.IsZero() {
+			runStart = snap.Start
+		}
+		if tree != nil {
+			tree.Add(snap.Procs, snap.ProcTotals, infoMap, snap.End)
+		}
+		var traceErr error
+		if trace != nil {
+			traceErr = trace.WriteSample(snap.Procs, snap.Sys, infoMap)
+		}
+		if bursts != nil {
+			windowBursts = append(windowBursts, bursts.Add(snap.Procs, snap.Carried, snap.Sys, infoMap)...)
+		}
 		if *useTui {
-			tuiListUpdate(infoMap, topPids, procSum, procHist, taskHist, sysSum, sysHist, *jiffy, *interval, *samples)
-		} else {
-			dumpStats(infoMap, topPids, procSum, procHist, taskHist, sysSum, sysHist, *jiffy, *interval, *samples)
-		}
-		procHist = make(lib.ProcStatsHistMap)
-		taskHist = make(lib.TaskStatsHistMap)
-		procSum = make(lib.ProcSampleMap)
-		sysHist = lib.NewSysStatsHist()
-		sysSum = &lib.SystemStats{}
-		t2 = time.Now()
-		adjustedSleep = targetSleep - t2.Sub(t1)
-		// If we can't keep up, try to buy ourselves a little headroom by sleeping for a magic number of ms
-		if adjustedSleep <= 0 {
-			adjustedSleep = time.Duration(100) * time.Millisecond
+			tuiGraphUpdate(snap.Procs, snap.Sys, topPids, uint32(*jiffy), intervalms)
 		}
-	}
-}
 
-// Wrapper to sort histograms by max but remember which pid they are
-type sortHist struct {
-	pid  int
-	proc *lib.ProcStatsHist
-	task *lib.TaskStatsHist
-}
+		if w := summarizer.Add(snap); w != nil {
+			summarize(w)
+		}
+		if *duration > 0 && snap.End.Sub(runStart) >= *duration {
+			cancel()
+		}
+		return traceErr
+	}
 
-// ByMax sorts stats by max usage
-type ByMax []*sortHist
+	sampler, err := lib.NewSampler(append(opts, lib.WithCallback(sampled))...)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	tiers = sampler.Tiers()
+	if err = sampler.Start(ctx); err == io.EOF {
+		fmt.Printf("no samples to replay in %s\n", capture)
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		errors++
+	}
+	sampler.Close()
 
-func (m ByMax) Len() int {
-	return len(m)
-}
-func (m ByMax) Swap(i, j int) {
-	m[i], m[j] = m[j], m[i]
-}
-func (m ByMax) Less(i, j int) bool {
-	var maxI, maxJ float64
-
-	// We might have proc stats but no taskstats because of unfortuante timing
-	if m[i].task == nil || m[j].task == nil {
-		maxI = maxList([]float64{
-			float64(m[i].proc.Ustime.Max()),
-			float64(m[i].proc.Cutime.Max()+m[i].proc.Cstime.Max()) / 1000,
-		})
-		maxJ = maxList([]float64{
-			float64(m[j].proc.Ustime.Max()),
-			float64(m[j].proc.Cutime.Max()+m[j].proc.Cstime.Max()) / 1000,
-		})
+	// a partial summary at the end of a replay still gets shown
+	if bursts != nil {
+		windowBursts = append(windowBursts, bursts.Flush(infoMap)...)
+	}
+	if w := summarizer.Flush(); w != nil {
+		summarize(w)
 	} else {
-		maxI = maxList([]float64{
-			float64(m[i].proc.Ustime.Max()),
-			float64(m[i].proc.Cutime.Max()+m[i].proc.Cstime.Max()) / 100,
-			float64(m[i].task.Cpudelay.Max()) / 1000 / 1000,
-			float64(m[i].task.Iowait.Max()) / 1000 / 1000,
-			float64(m[i].task.Swap.Max()) / 1000 / 1000,
-		})
-		maxJ = maxList([]float64{
-			float64(m[j].proc.Ustime.Max()),
-			float64(m[j].proc.Cutime.Max()+m[j].proc.Cstime.Max()) / 100,
-			float64(m[j].task.Cpudelay.Max()) / 1000 / 1000,
-			float64(m[j].task.Iowait.Max()) / 1000 / 1000,
-			float64(m[j].task.Swap.Max()) / 1000 / 1000,
-		})
-	}
-	return maxI > maxJ
-}
-func maxList(list []float64) float64 {
-	ret := list[0]
-	for i := 1; i < len(list); i++ {
-		if list[i] > ret {
-			ret = list[i]
+		logBursts(windowBursts)
+		if textOut {
+			dumpBursts(windowBursts)
 		}
 	}
-	return ret
-}
 
-func sortList(procHist lib.ProcStatsHistMap, taskHist lib.TaskStatsHistMap, limit int) []*sortHist {
-	var list []*sortHist
-
-	// let's hope that pid is in both sets, otherwise this will blow up
-	for pid, hist := range procHist {
-		list = append(list, &sortHist{pid, hist, taskHist[pid]})
+	// the end of a replay or a wrapped command, -duration, -count, a signal or an error
+	if triggers != nil {
+		triggers.Wait()
 	}
-	sort.Sort(ByMax(list))
-
-	if len(list) > limit {
-		list = list[:limit]
+	if run != nil && run.samples() > 0 {
+		if tiers != nil {
+			run.tiers = &tierStats
+		}
+		var formatSink lib.Sink
+		if textOut == false {
+			formatSink = sinks[0] // initSinks puts it first
+		}
+		if err = run.write(textOut, formatSink, ranker.Key, infoMap, cols, *wrap, *topN, *jiffy, *interval); err != nil {
+			log.Println(err)
+			errors++
+		}
+	}
+	for _, sink := range sinks {
+		if err = sink.Close(); err != nil {
+			log.Println(err)
+			errors++
+		}
 	}
 
-	return list
+	status := 0
+	if errors > 0 {
+		status = 1
+	}
+	if cmd != nil {
+		cmd.report(os.Stderr, tree, *topN, *interval)
+		status = cmd.status()
+	} else if *useTui && stopped(stop) == false {
+		select {} // leave the last summary up until q
+	} else if capture != nil && stopped(stop) == false {
+		fmt.Fprintln(os.Stderr, "end of capture")
+	}
+	cleanup(*memprofile, closers)
+	os.Exit(status)
 }
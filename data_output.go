@@ -0,0 +1,47 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Machine readable output, selected with -format. jsonl writes each summary window as one
+// JSON object per line, and csv is lib.CSVSink.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	lib "github.com/uber-common/cpustat/lib"
+)
+
+type jsonlSink struct {
+	out *json.Encoder
+}
+
+func newJSONLSink() *jsonlSink {
+	return &jsonlSink{json.NewEncoder(os.Stdout)}
+}
+
+func (j *jsonlSink) Write(s *lib.Summary) error {
+	return j.out.Encode(s)
+}
+
+func (j *jsonlSink) Close() error {
+	return nil
+}
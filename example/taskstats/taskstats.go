@@ -30,13 +30,17 @@ import (
 )
 
 func main() {
-	conn := lib.NLInit()
+	conn, err := lib.NLInit()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	fmt.Println(conn)
 
 	sample := lib.ProcSample{}
 	sample.Pid = os.Getpid()
 
-	err := lib.TaskStatsLookupPid(conn, &sample)
+	err = lib.TaskStatsLookupPid(conn, &sample)
 
 	fmt.Printf("proc: %+v\n", sample.Proc)
 	fmt.Printf("task: %+v\n", sample.Task)
@@ -0,0 +1,100 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// The summary of a whole run, for -duration, -count and -final. Each window is merged in as
+// it ends, so this is exactly what one window as long as the run would have shown.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	lib "github.com/uber-common/cpustat/lib"
+)
+
+type runTotals struct {
+	start, end time.Time
+	procSum    lib.ProcSampleMap
+	procHist   lib.ProcStatsHistMap
+	taskHist   lib.TaskStatsHistMap
+	sysSum     *lib.SystemStats
+	sysHist    *lib.SystemStatsHist
+	timing     *lib.SampleTiming
+	tiers      *lib.TierStats
+}
+
+func newRunTotals() *runTotals {
+	return &runTotals{
+		procSum:  make(lib.ProcSampleMap),
+		procHist: make(lib.ProcStatsHistMap),
+		taskHist: make(lib.TaskStatsHistMap),
+		sysSum:   &lib.SystemStats{},
+		sysHist:  lib.NewSysStatsHist(),
+		timing:   lib.NewSampleTiming(),
+	}
+}
+
+func (r *runTotals) add(start, end time.Time, procSum lib.ProcSampleMap, procHist lib.ProcStatsHistMap,
+	taskHist lib.TaskStatsHistMap, sysSum *lib.SystemStats, sysHist *lib.SystemStatsHist, timing *lib.SampleTiming) {
+
+	if r.start.IsZero() {
+		r.start = start
+	}
+	r.end = end
+	lib.MergeProcSums(r.procSum, procSum)
+	lib.MergeProcStatsHists(r.procHist, procHist)
+	lib.MergeTaskStatsHists(r.taskHist, taskHist)
+	lib.MergeSysStats(r.sysSum, sysSum)
+	lib.MergeSysStatsHists(r.sysHist, sysHist)
+	r.timing.Merge(timing)
+}
+
+func (r *runTotals) samples() int {
+	return int(r.sysHist.Usr.TotalCount())
+}
+
+// write shows the final summary like a window, as text or to the -format sink
+func (r *runTotals) write(text bool, sink lib.Sink, key lib.SortKey, infoMap lib.ProcInfoMap, cols []*column,
+	wrap bool, topN, jiffy, interval int) error {
+
+	// the ranking is of the whole run, without smoothing across windows
+	list := lib.NewRanker(key, 0, jiffy, interval).Rank(r.procHist, r.procSum, topN)
+	if text {
+		fmt.Printf("\nwhole run: %s from %s to %s\n", r.end.Sub(r.start).Round(time.Millisecond),
+			r.start.Format("15:04:05"), r.end.Format("15:04:05"))
+		dumpStats(infoMap, list, r.procSum, r.procHist, r.taskHist, r.sysSum, r.sysHist, cols, wrap, jiffy, interval,
+			r.samples())
+		dumpTiming(r.timing)
+		if r.tiers != nil {
+			dumpTiers(*r.tiers)
+		}
+		return nil
+	}
+	if sink == nil {
+		return nil
+	}
+	summary := lib.NewSummary(r.start, r.end, infoMap, list, r.procSum, r.procHist, r.taskHist, r.sysSum, r.sysHist,
+		jiffy, interval)
+	summary.SetTiming(r.timing)
+	summary.Tiers = r.tiers
+	summary.Final = true
+	return sink.Write(summary)
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Microbursts are the spikes that averaging hides. A summary only shows one as a higher
+// max, with no idea of when it was or how long it lasted, so the detector looks at every
+// sample and reports each burst as an event with a start, end and peak.
+
+package cpustat
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// BurstConfig says which samples are part of a burst. At least one of Threshold and Sigma
+// has to be set.
+type BurstConfig struct {
+	Threshold float64 // samples above this percent are bursting, 0 to turn off
+	Sigma     float64 // or this many standard deviations above the baseline, 0 to turn off
+	Floor     float64 // samples at or below this percent never count for Sigma, 10 if 0
+}
+
+// Burst is a run of consecutive samples that were all bursting. Percentages are of one CPU
+// for a process, and of all CPUs for the system.
+type Burst struct {
+	Pid      int       `json:"pid"` // 0 for the whole system
+	Name     string    `json:"name"`
+	Start    time.Time `json:"start"` // the start of the first sample
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration_ms"`
+	Samples  int       `json:"samples"`
+	Peak     float64   `json:"peak_pct"`
+	PeakTime time.Time `json:"peak_time"`
+	Avg      float64   `json:"avg_pct"`
+	Baseline float64   `json:"baseline_pct"` // moving average before the burst started
+}
+
+const (
+	burstBaselineSamples = 50 // samples the baseline moving average mostly covers
+	burstWarmup          = 10 // samples of baseline needed before Sigma is used
+)
+
+// burstSeries follows one process, or the system
+type burstSeries struct {
+	mean, variance float64
+	seen           int
+	cur            *Burst
+	sum            float64
+}
+
+// BurstDetector finds bursts in the CPU of every process and the busy percent of the
+// system, one sample at a time
+type BurstDetector struct {
+	conf     BurstConfig
+	jiffy    int
+	interval int
+	last     time.Time
+	system   burstSeries
+	procs    map[int]*burstSeries
+}
+
+func NewBurstDetector(conf BurstConfig, jiffy, interval int) *BurstDetector {
+	if conf.Floor == 0 {
+		conf.Floor = 10
+	}
+	return &BurstDetector{conf: conf, jiffy: jiffy, interval: interval, procs: make(map[int]*burstSeries)}
+}
+
+// Add checks the deltas of one sample, and returns the bursts that ended before it. carried
+// are the processes that are still there but weren't read, like Snapshot.Carried.
+func (d *BurstDetector) Add(procDelta ProcSampleMap, carried Pidlist, sysDelta *SystemStats,
+	infoMap ProcInfoMap) []Burst {
+
+	now := sysDelta.CaptureTime
+	start := d.last
+	if start.IsZero() {
+		start = now.Add(-time.Duration(d.interval) * time.Millisecond)
+	}
+	d.last = now
+
+	var ended []Burst
+	if b := d.add(&d.system, BusyPct(sysDelta), start, now); b != nil {
+		b.Name = "system"
+		ended = append(ended, *b)
+	}
+
+	for pid, delta := range procDelta {
+		s, ok := d.procs[pid]
+		if ok == false {
+			s = &burstSeries{}
+			d.procs[pid] = s
+		}
+		value := TicksPct(float64(delta.Proc.Utime+delta.Proc.Stime), d.jiffy, float64(d.interval))
+		if b := d.add(s, value, start, now); b != nil {
+			ended = append(ended, d.named(*b, pid, infoMap))
+		}
+	}
+
+	// a process that is gone ends its burst, but a carried one keeps it and its baseline
+	kept := make(map[int]bool, len(carried))
+	for _, pid := range carried {
+		kept[pid] = true
+	}
+	for pid, s := range d.procs {
+		if _, ok := procDelta[pid]; ok || kept[pid] {
+			continue
+		}
+		if s.cur != nil {
+			ended = append(ended, d.named(d.finish(s), pid, infoMap))
+		}
+		delete(d.procs, pid)
+	}
+	sort.Sort(burstsByStart(ended))
+	return ended
+}
+
+// Flush ends every burst that is still going, like at the end of a replay
+func (d *BurstDetector) Flush(infoMap ProcInfoMap) []Burst {
+	var ended []Burst
+	if d.system.cur != nil {
+		b := d.finish(&d.system)
+		b.Name = "system"
+		ended = append(ended, b)
+	}
+	for pid, s := range d.procs {
+		if s.cur != nil {
+			ended = append(ended, d.named(d.finish(s), pid, infoMap))
+		}
+	}
+	sort.Sort(burstsByStart(ended))
+	return ended
+}
+
+func (d *BurstDetector) named(b Burst, pid int, infoMap ProcInfoMap) Burst {
+	b.Pid = pid
+	if info, ok := infoMap[pid]; ok {
+		b.Name = info.Friendly
+	}
+	return b
+}
+
+// add follows one value, and returns the burst it ended, if any
+func (d *BurstDetector) add(s *burstSeries, value float64, start, now time.Time) *Burst {
+	bursting := d.conf.Threshold > 0 && value > d.conf.Threshold
+	if d.conf.Sigma > 0 && s.seen >= burstWarmup && value > d.conf.Floor &&
+		value > s.mean+d.conf.Sigma*math.Sqrt(s.variance) {
+		bursting = true
+	}
+
+	if bursting {
+		if s.cur == nil {
+			s.cur = &Burst{Start: start, Baseline: s.mean}
+			s.sum = 0
+		}
+		b := s.cur
+		b.End = now
+		b.Samples++
+		s.sum += value
+		if value > b.Peak || b.Samples == 1 {
+			b.Peak, b.PeakTime = value, now
+		}
+		return nil
+	}
+
+	var ended *Burst
+	if s.cur != nil {
+		b := d.finish(s)
+		ended = &b
+	}
+	// the baseline leaves out bursts, so a long one doesn't become normal
+	alpha := 2.0 / (burstBaselineSamples + 1)
+	if s.seen == 0 {
+		s.mean = value
+	} else {
+		diff := value - s.mean
+		s.mean += alpha * diff
+		s.variance = (1 - alpha) * (s.variance + alpha*diff*diff)
+	}
+	s.seen++
+	return ended
+}
+
+func (d *BurstDetector) finish(s *burstSeries) Burst {
+	b := *s.cur
+	b.Duration = roundBurst(float64(b.End.Sub(b.Start)) / float64(time.Millisecond))
+	b.Avg = roundBurst(s.sum / float64(b.Samples))
+	b.Peak = roundBurst(b.Peak)
+	b.Baseline = roundBurst(b.Baseline)
+	s.cur = nil
+	return b
+}
+
+// roundBurst keeps two decimals, which is more than a sample can measure anyway
+func roundBurst(val float64) float64 {
+	return math.Round(val*100) / 100
+}
+
+type burstsByStart []Burst
+
+func (b burstsByStart) Len() int      { return len(b) }
+func (b burstsByStart) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b burstsByStart) Less(i, j int) bool {
+	if b[i].Start.Equal(b[j].Start) == false {
+		return b[i].Start.Before(b[j].Start)
+	}
+	return b[i].Pid < b[j].Pid
+}
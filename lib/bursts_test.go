@@ -0,0 +1,104 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// burstSample is a sample where pid 1 used ticks and the system was busy pct percent
+func burstSample(now time.Time, ticks uint64, busy uint64) (ProcSampleMap, *SystemStats) {
+	return ProcSampleMap{1: &ProcSample{Proc: ProcStats{Utime: ticks}}},
+		&SystemStats{CaptureTime: now, Usr: busy, Idle: 100 - busy}
+}
+
+func TestBurstThreshold(t *testing.T) {
+	d := NewBurstDetector(BurstConfig{Threshold: 50}, 100, 100)
+	infoMap := ProcInfoMap{1: &ProcInfo{Friendly: "api"}}
+	start := time.Unix(1500000000, 0)
+
+	// pid 1 at 10% except for samples 3 to 5, with a peak in 4
+	ticks := []uint64{1, 1, 1, 6, 9, 7, 1, 1}
+	var bursts []Burst
+	for i, tick := range ticks {
+		procDelta, sysDelta := burstSample(start.Add(time.Duration(i+1)*100*time.Millisecond), tick, 20)
+		bursts = append(bursts, d.Add(procDelta, nil, sysDelta, infoMap)...)
+	}
+	if len(bursts) != 1 {
+		t.Fatalf("got %d bursts, want 1", len(bursts))
+	}
+	b := bursts[0]
+	if b.Pid != 1 || b.Name != "api" || b.Samples != 3 || math.Abs(b.Peak-90) > 0.01 || math.Abs(b.Avg-73.33) > 0.01 {
+		t.Errorf("burst %+v, want pid 1 api with 3 samples, peak 90 and avg 73.3", b)
+	}
+	if b.Start != start.Add(300*time.Millisecond) || b.End != start.Add(600*time.Millisecond) ||
+		b.Duration != 300 || b.PeakTime != start.Add(500*time.Millisecond) {
+		t.Errorf("burst from %s to %s, %vms, peak at %s", b.Start.Sub(start), b.End.Sub(start), b.Duration,
+			b.PeakTime.Sub(start))
+	}
+}
+
+func TestBurstSigma(t *testing.T) {
+	d := NewBurstDetector(BurstConfig{Sigma: 3}, 100, 100)
+	start := time.Unix(1500000000, 0)
+	now := start
+	var bursts []Burst
+	add := func(ticks, busy uint64) {
+		now = now.Add(100 * time.Millisecond)
+		procDelta, sysDelta := burstSample(now, ticks, busy)
+		bursts = append(bursts, d.Add(procDelta, nil, sysDelta, ProcInfoMap{})...)
+	}
+	// a steady baseline wobbling between 10 and 20%, then the system jumps to 90%
+	for i := 0; i < 30; i++ {
+		add(1+uint64(i%2), 10+uint64(i%2)*10)
+	}
+	add(2, 90)
+	add(2, 90)
+	add(1, 10)
+	if len(bursts) != 1 || bursts[0].Pid != 0 || bursts[0].Name != "system" || bursts[0].Samples != 2 {
+		t.Fatalf("got bursts %+v, want one of the system with 2 samples", bursts)
+	}
+	if bursts[0].Baseline < 10 || bursts[0].Baseline > 20 {
+		t.Errorf("baseline %v, want between 10 and 20", bursts[0].Baseline)
+	}
+
+	// a process in the slow tier that wasn't read keeps its burst
+	bursts = nil
+	add(9, 95)
+	now = now.Add(100 * time.Millisecond)
+	bursts = append(bursts, d.Add(ProcSampleMap{}, Pidlist{1}, &SystemStats{CaptureTime: now, Usr: 95, Idle: 5},
+		ProcInfoMap{})...)
+	if len(bursts) != 0 {
+		t.Fatalf("got bursts %+v while pid 1 was carried, want none", bursts)
+	}
+
+	// an exiting process ends its burst, and Flush ends the rest
+	now = now.Add(100 * time.Millisecond)
+	bursts = append(bursts, d.Add(ProcSampleMap{}, nil, &SystemStats{CaptureTime: now, Usr: 95, Idle: 5}, ProcInfoMap{})...)
+	if len(bursts) != 1 || bursts[0].Pid != 1 {
+		t.Fatalf("got bursts %+v after pid 1 exited, want its burst", bursts)
+	}
+	if flushed := d.Flush(ProcInfoMap{}); len(flushed) != 1 || flushed[0].Pid != 0 || flushed[0].Samples != 3 {
+		t.Errorf("flush = %+v, want the system burst with 3 samples", flushed)
+	}
+}
@@ -0,0 +1,862 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Capture files hold every raw sample, so a run can be replayed through the same code
+// later or somewhere else. The format is a magic number and version, then records:
+//
+//	type byte, uvarint payload length, payload
+//
+// The header record has the sampling interval and where it came from. Each sample record
+// has the system stats and every process sample, and each info record has the ProcInfo for
+// a process the first time it appears in a sample. A per-CPU record before a sample has the
+// times of each CPU, if the writer had them. Numbers are varints, and most are deltas
+// from the previous sample, so a capture is a small fraction of the size of the raw structs.
+// Every captureKeyframe samples, a sample is written in full so reading can start there.
+//
+// When the capture is closed, an index of the keyframes and info records is written at the
+// end, followed by its offset and a second magic number. A capture that was cut off without
+// one is still readable, it just has to be scanned to find its way around.
+
+package cpustat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+const captureMagic = "CPUSTATC"
+const captureIndexMagic = "CPSINDEX"
+const CaptureVersion = 1
+
+// write a full sample every this many samples
+const captureKeyframe = 64
+
+// captureMaxRecord is the most a record can be, which a sample of tens of thousands of
+// processes is well under
+const captureMaxRecord = 64 << 20
+
+const (
+	recHeader = 'H'
+	recSample = 'S'
+	recInfo   = 'I'
+	recIndex  = 'X'
+	recPerCPU = 'C'
+)
+
+// procFields are the counters in a ProcSample that are delta encoded, in file order
+func procFields(s *ProcSample) []*uint64 {
+	p, t := &s.Proc, &s.Task
+	return []*uint64{
+		&p.Utime, &p.Stime, &p.Cutime, &p.Cstime, &p.Numthreads, &p.Rss, &p.Guesttime, &p.Cguesttime,
+		&t.Cpudelaycount, &t.Cpudelaytotal, &t.Blkiodelaycount, &t.Blkiodelaytotal,
+		&t.Swapindelaycount, &t.Swapindelaytotal, &t.Nvcsw, &t.Nivcsw,
+		&t.Freepagesdelaycount, &t.Freepagesdelaytotal, &t.Readbytes, &t.Writebytes,
+	}
+}
+
+// sysFields are the counters in SystemStats, in file order
+func sysFields(s *SystemStats) []*uint64 {
+	return []*uint64{
+		&s.Usr, &s.Nice, &s.Sys, &s.Idle, &s.Iowait, &s.Irq, &s.Softirq, &s.Steal, &s.Guest,
+		&s.GuestNice, &s.Ctxt, &s.ProcsTotal, &s.ProcsRunning, &s.ProcsBlocked,
+	}
+}
+
+// capEncoder builds a record payload
+type capEncoder struct {
+	buf []byte
+}
+
+func (e *capEncoder) uvarint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func (e *capEncoder) varint(v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, tmp[:binary.PutVarint(tmp[:], v)]...)
+}
+
+func (e *capEncoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// time is encoded relative to base, with 0 meaning the zero time
+func (e *capEncoder) time(t, base time.Time) {
+	if t.IsZero() {
+		e.uvarint(0)
+		return
+	}
+	// base is written as wall time, so the monotonic clock can't be used to get the offset
+	d := t.Round(0).Sub(base.Round(0))
+	zigzag := uint64(d<<1) ^ uint64(d>>63)
+	e.uvarint(zigzag + 1)
+}
+
+// counters are deltas from prev if there is one, and wrap around if they go backwards
+func (e *capEncoder) counters(cur, prev []*uint64) {
+	for i, val := range cur {
+		if prev == nil {
+			e.uvarint(*val)
+		} else {
+			e.varint(int64(*val - *prev[i]))
+		}
+	}
+}
+
+// capDecoder reads a record payload. The first error sticks, and everything after it is 0.
+type capDecoder struct {
+	buf []byte
+	err error
+}
+
+var errCaptureCorrupt = errors.New("capture record is corrupt")
+
+func (d *capDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errCaptureCorrupt
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *capDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errCaptureCorrupt
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// count reads how many items follow, which each take at least min bytes, so a corrupt count
+// can't ask for more than the rest of the record could hold
+func (d *capDecoder) count(min int) int {
+	n := d.uvarint()
+	if d.err == nil && n > uint64(len(d.buf)/min) {
+		d.err = errCaptureCorrupt
+	}
+	if d.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (d *capDecoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = errCaptureCorrupt
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+func (d *capDecoder) time(base time.Time) time.Time {
+	v := d.uvarint()
+	if v == 0 {
+		return time.Time{}
+	}
+	v--
+	return base.Add(time.Duration(int64(v>>1) ^ -int64(v&1)))
+}
+
+func (d *capDecoder) counters(cur, prev []*uint64) {
+	for i, val := range cur {
+		if prev == nil {
+			*val = d.uvarint()
+		} else {
+			*val = *prev[i] + uint64(d.varint())
+		}
+	}
+}
+
+func encodeInfo(e *capEncoder, pid int, info *ProcInfo) {
+	e.uvarint(uint64(pid))
+	e.varint(info.FirstSeen.UnixNano())
+	e.string(info.Comm)
+	e.uvarint(uint64(len(info.Cmdline)))
+	for _, arg := range info.Cmdline {
+		e.string(arg)
+	}
+	e.string(info.Friendly)
+	e.uvarint(info.Ppid)
+	e.varint(info.Pgrp)
+	e.varint(info.Session)
+	e.varint(info.Ttynr)
+	e.varint(info.Tpgid)
+	e.uvarint(info.Flags)
+	e.uvarint(info.Starttime)
+	e.varint(info.Nice)
+	e.uvarint(info.Rtpriority)
+	e.uvarint(info.Policy)
+	e.uvarint(uint64(info.UID))
+	e.string(info.Cgroup)
+}
+
+func decodeInfo(d *capDecoder) (int, *ProcInfo) {
+	info := ProcInfo{}
+	pid := int(d.uvarint())
+	info.Pid = uint64(pid)
+	info.FirstSeen = time.Unix(0, d.varint())
+	info.LastSeen = info.FirstSeen
+	info.Comm = d.string()
+	args := d.uvarint()
+	for i := uint64(0); i < args && d.err == nil; i++ {
+		info.Cmdline = append(info.Cmdline, d.string())
+	}
+	info.Friendly = d.string()
+	info.Ppid = d.uvarint()
+	info.Pgrp = d.varint()
+	info.Session = d.varint()
+	info.Ttynr = d.varint()
+	info.Tpgid = d.varint()
+	info.Flags = d.uvarint()
+	info.Starttime = d.uvarint()
+	info.Nice = d.varint()
+	info.Rtpriority = d.uvarint()
+	info.Policy = d.uvarint()
+	info.UID = uint32(d.uvarint())
+	info.Cgroup = d.string()
+	return pid, &info
+}
+
+// CaptureHeader describes where a capture came from. NewCaptureWriter fills in the fields
+// after Jiffy for this machine if they are empty.
+type CaptureHeader struct {
+	Interval int // ms
+	Jiffy    int
+	Filters  string // the -p and -u options, if any
+	Start    time.Time
+	Host     string
+	Kernel   string // kernel release, like 4.9.0-3-amd64
+	CPUs     int
+}
+
+type captureKeyframeEntry struct {
+	time   time.Time
+	offset int64
+}
+
+// CaptureWriter writes samples to a capture file
+type CaptureWriter struct {
+	closer    io.Closer
+	out       *bufio.Writer
+	offset    int64
+	samples   int
+	last      time.Time
+	prevSys   SystemStats
+	prevProcs map[int]ProcSample
+	written   map[int]time.Time // FirstSeen of the ProcInfo last written for each pid
+	keyframes []captureKeyframeEntry
+	infos     []int64
+	prevCPUs  PerCPUStats
+	cpuOffset int64 // where the per-CPU record for the next sample starts, or -1
+}
+
+// CaptureFilters describes the -p and -u flags a capture was taken with
+func CaptureFilters(pidOnly, usrOnly string) string {
+	var args []string
+	if pidOnly != "" {
+		args = append(args, "-p "+pidOnly)
+	}
+	if usrOnly != "" {
+		args = append(args, "-u "+usrOnly)
+	}
+	return strings.Join(args, " ")
+}
+
+// CreateCapture starts a new capture file, replacing any that is there
+func CreateCapture(filename string, h CaptureHeader) (*CaptureWriter, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	w, err := NewCaptureWriter(f, h)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// NewCaptureWriter starts a capture on out, which Close closes if it is an io.Closer
+func NewCaptureWriter(out io.Writer, h CaptureHeader) (*CaptureWriter, error) {
+	w := CaptureWriter{
+		out:       bufio.NewWriterSize(out, 256*1024),
+		written:   make(map[int]time.Time),
+		cpuOffset: -1,
+	}
+	w.closer, _ = out.(io.Closer)
+	var magic [10]byte
+	copy(magic[:], captureMagic)
+	binary.BigEndian.PutUint16(magic[8:], CaptureVersion)
+	w.write(magic[:])
+
+	if h.Start.IsZero() {
+		h.Start = time.Now()
+	}
+	if h.Host == "" {
+		h.Host, _ = os.Hostname()
+	}
+	if h.Kernel == "" {
+		// not ReadSmallFile, since captures are also written while the agent samples
+		if release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+			h.Kernel = strings.TrimSpace(string(release))
+		}
+	}
+	if h.CPUs == 0 {
+		h.CPUs = runtime.NumCPU()
+	}
+	var e capEncoder
+	e.uvarint(uint64(h.Interval))
+	e.uvarint(uint64(h.Jiffy))
+	e.varint(h.Start.UnixNano())
+	e.string(h.Host)
+	e.string(h.Kernel)
+	e.string(h.Filters)
+	e.uvarint(uint64(h.CPUs))
+	if err := w.record(recHeader, e.buf); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func (w *CaptureWriter) write(b []byte) error {
+	n, err := w.out.Write(b)
+	w.offset += int64(n)
+	return err
+}
+
+func (w *CaptureWriter) record(kind byte, payload []byte) error {
+	var e capEncoder
+	e.buf = append(e.buf, kind)
+	e.uvarint(uint64(len(payload)))
+	if err := w.write(e.buf); err != nil {
+		return err
+	}
+	return w.write(payload)
+}
+
+// WritePerCPU adds the times of each CPU for the next sample, so it has to come before the
+// WriteSample of that sample
+func (w *CaptureWriter) WritePerCPU(cpus PerCPUStats) error {
+	// written in full with every keyframe, or if a CPU came online
+	full := w.samples%captureKeyframe == 0 || len(cpus) != len(w.prevCPUs)
+	var e capEncoder
+	e.uvarint(uint64(len(cpus)))
+	if full {
+		e.uvarint(1)
+	} else {
+		e.uvarint(0)
+	}
+	for i := range cpus {
+		if full {
+			e.counters(cpuFields(&cpus[i]), nil)
+		} else {
+			e.counters(cpuFields(&cpus[i]), cpuFields(&w.prevCPUs[i]))
+		}
+	}
+	w.cpuOffset = w.offset
+	if err := w.record(recPerCPU, e.buf); err != nil {
+		return err
+	}
+	w.prevCPUs = append(w.prevCPUs[:0], cpus...)
+	return nil
+}
+
+func cpuFields(c *CPUTimes) []*uint64 {
+	return []*uint64{&c.Usr, &c.Nice, &c.Sys, &c.Idle, &c.Iowait, &c.Irq, &c.Softirq, &c.Steal}
+}
+
+// WriteSample adds a sample. Any processes that haven't been seen before have their
+// ProcInfo written first.
+func (w *CaptureWriter) WriteSample(procs *ProcSampleList, sys *SystemStats, infoMap ProcInfoMap) error {
+	for i := uint32(0); i < procs.Len; i++ {
+		pid := procs.Samples[i].Pid
+		info, ok := infoMap[pid]
+		if ok == false {
+			continue
+		}
+		if firstSeen, ok := w.written[pid]; ok && firstSeen.Equal(info.FirstSeen) {
+			continue
+		}
+		var e capEncoder
+		encodeInfo(&e, pid, info)
+		w.infos = append(w.infos, w.offset)
+		if err := w.record(recInfo, e.buf); err != nil {
+			return err
+		}
+		w.written[pid] = info.FirstSeen
+	}
+
+	keyframe := w.samples%captureKeyframe == 0
+	if keyframe {
+		// start reading from the per-CPU record, if this sample has one
+		offset := w.offset
+		if w.cpuOffset >= 0 {
+			offset = w.cpuOffset
+		}
+		w.keyframes = append(w.keyframes, captureKeyframeEntry{sys.CaptureTime, offset})
+	}
+	w.cpuOffset = -1
+
+	var e capEncoder
+	base := sys.CaptureTime
+	e.varint(base.UnixNano())
+	if keyframe {
+		e.uvarint(1)
+		e.counters(sysFields(sys), nil)
+	} else {
+		e.uvarint(0)
+		e.counters(sysFields(sys), sysFields(&w.prevSys))
+	}
+
+	e.uvarint(uint64(procs.Len))
+	curProcs := make(map[int]ProcSample, procs.Len)
+	lastPid := 0
+	for i := uint32(0); i < procs.Len; i++ {
+		sample := procs.Samples[i]
+		e.varint(int64(sample.Pid - lastPid))
+		lastPid = sample.Pid
+		e.time(sample.Proc.CaptureTime, base)
+		e.time(sample.Task.Capturetime, base)
+
+		if prev, ok := w.prevProcs[sample.Pid]; ok && keyframe == false {
+			e.uvarint(1)
+			e.counters(procFields(&sample), procFields(&prev))
+		} else {
+			e.uvarint(0)
+			e.counters(procFields(&sample), nil)
+		}
+		curProcs[sample.Pid] = sample
+	}
+	if err := w.record(recSample, e.buf); err != nil {
+		return err
+	}
+
+	w.prevSys = *sys
+	w.prevProcs = curProcs
+	w.samples++
+	w.last = sys.CaptureTime
+	return nil
+}
+
+// Close writes the index and closes the file
+func (w *CaptureWriter) Close() error {
+	var e capEncoder
+	e.uvarint(uint64(w.samples))
+	e.varint(w.last.UnixNano())
+	e.uvarint(uint64(len(w.keyframes)))
+	for _, k := range w.keyframes {
+		e.varint(k.time.UnixNano())
+		e.uvarint(uint64(k.offset))
+	}
+	e.uvarint(uint64(len(w.infos)))
+	for _, offset := range w.infos {
+		e.uvarint(uint64(offset))
+	}
+
+	indexOffset := w.offset
+	w.record(recIndex, e.buf)
+	var trailer [16]byte
+	binary.LittleEndian.PutUint64(trailer[:8], uint64(indexOffset))
+	copy(trailer[8:], captureIndexMagic)
+	w.write(trailer[:])
+
+	err := w.out.Flush()
+	if w.closer != nil {
+		if cerr := w.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// CaptureReader reads samples back out of a capture file
+type CaptureReader struct {
+	CaptureHeader
+	Samples   int       // from the index, 0 if the capture has none
+	End       time.Time // time of the last sample
+	file      *os.File
+	size      int64 // of the file, as far as it has been checked
+	in        *bufio.Reader
+	offset    int64
+	prevSys   SystemStats
+	prevProcs map[int]ProcSample
+	keyframes []captureKeyframeEntry
+	infos     []int64
+	prevCPUs  PerCPUStats // last per-CPU record read
+	nextCPUs  PerCPUStats // for the sample after the per-CPU record
+	cpus      PerCPUStats // for the last sample read
+}
+
+// OpenCapture reads the header and index of a capture. If there is no index, the whole
+// file is scanned to build one.
+func OpenCapture(filename string) (*CaptureReader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := CaptureReader{file: f, in: bufio.NewReaderSize(f, 256*1024)}
+	if err = r.open(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return &r, nil
+}
+
+func (r *CaptureReader) open() error {
+	var magic [10]byte
+	if _, err := io.ReadFull(r.in, magic[:]); err != nil || string(magic[:8]) != captureMagic {
+		return errors.New("not a cpustat capture")
+	}
+	if version := binary.BigEndian.Uint16(magic[8:]); version != CaptureVersion {
+		return fmt.Errorf("capture version %d is not supported, this cpustat reads version %d", version, CaptureVersion)
+	}
+	r.offset = int64(len(magic))
+
+	kind, payload, err := r.readRecord()
+	if err != nil || kind != recHeader {
+		return errors.New("capture header is missing")
+	}
+	d := capDecoder{buf: payload}
+	r.Interval = int(d.uvarint())
+	r.Jiffy = int(d.uvarint())
+	r.Start = time.Unix(0, d.varint())
+	r.Host = d.string()
+	r.Kernel = d.string()
+	r.Filters = d.string()
+	r.CPUs = int(d.uvarint())
+	if d.err != nil {
+		return d.err
+	}
+	dataStart := r.offset
+
+	if r.readIndex() == false {
+		if err = r.scanIndex(dataStart); err != nil {
+			return err
+		}
+	}
+	return r.seekOffset(dataStart)
+}
+
+// readIndex loads the index from the end of the file, if there is one
+func (r *CaptureReader) readIndex() bool {
+	stat, err := r.file.Stat()
+	if err != nil || stat.Size() < 16 {
+		return false
+	}
+	var trailer [16]byte
+	if _, err = r.file.ReadAt(trailer[:], stat.Size()-16); err != nil || string(trailer[8:]) != captureIndexMagic {
+		return false
+	}
+	if err = r.seekOffset(int64(binary.LittleEndian.Uint64(trailer[:8]))); err != nil {
+		return false
+	}
+	kind, payload, err := r.readRecord()
+	if err != nil || kind != recIndex {
+		return false
+	}
+	d := capDecoder{buf: payload}
+	r.Samples = int(d.uvarint())
+	r.End = time.Unix(0, d.varint())
+	count := d.uvarint()
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		t := time.Unix(0, d.varint())
+		r.keyframes = append(r.keyframes, captureKeyframeEntry{t, int64(d.uvarint())})
+	}
+	count = d.uvarint()
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		r.infos = append(r.infos, int64(d.uvarint()))
+	}
+	return d.err == nil
+}
+
+// scanIndex builds the index by reading every record, for captures that were cut off
+func (r *CaptureReader) scanIndex(from int64) error {
+	if err := r.seekOffset(from); err != nil {
+		return err
+	}
+	r.keyframes, r.infos, r.Samples = nil, nil, 0
+	cpuOffset := int64(-1)
+	for {
+		offset := r.offset
+		kind, payload, err := r.readRecord()
+		if err != nil {
+			// a partial record at the end is expected if the writer was killed
+			return nil
+		}
+		switch kind {
+		case recInfo:
+			r.infos = append(r.infos, offset)
+		case recPerCPU:
+			cpuOffset = offset
+		case recSample:
+			d := capDecoder{buf: payload}
+			t := time.Unix(0, d.varint())
+			if d.uvarint() == 1 {
+				if cpuOffset >= 0 {
+					offset = cpuOffset
+				}
+				r.keyframes = append(r.keyframes, captureKeyframeEntry{t, offset})
+			}
+			cpuOffset = -1
+			r.Samples++
+			r.End = t
+		}
+	}
+}
+
+func (r *CaptureReader) seekOffset(offset int64) error {
+	if _, err := r.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	r.in.Reset(r.file)
+	r.offset = offset
+	r.prevProcs = nil
+	r.prevCPUs, r.nextCPUs = nil, nil
+	return nil
+}
+
+func (r *CaptureReader) readRecord() (byte, []byte, error) {
+	kind, err := r.in.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	size, err := binary.ReadUvarint(r.in)
+	if err != nil {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	if size > captureMaxRecord {
+		return 0, nil, errCaptureCorrupt
+	}
+	var e capEncoder
+	e.uvarint(size)
+	end := r.offset + 1 + int64(len(e.buf)) + int64(size)
+	if end > r.size {
+		// the capture may still be being written
+		if stat, err := r.file.Stat(); err == nil {
+			r.size = stat.Size()
+		}
+		if end > r.size {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+	}
+	payload := make([]byte, size)
+	if _, err = io.ReadFull(r.in, payload); err != nil {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	r.offset = end
+	return kind, payload, nil
+}
+
+// Seek moves to the last keyframe at or before t, so the next sample read is at or before
+// t, and loads the ProcInfo of every process seen before there into infoMap.
+func (r *CaptureReader) Seek(t time.Time, infoMap ProcInfoMap) error {
+	if len(r.keyframes) == 0 {
+		return nil
+	}
+	pos := sort.Search(len(r.keyframes), func(i int) bool { return r.keyframes[i].time.After(t) }) - 1
+	if pos < 0 {
+		pos = 0
+	}
+	target := r.keyframes[pos].offset
+	for _, offset := range r.infos {
+		if offset >= target {
+			break
+		}
+		if err := r.seekOffset(offset); err != nil {
+			return err
+		}
+		kind, payload, err := r.readRecord()
+		if err != nil || kind != recInfo {
+			return errCaptureCorrupt
+		}
+		d := capDecoder{buf: payload}
+		pid, info := decodeInfo(&d)
+		infoMap[pid] = info
+	}
+	return r.seekOffset(target)
+}
+
+// Next reads the next sample into procs and sys, adding any new processes to infoMap.
+// It returns io.EOF at the end of the capture.
+func (r *CaptureReader) Next(procs *ProcSampleList, sys *SystemStats, infoMap ProcInfoMap) error {
+	for {
+		kind, payload, err := r.readRecord()
+		if err == io.ErrUnexpectedEOF {
+			return io.EOF // cut off in the middle of a record
+		}
+		if err != nil {
+			return err
+		}
+		d := capDecoder{buf: payload}
+		switch kind {
+		case recInfo:
+			pid, info := decodeInfo(&d)
+			if d.err != nil {
+				return d.err
+			}
+			infoMap[pid] = info
+		case recPerCPU:
+			r.decodePerCPU(&d)
+			if d.err != nil {
+				return d.err
+			}
+		case recSample:
+			r.cpus, r.nextCPUs = r.nextCPUs, nil
+			return r.decodeSample(&d, procs, sys)
+		case recIndex:
+			return io.EOF
+		}
+	}
+}
+
+func (r *CaptureReader) decodePerCPU(d *capDecoder) {
+	count := d.count(len(cpuFields(&CPUTimes{})))
+	full := d.uvarint() == 1
+	if d.err != nil {
+		return
+	}
+	if full == false && len(r.prevCPUs) != count {
+		// after a seek, the deltas have nothing to apply to until the next keyframe
+		r.nextCPUs = nil
+		return
+	}
+	cpus := make(PerCPUStats, count)
+	for i := range cpus {
+		if full {
+			d.counters(cpuFields(&cpus[i]), nil)
+		} else {
+			d.counters(cpuFields(&cpus[i]), cpuFields(&r.prevCPUs[i]))
+		}
+	}
+	r.prevCPUs, r.nextCPUs = cpus, cpus
+}
+
+// PerCPU returns the times of each CPU for the last sample read, or nil if it doesn't have
+// them. The slice is not reused, so it can be kept.
+func (r *CaptureReader) PerCPU() PerCPUStats {
+	return r.cpus
+}
+
+func (r *CaptureReader) decodeSample(d *capDecoder, procs *ProcSampleList, sys *SystemStats) error {
+	base := time.Unix(0, d.varint())
+	keyframe := d.uvarint() == 1
+	if keyframe == false && r.prevProcs == nil {
+		return errors.New("capture sample read without a keyframe before it")
+	}
+	sys.CaptureTime = base
+	if keyframe {
+		d.counters(sysFields(sys), nil)
+	} else {
+		d.counters(sysFields(sys), sysFields(&r.prevSys))
+	}
+
+	// a pid, two times and whether it's a delta, then the counters, each at least a byte
+	count := d.count(4 + len(procFields(&ProcSample{})))
+	if d.err != nil {
+		return d.err
+	}
+	if count > len(procs.Samples) {
+		procs.Samples = make([]ProcSample, count)
+	}
+	curProcs := make(map[int]ProcSample, count)
+	pid := 0
+	for i := 0; i < count && d.err == nil; i++ {
+		sample := &procs.Samples[i]
+		pid += int(d.varint())
+		sample.Pid = pid
+		sample.Proc.CaptureTime = d.time(base)
+		sample.Task.Capturetime = d.time(base)
+		if d.uvarint() == 1 {
+			prev, ok := r.prevProcs[pid]
+			if ok == false {
+				return errCaptureCorrupt
+			}
+			d.counters(procFields(sample), procFields(&prev))
+		} else {
+			d.counters(procFields(sample), nil)
+		}
+		curProcs[pid] = *sample
+	}
+	if d.err != nil {
+		return d.err
+	}
+	procs.Len = uint32(count)
+	r.prevSys = *sys
+	r.prevProcs = curProcs
+	return nil
+}
+
+// ParseTime turns a time given on the command line into a time, either an offset from the
+// start of the capture like 90s, or an absolute RFC3339 time. "" is the zero time.
+func (r *CaptureReader) ParseTime(arg string) (time.Time, error) {
+	if arg == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(arg); err == nil {
+		return r.Start.Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, arg)
+	if err != nil {
+		return t, fmt.Errorf("%q is not an offset like 90s or a time like 2017-06-01T15:04:05Z", arg)
+	}
+	return t, nil
+}
+
+func (r *CaptureReader) Close() error {
+	return r.file.Close()
+}
+
+// String describes the capture, for error messages and the like
+func (r *CaptureReader) String() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "capture from %s at %s", r.Host, r.Start.Format(time.RFC3339))
+	if r.Samples > 0 {
+		fmt.Fprintf(&b, ", %d samples to %s", r.Samples, r.End.Format(time.RFC3339))
+	}
+	return b.String()
+}
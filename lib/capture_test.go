@@ -0,0 +1,370 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// captureSamples makes n samples of a few processes, with one that starts partway through
+// and one that exits
+func captureSamples(n int) ([]ProcSampleList, []SystemStats, []ProcInfoMap) {
+	start := time.Unix(1500000000, 0)
+	var lists []ProcSampleList
+	var systems []SystemStats
+	var infos []ProcInfoMap
+	infoMap := make(ProcInfoMap)
+	for i := 0; i < n; i++ {
+		now := start.Add(time.Duration(i) * 200 * time.Millisecond)
+		list := NewProcSampleList(8)
+		for _, pid := range []int{1, 50, 51, 3000} {
+			if pid == 3000 && i < n/2 || pid == 51 && i > n/3 {
+				continue
+			}
+			if _, ok := infoMap[pid]; ok == false {
+				infoMap[pid] = &ProcInfo{
+					FirstSeen: now, LastSeen: now, Comm: "proc", Cmdline: []string{"/bin/proc", "-x"},
+					Friendly: "proc", Pid: uint64(pid), Ppid: 1, Nice: -5, UID: 1000, Cgroup: "/a/b",
+				}
+			}
+			s := &list.Samples[list.Len]
+			s.Pid = pid
+			s.Proc = ProcStats{CaptureTime: now.Add(time.Millisecond), Utime: uint64(i * pid), Stime: uint64(i),
+				Numthreads: 4, Rss: uint64(1000 - i)}
+			if pid != 50 {
+				s.Task = TaskStats{Capturetime: now.Add(2 * time.Millisecond), Cpudelaytotal: uint64(i) * 1e6,
+					Nvcsw: uint64(i * 3), Writebytes: uint64(i) << 20}
+			}
+			list.Len++
+		}
+		lists = append(lists, list)
+		systems = append(systems, SystemStats{CaptureTime: now, Usr: uint64(i * 10), Idle: uint64(i * 90),
+			Ctxt: uint64(i * 1000), ProcsRunning: uint64(i % 3)})
+		copied := make(ProcInfoMap)
+		for pid, info := range infoMap {
+			copied[pid] = info
+		}
+		infos = append(infos, copied)
+	}
+	return lists, systems, infos
+}
+
+// testCPUs are the per-CPU times for sample i, which every tenth sample doesn't have
+func testCPUs(i int) PerCPUStats {
+	if i%10 == 5 {
+		return nil
+	}
+	return PerCPUStats{{Usr: uint64(i * 3), Idle: uint64(i * 7)}, {Sys: uint64(i), Idle: uint64(i * 9), Steal: 1}}
+}
+
+func checkCPUs(t *testing.T, i int, got PerCPUStats) {
+	if want := testCPUs(i); reflect.DeepEqual(got, want) == false {
+		t.Errorf("sample %d per-CPU = %v, want %v", i, got, want)
+	}
+}
+
+func writeTestCapture(t *testing.T, n int) (string, []ProcSampleList, []SystemStats, []ProcInfoMap) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "test.cps")
+	lists, systems, infos := captureSamples(n)
+	w, err := CreateCapture(filename, CaptureHeader{Interval: 200, Jiffy: 100, Filters: "-p 1,50", Kernel: "4.9.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range lists {
+		if cpus := testCPUs(i); cpus != nil {
+			if err = w.WritePerCPU(cpus); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = w.WriteSample(&lists[i], &systems[i], infos[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return filename, lists, systems, infos
+}
+
+func checkSample(t *testing.T, i int, got, want *ProcSampleList, gotSys, wantSys *SystemStats) {
+	if got.Len != want.Len {
+		t.Fatalf("sample %d has %d procs, want %d", i, got.Len, want.Len)
+	}
+	for j := uint32(0); j < got.Len; j++ {
+		g, w := got.Samples[j], want.Samples[j]
+		if g.Proc.CaptureTime.Equal(w.Proc.CaptureTime) == false || g.Task.Capturetime.Equal(w.Task.Capturetime) == false {
+			t.Errorf("sample %d pid %d times = %v %v, want %v %v", i, g.Pid,
+				g.Proc.CaptureTime, g.Task.Capturetime, w.Proc.CaptureTime, w.Task.Capturetime)
+		}
+		g.Proc.CaptureTime, g.Task.Capturetime = w.Proc.CaptureTime, w.Task.Capturetime
+		if reflect.DeepEqual(g, w) == false {
+			t.Errorf("sample %d = %+v, want %+v", i, g, w)
+		}
+	}
+	if gotSys.CaptureTime.Equal(wantSys.CaptureTime) == false {
+		t.Errorf("sample %d time = %v, want %v", i, gotSys.CaptureTime, wantSys.CaptureTime)
+	}
+	g := *gotSys
+	g.CaptureTime = wantSys.CaptureTime
+	if reflect.DeepEqual(g, *wantSys) == false {
+		t.Errorf("sample %d system = %+v, want %+v", i, g, *wantSys)
+	}
+}
+
+func TestCaptureRoundTrip(t *testing.T) {
+	n := captureKeyframe*2 + 10
+	filename, lists, systems, infos := writeTestCapture(t, n)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	r, err := OpenCapture(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.Interval != 200 || r.Jiffy != 100 || r.Samples != n {
+		t.Errorf("header = %d %d %d, want 200 100 %d", r.Interval, r.Jiffy, r.Samples, n)
+	}
+	if r.Filters != "-p 1,50" || r.Kernel != "4.9.0" || r.CPUs == 0 || r.Host == "" {
+		t.Errorf("header = %+v, want filters and kernel from the writer, and host and CPUs filled in", r.CaptureHeader)
+	}
+	if r.End.Equal(systems[n-1].CaptureTime) == false {
+		t.Errorf("end = %v, want %v", r.End, systems[n-1].CaptureTime)
+	}
+
+	list := NewProcSampleList(8)
+	var sys SystemStats
+	infoMap := make(ProcInfoMap)
+	for i := 0; i < n; i++ {
+		if err = r.Next(&list, &sys, infoMap); err != nil {
+			t.Fatalf("sample %d: %s", i, err)
+		}
+		checkSample(t, i, &list, &lists[i], &sys, &systems[i])
+		checkCPUs(t, i, r.PerCPU())
+	}
+	if err = r.Next(&list, &sys, infoMap); err != io.EOF {
+		t.Errorf("read past the end got %v, want EOF", err)
+	}
+
+	want := infos[n-1]
+	if len(infoMap) != len(want) {
+		t.Fatalf("got %d infos, want %d", len(infoMap), len(want))
+	}
+	for pid, info := range want {
+		got := infoMap[pid]
+		if got.FirstSeen.Equal(info.FirstSeen) == false {
+			t.Errorf("pid %d first seen = %v, want %v", pid, got.FirstSeen, info.FirstSeen)
+		}
+		g, w := *got, *info
+		g.FirstSeen, g.LastSeen = w.FirstSeen, w.LastSeen
+		if reflect.DeepEqual(g, w) == false {
+			t.Errorf("pid %d info = %+v, want %+v", pid, g, w)
+		}
+	}
+}
+
+func TestCaptureSeek(t *testing.T) {
+	n := captureKeyframe*3 + 5
+	filename, lists, systems, _ := writeTestCapture(t, n)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	r, err := OpenCapture(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	target := captureKeyframe*2 + 7
+	infoMap := make(ProcInfoMap)
+	if err = r.Seek(systems[target].CaptureTime, infoMap); err != nil {
+		t.Fatal(err)
+	}
+	// pid 3000 started before the keyframe, so its info has to come from the seek
+	if _, ok := infoMap[3000]; ok == false {
+		t.Error("seek did not load info for pid 3000")
+	}
+
+	list := NewProcSampleList(8)
+	var sys SystemStats
+	for i := captureKeyframe * 2; i <= target; i++ {
+		if err = r.Next(&list, &sys, infoMap); err != nil {
+			t.Fatal(err)
+		}
+		checkSample(t, i, &list, &lists[i], &sys, &systems[i])
+		checkCPUs(t, i, r.PerCPU())
+	}
+}
+
+func TestCaptureTruncated(t *testing.T) {
+	n := captureKeyframe + 20
+	filename, lists, systems, _ := writeTestCapture(t, n)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	// chop off the index and part of the last sample, like a writer that was killed
+	stat, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenCapture(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexSize := stat.Size() - r.keyframes[len(r.keyframes)-1].offset
+	r.Close()
+	if err = os.Truncate(filename, stat.Size()-indexSize/2); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = OpenCapture(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if len(r.keyframes) != 2 || r.Samples == 0 || r.Samples >= n {
+		t.Fatalf("scanned %d keyframes and %d samples", len(r.keyframes), r.Samples)
+	}
+
+	list := NewProcSampleList(8)
+	var sys SystemStats
+	infoMap := make(ProcInfoMap)
+	read := 0
+	for ; ; read++ {
+		err = r.Next(&list, &sys, infoMap)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSample(t, read, &list, &lists[read], &sys, &systems[read])
+	}
+	if read != r.Samples {
+		t.Errorf("read %d samples, scan found %d", read, r.Samples)
+	}
+}
+
+func TestCaptureNotCapture(t *testing.T) {
+	f, err := ioutil.TempFile("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("this is not a capture file")
+	f.Close()
+	if _, err = OpenCapture(f.Name()); err == nil {
+		t.Error("opening a text file as a capture did not fail")
+	}
+}
+
+// rawCapture writes a capture with a header and then records, which are each a kind and
+// a payload
+func rawCapture(t *testing.T, records ...[]byte) string {
+	f, err := ioutil.TempFile("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var e capEncoder
+	e.buf = append(e.buf, captureMagic...)
+	e.buf = append(e.buf, 0, CaptureVersion)
+	var h capEncoder
+	h.uvarint(200)
+	h.uvarint(100)
+	h.varint(1500000000e9)
+	h.string("host")
+	h.string("4.9.0")
+	h.string("")
+	h.uvarint(2)
+	records = append([][]byte{append([]byte{recHeader}, h.buf...)}, records...)
+	for _, rec := range records {
+		e.buf = append(e.buf, rec[0])
+		e.uvarint(uint64(len(rec) - 1))
+		e.buf = append(e.buf, rec[1:]...)
+	}
+	f.Write(e.buf)
+	return f.Name()
+}
+
+func TestCaptureCorruptSizes(t *testing.T) {
+	// a sample that says it has a billion processes, in a few bytes
+	var sample capEncoder
+	sample.varint(1500000000e9)
+	sample.uvarint(1)
+	sample.counters(sysFields(&SystemStats{}), nil)
+	sample.uvarint(1e9)
+	// per-CPU times for a billion CPUs
+	var cpus capEncoder
+	cpus.uvarint(1e9)
+	cpus.uvarint(1)
+
+	for name, record := range map[string][]byte{
+		"sample":  append([]byte{recSample}, sample.buf...),
+		"per-CPU": append([]byte{recPerCPU}, cpus.buf...),
+	} {
+		filename := rawCapture(t, record)
+		r, err := OpenCapture(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list := NewProcSampleList(8)
+		var sys SystemStats
+		if err = r.Next(&list, &sys, make(ProcInfoMap)); err != errCaptureCorrupt {
+			t.Errorf("%s with a huge count got %v, want %v", name, err, errCaptureCorrupt)
+		}
+		r.Close()
+		os.Remove(filename)
+	}
+
+	// a record that says it's bigger than the file, and one bigger than any record can be
+	for _, size := range []uint64{1 << 20, 1 << 40} {
+		var e capEncoder
+		e.uvarint(size)
+		filename := rawCapture(t)
+		f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(append([]byte{recSample}, e.buf...))
+		f.Write(make([]byte, 100))
+		f.Close()
+
+		r, err := OpenCapture(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list := NewProcSampleList(8)
+		var sys SystemStats
+		if err = r.Next(&list, &sys, make(ProcInfoMap)); err == nil {
+			t.Errorf("a record of %d bytes in a small file was read", size)
+		}
+		r.Close()
+		os.Remove(filename)
+	}
+}
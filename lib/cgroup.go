@@ -0,0 +1,80 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// cgroup membership from /proc/[pid]/cgroup, which is how we find the container or
+// systemd unit that a process belongs to
+
+package cpustat
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ReadCgroup returns the cgroup path of pid, or "" if it can't be read
+func ReadCgroup(pid int) string {
+	lines, err := ReadFileLines(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+	return cgroupFromLines(lines)
+}
+
+// cgroupFromLines picks the most useful path out of the hierarchy:controllers:path lines.
+// On cgroup v1 each controller can have a different path, and the cpu controller is the one
+// that matters to us. Otherwise use the unified hierarchy, then whatever is first.
+func cgroupFromLines(lines []string) string {
+	var unified, first string
+	for _, line := range lines {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			if controller == "cpu" {
+				return parts[2]
+			}
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			unified = parts[2]
+		}
+		if first == "" {
+			first = parts[2]
+		}
+	}
+	if unified != "" {
+		return unified
+	}
+	return first
+}
+
+// docker, containerd, cri-o and podman all name the cgroup after the 64 hex digit container
+// id, in forms like /docker/<id>, /kubepods/.../cri-containerd-<id>.scope or libpod-<id>.scope
+var containerIDPattern = regexp.MustCompile(`(?:^|[/-])([0-9a-f]{64})(?:\.scope)?$`)
+
+// ContainerID finds the container id in a cgroup path, or "" if it isn't in a container
+func ContainerID(cgroup string) string {
+	match := containerIDPattern.FindStringSubmatch(cgroup)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"strings"
+	"testing"
+)
+
+var cgroupTests = []struct {
+	file string
+	want string
+}{
+	{"0::/system.slice/nginx.service", "/system.slice/nginx.service"},
+	{`12:pids:/docker/abc
+11:cpu,cpuacct:/docker/abc123
+1:name=systemd:/docker/def`, "/docker/abc123"},
+	{`2:memory:/user.slice
+1:name=systemd:/user.slice/session-1.scope
+0::/user.slice/user-1000.slice`, "/user.slice/user-1000.slice"},
+	{"3:memory:/mem", "/mem"},
+	{"garbage", ""},
+}
+
+func TestCgroupFromLines(t *testing.T) {
+	for _, tt := range cgroupTests {
+		if got := cgroupFromLines(strings.Split(tt.file, "\n")); got != tt.want {
+			t.Errorf("cgroup of %q = %q, want %q", tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestContainerID(t *testing.T) {
+	id := strings.Repeat("0123456789abcdef", 4)
+	tests := []struct {
+		cgroup string
+		want   string
+	}{
+		{"/docker/" + id, id},
+		{"/kubepods/burstable/pod1234/cri-containerd-" + id + ".scope", id},
+		{"/machine.slice/libpod-" + id + ".scope", id},
+		{"/system.slice/docker.service", ""},
+		{"/docker/" + id[:60], ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := ContainerID(tt.cgroup); got != tt.want {
+			t.Errorf("ContainerID(%q) = %q, want %q", tt.cgroup, got, tt.want)
+		}
+	}
+}
@@ -20,15 +20,8 @@
 
 // This package reads and caches the results from /proc/pid/cmdline.
 // It also perhaps surprisingly transforms these names into names that are more useful in
-// some environments. It would be nice if there was some way to let people extend these
-// rules based on how they run their programs.
-
-// TODO handle these:
-// udocker   85999 13.3  0.3 1742504 417780 ?      Sl   Apr06 933:29 python -m geosnapper.app /var/run/udocker/geosnapper-0.sock 0
-// uber      52832  0.3  0.0 370500 35404 ?        Sl   Apr06  25:34 /usr/bin/python /usr/bin/sortsol_sender docker_daemon-access
-// udocker   46233 53.6  0.0 260308 81976 ?        Rs   Apr08 2190:05 /usr/bin/python /usr/local/bin/celery worker --app=polaris -l INFO -Q polaris -c 5 --logfile=/var/log/udocker/polaris/polaris-celery.log
-// udocker   43061  2.6  0.1 3338048 149152 ?      Sl   Apr09 102:54 /usr/bin/python /usr/local/bin/mastermind-tornado /var/run/udocker/mastermind-3.sock 3
-// nsca      88499  0.0  0.0  40040 12908 ?        S    17:15   0:00 python /usr/local/sbin/nagios_autocheck_submitter --nagios-host=nagioscheck.local.uber.internal --splay 600
+// some environments. The transformations are driven by the resolver list in resolvers.go,
+// which users can extend with Go functions or with rules loaded from a file.
 
 package cpustat
 
@@ -60,6 +53,7 @@ type ProcInfo struct {
 	Rtpriority uint64
 	Policy     uint64
 	UID        uint32
+	Cgroup     string // cgroup path, from the cpu controller on cgroup v1
 }
 
 type ProcInfoMap map[int]*ProcInfo
@@ -87,6 +81,26 @@ func (m ProcInfoMap) MaybePrune(chance float64, pids Pidlist, expiry time.Durati
 	fmt.Println("pruned", removed, "entries from infoMap")
 }
 
+// Ancestry returns pid and the parents of pid that are in the map, starting with the
+// oldest ancestor
+func (m ProcInfoMap) Ancestry(pid int) Pidlist {
+	var ret Pidlist
+	seen := make(map[int]bool)
+	for pid > 0 && seen[pid] == false {
+		info, ok := m[pid]
+		if ok == false {
+			break
+		}
+		seen[pid] = true
+		ret = append(ret, pid)
+		pid = int(info.Ppid)
+	}
+	for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+	return ret
+}
+
 func (p *ProcInfo) init() {
 	p.FirstSeen = time.Now()
 	p.LastSeen = p.FirstSeen
@@ -127,27 +141,12 @@ func (p *ProcInfo) updateCmdline() {
 		}
 	}
 
-	pathParts := strings.Split(p.Cmdline[0], "/")
-	lastPath := pathParts[len(pathParts)-1]
-	switch lastPath {
-	case "python":
-		p.Friendly = resolvePython(p.Cmdline)
-	case "docker":
-		p.Friendly = resolveDocker(p.Cmdline)
-	case "java":
-		p.Friendly = resolveJava(p.Cmdline)
-	case "sh", "bash":
-		p.Friendly = resolveSh(p.Cmdline)
-	case "xargs":
-		p.Friendly = resolveXargs(p.Cmdline)
-	case "node0.10", "node":
-		p.Friendly = resolveNode(p.Cmdline)
-	case "uwsgi":
-		p.Friendly = resolveUwsgi(p.Cmdline)
-	default:
-		p.Friendly = resolveDefault(p.Cmdline, p.Comm)
+	if len(p.Cmdline) == 0 {
+		p.Friendly = p.Comm
+		return
 	}
 
+	p.Friendly = FriendlyName(p.Comm, p.Cmdline)
 	p.Friendly = strings.Map(StripSpecial, p.Friendly)
 }
 
@@ -188,18 +187,6 @@ func resolveSh(parts []string) string {
 	return parts[0]
 }
 
-func resolvePython(parts []string) string {
-	if len(parts) <= 1 {
-		return "python"
-	}
-	argParts := strings.Split(parts[1], "/")
-	file := argParts[len(argParts)-1]
-	if len(file) > 1 {
-		return file
-	}
-	return "python"
-}
-
 func resolveDocker(parts []string) string {
 	if len(parts) <= 1 {
 		return "docker"
@@ -212,24 +199,6 @@ func resolveDocker(parts []string) string {
 	return "docker"
 }
 
-func resolveJava(parts []string) string {
-	if len(parts) <= 1 {
-		return "java1"
-	}
-	for i := 1; i < len(parts); { // start at 1 because 0 is "java"
-		if parts[i][0] == byte('-') {
-			if parts[i] == "-cp" {
-				i += 2
-			} else {
-				i++
-			}
-		} else {
-			return parts[i]
-		}
-	}
-	return "java2"
-}
-
 func resolveDefault(parts []string, comm string) string {
 	if strings.Count(parts[0], "/") >= 2 {
 		pathParts := strings.Split(parts[0], "/")
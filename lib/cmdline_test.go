@@ -0,0 +1,232 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+var friendlyNameTests = []struct {
+	comm    string
+	cmdline string
+	want    string
+}{
+	{"python", "/usr/bin/python /usr/bin/sortsol_sender docker_daemon-access", "sortsol_sender"},
+	{"python", "python", "python"},
+	{"docker", "/usr/bin/docker daemon", "docker daemon"},
+	{"docker", "docker", "docker"},
+	{"java", "java -cp /opt/lib/* com.example.Main", "com.example.Main"},
+	{"java", "java", "java"},
+	{"java", "java -server -Xmx1g", "java"},
+	{"bash", "/bin/bash -c sleep 10", "/bin/bash"},
+	{"sh", "sh /etc/init.d/foo", "sh"},
+	{"xargs", "xargs -n1 /usr/bin/gzip", "xargs gzip"},
+	{"xargs", "xargs", "xargs"},
+	{"node", "/usr/bin/node /srv/app/server.js", "server.js"},
+	{"node", "node0.10 /srv/app/index.js --port 80", "index.js"},
+	{"uwsgi", "/usr/bin/uwsgi --json /etc/uwsgi/apps/myapp/uwsgi.json", "myapp"},
+	{"uwsgi", "uwsgi --ini app.ini", "uwsgi"},
+	{"nginx", "/usr/sbin/nginx -g daemon off;", "nginx"},
+	{"nginx", "nginx: worker process", "nginx worker"},
+}
+
+var runtimeNameTests = []struct {
+	comm    string
+	cmdline string
+	want    string
+}{
+	{"java", "/usr/bin/java -Xmx4g -jar /opt/kafka/libs/kafka-rest.jar config.properties", "kafka-rest"},
+	{"java", "java -cp a.jar:b.jar -Dfoo=bar org.apache.catalina.startup.Bootstrap start", "org.apache.catalina.startup.Bootstrap"},
+	{"java", "java --module-path mods -m com.example.app/com.example.app.Main", "com.example.app"},
+	{"java", "java --module=com.example.app", "com.example.app"},
+	{"java", "java -jar", "java"},
+	{"python", "python -m geosnapper.app /var/run/udocker/geosnapper-0.sock 0", "geosnapper.app"},
+	{"python3", "/usr/bin/python3.6 -u -W ignore /srv/bin/mastermind-tornado /var/run/mastermind-3.sock 3", "mastermind-tornado"},
+	{"python", "python -c import time; time.sleep(10)", "python -c"},
+	{"python", "/usr/bin/python /usr/local/bin/celery worker --app=polaris -l INFO -Q polaris -c 5", "celery polaris"},
+	{"python", "python -m celery -A proj.celery:app beat", "celery proj.celery"},
+	{"python", "python -m gunicorn -w 4 -b 0.0.0.0:8000 myproject.wsgi:application", "gunicorn myproject.wsgi"},
+	{"gunicorn", "/srv/venv/bin/gunicorn --bind unix:/tmp/g.sock -n billing app:wsgi", "gunicorn billing"},
+	{"gunicorn", "gunicorn", "gunicorn"},
+	{"gunicorn", "gunicorn: master [myproject.wsgi:application]", "gunicorn myproject.wsgi"},
+	{"gunicorn", "gunicorn: worker [billing]", "gunicorn billing"},
+	{"celery", "celery multi start w1", "celery multi"},
+	{"celery", "[celeryd: celery@web01:MainProcess] -active- (worker -A polaris -l info)", "celery polaris"},
+	{"celery", "[celeryd: celery@web01:ForkPoolWorker-1]", "celery"},
+	{"ruby", "ruby script/worker.rb", "worker.rb"},
+	{"ruby", "/usr/bin/ruby2.5 -I lib /usr/local/bin/bundle exec sidekiq -C config/sidekiq.yml", "sidekiq"},
+	{"ruby", "ruby -e puts 1", "ruby -e"},
+	{"bundle", "bundle exec rake jobs:work", "rake"},
+	{"ruby", "puma 3.12.0 (tcp://0.0.0.0:3000) [storefront]", "puma storefront"},
+	{"ruby", "puma: cluster worker 0: 1234 [storefront]", "puma storefront"},
+	{"ruby", "puma 3.12.0 (tcp://0.0.0.0:3000)", "puma"},
+	{"ruby", "sidekiq 5.2.7 storefront [0 of 10 busy]", "sidekiq storefront"},
+	{"ruby", "sidekiq 5.2.7 [3 of 10 busy]", "sidekiq"},
+	{"php-fpm7.0", "php-fpm: pool www", "php-fpm www"},
+	{"php-fpm7.0", "php-fpm: master process (/etc/php/7.0/fpm/php-fpm.conf)", "php-fpm master"},
+	{"php", "/usr/bin/php7.0 -d memory_limit=-1 /var/www/artisan queue:work", "artisan"},
+	{"php", "php -f /var/www/cron.php", "cron.php"},
+	{"postgres", "postgres: checkpointer process", "postgres checkpointer"},
+	{"postgres", "postgres: main: background writer", "postgres background"},
+	{"postgres", "postgres: alice billing 10.0.0.1(5432) idle", "postgres"},
+	{"sshd", "sshd: alice [priv]", "sshd"},
+}
+
+func TestFriendlyNameDefaults(t *testing.T) {
+	for _, tt := range append(friendlyNameTests, runtimeNameTests...) {
+		got := FriendlyName(tt.comm, strings.Fields(tt.cmdline))
+		if got != tt.want {
+			t.Errorf("FriendlyName(%q, %q) = %q, want %q", tt.comm, tt.cmdline, got, tt.want)
+		}
+	}
+}
+
+// an empty argument, like from foo\0\0bar in /proc/[pid]/cmdline, must not trip up any runtime
+func TestFriendlyNameEmptyArg(t *testing.T) {
+	for _, comm := range []string{"java", "python", "python3", "ruby", "php", "node"} {
+		if got := FriendlyName(comm, []string{comm, "", "app"}); got == "" {
+			t.Errorf("FriendlyName(%q) with an empty argument is empty", comm)
+		}
+	}
+}
+
+var nameRuleTests = []struct {
+	rule    NameRule
+	cmdline string
+	want    string
+	ok      bool
+}{
+	{NameRule{Argv0: "beam", Arg: -1}, "/usr/lib/erlang/beam.smp -- -home /srv/rabbit", "/srv/rabbit", true},
+	{NameRule{Argv0: "beam", Arg: -1, StripPath: true}, "/usr/lib/erlang/beam.smp -- -home /srv/rabbit", "rabbit", true},
+	{NameRule{Argv0: "beam", Arg: 5}, "/usr/lib/erlang/beam.smp -- -home /srv/rabbit", "", false},
+	{NameRule{Comm: "^ruby$", Arg: 1, Template: "ruby {{.Arg}}"}, "ruby script/worker.rb", "ruby script/worker.rb", true},
+	{NameRule{Comm: "^ruby$"}, "python foo.py", "", false},
+	{NameRule{Argv0: "envoy", Template: "{{index .Args 2}}-{{.Comm}}"}, "envoy -c front.yaml", "front.yaml-envoy", true},
+	{NameRule{Argv0: "envoy", Template: "{{index .Args 5}}"}, "envoy -c front.yaml", "", false},
+}
+
+func TestNameRule(t *testing.T) {
+	for _, tt := range nameRuleTests {
+		rule := tt.rule
+		if err := rule.Compile(); err != nil {
+			t.Fatal(err)
+		}
+		parts := strings.Fields(tt.cmdline)
+		got, ok := rule.Resolve(basename(parts[0]), parts)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("rule %+v on %q = %q, %v want %q, %v", tt.rule, tt.cmdline, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNameRuleBadRegexp(t *testing.T) {
+	rule := NameRule{Argv0: "(unclosed"}
+	if err := rule.Compile(); err == nil {
+		t.Error("bad regexp should fail to compile")
+	}
+}
+
+func TestLoadNameRules(t *testing.T) {
+	defer func() { customResolvers = nil }()
+
+	tmpfile, err := ioutil.TempFile("", "cmdline_test.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.WriteString(`[
+		{"argv0": "(^|/)python$", "arg": 2, "template": "py {{.Arg}}"},
+		{"argv0": "(^|/)python$", "arg": 1, "strip_path": true}
+	]`)
+	tmpfile.Close()
+
+	if err = LoadNameRules(tmpfile.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if got := FriendlyName("python", []string{"python", "-m", "geosnapper.app"}); got != "py geosnapper.app" {
+		t.Error("first rule in file should win, got", got)
+	}
+	if got := FriendlyName("python", []string{"/usr/bin/python", "/usr/local/bin/celery"}); got != "celery" {
+		t.Error("second rule in file should be used when the first doesn't match, got", got)
+	}
+
+	RegisterResolver(ResolverFunc(func(comm string, cmdline []string) (string, bool) {
+		return "custom", comm == "python"
+	}))
+	if got := FriendlyName("python", []string{"python", "foo.py"}); got != "custom" {
+		t.Error("registered resolver should take precedence over rules, got", got)
+	}
+	if got := FriendlyName("node", []string{"node", "server.js"}); got != "server.js" {
+		t.Error("defaults should still apply, got", got)
+	}
+}
+
+func TestLoadNameRulesBadFile(t *testing.T) {
+	defer func() { customResolvers = nil }()
+
+	tmpfile, err := ioutil.TempFile("", "cmdline_test.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.WriteString(`[{"argv0": "ok"}, {"comm": "[bad"}]`)
+	tmpfile.Close()
+
+	if err = LoadNameRules(tmpfile.Name()); err == nil {
+		t.Error("rule file with a bad regexp should be an error")
+	}
+	if len(customResolvers) != 0 {
+		t.Error("no rules should be registered from a bad file")
+	}
+}
+
+func TestAncestry(t *testing.T) {
+	m := ProcInfoMap{
+		1:   &ProcInfo{Pid: 1, Ppid: 0},
+		10:  &ProcInfo{Pid: 10, Ppid: 1},
+		20:  &ProcInfo{Pid: 20, Ppid: 10},
+		30:  &ProcInfo{Pid: 30, Ppid: 99}, // parent exited before we saw it
+		40:  &ProcInfo{Pid: 40, Ppid: 41},
+		41:  &ProcInfo{Pid: 41, Ppid: 40},
+		100: &ProcInfo{Pid: 100, Ppid: 100},
+	}
+	tests := []struct {
+		pid  int
+		want Pidlist
+	}{
+		{20, Pidlist{1, 10, 20}},
+		{1, Pidlist{1}},
+		{30, Pidlist{30}},
+		{40, Pidlist{41, 40}},
+		{100, Pidlist{100}},
+		{5, nil},
+	}
+	for _, tt := range tests {
+		got := m.Ancestry(tt.pid)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("Ancestry(%d) = %v, want %v", tt.pid, got, tt.want)
+		}
+	}
+}
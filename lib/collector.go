@@ -0,0 +1,299 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Collectors are the sources of what a Sampler reads, besides /proc/[pid]/stat, which every
+// sample needs to list the processes. A collector that declares metrics gets room for their
+// values in ProcSample.Values or SystemStats.Values, and they are diffed and summarized by
+// what they were declared as. One that declares none fills the fields of the sample instead,
+// like the default ones for taskstats and /proc/stat do, and a replacement for either has to
+// fill the same fields for the summaries to have them.
+
+package cpustat
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricKind says how a metric is summarized
+type MetricKind int
+
+const (
+	// Counter only goes up, like CPU time, so each interval records how much it went up by
+	Counter MetricKind = iota
+	// Gauge is a level, like memory, so each interval records its latest value
+	Gauge
+)
+
+// Metric is one value that a collector reads. Values can't be negative.
+type Metric struct {
+	Name string
+	Unit string // like "ns", "bytes" or "ticks"
+	Kind MetricKind
+}
+
+// Collector is a source of metrics, which is a ProcCollector or a SystemCollector. If it's
+// also an io.Closer, the Sampler closes it.
+type Collector interface {
+	// Metrics are what the collector reads, in the order of its values, or nil if it fills
+	// the fields of the sample instead
+	Metrics() []Metric
+}
+
+// ProcCollector reads more about each process in a sample, after /proc/[pid]/stat is read
+type ProcCollector interface {
+	Collector
+	// CollectProcs puts the values of procs.Samples[i] in values[i], which has room for
+	// one per metric. A value it can't read should be NaN, so that it isn't diffed.
+	CollectProcs(procs *ProcSampleList, values [][]float64) error
+}
+
+// SystemCollector reads about the whole system, once each sample
+type SystemCollector interface {
+	Collector
+	CollectSystem(sys *SystemStats, values []float64) error
+}
+
+// Metrics are the metrics kept in ProcSample.Values and SystemStats.Values, in their order
+type Metrics struct {
+	Proc   []Metric
+	System []Metric
+}
+
+// DefaultCollectors are taskstats and /proc/stat, which fill the fields of ProcSample.Task
+// and SystemStats that cpustat's summaries are made from
+func DefaultCollectors() ([]Collector, error) {
+	task, err := NewTaskStatsCollector()
+	if err != nil {
+		return nil, err
+	}
+	return []Collector{task, &SystemStatsCollector{}}, nil
+}
+
+// TaskStatsCollector reads the delay accounting of each process over netlink, into
+// ProcSample.Task
+type TaskStatsCollector struct {
+	conn *NLConn
+}
+
+func NewTaskStatsCollector() (*TaskStatsCollector, error) {
+	conn, err := NLInit()
+	if err != nil {
+		return nil, fmt.Errorf("opening taskstats: %s", err)
+	}
+	return &TaskStatsCollector{conn: conn}, nil
+}
+
+// Metrics is empty, since taskstats has fields of its own
+func (c *TaskStatsCollector) Metrics() []Metric {
+	return nil
+}
+
+func (c *TaskStatsCollector) CollectProcs(procs *ProcSampleList, values [][]float64) error {
+	return TaskStatsReader(c.conn, procs)
+}
+
+func (c *TaskStatsCollector) Close() error {
+	return c.conn.Close()
+}
+
+// SystemStatsCollector reads /proc/stat into SystemStats
+type SystemStatsCollector struct{}
+
+// Metrics is empty, since /proc/stat has fields of its own
+func (c *SystemStatsCollector) Metrics() []Metric {
+	return nil
+}
+
+func (c *SystemStatsCollector) CollectSystem(sys *SystemStats, values []float64) error {
+	return SystemStatsReader(sys)
+}
+
+// ProcFileCollector reads metrics from a file for each process, with a line for each
+// value, like "name value" or "name: value unit". The path has a %d for the pid, like
+// /proc/%d/io or a file that an application writes about itself. Lines it wasn't asked
+// for are skipped.
+type ProcFileCollector struct {
+	path    string
+	metrics []Metric
+	index   map[string]int
+}
+
+func NewProcFileCollector(path string, metrics ...Metric) *ProcFileCollector {
+	c := ProcFileCollector{path: path, metrics: metrics, index: make(map[string]int)}
+	for i, m := range metrics {
+		c.index[m.Name] = i
+	}
+	return &c
+}
+
+func (c *ProcFileCollector) Metrics() []Metric {
+	return c.metrics
+}
+
+// CollectProcs marks processes without a file, or that we can't read, as missing
+func (c *ProcFileCollector) CollectProcs(procs *ProcSampleList, values [][]float64) error {
+	for i := uint32(0); i < procs.Len; i++ {
+		file, err := ReadSmallFile(fmt.Sprintf(c.path, procs.Samples[i].Pid))
+		if err != nil {
+			for j := range values[i] {
+				values[i][j] = math.NaN()
+			}
+			continue
+		}
+		c.parse(string(file), values[i])
+	}
+	return nil
+}
+
+func (c *ProcFileCollector) parse(file string, values []float64) {
+	for _, line := range strings.Split(file, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 2 {
+			continue
+		}
+		i, ok := c.index[strings.TrimSuffix(parts[0], ":")]
+		if ok == false {
+			continue
+		}
+		if val, err := strconv.ParseFloat(parts[1], 64); err == nil && val > 0 {
+			values[i] = val
+		}
+	}
+}
+
+// collectorMetrics lists the metrics that collectors keep in Values, and checks that each
+// collector is one that a Sampler knows how to run
+func collectorMetrics(collectors []Collector) (Metrics, error) {
+	var metrics Metrics
+	procNames, sysNames := make(map[string]bool), make(map[string]bool)
+	for _, c := range collectors {
+		_, isProc := c.(ProcCollector)
+		_, isSys := c.(SystemCollector)
+		if isProc == isSys {
+			return Metrics{}, fmt.Errorf("collector %T has to read either processes or the system", c)
+		}
+		list, names := &metrics.System, sysNames
+		if isProc {
+			list, names = &metrics.Proc, procNames
+		}
+		for _, m := range c.Metrics() {
+			if names[m.Name] {
+				return Metrics{}, fmt.Errorf("metric %s is read by more than one collector", m.Name)
+			}
+			names[m.Name] = true
+			*list = append(*list, m)
+		}
+	}
+	return metrics, nil
+}
+
+// ProcMetricsRecord diffs the Values of two lists like ProcStatsRecord does their fields,
+// for the processes that ProcStatsRecord put in deltaMap
+func ProcMetricsRecord(interval uint32, metrics []Metric, curList, prevList ProcSampleList,
+	sumMap, deltaMap ProcSampleMap) {
+
+	curPos := uint32(0)
+	prevPos := uint32(0)
+
+	for curPos < curList.Len && prevPos < prevList.Len {
+		cur, prev := &curList.Samples[curPos], &prevList.Samples[prevPos]
+		if cur.Pid == prev.Pid {
+			delta, ok := deltaMap[cur.Pid]
+			if ok && len(cur.Values) == len(metrics) && len(prev.Values) == len(metrics) {
+				sum := sumMap[cur.Pid]
+				if sum.Values == nil {
+					sum.Values = make([]float64, len(metrics))
+				}
+				delta.Values = make([]float64, len(metrics))
+				recordValues(metrics, valueScale(interval, cur.Proc.CaptureTime, prev.Proc.CaptureTime),
+					cur.Values, prev.Values, sum.Values, delta.Values)
+			}
+			curPos++
+			prevPos++
+		} else if cur.Pid < prev.Pid {
+			curPos++
+		} else {
+			prevPos++
+		}
+	}
+}
+
+// SystemMetricsRecord diffs the Values of two system samples into delta, which is from
+// SystemStatsRecord, and adds them to sum
+func SystemMetricsRecord(interval uint32, metrics []Metric, cur, prev, sum, delta *SystemStats) {
+	if len(cur.Values) != len(metrics) || len(prev.Values) != len(metrics) {
+		return
+	}
+	if sum.Values == nil {
+		sum.Values = make([]float64, len(metrics))
+	}
+	delta.Values = make([]float64, len(metrics))
+	recordValues(metrics, valueScale(interval, cur.CaptureTime, prev.CaptureTime), cur.Values, prev.Values,
+		sum.Values, delta.Values)
+}
+
+func valueScale(interval uint32, cur, prev time.Time) float64 {
+	return float64(interval) / float64(cur.Sub(prev)/time.Millisecond)
+}
+
+// recordValues puts the change of each counter in one interval in delta and adds it to
+// sum, and puts the latest value of each gauge in both
+func recordValues(metrics []Metric, scale float64, cur, prev, sum, delta []float64) {
+	for i, m := range metrics {
+		if math.IsNaN(cur[i]) { // a collector couldn't read it this time
+			continue
+		}
+		if m.Kind == Gauge {
+			sum[i], delta[i] = cur[i], cur[i]
+			continue
+		}
+		if math.IsNaN(prev[i]) {
+			continue
+		}
+		change := cur[i] - prev[i]
+		if change < 0 { // the counter was reset
+			change = 0
+		}
+		sum[i] += change
+		delta[i] = change * scale
+	}
+}
+
+// addValues adds the counters of change to sum, and takes its gauges
+func addValues(metrics []Metric, sum, change []float64) []float64 {
+	if len(change) != len(metrics) {
+		return sum
+	}
+	if sum == nil {
+		sum = make([]float64, len(metrics))
+	}
+	for i, m := range metrics {
+		if m.Kind == Gauge {
+			sum[i] = change[i]
+		} else {
+			sum[i] += change[i]
+		}
+	}
+	return sum
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeQueue is a system collector of a queue's length and the jobs it has done
+type fakeQueue struct {
+	jobs float64
+}
+
+func (q *fakeQueue) Metrics() []Metric {
+	return []Metric{{"queued", "jobs", Gauge}, {"done", "jobs", Counter}}
+}
+
+func (q *fakeQueue) CollectSystem(sys *SystemStats, values []float64) error {
+	q.jobs += 20
+	values[0], values[1] = 3, q.jobs
+	return nil
+}
+
+func TestProcFileCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stats := "requests: 12\nlatency 3.5 ms\nignored 9\nbroken x\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "7.stats"), []byte(stats), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewProcFileCollector(filepath.Join(dir, "%d.stats"), Metric{"requests", "requests", Counter},
+		Metric{"latency", "ms", Gauge}, Metric{"broken", "", Gauge})
+	procs := ProcSampleList{Samples: []ProcSample{{Pid: 7}, {Pid: 8}}, Len: 2}
+	values := [][]float64{make([]float64, 3), make([]float64, 3)}
+	if err := c.CollectProcs(&procs, values); err != nil {
+		t.Fatal(err)
+	}
+	if values[0][0] != 12 || values[0][1] != 3.5 || values[0][2] != 0 {
+		t.Errorf("read %v from the stats file", values[0])
+	}
+	if math.IsNaN(values[1][0]) == false || math.IsNaN(values[1][1]) == false {
+		t.Errorf("read %v for a process without a stats file, want it missing", values[1])
+	}
+}
+
+func TestRecordValuesMissing(t *testing.T) {
+	metrics := []Metric{{"requests", "requests", Counter}, {"latency", "ms", Gauge}}
+	sum, delta := []float64{5, 2}, make([]float64, 2)
+	recordValues(metrics, 1, []float64{math.NaN(), math.NaN()}, []float64{100, 3}, sum, delta)
+	if sum[0] != 5 || sum[1] != 2 || delta[0] != 0 || delta[1] != 0 {
+		t.Errorf("a failed read gave sum %v and delta %v", sum, delta)
+	}
+	delta = make([]float64, 2)
+	recordValues(metrics, 1, []float64{110, 4}, []float64{math.NaN(), math.NaN()}, sum, delta)
+	if sum[0] != 5 || sum[1] != 4 || delta[0] != 0 || delta[1] != 4 {
+		t.Errorf("the read after a failed one gave sum %v and delta %v", sum, delta)
+	}
+}
+
+func TestCollectorMetrics(t *testing.T) {
+	files := NewProcFileCollector("/proc/%d/io", Metric{"read_bytes", "bytes", Counter})
+	metrics, err := collectorMetrics([]Collector{&SystemStatsCollector{}, files, &fakeQueue{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics.Proc) != 1 || len(metrics.System) != 2 || metrics.System[1].Name != "done" {
+		t.Errorf("collector metrics %+v", metrics)
+	}
+	if _, err := collectorMetrics([]Collector{&fakeQueue{}, &fakeQueue{}}); err == nil {
+		t.Error("two collectors read the same metric")
+	}
+}
+
+func TestCollectorSampling(t *testing.T) {
+	queue := &fakeQueue{}
+	sysMetrics := queue.Metrics()
+	procMetrics := []Metric{{"requests", "requests", Counter}, {"conns", "connections", Gauge}}
+	live := newLiveSource(10, Filters{}, []Collector{queue}, Metrics{procMetrics, sysMetrics}, nil)
+
+	start := time.Unix(1500000000, 0)
+	sample := func(i int, requests, conns float64, sys *SystemStats) ProcSampleList {
+		if err := live.readSystem(sys); err != nil {
+			t.Fatal(err)
+		}
+		now := start.Add(time.Duration(i) * 100 * time.Millisecond)
+		sys.CaptureTime = now
+		return ProcSampleList{Samples: []ProcSample{{Pid: 7, Proc: ProcStats{CaptureTime: now},
+			Values: []float64{requests, conns}}}, Len: 1}
+	}
+
+	w := NewWindow()
+	var prevSys, sys SystemStats
+	prev := sample(0, 100, 4, &prevSys)
+	for i, requests := range []float64{110, 130, 100} {
+		cur := sample(i+1, requests, float64(5+i), &sys)
+		snap := NewSnapshot(100, cur, prev, &sys, &prevSys)
+		snap.recordMetrics(Metrics{procMetrics, sysMetrics}, cur, prev, &sys, &prevSys)
+		w.Add(snap)
+		prev, prevSys = cur, sys
+	}
+
+	summary := w.Summary(ProcInfoMap{7: &ProcInfo{Comm: "seven"}}, Pidlist{7}, 100, 100)
+	if len(summary.Procs) != 1 {
+		t.Fatalf("summary of %d procs", len(summary.Procs))
+	}
+	// the counter went down at the end, which counts as a reset instead of a negative change
+	requests := summary.Procs[0].Metrics["requests"]
+	if requests.Value != 30 || requests.Min != 0 || requests.Max != 20 || requests.Unit != "requests" {
+		t.Errorf("requests %+v", requests)
+	}
+	if conns := summary.Procs[0].Metrics["conns"]; conns.Value != 7 || conns.Min != 5 || conns.Avg != 6 {
+		t.Errorf("connections %+v", conns)
+	}
+	done, queued := summary.System.Metrics["done"], summary.System.Metrics["queued"]
+	if done.Value != 60 || done.Avg != 20 || queued.Value != 3 || queued.Max != 3 {
+		t.Errorf("system metrics %+v", summary.System.Metrics)
+	}
+}
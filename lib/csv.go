@@ -0,0 +1,141 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// CSV output writes a header once, then a system row and a row per process for each
+// window. The column names are the json field paths, and the record column says which
+// kind of row it is.
+
+package cpustat
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// CSVSink writes each summary as csv rows
+type CSVSink struct {
+	out     *csv.Writer
+	metrics Metrics // of the collectors, with columns after the built in ones
+}
+
+// NewCSVSink writes the header, which is the same for every window
+func NewCSVSink(out io.Writer, metrics Metrics) (*CSVSink, error) {
+	c := CSVSink{csv.NewWriter(out), metrics}
+	header := []string{"version", "start", "end", "window_ms", "interval_ms", "samples", "missed_samples", "record"}
+	header = append(header, c.systemNames("system.")...)
+	header = append(header, c.procNames("proc.")...)
+	c.out.Write(header)
+	c.out.Flush()
+	return &c, c.out.Error()
+}
+
+func (c *CSVSink) Write(s *Summary) error {
+	window := []string{
+		fmt.Sprint(s.Version),
+		s.Start.Format(time.RFC3339Nano),
+		s.End.Format(time.RFC3339Nano),
+		csvFloat(s.Window),
+		fmt.Sprint(s.Interval),
+		fmt.Sprint(s.Samples),
+		fmt.Sprint(s.Missed),
+	}
+	sysBlank := make([]string, len(c.systemNames("")))
+	procBlank := make([]string, len(c.procNames("")))
+
+	// the final summary of the whole run has its own record types
+	prefix := ""
+	if s.Final {
+		prefix = "final_"
+	}
+	row := append(append([]string{}, window...), prefix+"system")
+	row = append(row, csvValues(Fields(s.System))...)
+	row = append(row, metricValues(c.metrics.System, s.System.Metrics)...)
+	c.out.Write(append(row, procBlank...))
+	for _, proc := range s.Procs {
+		row = append(append([]string{}, window...), prefix+"proc")
+		row = append(row, sysBlank...)
+		row = append(row, csvValues(Fields(proc))...)
+		c.out.Write(append(row, metricValues(c.metrics.Proc, proc.Metrics)...))
+	}
+	c.out.Flush()
+	return c.out.Error()
+}
+
+func (c *CSVSink) Close() error {
+	return nil
+}
+
+func (c *CSVSink) systemNames(prefix string) []string {
+	return append(csvNames(prefix, Fields(SystemSummary{})), metricNames(prefix, c.metrics.System)...)
+}
+
+func (c *CSVSink) procNames(prefix string) []string {
+	return append(csvNames(prefix, Fields(ProcSummary{})), metricNames(prefix, c.metrics.Proc)...)
+}
+
+func csvNames(prefix string, fields []Field) []string {
+	var names []string
+	for _, field := range fields {
+		names = append(names, prefix+field.Name)
+	}
+	return names
+}
+
+// metricNames are the columns of the collectors' metrics, one for each stat of each
+func metricNames(prefix string, metrics []Metric) []string {
+	var names []string
+	for _, m := range metrics {
+		names = append(names, csvNames(prefix, MetricStatFields(m.Name, MetricStat{}))...)
+	}
+	return names
+}
+
+// metricValues fills the metric columns, leaving the ones without a value blank
+func metricValues(metrics []Metric, stats map[string]MetricStat) []string {
+	var vals []string
+	for _, m := range metrics {
+		fields := MetricStatFields(m.Name, stats[m.Name])
+		if _, ok := stats[m.Name]; ok {
+			vals = append(vals, csvValues(fields)...)
+		} else {
+			vals = append(vals, make([]string, len(fields))...)
+		}
+	}
+	return vals
+}
+
+func csvValues(fields []Field) []string {
+	var vals []string
+	for _, field := range fields {
+		if val, ok := field.Value.(float64); ok {
+			vals = append(vals, csvFloat(val))
+		} else {
+			vals = append(vals, fmt.Sprint(field.Value))
+		}
+	}
+	return vals
+}
+
+func csvFloat(val float64) string {
+	return strconv.FormatFloat(val, 'f', 3, 64)
+}
@@ -0,0 +1,309 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Comparing two windows, like before and after a deploy. Pids change whenever a service
+// restarts, so processes are lined up by a group key like the friendly name instead, and
+// each group is the total of its processes in every sample.
+
+package cpustat
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/codahale/hdrhistogram"
+)
+
+// GroupKey names the group a process is in. info is nil if we never learned about it.
+type GroupKey func(pid int, info *ProcInfo) string
+
+var groupKeys = map[string]GroupKey{
+	"name": func(pid int, info *ProcInfo) string {
+		if info == nil {
+			return "unknown"
+		}
+		return info.Friendly
+	},
+	"cgroup": func(pid int, info *ProcInfo) string {
+		if info == nil {
+			return "unknown"
+		}
+		if info.Cgroup == "" {
+			return "/"
+		}
+		return info.Cgroup
+	},
+}
+
+// ParseGroupKey converts "name" or "cgroup" into a GroupKey
+func ParseGroupKey(s string) (GroupKey, error) {
+	key, ok := groupKeys[s]
+	if ok == false {
+		return nil, fmt.Errorf("unknown group %q, must be name or cgroup", s)
+	}
+	return key, nil
+}
+
+// GroupStats are the totals of every process in a group for each sample that any of them
+// were in. Values are in units that don't depend on the interval, so captures taken with
+// different intervals can be compared.
+type GroupStats struct {
+	Pids   map[int]bool
+	CPU    *hdrhistogram.Histogram // usr+sys, hundredths of a percent of a CPU
+	Runq   *hdrhistogram.Histogram // hundredths of a percent of a CPU
+	Iowait *hdrhistogram.Histogram // hundredths of a percent of a CPU
+	Ctxsw  *hdrhistogram.Histogram // voluntary plus involuntary per second
+	RSS    *hdrhistogram.Histogram // KB
+}
+
+type GroupStatsMap map[string]*GroupStats
+
+// groupRSSMax is the most KB that GroupStats.RSS tracks, 16 TB, since a group of big
+// processes goes well past histMax
+const groupRSSMax = 1 << 34
+
+func NewGroupStats() *GroupStats {
+	return &GroupStats{
+		Pids:   make(map[int]bool),
+		CPU:    hdrhistogram.New(histMin, histMax, histSigFigs),
+		Runq:   hdrhistogram.New(histMin, histMax, histSigFigs),
+		Iowait: hdrhistogram.New(histMin, histMax, histSigFigs),
+		Ctxsw:  hdrhistogram.New(histMin, histMax, histSigFigs),
+		RSS:    hdrhistogram.New(histMin, groupRSSMax, histSigFigs),
+	}
+}
+
+// UpdateGroupStats adds up the deltas of one sample by group, and records the totals. RSS
+// comes from procSum, since it isn't a delta.
+func UpdateGroupStats(groups GroupStatsMap, key GroupKey, procDelta, procSum ProcSampleMap,
+	infoMap ProcInfoMap, jiffy, interval int) {
+
+	type total struct {
+		ticks, runq, iowait, ctxsw, rss uint64
+	}
+	totals := make(map[string]*total)
+	for pid, delta := range procDelta {
+		name := key(pid, infoMap[pid])
+		t, ok := totals[name]
+		if ok == false {
+			t = &total{}
+			totals[name] = t
+		}
+		t.ticks += delta.Proc.Utime + delta.Proc.Stime
+		t.runq += delta.Task.Cpudelaytotal
+		t.iowait += delta.Task.Blkiodelaytotal
+		t.ctxsw += delta.Task.Nvcsw + delta.Task.Nivcsw
+		if sum, ok := procSum[pid]; ok {
+			t.rss += sum.Proc.Rss
+		}
+
+		g, ok := groups[name]
+		if ok == false {
+			g = NewGroupStats()
+			groups[name] = g
+		}
+		g.Pids[pid] = true
+	}
+
+	sampleSec := float64(interval) / 1000
+	nsPct := func(ns uint64) int64 {
+		return int64(math.Round(NsPct(float64(ns), float64(interval)) * 100))
+	}
+	for name, t := range totals {
+		g := groups[name]
+		recordClamped(g.CPU, int64(math.Round(TicksPct(float64(t.ticks), jiffy, float64(interval))*100)))
+		recordClamped(g.Runq, nsPct(t.runq))
+		recordClamped(g.Iowait, nsPct(t.iowait))
+		recordClamped(g.Ctxsw, int64(math.Round(float64(t.ctxsw)/sampleSec)))
+		recordClamped(g.RSS, int64(t.rss*PageSize/1024))
+	}
+}
+
+// recordClamped records val, or the most that h tracks if val is more, so that it isn't
+// dropped
+func recordClamped(h *hdrhistogram.Histogram, val int64) {
+	if max := h.HighestTrackableValue(); val > max {
+		val = max
+	}
+	h.RecordValue(val)
+}
+
+// DiffStat is one metric of a group in both windows
+type DiffStat struct {
+	Before      Stat    `json:"before"`
+	After       Stat    `json:"after"`
+	P95Before   float64 `json:"p95_before"`
+	P95After    float64 `json:"p95_after"`
+	Change      float64 `json:"change"` // of the average
+	KS          float64 `json:"ks"`     // largest difference between the two distributions, 0 to 1
+	Significant bool    `json:"significant"`
+}
+
+// GroupDiff compares a group across two windows. A group that is only in one window has
+// zeros for the other.
+type GroupDiff struct {
+	Name        string   `json:"name"`
+	Status      string   `json:"status"`  // same, changed, appeared or disappeared
+	Changed     string   `json:"changed"` // the metrics with significant changes, like cpu,runq
+	ProcsBefore int      `json:"procs_before"`
+	ProcsAfter  int      `json:"procs_after"`
+	CPU         DiffStat `json:"cpu_pct"`
+	Runq        DiffStat `json:"runq_pct"`
+	Iowait      DiffStat `json:"iowait_pct"`
+	Ctxsw       DiffStat `json:"ctxsw_per_sec"`
+	RSS         DiffStat `json:"rss_bytes"`
+}
+
+var diffMetrics = []string{"cpu", "runq", "iowait", "ctxsw", "rss"}
+
+// DiffGroups compares every group in before and after, with the biggest changes in CPU first
+func DiffGroups(before, after GroupStatsMap) []GroupDiff {
+	names := make(map[string]bool)
+	for name := range before {
+		names[name] = true
+	}
+	for name := range after {
+		names[name] = true
+	}
+
+	diffs := make([]GroupDiff, 0, len(names))
+	for name := range names {
+		b, a := before[name], after[name]
+		d := GroupDiff{Name: name}
+		stat := func(get func(g *GroupStats) *hdrhistogram.Histogram, scale, floor float64) DiffStat {
+			var hb, ha *hdrhistogram.Histogram
+			if b != nil {
+				hb = get(b)
+			}
+			if a != nil {
+				ha = get(a)
+			}
+			return diffStat(hb, ha, scale, floor)
+		}
+		d.CPU = stat(func(g *GroupStats) *hdrhistogram.Histogram { return g.CPU }, 0.01, 1)
+		d.Runq = stat(func(g *GroupStats) *hdrhistogram.Histogram { return g.Runq }, 0.01, 1)
+		d.Iowait = stat(func(g *GroupStats) *hdrhistogram.Histogram { return g.Iowait }, 0.01, 1)
+		d.Ctxsw = stat(func(g *GroupStats) *hdrhistogram.Histogram { return g.Ctxsw }, 1, 10)
+		d.RSS = stat(func(g *GroupStats) *hdrhistogram.Histogram { return g.RSS }, 1024, 10*1024*1024)
+
+		switch {
+		case b == nil:
+			d.Status = "appeared"
+			d.ProcsAfter = len(a.Pids)
+		case a == nil:
+			d.Status = "disappeared"
+			d.ProcsBefore = len(b.Pids)
+		default:
+			d.ProcsBefore, d.ProcsAfter = len(b.Pids), len(a.Pids)
+			var changed []string
+			for i, s := range []DiffStat{d.CPU, d.Runq, d.Iowait, d.Ctxsw, d.RSS} {
+				if s.Significant {
+					changed = append(changed, diffMetrics[i])
+				}
+			}
+			d.Changed = strings.Join(changed, ",")
+			d.Status = "same"
+			if len(changed) > 0 {
+				d.Status = "changed"
+			}
+		}
+		diffs = append(diffs, d)
+	}
+	sort.Sort(byCPUChange(diffs))
+	return diffs
+}
+
+type byCPUChange []GroupDiff
+
+func (d byCPUChange) Len() int      { return len(d) }
+func (d byCPUChange) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d byCPUChange) Less(i, j int) bool {
+	ci, cj := math.Abs(d[i].CPU.Change), math.Abs(d[j].CPU.Change)
+	if ci != cj {
+		return ci > cj
+	}
+	return d[i].Name < d[j].Name
+}
+
+// diffStat compares two distributions, either of which can be nil. Values are multiplied
+// by scale to get back to the units of the json names. Lots of samples make tiny changes
+// stand out from chance, so a change also has to be at least floor, and 5% of the average,
+// to be significant.
+func diffStat(before, after *hdrhistogram.Histogram, scale, floor float64) DiffStat {
+	var s DiffStat
+	histStat := func(h *hdrhistogram.Histogram) (Stat, float64) {
+		if h == nil || h.TotalCount() == 0 {
+			return Stat{}, 0
+		}
+		return Stat{float64(h.Min()) * scale, h.Mean() * scale, float64(h.Max()) * scale},
+			float64(h.ValueAtQuantile(95)) * scale
+	}
+	s.Before, s.P95Before = histStat(before)
+	s.After, s.P95After = histStat(after)
+	s.Change = s.After.Avg - s.Before.Avg
+	if before != nil && after != nil {
+		s.KS, s.Significant = KSTest(before, after)
+		change := math.Abs(s.Change)
+		if change < floor || change < 0.05*math.Max(s.Before.Avg, s.After.Avg) {
+			s.Significant = false
+		}
+	}
+	return s
+}
+
+// KSTest is the two sample Kolmogorov-Smirnov test of whether two histograms come from
+// the same distribution. It returns the largest difference between their cumulative
+// distributions, and whether that is bigger than chance would explain at the 1% level.
+// Samples next to each other aren't independent, so treat it as a hint.
+func KSTest(a, b *hdrhistogram.Histogram) (float64, bool) {
+	n, m := a.TotalCount(), b.TotalCount()
+	if n == 0 || m == 0 {
+		return 0, false
+	}
+	counts := make(map[int64][2]int64)
+	for _, bar := range a.Distribution() {
+		c := counts[bar.From]
+		c[0] += bar.Count
+		counts[bar.From] = c
+	}
+	for _, bar := range b.Distribution() {
+		c := counts[bar.From]
+		c[1] += bar.Count
+		counts[bar.From] = c
+	}
+	values := make([]int, 0, len(counts))
+	for val := range counts {
+		values = append(values, int(val))
+	}
+	sort.Ints(values)
+
+	var sumA, sumB int64
+	var d float64
+	for _, val := range values {
+		c := counts[int64(val)]
+		sumA += c[0]
+		sumB += c[1]
+		d = math.Max(d, math.Abs(float64(sumA)/float64(n)-float64(sumB)/float64(m)))
+	}
+	critical := 1.63 * math.Sqrt(float64(n+m)/float64(n*m))
+	return d, d > critical
+}
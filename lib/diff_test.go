@@ -0,0 +1,136 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"math"
+	"testing"
+
+	"github.com/codahale/hdrhistogram"
+)
+
+func TestKSTest(t *testing.T) {
+	a := hdrhistogram.New(histMin, histMax, histSigFigs)
+	b := hdrhistogram.New(histMin, histMax, histSigFigs)
+	c := hdrhistogram.New(histMin, histMax, histSigFigs)
+	for i := 0; i < 200; i++ {
+		a.RecordValue(int64(i % 10))
+		b.RecordValue(int64((i + 3) % 10))
+		c.RecordValue(int64(i%10 + 5))
+	}
+
+	if d, significant := KSTest(a, b); d != 0 || significant {
+		t.Errorf("same distributions: ks = %v %v, want 0 false", d, significant)
+	}
+	if d, significant := KSTest(a, c); d != 0.5 || significant == false {
+		t.Errorf("shifted distributions: ks = %v %v, want 0.5 true", d, significant)
+	}
+	if _, significant := KSTest(a, hdrhistogram.New(histMin, histMax, histSigFigs)); significant {
+		t.Error("empty histogram is significant")
+	}
+}
+
+func TestDiffGroups(t *testing.T) {
+	key, err := ParseGroupKey("name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseGroupKey("pid"); err == nil {
+		t.Error("ParseGroupKey accepted pid")
+	}
+
+	// api restarts with a new pid and gets busier, db stays the same, cron goes away and
+	// batch shows up
+	beforeInfo := ProcInfoMap{
+		1: &ProcInfo{Friendly: "api"},
+		2: &ProcInfo{Friendly: "api"},
+		3: &ProcInfo{Friendly: "db"},
+		4: &ProcInfo{Friendly: "cron"},
+	}
+	afterInfo := ProcInfoMap{
+		10: &ProcInfo{Friendly: "api"},
+		3:  &ProcInfo{Friendly: "db"},
+		11: &ProcInfo{Friendly: "batch"},
+	}
+	before := make(GroupStatsMap)
+	after := make(GroupStatsMap)
+	for i := 0; i < 100; i++ {
+		UpdateGroupStats(before, key, ProcSampleMap{
+			1: &ProcSample{Proc: ProcStats{Utime: 2}},
+			2: &ProcSample{Proc: ProcStats{Utime: 1, Stime: 1}},
+			3: &ProcSample{Proc: ProcStats{Utime: uint64(i % 3)}},
+			4: &ProcSample{Proc: ProcStats{Stime: 1}},
+		}, ProcSampleMap{}, beforeInfo, 100, 100)
+		UpdateGroupStats(after, key, ProcSampleMap{
+			10: &ProcSample{Proc: ProcStats{Utime: 8}},
+			3:  &ProcSample{Proc: ProcStats{Utime: uint64((i + 1) % 3)}},
+			11: &ProcSample{Proc: ProcStats{Utime: 1}},
+		}, ProcSampleMap{}, afterInfo, 100, 100)
+	}
+
+	diffs := DiffGroups(before, after)
+	want := []struct {
+		name, status        string
+		procsBefore, after  int
+		cpuBefore, cpuAfter float64
+	}{
+		{"api", "changed", 2, 1, 40, 80},
+		{"batch", "appeared", 0, 1, 0, 10},
+		{"cron", "disappeared", 1, 0, 10, 0},
+		{"db", "same", 1, 1, 9.9, 10},
+	}
+	if len(diffs) != len(want) {
+		t.Fatalf("got %d groups, want %d", len(diffs), len(want))
+	}
+	for i, w := range want {
+		d := diffs[i]
+		if d.Name != w.name || d.Status != w.status || d.ProcsBefore != w.procsBefore || d.ProcsAfter != w.after {
+			t.Errorf("group %d = %s %s %d %d, want %s %s %d %d", i, d.Name, d.Status, d.ProcsBefore, d.ProcsAfter,
+				w.name, w.status, w.procsBefore, w.after)
+		}
+		// histograms only keep 2 significant figures
+		if w.status == "changed" && d.Changed != "cpu" {
+			t.Errorf("%s changed %q, want cpu", d.Name, d.Changed)
+		}
+		if math.Abs(d.CPU.Before.Avg-w.cpuBefore) > 0.5 || math.Abs(d.CPU.After.Avg-w.cpuAfter) > 0.5 {
+			t.Errorf("%s cpu = %v to %v, want %v to %v", d.Name, d.CPU.Before.Avg, d.CPU.After.Avg,
+				w.cpuBefore, w.cpuAfter)
+		}
+	}
+}
+
+func TestGroupStatsClamped(t *testing.T) {
+	groups := make(GroupStatsMap)
+	key, _ := ParseGroupKey("name")
+	infoMap := ProcInfoMap{1: &ProcInfo{Friendly: "db"}}
+	// 200 GB of RSS, and a delay far past what the histograms track
+	rss := uint64(200<<30) / PageSize
+	UpdateGroupStats(groups, key, ProcSampleMap{1: &ProcSample{Task: TaskStats{Cpudelaytotal: 1e18}}},
+		ProcSampleMap{1: &ProcSample{Proc: ProcStats{Rss: rss}}}, infoMap, 100, 100)
+
+	g := groups["db"]
+	if g.RSS.TotalCount() != 1 || g.RSS.Max() < 199<<20 {
+		t.Errorf("rss max %d KB from %d samples, want 200 GB", g.RSS.Max(), g.RSS.TotalCount())
+	}
+	if g.Runq.TotalCount() != 1 || g.Runq.Max() < histMax*99/100 {
+		t.Errorf("runq max %d from %d samples, want it clamped to %d", g.Runq.Max(), g.Runq.TotalCount(), histMax)
+	}
+}
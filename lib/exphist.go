@@ -0,0 +1,117 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Base 2 exponential histograms, in the form OpenTelemetry uses. Bucket i holds values in
+// (2^(i/2^scale), 2^((i+1)/2^scale)], so the relative error is the same at every magnitude,
+// which suits data like ours where a process can be anywhere from 0.01% to 1000% of a CPU.
+
+package cpustat
+
+import (
+	"math"
+)
+
+// ExpHistogramMaxBuckets is the most buckets a histogram will use before lowering its scale
+const ExpHistogramMaxBuckets = 160
+
+type ExpHistogram struct {
+	Scale     int32
+	ZeroCount uint64
+	Count     uint64
+	Sum       float64
+	Min       float64
+	Max       float64
+	buckets   map[int32]uint64
+	low, high int32 // bucket index range in use
+}
+
+// NewExpHistogram starts at scale, which is lowered as needed to fit the values recorded
+func NewExpHistogram(scale int32) *ExpHistogram {
+	return &ExpHistogram{Scale: scale, buckets: make(map[int32]uint64)}
+}
+
+// Record adds a value, which must not be negative
+func (h *ExpHistogram) Record(val float64) {
+	h.RecordN(val, 1)
+}
+
+// RecordN adds a value n times, like a value that held for n intervals
+func (h *ExpHistogram) RecordN(val float64, n uint64) {
+	if n == 0 {
+		return
+	}
+	if h.Count == 0 || val < h.Min {
+		h.Min = val
+	}
+	if h.Count == 0 || val > h.Max {
+		h.Max = val
+	}
+	h.Count += n
+	h.Sum += val * float64(n)
+
+	if val <= 0 {
+		h.ZeroCount += n
+		return
+	}
+	index := h.index(val)
+	if len(h.buckets) == 0 {
+		h.low, h.high = index, index
+	}
+	for (index < h.low && h.high-index >= ExpHistogramMaxBuckets) ||
+		(index > h.high && index-h.low >= ExpHistogramMaxBuckets) {
+		h.downscale()
+		index = h.index(val)
+	}
+	if index < h.low {
+		h.low = index
+	}
+	if index > h.high {
+		h.high = index
+	}
+	h.buckets[index] += n
+}
+
+func (h *ExpHistogram) index(val float64) int32 {
+	return int32(math.Ceil(math.Log2(val)*math.Exp2(float64(h.Scale)))) - 1
+}
+
+// downscale halves the resolution by merging pairs of buckets
+func (h *ExpHistogram) downscale() {
+	merged := make(map[int32]uint64, len(h.buckets))
+	for index, count := range h.buckets {
+		merged[index>>1] += count
+	}
+	h.buckets = merged
+	h.low >>= 1
+	h.high >>= 1
+	h.Scale--
+}
+
+// Buckets returns the index of the first positive bucket and the counts from there on
+func (h *ExpHistogram) Buckets() (int32, []uint64) {
+	if len(h.buckets) == 0 {
+		return 0, nil
+	}
+	counts := make([]uint64, h.high-h.low+1)
+	for index, count := range h.buckets {
+		counts[index-h.low] = count
+	}
+	return h.low, counts
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"math"
+	"testing"
+)
+
+func TestExpHistogram(t *testing.T) {
+	h := NewExpHistogram(0)
+	for _, val := range []float64{0, 1, 2, 3, 4, 5} {
+		h.Record(val)
+	}
+	if h.Count != 6 || h.ZeroCount != 1 || h.Sum != 15 || h.Min != 0 || h.Max != 5 {
+		t.Errorf("bad totals %+v", h)
+	}
+	// at scale 0 the buckets are (0.5,1], (1,2], (2,4], (4,8]
+	offset, counts := h.Buckets()
+	if offset != -1 || len(counts) != 4 || counts[0] != 1 || counts[1] != 1 || counts[2] != 2 || counts[3] != 1 {
+		t.Error("bad buckets", offset, counts)
+	}
+}
+
+func TestExpHistogramRecordN(t *testing.T) {
+	h, each := NewExpHistogram(4), NewExpHistogram(4)
+	for _, val := range []float64{0, 3, 250} {
+		h.RecordN(val, 1000)
+		for n := 0; n < 1000; n++ {
+			each.Record(val)
+		}
+	}
+	if h.Count != each.Count || h.ZeroCount != each.ZeroCount || h.Sum != each.Sum ||
+		h.Min != each.Min || h.Max != each.Max || h.Scale != each.Scale {
+		t.Errorf("RecordN %+v, Record %+v", h, each)
+	}
+	offset, counts := h.Buckets()
+	eachOffset, eachCounts := each.Buckets()
+	if offset != eachOffset || len(counts) != len(eachCounts) {
+		t.Fatal("different buckets", offset, counts, eachOffset, eachCounts)
+	}
+	for i := range counts {
+		if counts[i] != eachCounts[i] {
+			t.Error("different buckets", counts, eachCounts)
+		}
+	}
+}
+
+func TestExpHistogramDownscale(t *testing.T) {
+	h := NewExpHistogram(8)
+	h.Record(0.01)
+	h.Record(10000)
+	if h.Scale >= 8 {
+		t.Error("scale should have been lowered to fit, still", h.Scale)
+	}
+	offset, counts := h.Buckets()
+	if len(counts) > ExpHistogramMaxBuckets {
+		t.Error("too many buckets", len(counts))
+	}
+	// both values have to land in buckets that contain them
+	base := math.Exp2(math.Exp2(-float64(h.Scale)))
+	for i, val := range []float64{0.01, 10000} {
+		index := offset
+		if i == 1 {
+			index = offset + int32(len(counts)) - 1
+		}
+		if val <= math.Pow(base, float64(index)) || val > math.Pow(base, float64(index+1)) {
+			t.Errorf("%f isn't in bucket %d at scale %d", val, index, h.Scale)
+		}
+	}
+}
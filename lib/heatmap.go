@@ -0,0 +1,278 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Subsecond offset heatmaps, as described by Brendan Gregg. Each column is one second and
+// each row is an offset within that second, so a burst that lasts 200ms every 5 seconds
+// stands out as a dot pattern instead of being averaged into a flat line.
+
+package cpustat
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// ProcMatch picks the processes whose CPU goes into a heatmap. The zero value matches
+// nothing, which means the heatmap shows the whole system.
+type ProcMatch struct {
+	Pid    int
+	Name   string // friendly name
+	Cgroup string // cgroup path, or a prefix of one
+}
+
+func (m ProcMatch) Any() bool {
+	return m.Pid != 0 || m.Name != "" || m.Cgroup != ""
+}
+
+func (m ProcMatch) Match(pid int, info *ProcInfo) bool {
+	if m.Pid != 0 && m.Pid != pid {
+		return false
+	}
+	if m.Name != "" && (info == nil || info.Friendly != m.Name) {
+		return false
+	}
+	if m.Cgroup != "" && (info == nil || strings.HasPrefix(info.Cgroup, m.Cgroup) == false) {
+		return false
+	}
+	return true
+}
+
+func (m ProcMatch) String() string {
+	var parts []string
+	if m.Pid != 0 {
+		parts = append(parts, fmt.Sprintf("pid %d", m.Pid))
+	}
+	if m.Name != "" {
+		parts = append(parts, m.Name)
+	}
+	if m.Cgroup != "" {
+		parts = append(parts, "cgroup "+m.Cgroup)
+	}
+	if len(parts) == 0 {
+		return "system"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// BusyPct is how much of the machine's CPU time in a SystemStatsRecord delta was not idle
+// or waiting for IO, which doesn't depend on how many CPUs there are
+func BusyPct(delta *SystemStats) float64 {
+	idle := delta.Idle + delta.Iowait
+	total := idle + delta.Usr + delta.Nice + delta.Sys + delta.Irq + delta.Softirq + delta.Steal
+	if total == 0 {
+		return 0
+	}
+	return float64(SafeSub(total, idle)) / float64(total) * 100
+}
+
+// HeatmapValue is what a heatmap shows for one sample. That's BusyPct if match is empty,
+// or else the CPU used by the matching processes, as a percent of one CPU.
+func HeatmapValue(procDelta ProcSampleMap, sysDelta *SystemStats, infoMap ProcInfoMap, match ProcMatch,
+	jiffy, interval int) float64 {
+
+	if match.Any() == false {
+		return BusyPct(sysDelta)
+	}
+	var ticks uint64
+	for pid, delta := range procDelta {
+		if match.Match(pid, infoMap[pid]) {
+			ticks += delta.Proc.Utime + delta.Proc.Stime
+		}
+	}
+	return TicksPct(float64(ticks), jiffy, float64(interval))
+}
+
+// Heatmap holds the average value in each cell
+type Heatmap struct {
+	Start    time.Time // start of the first column
+	Interval int       // ms covered by each row
+	sums     [][]float64
+	counts   [][]int
+}
+
+func NewHeatmap(interval int) *Heatmap {
+	return &Heatmap{Interval: interval}
+}
+
+func (h *Heatmap) Rows() int {
+	rows := 1000 / h.Interval
+	if rows < 1 {
+		rows = 1
+	}
+	return rows
+}
+
+func (h *Heatmap) Columns() int {
+	return len(h.sums)
+}
+
+// Add puts a sample taken at t in its cell. Samples from before the first one are dropped.
+func (h *Heatmap) Add(t time.Time, value float64) {
+	if h.Start.IsZero() {
+		h.Start = t.Truncate(time.Second)
+	}
+	if t.Before(h.Start) {
+		return
+	}
+	offset := t.Sub(h.Start)
+	col := int(offset / time.Second)
+	row := int(offset%time.Second) / int(time.Duration(h.Interval)*time.Millisecond)
+	if row >= h.Rows() {
+		row = h.Rows() - 1
+	}
+	for len(h.sums) <= col {
+		h.sums = append(h.sums, make([]float64, h.Rows()))
+		h.counts = append(h.counts, make([]int, h.Rows()))
+	}
+	h.sums[col][row] += value
+	h.counts[col][row]++
+}
+
+// Cell returns the average value of a cell, and false if there were no samples in it
+func (h *Heatmap) Cell(col, row int) (float64, bool) {
+	if h.counts[col][row] == 0 {
+		return 0, false
+	}
+	return h.sums[col][row] / float64(h.counts[col][row]), true
+}
+
+// Max is the largest cell, or 100 if that's larger, so a mostly idle map stays pale
+func (h *Heatmap) Max() float64 {
+	max := 100.0
+	for col := range h.sums {
+		for row := range h.sums[col] {
+			if val, ok := h.Cell(col, row); ok && val > max {
+				max = val
+			}
+		}
+	}
+	return max
+}
+
+// HeatColor goes from white for 0 through yellow and orange to red for 1
+func HeatColor(frac float64) (r, g, b int) {
+	frac = math.Max(0, math.Min(1, frac))
+	if frac == 0 {
+		return 255, 255, 255
+	}
+	return 255, int(235 - 215*frac), int(150 - 150*frac)
+}
+
+// ansiHeat are 256 color terminal codes from white through yellow to red
+var ansiHeat = []int{231, 230, 229, 228, 227, 226, 220, 214, 208, 202, 196}
+
+// WriteSVG draws the heatmap with a cell for every sample, and a tooltip on each cell
+func (h *Heatmap) WriteSVG(w io.Writer, title string) error {
+	const left, top, bottom = 60, 30, 40
+	cols, rows := h.Columns(), h.Rows()
+	cellW := math.Max(1, math.Min(10, 1200/math.Max(1, float64(cols))))
+	cellH := math.Max(2, math.Min(20, 400/float64(rows)))
+	width := math.Max(400, left+cellW*float64(cols)+20)
+	height := top + cellH*float64(rows) + bottom
+	max := h.Max()
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" font-family="sans-serif" font-size="11">`+"\n",
+		width, height)
+	fmt.Fprintf(out, `<text x="%d" y="18" font-size="14">%s</text>`+"\n", left, xmlEscape(title))
+	fmt.Fprintf(out, `<rect x="%d" y="%d" width="%.1f" height="%.1f" fill="#eeeeee"/>`+"\n",
+		left, top, cellW*float64(cols), cellH*float64(rows))
+	for col := 0; col < cols; col++ {
+		for row := 0; row < rows; row++ {
+			val, ok := h.Cell(col, row)
+			if ok == false {
+				continue
+			}
+			r, g, b := HeatColor(val / max)
+			// row 0 is the start of the second, at the bottom
+			y := top + cellH*float64(rows-row-1)
+			t := h.Start.Add(time.Duration(col)*time.Second + time.Duration(row*h.Interval)*time.Millisecond)
+			fmt.Fprintf(out, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="rgb(%d,%d,%d)"><title>%s %.1f%%</title></rect>`+"\n",
+				left+cellW*float64(col), y, cellW, cellH, r, g, b, t.Format("15:04:05.000"), val)
+		}
+	}
+
+	// a time label about every 100 pixels, and offsets at the bottom and top
+	every := int(math.Ceil(100 / cellW))
+	for col := 0; col < cols; col += every {
+		fmt.Fprintf(out, `<text x="%.1f" y="%.1f">%s</text>`+"\n", left+cellW*float64(col),
+			top+cellH*float64(rows)+15, h.Start.Add(time.Duration(col)*time.Second).Format("15:04:05"))
+	}
+	fmt.Fprintf(out, `<text x="4" y="%.1f">0ms</text>`+"\n", top+cellH*float64(rows))
+	fmt.Fprintf(out, `<text x="4" y="%d">%dms</text>`+"\n", top+10, rows*h.Interval)
+	fmt.Fprintf(out, `<text x="%d" y="%.1f">darkest is %.0f%%</text>`+"\n", left, height-8, max)
+	fmt.Fprintln(out, "</svg>")
+	return out.Flush()
+}
+
+func xmlEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;").Replace(s)
+}
+
+// WriteANSI draws the heatmap with terminal colors, fitting it in width by height
+// characters by averaging neighboring cells
+func (h *Heatmap) WriteANSI(w io.Writer, title string, width, height int) error {
+	const labelW = 7
+	cols, rows := h.Columns(), h.Rows()
+	colGroup := int(math.Ceil(float64(cols) / math.Max(1, float64(width-labelW))))
+	rowGroup := int(math.Ceil(float64(rows) / math.Max(1, float64(height))))
+	if colGroup < 1 {
+		colGroup = 1
+	}
+	if rowGroup < 1 {
+		rowGroup = 1
+	}
+	max := h.Max()
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, title)
+	for row := rows - 1; row >= 0; row -= rowGroup {
+		lowest := row - rowGroup + 1
+		if lowest < 0 {
+			lowest = 0
+		}
+		fmt.Fprintf(out, "%5dms ", lowest*h.Interval)
+		for col := 0; col < cols; col += colGroup {
+			var sum float64
+			var count int
+			for c := col; c < col+colGroup && c < cols; c++ {
+				for r := lowest; r <= row; r++ {
+					sum += h.sums[c][r]
+					count += h.counts[c][r]
+				}
+			}
+			if count == 0 {
+				out.WriteString(" ")
+				continue
+			}
+			frac := math.Max(0, math.Min(1, sum/float64(count)/max))
+			fmt.Fprintf(out, "\x1b[48;5;%dm \x1b[0m", ansiHeat[int(frac*float64(len(ansiHeat)-1)+0.5)])
+		}
+		out.WriteString("\n")
+	}
+	end := h.Start.Add(time.Duration(cols) * time.Second)
+	fmt.Fprintf(out, "%*s%s to %s, %ds per column, darkest is %.0f%%\n", labelW+1, "",
+		h.Start.Format("15:04:05"), end.Format("15:04:05"), colGroup, max)
+	return out.Flush()
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeatmapAdd(t *testing.T) {
+	h := NewHeatmap(200)
+	start := time.Unix(1500000000, 0)
+	h.Add(start.Add(100*time.Millisecond), 10)
+	h.Add(start.Add(150*time.Millisecond), 30) // same cell, averaged
+	h.Add(start.Add(2*time.Second+900*time.Millisecond), 250)
+	h.Add(start.Add(-time.Second), 99) // before the start, dropped
+
+	if h.Rows() != 5 || h.Columns() != 3 {
+		t.Fatalf("heatmap is %d by %d, want 5 rows and 3 columns", h.Rows(), h.Columns())
+	}
+	if val, ok := h.Cell(0, 0); ok == false || val != 20 {
+		t.Errorf("cell 0,0 = %v %v, want 20", val, ok)
+	}
+	if val, ok := h.Cell(2, 4); ok == false || val != 250 {
+		t.Errorf("cell 2,4 = %v %v, want 250", val, ok)
+	}
+	if _, ok := h.Cell(1, 0); ok {
+		t.Error("cell 1,0 has a value, but nothing was added there")
+	}
+	if h.Max() != 250 {
+		t.Errorf("max = %v, want 250", h.Max())
+	}
+}
+
+func TestHeatmapValue(t *testing.T) {
+	infoMap := ProcInfoMap{
+		1: &ProcInfo{Friendly: "api", Cgroup: "/system.slice/api.service"},
+		2: &ProcInfo{Friendly: "api", Cgroup: "/system.slice/api-canary.service"},
+		3: &ProcInfo{Friendly: "db", Cgroup: "/system.slice/db.service"},
+	}
+	procDelta := ProcSampleMap{
+		1: &ProcSample{Proc: ProcStats{Utime: 10, Stime: 10}},
+		2: &ProcSample{Proc: ProcStats{Utime: 5}},
+		3: &ProcSample{Proc: ProcStats{Utime: 50}},
+	}
+	sysDelta := &SystemStats{Usr: 60, Sys: 15, Idle: 100, Iowait: 25}
+
+	tests := []struct {
+		match ProcMatch
+		want  float64
+	}{
+		{ProcMatch{}, 37.5},
+		{ProcMatch{Pid: 1}, 20},
+		{ProcMatch{Name: "api"}, 25},
+		{ProcMatch{Cgroup: "/system.slice/api"}, 25},
+		{ProcMatch{Name: "api", Cgroup: "/system.slice/api.service"}, 20},
+		{ProcMatch{Pid: 3, Name: "api"}, 0},
+	}
+	for _, tt := range tests {
+		// 100 ticks per second and 1s samples, so ticks are percent of a CPU
+		if got := HeatmapValue(procDelta, sysDelta, infoMap, tt.match, 100, 1000); got != tt.want {
+			t.Errorf("value for %s = %v, want %v", tt.match, got, tt.want)
+		}
+	}
+}
+
+func heatmapFixture() *Heatmap {
+	h := NewHeatmap(100)
+	start := time.Unix(1500000000, 0)
+	for i := 0; i < 300; i++ {
+		h.Add(start.Add(time.Duration(i)*100*time.Millisecond), float64(i%10*10))
+	}
+	return h
+}
+
+func TestHeatmapSVG(t *testing.T) {
+	var out bytes.Buffer
+	if err := heatmapFixture().WriteSVG(&out, "a <test>"); err != nil {
+		t.Fatal(err)
+	}
+	rects := 0
+	dec := xml.NewDecoder(&out)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("SVG is not valid XML: %s", err)
+		}
+		if el, ok := tok.(xml.StartElement); ok && el.Name.Local == "rect" {
+			rects++
+		}
+	}
+	// one for the background and one per sample
+	if rects != 301 {
+		t.Errorf("got %d rects, want 301", rects)
+	}
+}
+
+func TestHeatmapANSI(t *testing.T) {
+	var out bytes.Buffer
+	if err := heatmapFixture().WriteANSI(&out, "title", 17, 5); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	// the title, 10 rows squeezed into 5, and the time axis
+	if len(lines) != 7 {
+		t.Fatalf("got %d lines, want 7:\n%s", len(lines), out.String())
+	}
+	// 30 columns squeezed into 10
+	if cells := strings.Count(lines[1], "\x1b[48;5;"); cells != 10 {
+		t.Errorf("got %d cells in a row, want 10", cells)
+	}
+	if strings.Contains(lines[6], "3s per column") == false {
+		t.Errorf("axis = %q, want 3s per column", lines[6])
+	}
+}
@@ -44,20 +44,23 @@ type ProcStatsHist struct {
 
 type ProcStatsHistMap map[int]*ProcStatsHist
 
+// A delta counts once for each interval it covers, which is more than one when samples were
+// missed or the process is in the slow tier, so the sums are still divided by the time they cover.
 func UpdateProcStatsHist(histMap ProcStatsHistMap, deltaMap ProcSampleMap) {
 	for pid, deltaSample := range deltaMap {
 		if _, ok := histMap[pid]; ok != true {
 			histMap[pid] = NewProcStatsHist()
 		}
 		hist := histMap[pid]
+		weight := deltaSample.weight()
 
 		delta := &(deltaSample.Proc)
-		hist.Utime.RecordValue(int64(delta.Utime))
-		hist.Stime.RecordValue(int64(delta.Stime))
-		hist.Ustime.RecordValue(int64(delta.Utime + delta.Stime))
-		hist.Cutime.RecordValue(int64(delta.Cutime))
-		hist.Cstime.RecordValue(int64(delta.Cstime))
-		hist.Custime.RecordValue(int64(delta.Cutime + delta.Cstime))
+		hist.Utime.RecordValues(int64(delta.Utime), weight)
+		hist.Stime.RecordValues(int64(delta.Stime), weight)
+		hist.Ustime.RecordValues(int64(delta.Utime+delta.Stime), weight)
+		hist.Cutime.RecordValues(int64(delta.Cutime), weight)
+		hist.Cstime.RecordValues(int64(delta.Cstime), weight)
+		hist.Custime.RecordValues(int64(delta.Cutime+delta.Cstime), weight)
 	}
 }
 
@@ -87,10 +90,11 @@ func UpdateTaskStatsHist(histMap TaskStatsHistMap, deltaMap ProcSampleMap) {
 		}
 		hist := histMap[pid]
 		delta := &(deltaSample.Task)
+		weight := deltaSample.weight()
 
-		hist.Cpudelay.RecordValue(int64(delta.Cpudelaytotal))
-		hist.Iowait.RecordValue(int64(delta.Blkiodelaytotal))
-		hist.Swap.RecordValue(int64(delta.Swapindelaytotal))
+		hist.Cpudelay.RecordValues(int64(delta.Cpudelaytotal), weight)
+		hist.Iowait.RecordValues(int64(delta.Blkiodelaytotal), weight)
+		hist.Swap.RecordValues(int64(delta.Swapindelaytotal), weight)
 	}
 }
 
@@ -114,14 +118,19 @@ type SystemStatsHist struct {
 }
 
 func UpdateSysStatsHist(hist *SystemStatsHist, delta *SystemStats) {
-	hist.Usr.RecordValue(int64(delta.Usr))
-	hist.Nice.RecordValue(int64(delta.Nice))
-	hist.Sys.RecordValue(int64(delta.Sys))
-	hist.Idle.RecordValue(int64(delta.Idle))
-	hist.Iowait.RecordValue(int64(delta.Iowait))
-	hist.ProcsTotal.RecordValue(int64(delta.ProcsTotal))
-	hist.ProcsRunning.RecordValue(int64(delta.ProcsRunning))
-	hist.ProcsBlocked.RecordValue(int64(delta.ProcsBlocked))
+	UpdateSysStatsHistWeighted(hist, delta, 1)
+}
+
+// UpdateSysStatsHistWeighted counts delta weight times, for a delta that covers missed samples
+func UpdateSysStatsHistWeighted(hist *SystemStatsHist, delta *SystemStats, weight int64) {
+	hist.Usr.RecordValues(int64(delta.Usr), weight)
+	hist.Nice.RecordValues(int64(delta.Nice), weight)
+	hist.Sys.RecordValues(int64(delta.Sys), weight)
+	hist.Idle.RecordValues(int64(delta.Idle), weight)
+	hist.Iowait.RecordValues(int64(delta.Iowait), weight)
+	hist.ProcsTotal.RecordValues(int64(delta.ProcsTotal), weight)
+	hist.ProcsRunning.RecordValues(int64(delta.ProcsRunning), weight)
+	hist.ProcsBlocked.RecordValues(int64(delta.ProcsBlocked), weight)
 }
 
 func NewSysStatsHist() *SystemStatsHist {
@@ -0,0 +1,188 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// InfluxDB line protocol output, over UDP, HTTP or to a file. The system summary is
+// written to the cpustat_system measurement and each process to cpustat_proc, tagged with
+// its name and pid, all timestamped with the end of the window.
+
+package cpustat
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const influxMaxUDPPacket = 1400
+const influxMaxHTTPBody = 1024 * 1024
+
+type InfluxSink struct {
+	Tags  map[string]string // extra tags for every point
+	batch batcher
+	close func() error
+}
+
+// NewInfluxSink writes to dest, which is a udp://host:port address, an http:// or https://
+// write URL like http://localhost:8086/write?db=cpustat, or a file name to append to.
+// Up to maxBuffered bytes of points are kept for retry when writes fail.
+func NewInfluxSink(dest string, maxBuffered int) (*InfluxSink, error) {
+	s := InfluxSink{}
+	s.batch.maxBuffered = maxBuffered
+
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "udp":
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		s.batch.maxPayload = influxMaxUDPPacket
+		s.batch.send = func(payload []byte) error {
+			_, err := conn.Write(payload)
+			return err
+		}
+		s.close = conn.Close
+	case "http", "https":
+		client := &http.Client{Timeout: 10 * time.Second}
+		s.batch.maxPayload = influxMaxHTTPBody
+		s.batch.send = func(payload []byte) error {
+			return influxPost(client, dest, payload)
+		}
+		s.close = func() error { return nil }
+	case "", "file":
+		path := dest
+		if u.Scheme == "file" {
+			path = u.Path
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		s.batch.maxPayload = influxMaxHTTPBody
+		s.batch.send = func(payload []byte) error {
+			_, err := f.Write(payload)
+			return err
+		}
+		s.close = f.Close
+	default:
+		return nil, fmt.Errorf("unknown influx destination %q, must be udp://, http://, https:// or a file", dest)
+	}
+	return &s, nil
+}
+
+func influxPost(client *http.Client, dest string, payload []byte) error {
+	resp, err := client.Post(dest, "text/plain; charset=utf-8", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("influx write to %s failed: %s %s", dest, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (s *InfluxSink) Write(summary *Summary) error {
+	ts := summary.End.UnixNano()
+
+	sysFields := []Field{
+		{"version", summary.Version},
+		{"window_ms", summary.Window},
+		{"samples", summary.Samples},
+	}
+	sysFields = append(sysFields, Fields(summary.System)...)
+	sysFields = append(sysFields, MetricFields(summary.System.Metrics)...)
+	lines := []string{influxLine("cpustat_system", s.tagSet(nil), sysFields, ts)}
+
+	for _, proc := range summary.Procs {
+		var fields []Field
+		for _, field := range Fields(proc) {
+			switch field.Name {
+			case "pid", "name", "cmdline":
+				continue
+			}
+			fields = append(fields, field)
+		}
+		fields = append(fields, MetricFields(proc.Metrics)...)
+		tags := s.tagSet(map[string]string{"name": proc.Name, "pid": fmt.Sprint(proc.Pid)})
+		lines = append(lines, influxLine("cpustat_proc", tags, fields, ts))
+	}
+	return s.batch.flush(lines)
+}
+
+func (s *InfluxSink) Close() error {
+	return s.close()
+}
+
+// tagSet formats the extra tags plus more, sorted by key like influx prefers
+func (s *InfluxSink) tagSet(more map[string]string) string {
+	var tags []string
+	for k, v := range s.Tags {
+		if _, ok := more[k]; ok == false {
+			tags = append(tags, influxKey(k)+"="+influxKey(v))
+		}
+	}
+	for k, v := range more {
+		if v == "" {
+			continue // influx doesn't allow empty tag values
+		}
+		tags = append(tags, influxKey(k)+"="+influxKey(v))
+	}
+	sort.Strings(tags)
+	if len(tags) == 0 {
+		return ""
+	}
+	return "," + strings.Join(tags, ",")
+}
+
+func influxLine(measurement, tags string, fields []Field, ts int64) string {
+	parts := make([]string, 0, len(fields))
+	for _, field := range fields {
+		name := influxKey(strings.Replace(field.Name, ".", "_", -1))
+		switch val := field.Value.(type) {
+		case string:
+			parts = append(parts, name+`="`+influxStringEscaper.Replace(val)+`"`)
+		case float64:
+			parts = append(parts, name+"="+strconv.FormatFloat(val, 'f', -1, 64))
+		default:
+			parts = append(parts, fmt.Sprintf("%s=%di", name, val))
+		}
+	}
+	return fmt.Sprintf("%s%s %s %d", measurement, tags, strings.Join(parts, ","), ts)
+}
+
+var influxStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+var influxKeyEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", " ")
+
+func influxKey(key string) string {
+	return influxKeyEscaper.Replace(key)
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Adding the sums and histograms of one window into those of a longer one, like the whole
+// run. Counters add up, and gauges like RSS keep the latest value.
+
+package cpustat
+
+// MergeProcSums adds the sums of each process in from into
+func MergeProcSums(into, from ProcSampleMap) {
+	for pid, f := range from {
+		s, ok := into[pid]
+		if ok == false {
+			copied := *f
+			into[pid] = &copied
+			continue
+		}
+		s.Proc.CaptureTime = f.Proc.CaptureTime
+		s.Proc.Utime += f.Proc.Utime
+		s.Proc.Stime += f.Proc.Stime
+		s.Proc.Cutime += f.Proc.Cutime
+		s.Proc.Cstime += f.Proc.Cstime
+		s.Proc.Numthreads = f.Proc.Numthreads
+		s.Proc.Rss = f.Proc.Rss
+		s.Proc.Guesttime += f.Proc.Guesttime
+		s.Proc.Cguesttime += f.Proc.Cguesttime
+
+		s.Task.Capturetime = f.Task.Capturetime
+		s.Task.Cpudelaycount += f.Task.Cpudelaycount
+		s.Task.Cpudelaytotal += f.Task.Cpudelaytotal
+		s.Task.Blkiodelaycount += f.Task.Blkiodelaycount
+		s.Task.Blkiodelaytotal += f.Task.Blkiodelaytotal
+		s.Task.Swapindelaycount += f.Task.Swapindelaycount
+		s.Task.Swapindelaytotal += f.Task.Swapindelaytotal
+		s.Task.Nvcsw += f.Task.Nvcsw
+		s.Task.Nivcsw += f.Task.Nivcsw
+		s.Task.Freepagesdelaycount += f.Task.Freepagesdelaycount
+		s.Task.Freepagesdelaytotal += f.Task.Freepagesdelaytotal
+		s.Task.Readbytes += f.Task.Readbytes
+		s.Task.Writebytes += f.Task.Writebytes
+	}
+}
+
+func MergeProcStatsHists(into, from ProcStatsHistMap) {
+	for pid, f := range from {
+		h, ok := into[pid]
+		if ok == false {
+			h = NewProcStatsHist()
+			into[pid] = h
+		}
+		h.Utime.Merge(f.Utime)
+		h.Stime.Merge(f.Stime)
+		h.Ustime.Merge(f.Ustime)
+		h.Cutime.Merge(f.Cutime)
+		h.Cstime.Merge(f.Cstime)
+		h.Custime.Merge(f.Custime)
+	}
+}
+
+func MergeTaskStatsHists(into, from TaskStatsHistMap) {
+	for pid, f := range from {
+		h, ok := into[pid]
+		if ok == false {
+			h = NewTaskStatsHist()
+			into[pid] = h
+		}
+		h.Cpudelay.Merge(f.Cpudelay)
+		h.Iowait.Merge(f.Iowait)
+		h.Swap.Merge(f.Swap)
+	}
+}
+
+func MergeSysStats(into, from *SystemStats) {
+	into.CaptureTime = from.CaptureTime
+	into.Usr += from.Usr
+	into.Nice += from.Nice
+	into.Sys += from.Sys
+	into.Idle += from.Idle
+	into.Iowait += from.Iowait
+	into.Irq += from.Irq
+	into.Softirq += from.Softirq
+	into.Steal += from.Steal
+	into.Guest += from.Guest
+	into.GuestNice += from.GuestNice
+	into.Ctxt += from.Ctxt
+	into.ProcsTotal += from.ProcsTotal
+	into.ProcsRunning = from.ProcsRunning
+	into.ProcsBlocked = from.ProcsBlocked
+}
+
+func MergeSysStatsHists(into, from *SystemStatsHist) {
+	into.Usr.Merge(from.Usr)
+	into.Nice.Merge(from.Nice)
+	into.Sys.Merge(from.Sys)
+	into.Idle.Merge(from.Idle)
+	into.Iowait.Merge(from.Iowait)
+	into.ProcsTotal.Merge(from.ProcsTotal)
+	into.ProcsRunning.Merge(from.ProcsRunning)
+	into.ProcsBlocked.Merge(from.ProcsBlocked)
+}
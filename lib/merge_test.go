@@ -0,0 +1,89 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMergeWindows(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	procSum := make(ProcSampleMap)
+	procHist := make(ProcStatsHistMap)
+	taskHist := make(TaskStatsHistMap)
+	sysSum := &SystemStats{}
+	sysHist := NewSysStatsHist()
+
+	// two windows of 5 samples, with pid 1 in both and pid 2 only in the second
+	for w := 0; w < 2; w++ {
+		winSum := make(ProcSampleMap)
+		winHist := make(ProcStatsHistMap)
+		winTask := make(TaskStatsHistMap)
+		winSys := &SystemStats{}
+		winSysHist := NewSysStatsHist()
+		for i := 0; i < 5; i++ {
+			now := start.Add(time.Duration(w*5+i+1) * 100 * time.Millisecond)
+			delta := ProcSampleMap{1: &ProcSample{Proc: ProcStats{CaptureTime: now, Utime: uint64(w + 1)},
+				Task: TaskStats{Nvcsw: 1}}}
+			if w == 1 {
+				delta[2] = &ProcSample{Proc: ProcStats{CaptureTime: now, Stime: 3}}
+			}
+			for pid, d := range delta {
+				if _, ok := winSum[pid]; ok == false {
+					winSum[pid] = &ProcSample{}
+				}
+				winSum[pid].Proc.Utime += d.Proc.Utime
+				winSum[pid].Proc.Stime += d.Proc.Stime
+				winSum[pid].Proc.Rss = uint64(10 * (w + 1))
+				winSum[pid].Task.Nvcsw += d.Task.Nvcsw
+			}
+			UpdateProcStatsHist(winHist, delta)
+			UpdateTaskStatsHist(winTask, delta)
+			sysDelta := &SystemStats{CaptureTime: now, Usr: 5, Idle: 5, ProcsRunning: uint64(w + 1)}
+			MergeSysStats(winSys, sysDelta)
+			UpdateSysStatsHist(winSysHist, sysDelta)
+		}
+		MergeProcSums(procSum, winSum)
+		MergeProcStatsHists(procHist, winHist)
+		MergeTaskStatsHists(taskHist, winTask)
+		MergeSysStats(sysSum, winSys)
+		MergeSysStatsHists(sysHist, winSysHist)
+	}
+
+	p := procSum[1]
+	if p.Proc.Utime != 15 || p.Proc.Rss != 20 || p.Task.Nvcsw != 10 || procSum[2].Proc.Stime != 15 {
+		t.Errorf("merged sums %+v and %+v", p, procSum[2])
+	}
+	h := procHist[1]
+	if h.Utime.TotalCount() != 10 || h.Utime.Min() != 1 || h.Utime.Max() != 2 || procHist[2].Stime.TotalCount() != 5 {
+		t.Errorf("merged hist of %d samples from %d to %d", h.Utime.TotalCount(), h.Utime.Min(), h.Utime.Max())
+	}
+	if taskHist[1].Cpudelay.TotalCount() != 10 {
+		t.Errorf("merged task hist of %d samples", taskHist[1].Cpudelay.TotalCount())
+	}
+	if sysSum.Usr != 50 || sysSum.ProcsRunning != 2 || sysSum.CaptureTime != start.Add(time.Second) {
+		t.Errorf("merged sys %+v", sysSum)
+	}
+	if sysHist.Usr.TotalCount() != 10 || sysHist.ProcsRunning.Max() != 2 {
+		t.Errorf("merged sys hist of %d samples", sysHist.Usr.TotalCount())
+	}
+}
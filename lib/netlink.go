@@ -26,12 +26,17 @@ import "C"
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"syscall"
 	"time"
 )
 
+// ErrTaskStatsPermission is returned for every process without the root privileges that
+// taskstats needs
+var ErrTaskStatsPermission = errors.New("no permission to read taskstats, which needs root")
+
 // On older Linux systems, including linux/genetlink.h and taskstats.h doesn't compile.
 // To fix this, we define these three symbols here. Note that they just happen to be
 // sequential, but they are from 3 different enums.
@@ -68,7 +73,7 @@ func readGetTaskstatsMessage(conn *NLConn, task *TaskStats) error {
 	}
 
 	if len(nlmsgs) != 1 {
-		panic(fmt.Sprint("got unexpected response size from get genl taskstats request: ", len(nlmsgs)))
+		return fmt.Errorf("got unexpected response size from get genl taskstats request: %d", len(nlmsgs))
 	}
 
 	if nlmsgs[0].Header.Type == syscall.NLMSG_ERROR {
@@ -76,7 +81,7 @@ func readGetTaskstatsMessage(conn *NLConn, task *TaskStats) error {
 		buf := bytes.NewBuffer(nlmsgs[0].Data)
 		_ = binary.Read(buf, binary.LittleEndian, &errno)
 		if errno == -1 {
-			panic("no permission")
+			return ErrTaskStatsPermission
 		}
 		return fmt.Errorf("Netlink error code %d getting taskstats for %d", errno, nlmsgs[0].Header.Pid)
 	}
@@ -141,8 +146,10 @@ func readGetTaskstatsMessage(conn *NLConn, task *TaskStats) error {
 	offset += 8 // writechar
 	offset += 8 // readsys
 	offset += 8 // writesys
-	offset += 8 // readbytes
-	offset += 8 // writebytes
+	task.Readbytes = endian.Uint64(payload[offset : offset+8])
+	offset += 8
+	task.Writebytes = endian.Uint64(payload[offset : offset+8])
+	offset += 8
 	offset += 8 // cancelled write bytes
 	task.Nvcsw = endian.Uint64(payload[offset : offset+8])
 	offset += 8
@@ -214,7 +221,7 @@ func readGetFamilyMessage(conn *NLConn) (uint16, error) {
 	}
 
 	if len(nlmsgs) != 1 {
-		panic(fmt.Sprint("got unexpected response size from get genl family request: ", len(nlmsgs)))
+		return 0, fmt.Errorf("got unexpected response size from get genl family request: %d", len(nlmsgs))
 	}
 
 	if nlmsgs[0].Header.Type == syscall.NLMSG_ERROR {
@@ -264,16 +271,11 @@ func sendGetFamilyCmdMessage(conn *NLConn) error {
 	return err
 }
 
-func getGenlFamily(conn *NLConn) uint16 {
-	err := sendGetFamilyCmdMessage(conn)
-	if err != nil {
-		panic(err)
-	}
-	gfamily, err := readGetFamilyMessage(conn)
-	if err != nil {
-		panic(err)
+func getGenlFamily(conn *NLConn) (uint16, error) {
+	if err := sendGetFamilyCmdMessage(conn); err != nil {
+		return 0, err
 	}
-	return gfamily
+	return readGetFamilyMessage(conn)
 }
 
 // NLConn holds the context necessary to pass around to external callers
@@ -306,11 +308,10 @@ func (s NLConn) String() string {
 }
 
 // NLInit sets up a new taskstats netlink socket
-// All errors are fatal.
-func NLInit() *NLConn {
+func NLInit() (*NLConn, error) {
 	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM, syscall.NETLINK_GENERIC)
 	if err != nil {
-		panic(os.NewSyscallError("socket", err))
+		return nil, os.NewSyscallError("socket", err)
 	}
 	conn := NLConn{}
 	conn.fd = fd
@@ -322,10 +323,13 @@ func NLInit() *NLConn {
 	conn.readBuf = make([]byte, 4096)
 	err = syscall.Bind(fd, &conn.addr)
 	if err != nil {
-		panic(os.NewSyscallError("bind", err))
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
 	}
 
-	conn.genlFamily = getGenlFamily(&conn)
-
-	return &conn
+	if conn.genlFamily, err = getGenlFamily(&conn); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &conn, nil
 }
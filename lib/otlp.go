@@ -0,0 +1,322 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// OpenTelemetry metrics export over OTLP/HTTP or OTLP/gRPC. The protobuf encoding is done
+// by hand here because it's a small, stable subset of the schema: resources with
+// attributes, gauges and exponential histograms.
+
+package cpustat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OTLPAttribute values can be string, int64 or float64
+type OTLPAttribute struct {
+	Key   string
+	Value interface{}
+}
+
+type OTLPGaugePoint struct {
+	Attributes []OTLPAttribute
+	Time       time.Time
+	Value      float64
+}
+
+type OTLPHistogramPoint struct {
+	Attributes []OTLPAttribute
+	Start      time.Time
+	Time       time.Time
+	Hist       *ExpHistogram
+}
+
+// OTLPMetric has either gauge or histogram points. Histograms are always delta temporality,
+// because each window is independent of the last.
+type OTLPMetric struct {
+	Name        string
+	Description string
+	Unit        string
+	Gauge       []OTLPGaugePoint
+	Histogram   []OTLPHistogramPoint
+}
+
+// OTLPResource is the thing being measured, like a host or a process, and its metrics
+type OTLPResource struct {
+	Attributes []OTLPAttribute
+	Metrics    []OTLPMetric
+}
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// protoBuf appends protobuf fields to a byte slice
+type protoBuf []byte
+
+func (b *protoBuf) varint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	*b = append(*b, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func (b *protoBuf) tag(field, wire int) {
+	b.varint(uint64(field<<3 | wire))
+}
+
+func (b *protoBuf) uint(field int, v uint64) {
+	b.tag(field, wireVarint)
+	b.varint(v)
+}
+
+func (b *protoBuf) sint32(field int, v int32) {
+	b.uint(field, uint64(uint32((v<<1)^(v>>31))))
+}
+
+func (b *protoBuf) fixed64(field int, v uint64) {
+	b.tag(field, wireFixed64)
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	*b = append(*b, tmp[:]...)
+}
+
+func (b *protoBuf) double(field int, v float64) {
+	b.fixed64(field, math.Float64bits(v))
+}
+
+func (b *protoBuf) bytes(field int, v []byte) {
+	b.tag(field, wireBytes)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *protoBuf) string(field int, v string) {
+	b.bytes(field, []byte(v))
+}
+
+// message appends a nested message built by fn
+func (b *protoBuf) message(field int, fn func(m *protoBuf)) {
+	var m protoBuf
+	fn(&m)
+	b.bytes(field, m)
+}
+
+func encodeAttribute(b *protoBuf, field int, attr OTLPAttribute) {
+	b.message(field, func(kv *protoBuf) {
+		kv.string(1, attr.Key)
+		kv.message(2, func(any *protoBuf) {
+			switch val := attr.Value.(type) {
+			case string:
+				any.string(1, val)
+			case int64:
+				any.uint(3, uint64(val))
+			case float64:
+				any.double(4, val)
+			default:
+				any.string(1, fmt.Sprint(val))
+			}
+		})
+	})
+}
+
+func encodeAttributes(b *protoBuf, field int, attrs []OTLPAttribute) {
+	for _, attr := range attrs {
+		encodeAttribute(b, field, attr)
+	}
+}
+
+func timeNanos(t time.Time) uint64 {
+	return uint64(t.UnixNano())
+}
+
+func encodeMetric(b *protoBuf, metric *OTLPMetric) {
+	b.message(2, func(m *protoBuf) {
+		m.string(1, metric.Name)
+		m.string(2, metric.Description)
+		m.string(3, metric.Unit)
+		if len(metric.Histogram) > 0 {
+			m.message(10, func(hist *protoBuf) {
+				for _, point := range metric.Histogram {
+					hist.message(1, func(p *protoBuf) { encodeHistogramPoint(p, &point) })
+				}
+				hist.uint(2, 1) // AGGREGATION_TEMPORALITY_DELTA
+			})
+			return
+		}
+		m.message(5, func(gauge *protoBuf) {
+			for _, point := range metric.Gauge {
+				gauge.message(1, func(p *protoBuf) {
+					encodeAttributes(p, 7, point.Attributes)
+					p.fixed64(3, timeNanos(point.Time))
+					p.double(4, point.Value)
+				})
+			}
+		})
+	})
+}
+
+func encodeHistogramPoint(p *protoBuf, point *OTLPHistogramPoint) {
+	hist := point.Hist
+	encodeAttributes(p, 1, point.Attributes)
+	p.fixed64(2, timeNanos(point.Start))
+	p.fixed64(3, timeNanos(point.Time))
+	p.fixed64(4, hist.Count)
+	p.double(5, hist.Sum)
+	p.sint32(6, hist.Scale)
+	p.fixed64(7, hist.ZeroCount)
+	if offset, counts := hist.Buckets(); len(counts) > 0 {
+		p.message(8, func(buckets *protoBuf) {
+			buckets.sint32(1, offset)
+			buckets.message(2, func(packed *protoBuf) {
+				for _, count := range counts {
+					packed.varint(count)
+				}
+			})
+		})
+	}
+	if hist.Count > 0 {
+		p.double(12, hist.Min)
+		p.double(13, hist.Max)
+	}
+}
+
+// EncodeOTLPMetrics builds an ExportMetricsServiceRequest
+func EncodeOTLPMetrics(resources []OTLPResource, scope, version string) []byte {
+	var b protoBuf
+	for _, resource := range resources {
+		b.message(1, func(rm *protoBuf) {
+			rm.message(1, func(r *protoBuf) { encodeAttributes(r, 1, resource.Attributes) })
+			rm.message(2, func(sm *protoBuf) {
+				sm.message(1, func(s *protoBuf) {
+					s.string(1, scope)
+					s.string(2, version)
+				})
+				for i := range resource.Metrics {
+					encodeMetric(sm, &resource.Metrics[i])
+				}
+			})
+		})
+	}
+	return b
+}
+
+const otlpGRPCPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// OTLPExporter sends metrics to a collector
+type OTLPExporter struct {
+	Endpoint string // host:port
+	GRPC     bool   // OTLP/gRPC, otherwise OTLP/HTTP with protobuf
+	Headers  map[string]string
+	Scope    string // instrumentation scope name and version
+	Version  string
+	client   *http.Client
+}
+
+// NewOTLPExporter sends to endpoint, a host:port of a collector, using protocol grpc or http.
+// Collectors on each node usually aren't using TLS, so neither is this.
+func NewOTLPExporter(endpoint, protocol string) (*OTLPExporter, error) {
+	e := OTLPExporter{Endpoint: endpoint, Scope: "cpustat", Headers: make(map[string]string)}
+	transport := &http.Transport{}
+	switch protocol {
+	case "grpc":
+		e.GRPC = true
+		if err := enableH2C(transport); err != nil {
+			return nil, err
+		}
+	case "http":
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q, must be grpc or http", protocol)
+	}
+	e.client = &http.Client{Transport: transport, Timeout: 10 * time.Second}
+	return &e, nil
+}
+
+func (e *OTLPExporter) Export(resources []OTLPResource) error {
+	msg := EncodeOTLPMetrics(resources, e.Scope, e.Version)
+	if e.GRPC {
+		return e.exportGRPC(msg)
+	}
+	return e.exportHTTP(msg)
+}
+
+func (e *OTLPExporter) exportHTTP(msg []byte) error {
+	req, err := http.NewRequest("POST", "http://"+e.Endpoint+"/v1/metrics", bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP export to %s failed: %s %s", e.Endpoint, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (e *OTLPExporter) exportGRPC(msg []byte) error {
+	// a gRPC message is a compressed flag byte and a big endian length, then the protobuf
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	req, err := http.NewRequest("POST", "http://"+e.Endpoint+otlpGRPCPath, bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body) // trailers are only available after the body is read
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OTLP export to %s failed: %s", e.Endpoint, resp.Status)
+	}
+	// errors with no response message come back in the headers instead of trailers
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		return fmt.Errorf("OTLP export to %s failed: grpc status %s %s", e.Endpoint, status, message)
+	}
+	return nil
+}
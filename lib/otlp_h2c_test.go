@@ -0,0 +1,84 @@
+//go:build go1.24
+// +build go1.24
+
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// The OTLP/gRPC tests need an HTTP/2 server without TLS, which net/http has since Go 1.24.
+
+package cpustat
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// grpcReceiver is an OTLP/gRPC receiver that answers with status
+func grpcReceiver(t *testing.T, status string, got *[]byte) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != otlpGRPCPath || r.Header.Get("Content-Type") != "application/grpc" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+			t.Error("bad grpc frame")
+		}
+		*got = body[5:]
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write([]byte{0, 0, 0, 0, 0}) // empty ExportMetricsServiceResponse
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", status)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "status "+status)
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	return server
+}
+
+func TestOTLPExportGRPC(t *testing.T) {
+	var got []byte
+	server := grpcReceiver(t, "0", &got)
+	defer server.Close()
+
+	exporter, err := NewOTLPExporter(strings.TrimPrefix(server.URL, "http://"), "grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = exporter.Export(otlpFixture()); err != nil {
+		t.Fatal(err)
+	}
+	checkOTLPRequest(t, got)
+}
+
+func TestOTLPExportGRPCError(t *testing.T) {
+	var got []byte
+	server := grpcReceiver(t, "14", &got)
+	defer server.Close()
+
+	exporter, _ := NewOTLPExporter(strings.TrimPrefix(server.URL, "http://"), "grpc")
+	if err := exporter.Export(otlpFixture()); err == nil || strings.Contains(err.Error(), "status 14") == false {
+		t.Error("non-zero grpc status should be an error, got", err)
+	}
+}
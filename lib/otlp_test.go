@@ -0,0 +1,197 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// protoMsg is a decoded protobuf message, with each field's values in order. Varint and
+// fixed64 values are in num, length delimited ones in raw.
+type protoVal struct {
+	num uint64
+	raw []byte
+}
+type protoMsg map[int][]protoVal
+
+func decodeProto(t *testing.T, b []byte) protoMsg {
+	msg := make(protoMsg)
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+		field, wire := int(key>>3), int(key&7)
+		var val protoVal
+		switch wire {
+		case wireVarint:
+			val.num, n = binary.Uvarint(b)
+			b = b[n:]
+		case wireFixed64:
+			val.num = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			val.raw = b[n : n+int(size)]
+			b = b[n+int(size):]
+		default:
+			t.Fatal("unexpected wire type", wire)
+		}
+		msg[field] = append(msg[field], val)
+	}
+	return msg
+}
+
+func (m protoMsg) msg(t *testing.T, field int) protoMsg {
+	if len(m[field]) == 0 {
+		t.Fatal("missing field", field)
+	}
+	return decodeProto(t, m[field][0].raw)
+}
+
+func (m protoMsg) str(field int) string {
+	if len(m[field]) == 0 {
+		return ""
+	}
+	return string(m[field][0].raw)
+}
+
+// attrs decodes repeated KeyValues with string, int or double values
+func (m protoMsg) attrs(t *testing.T, field int) map[string]interface{} {
+	ret := make(map[string]interface{})
+	for _, kv := range m[field] {
+		pair := decodeProto(t, kv.raw)
+		any := pair.msg(t, 2)
+		switch {
+		case len(any[1]) > 0:
+			ret[pair.str(1)] = any.str(1)
+		case len(any[3]) > 0:
+			ret[pair.str(1)] = int64(any[3][0].num)
+		case len(any[4]) > 0:
+			ret[pair.str(1)] = math.Float64frombits(any[4][0].num)
+		}
+	}
+	return ret
+}
+
+func otlpFixture() []OTLPResource {
+	now := time.Unix(1500000000, 0)
+	hist := NewExpHistogram(3)
+	for _, val := range []float64{0, 12.5, 50, 100} {
+		hist.Record(val)
+	}
+	return []OTLPResource{{
+		Attributes: []OTLPAttribute{{"host.name", "web01"}, {"process.pid", int64(42)}},
+		Metrics: []OTLPMetric{
+			{Name: "cpustat.process.cpu", Unit: "%", Histogram: []OTLPHistogramPoint{
+				{Start: now.Add(-10 * time.Second), Time: now, Hist: hist},
+			}},
+			{Name: "cpustat.process.memory.rss", Unit: "By", Gauge: []OTLPGaugePoint{
+				{Attributes: []OTLPAttribute{{"state", "resident"}}, Time: now, Value: 4096},
+			}},
+		},
+	}}
+}
+
+// checkOTLPRequest decodes an ExportMetricsServiceRequest built from otlpFixture
+func checkOTLPRequest(t *testing.T, body []byte) {
+	req := decodeProto(t, body)
+	rm := req.msg(t, 1)
+	attrs := rm.msg(t, 1).attrs(t, 1)
+	if attrs["host.name"] != "web01" || attrs["process.pid"] != int64(42) {
+		t.Error("bad resource attributes", attrs)
+	}
+	sm := rm.msg(t, 2)
+	if scope := sm.msg(t, 1); scope.str(1) != "cpustat" {
+		t.Error("bad scope", scope.str(1))
+	}
+	if len(sm[2]) != 2 {
+		t.Fatal("expected 2 metrics, got", len(sm[2]))
+	}
+
+	hist := decodeProto(t, sm[2][0].raw)
+	if hist.str(1) != "cpustat.process.cpu" || hist.str(3) != "%" {
+		t.Error("bad histogram metric", hist.str(1), hist.str(3))
+	}
+	expHist := hist.msg(t, 10)
+	if expHist[2][0].num != 1 {
+		t.Error("histograms should be delta temporality")
+	}
+	point := expHist.msg(t, 1)
+	if point[3][0].num != 1500000000*1e9 || point[2][0].num != 1499999990*1e9 {
+		t.Error("bad histogram times", point[2][0].num, point[3][0].num)
+	}
+	if point[4][0].num != 4 || point[7][0].num != 1 || point[6][0].num != 6 { // scale 3 zigzag encoded
+		t.Error("bad count, zero count or scale", point[4][0].num, point[7][0].num, point[6][0].num)
+	}
+	if math.Float64frombits(point[5][0].num) != 162.5 || math.Float64frombits(point[13][0].num) != 100 {
+		t.Error("bad sum or max")
+	}
+	buckets := point.msg(t, 8)
+	var total uint64
+	counts := buckets[2][0].raw
+	for len(counts) > 0 {
+		count, n := binary.Uvarint(counts)
+		total += count
+		counts = counts[n:]
+	}
+	if total != 3 {
+		t.Error("positive buckets should hold 3 values, have", total)
+	}
+
+	gauge := decodeProto(t, sm[2][1].raw)
+	gp := gauge.msg(t, 5).msg(t, 1)
+	if math.Float64frombits(gp[4][0].num) != 4096 || gp.attrs(t, 7)["state"] != "resident" {
+		t.Error("bad gauge point")
+	}
+}
+
+func TestOTLPExportHTTP(t *testing.T) {
+	var got []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		got, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	exporter, err := NewOTLPExporter(strings.TrimPrefix(server.URL, "http://"), "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = exporter.Export(otlpFixture()); err != nil {
+		t.Fatal(err)
+	}
+	checkOTLPRequest(t, got)
+}
+
+func TestNewOTLPExporterBadProtocol(t *testing.T) {
+	if _, err := NewOTLPExporter("localhost:4317", "thrift"); err == nil {
+		t.Error("unknown protocol should be an error")
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// What sampling costs, measured by cpustat itself, so its overhead can be watched like any
+// other process's.
+
+package cpustat
+
+import (
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/codahale/hdrhistogram"
+)
+
+// Overhead follows how long each collection cycle takes. The rest of OverheadStats is read
+// from the process when asked for.
+type Overhead struct {
+	lock   sync.Mutex
+	cycles int64
+	total  time.Duration
+	cycle  *hdrhistogram.Histogram // µs
+}
+
+// OverheadStats is cpustat's own usage since it started
+type OverheadStats struct {
+	Cycles     int64
+	CycleTime  time.Duration           // spent collecting in all cycles
+	Cycle      *hdrhistogram.Histogram // µs each cycle took
+	CPU        time.Duration           // usr+sys of the whole process
+	AllocBytes uint64
+	Mallocs    uint64
+	MaxRSS     uint64 // bytes
+}
+
+func NewOverhead() *Overhead {
+	return &Overhead{cycle: hdrhistogram.New(histMin, histMax, histSigFigs)}
+}
+
+// Cycle counts a collection that started at start and just ended
+func (o *Overhead) Cycle(start time.Time) {
+	took := time.Since(start)
+	o.lock.Lock()
+	o.cycles++
+	o.total += took
+	o.cycle.RecordValue(int64(took / time.Microsecond))
+	o.lock.Unlock()
+}
+
+// Stats reads the usage of the process. It briefly stops the world to count allocations.
+func (o *Overhead) Stats() (OverheadStats, error) {
+	var stats OverheadStats
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return stats, err
+	}
+	stats.CPU = time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+	stats.MaxRSS = uint64(usage.Maxrss) * 1024
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats.AllocBytes, stats.Mallocs = mem.TotalAlloc, mem.Mallocs
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	stats.Cycles, stats.CycleTime = o.cycles, o.total
+	stats.Cycle = hdrhistogram.New(histMin, histMax, histSigFigs)
+	stats.Cycle.Merge(o.cycle)
+	return stats, nil
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOverhead(t *testing.T) {
+	o := NewOverhead()
+	o.Cycle(time.Now().Add(-2 * time.Millisecond))
+	o.Cycle(time.Now().Add(-4 * time.Millisecond))
+
+	stats, err := o.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Cycles != 2 || stats.Cycle.TotalCount() != 2 {
+		t.Errorf("counted %d cycles, want 2", stats.Cycles)
+	}
+	if stats.CycleTime < 6*time.Millisecond || stats.Cycle.Max() < 4000 {
+		t.Errorf("cycles took %s, max %dµs, want at least 6ms and 4000µs", stats.CycleTime, stats.Cycle.Max())
+	}
+	if stats.CPU <= 0 || stats.AllocBytes == 0 || stats.MaxRSS == 0 {
+		t.Errorf("got cpu %s, %d bytes allocated and %d rss, want them all over 0",
+			stats.CPU, stats.AllocBytes, stats.MaxRSS)
+	}
+}
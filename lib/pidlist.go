@@ -21,7 +21,6 @@
 package cpustat
 
 import (
-	"fmt"
 	"log"
 	"os"
 	"strconv"
@@ -47,7 +46,7 @@ func GetPidList(list *Pidlist, maxProcsToScan int) {
 		log.Fatal("pidlist Readdirnames: ", err)
 	}
 	if len(procNames) > maxProcsToScan-1 {
-		fmt.Println("proc table truncated because more than", maxProcsToScan, "procs found")
+		log.Println("proc table truncated because more than", maxProcsToScan, "procs found")
 	}
 	procDir.Close()
 
@@ -0,0 +1,54 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Pressure stall information, from /proc/pressure, which says how much of the time runnable
+// tasks were waiting for a CPU. It needs Linux 4.20 or later with PSI turned on.
+
+package cpustat
+
+import (
+	"errors"
+	"strings"
+)
+
+// CPUPressure returns the total µs that some runnable task was waiting for a CPU
+func CPUPressure() (uint64, error) {
+	lines, err := ReadFileLines("/proc/pressure/cpu")
+	if err != nil {
+		return 0, err
+	}
+	return pressureTotal(lines)
+}
+
+// pressureTotal finds total= on the some line
+func pressureTotal(lines []string) (uint64, error) {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "some" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, "total=") {
+				return ReadUInt(strings.TrimPrefix(field, "total=")), nil
+			}
+		}
+	}
+	return 0, errors.New("no some total in pressure file")
+}
@@ -24,14 +24,28 @@ package cpustat
 
 import (
 	"fmt"
+	"math"
+	"os"
 	"strings"
 	"time"
 )
 
+// PageSize is the bytes in a page, which ProcStats.Rss counts
+var PageSize = uint64(os.Getpagesize())
+
 type ProcSample struct {
-	Pid  int
-	Proc ProcStats
-	Task TaskStats
+	Pid    int
+	Proc   ProcStats
+	Task   TaskStats
+	Weight int64     // in a delta, the number of intervals it covers, if more than 1
+	Values []float64 // from collectors other than the built in ones, in the order of Metrics.Proc
+}
+
+func (s *ProcSample) weight() int64 {
+	if s.Weight > 1 {
+		return s.Weight
+	}
+	return 1
 }
 
 type ProcSampleList struct {
@@ -158,6 +172,13 @@ func ProcStatsReader(pids Pidlist, filter Filters, cur *ProcSampleList, infoMap
 		// this format of this file is insane because comm can have split chars in it
 		parts := procPidStatSplit(lines[0])
 
+		// a process that called exec is a new program, like a shell a build started
+		if newPid == false && info.Comm != strings.Map(StripSpecial, parts[1]) {
+			newPid = true
+			info = &ProcInfo{}
+			info.init()
+		}
+
 		if newPid {
 			info.Comm = strings.Map(StripSpecial, parts[1])
 			info.Pid = uint64(pid)
@@ -172,6 +193,7 @@ func ProcStatsReader(pids Pidlist, filter Filters, cur *ProcSampleList, infoMap
 			info.Rtpriority = ReadUInt(parts[39])
 			info.Policy = ReadUInt(parts[40])
 			info.updateCmdline() // note that this may leave UID at 0 if there's an error
+			info.Cgroup = ReadCgroup(pid)
 			infoMap[pid] = info
 		}
 
@@ -214,15 +236,22 @@ func ProcStatsRecord(interval uint32, curList, prevList ProcSampleList, sumMap,
 			prev := &(prevList.Samples[prevPos].Proc)
 			pid := curList.Samples[curPos].Pid
 
+			// a process in the slow tier that wasn't read this time has nothing new
+			if cur.CaptureTime.Equal(prev.CaptureTime) {
+				curPos++
+				prevPos++
+				continue
+			}
+
 			if _, ok := sumMap[pid]; ok == false {
 				sumMap[pid] = &ProcSample{}
 			}
-			deltaMap[pid] = &ProcSample{}
+			duration := float64(cur.CaptureTime.Sub(prev.CaptureTime) / time.Millisecond)
+			scale := float64(interval) / duration
+			deltaMap[pid] = &ProcSample{Weight: int64(math.Round(duration / float64(interval)))}
 			delta := &(deltaMap[pid].Proc)
 
 			delta.CaptureTime = cur.CaptureTime
-			duration := float64(cur.CaptureTime.Sub(prev.CaptureTime) / time.Millisecond)
-			scale := float64(interval) / duration
 
 			sum := &(sumMap[pid].Proc)
 			sum.CaptureTime = cur.CaptureTime
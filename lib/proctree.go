@@ -0,0 +1,204 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Following one command and everything it starts, for wrapping a command like a build. A
+// process is in the tree if its parent was when we first saw it, so children are picked up
+// as they fork, and stay in even if they are reparented later.
+
+package cpustat
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ProcTree is a root process and its descendants
+type ProcTree struct {
+	root    int
+	members map[int]bool // every pid in the last list, and whether it's in the tree
+	ppid    func(pid int) (int, error)
+}
+
+func NewProcTree(root int) *ProcTree {
+	return &ProcTree{root: root, members: make(map[int]bool), ppid: readPpid}
+}
+
+func readPpid(pid int) (int, error) {
+	lines, err := ReadFileLines(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	return int(ReadUInt(procPidStatSplit(lines[0])[3])), nil
+}
+
+// Filter keeps the pids in the tree, in the same order
+func (t *ProcTree) Filter(pids Pidlist) Pidlist {
+	// parents are usually older than their children, but pids wrap, so look up every new
+	// pid before deciding which ones are in
+	parents := make(map[int]int)
+	for _, pid := range pids {
+		if _, ok := t.members[pid]; ok == false {
+			if ppid, err := t.ppid(pid); err == nil {
+				parents[pid] = ppid
+			}
+		}
+	}
+
+	var inTree func(pid int, depth int) bool
+	inTree = func(pid int, depth int) bool {
+		if pid == t.root {
+			return true
+		}
+		if member, ok := t.members[pid]; ok {
+			return member
+		}
+		ppid, ok := parents[pid]
+		if ok == false || depth > len(parents) {
+			return false
+		}
+		member := inTree(ppid, depth+1)
+		t.members[pid] = member
+		return member
+	}
+
+	seen := make(map[int]bool, len(pids))
+	kept := pids[:0]
+	for _, pid := range pids {
+		seen[pid] = true
+		if inTree(pid, 0) {
+			kept = append(kept, pid)
+		}
+	}
+	// a pid that went away could be reused by anything
+	for pid := range t.members {
+		if seen[pid] == false {
+			delete(t.members, pid)
+		}
+	}
+	return kept
+}
+
+// TreeProc is the total of one process over a whole run
+type TreeProc struct {
+	Pid     int
+	Name    string
+	Usr     float64 // seconds of CPU
+	Sys     float64
+	Runq    float64 // seconds waiting for a CPU
+	Iowait  float64 // seconds waiting for storage
+	PeakRSS uint64  // bytes
+	Samples int
+	ticks   [2]uint64 // usr and sys
+	delay   [2]uint64 // runq and iowait ns
+}
+
+// TreeStats adds up a process tree over a whole run. The histograms in Tree are of the
+// whole tree in each sample, in the units of GroupStats.
+type TreeStats struct {
+	Start, End  time.Time
+	Samples     int
+	Tree        *GroupStats
+	PeakRSS     uint64 // bytes, of all processes at once
+	PeakRSSTime time.Time
+	PeakThreads uint64
+	PeakProcs   int
+	Procs       map[int]*TreeProc
+	jiffy       int
+	interval    int
+}
+
+func NewTreeStats(jiffy, interval int) *TreeStats {
+	return &TreeStats{Tree: NewGroupStats(), Procs: make(map[int]*TreeProc), jiffy: jiffy, interval: interval}
+}
+
+// Add counts one sample. procSum is what changed in the sample without scaling it to one
+// interval, like Snapshot.ProcTotals, so the totals are right for deltas that cover more
+// than one. It also has the current RSS and thread count.
+func (t *TreeStats) Add(procDelta, procSum ProcSampleMap, infoMap ProcInfoMap, now time.Time) {
+	if t.Samples == 0 {
+		t.Start = now.Add(-time.Duration(t.interval) * time.Millisecond)
+	}
+	t.End = now
+	t.Samples++
+	UpdateGroupStats(GroupStatsMap{"tree": t.Tree}, func(int, *ProcInfo) string { return "tree" },
+		procDelta, procSum, infoMap, t.jiffy, t.interval)
+
+	var rss, threads uint64
+	for pid, delta := range procDelta {
+		p, ok := t.Procs[pid]
+		if ok == false {
+			p = &TreeProc{Pid: pid}
+			t.Procs[pid] = p
+		}
+		if info, ok := infoMap[pid]; ok {
+			p.Name = info.Friendly
+		}
+		p.Samples += int(delta.weight())
+		if sum, ok := procSum[pid]; ok {
+			p.ticks[0] += sum.Proc.Utime
+			p.ticks[1] += sum.Proc.Stime
+			p.delay[0] += sum.Task.Cpudelaytotal
+			p.delay[1] += sum.Task.Blkiodelaytotal
+			p.Usr = float64(p.ticks[0]) / float64(t.jiffy)
+			p.Sys = float64(p.ticks[1]) / float64(t.jiffy)
+			p.Runq = float64(p.delay[0]) / 1e9
+			p.Iowait = float64(p.delay[1]) / 1e9
+			if sum.Proc.Rss*PageSize > p.PeakRSS {
+				p.PeakRSS = sum.Proc.Rss * PageSize
+			}
+			rss += sum.Proc.Rss * PageSize
+			threads += sum.Proc.Numthreads
+		}
+	}
+	if rss > t.PeakRSS {
+		t.PeakRSS, t.PeakRSSTime = rss, now
+	}
+	if threads > t.PeakThreads {
+		t.PeakThreads = threads
+	}
+	if len(procDelta) > t.PeakProcs {
+		t.PeakProcs = len(procDelta)
+	}
+}
+
+// Top returns the n processes that used the most CPU
+func (t *TreeStats) Top(n int) []*TreeProc {
+	list := make([]*TreeProc, 0, len(t.Procs))
+	for _, p := range t.Procs {
+		list = append(list, p)
+	}
+	sort.Sort(byTreeCPU(list))
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+type byTreeCPU []*TreeProc
+
+func (b byTreeCPU) Len() int      { return len(b) }
+func (b byTreeCPU) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byTreeCPU) Less(i, j int) bool {
+	if b[i].Usr+b[i].Sys != b[j].Usr+b[j].Sys {
+		return b[i].Usr+b[i].Sys > b[j].Usr+b[j].Sys
+	}
+	return b[i].Pid < b[j].Pid
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProcTreeFilter(t *testing.T) {
+	parents := map[int]int{1: 0, 50: 1, 100: 50, 101: 100, 102: 1, 103: 101, 20: 103}
+	tree := NewProcTree(100)
+	tree.ppid = func(pid int) (int, error) {
+		ppid, ok := parents[pid]
+		if ok == false {
+			return 0, errors.New("no such process")
+		}
+		return ppid, nil
+	}
+
+	// 20 is a grandchild of 100 that got a wrapped pid, and 104 exited before we looked
+	kept := tree.Filter(Pidlist{1, 20, 50, 100, 101, 102, 103, 104})
+	if reflect.DeepEqual(kept, Pidlist{20, 100, 101, 103}) == false {
+		t.Errorf("kept %v, want 20, 100, 101 and 103", kept)
+	}
+
+	// 101 exits and 103 is reparented to init, but stays in the tree
+	parents[103] = 1
+	delete(parents, 101)
+	parents[105] = 103
+	kept = tree.Filter(Pidlist{1, 20, 50, 100, 102, 103, 105})
+	if reflect.DeepEqual(kept, Pidlist{20, 100, 103, 105}) == false {
+		t.Errorf("kept %v after a reparent, want 20, 100, 103 and 105", kept)
+	}
+
+	// 101 is reused by something else
+	parents[101] = 1
+	kept = tree.Filter(Pidlist{1, 100, 101})
+	if reflect.DeepEqual(kept, Pidlist{100}) == false {
+		t.Errorf("kept %v after pid reuse, want 100", kept)
+	}
+}
+
+func TestTreeStats(t *testing.T) {
+	stats := NewTreeStats(100, 100)
+	infoMap := ProcInfoMap{1: &ProcInfo{Friendly: "make"}, 2: &ProcInfo{Friendly: "cc"}}
+	start := time.Unix(1500000000, 0)
+	for i := 0; i < 10; i++ {
+		procDelta := ProcSampleMap{
+			1: &ProcSample{Proc: ProcStats{Utime: 1}},
+			2: &ProcSample{Proc: ProcStats{Utime: 5, Stime: 2}, Task: TaskStats{Cpudelaytotal: 10000000}},
+		}
+		procSum := ProcSampleMap{
+			1: &ProcSample{Proc: ProcStats{Utime: 1, Rss: 10, Numthreads: 1}},
+			2: &ProcSample{Proc: ProcStats{Utime: 5, Stime: 2, Rss: uint64(100 + i), Numthreads: 4},
+				Task: TaskStats{Cpudelaytotal: 10000000}},
+		}
+		stats.Add(procDelta, procSum, infoMap, start.Add(time.Duration(i+1)*100*time.Millisecond))
+	}
+
+	if stats.Samples != 10 || stats.End.Sub(stats.Start) != time.Second {
+		t.Errorf("%d samples over %s, want 10 over 1s", stats.Samples, stats.End.Sub(stats.Start))
+	}
+	if stats.PeakRSS != 119*PageSize || stats.PeakThreads != 5 || stats.PeakProcs != 2 {
+		t.Errorf("peaks %d bytes, %d threads and %d procs", stats.PeakRSS, stats.PeakThreads, stats.PeakProcs)
+	}
+	if avg := stats.Tree.CPU.Mean(); avg < 7900 || avg > 8100 {
+		t.Errorf("tree cpu averaged %v, want 80%%", avg)
+	}
+
+	top := stats.Top(1)
+	if len(top) != 1 || top[0].Name != "cc" {
+		t.Fatalf("top %v, want cc", top)
+	}
+	if top[0].Usr != 0.5 || top[0].Sys != 0.2 || top[0].Runq != 0.1 {
+		t.Errorf("cc used %+v, want 0.5s usr, 0.2s sys and 0.1s runq", top[0])
+	}
+}
+
+func TestTreeStatsWeighted(t *testing.T) {
+	stats := NewTreeStats(100, 100)
+	infoMap := ProcInfoMap{1: &ProcInfo{Friendly: "make"}}
+	now := time.Unix(1500000000, 0)
+	// one interval, then a delta over 3 intervals that was scaled down to one
+	stats.Add(ProcSampleMap{1: &ProcSample{Proc: ProcStats{Utime: 10}}},
+		ProcSampleMap{1: &ProcSample{Proc: ProcStats{Utime: 10}}}, infoMap, now)
+	stats.Add(ProcSampleMap{1: &ProcSample{Weight: 3, Proc: ProcStats{Utime: 10},
+		Task: TaskStats{Cpudelaytotal: 1e8}}},
+		ProcSampleMap{1: &ProcSample{Proc: ProcStats{Utime: 30}, Task: TaskStats{Cpudelaytotal: 3e8}}},
+		infoMap, now.Add(400*time.Millisecond))
+
+	p := stats.Procs[1]
+	if p.Samples != 4 {
+		t.Errorf("%d samples, want 4 intervals", p.Samples)
+	}
+	if p.Usr != 0.4 || math.Abs(p.Runq-0.3) > 1e-9 {
+		t.Errorf("used %+v, want 0.4s usr and 0.3s runq", p)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// When the machine is saturated, cpustat's own sampling is starved along with everything
+// else, so the worst moments get the worst data. These keep the sampling going: a better
+// priority for the thread that samples, a cgroup with a bigger share of the CPU, and memory
+// that can't be swapped out.
+
+package cpustat
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// Protection is how to protect the sampling, where the zero value of each field leaves it alone
+type Protection struct {
+	Nice      int    // nice level of the sampling thread, negative is a higher priority
+	RTPrio    int    // SCHED_FIFO priority of the sampling thread, 1 to 99
+	Cgroup    string // cgroup to move the process to, created if needed, under /sys/fs/cgroup if relative
+	CPUWeight int    // cpu.weight of Cgroup, 1 to 10000 where 100 is the default
+	Mlock     bool   // lock memory in RAM as it is used
+}
+
+const (
+	mclCurrent = 1
+	mclFuture  = 2
+	mclOnfault = 4 // Linux 4.4, lock pages as they are touched instead of all at once
+	schedFifo  = 1
+)
+
+// Protect applies p. The priorities only apply to the calling thread, which it locks to the
+// calling goroutine, so that should be the one that samples.
+func Protect(p Protection) error {
+	if p.Cgroup != "" {
+		if err := joinCgroup(p.Cgroup, p.CPUWeight); err != nil {
+			return err
+		}
+	} else if p.CPUWeight != 0 {
+		return errors.New("a CPU weight needs a cgroup")
+	}
+
+	if p.Mlock {
+		// the buffers are allocated up front and mostly never touched, so locking them all
+		// at once could use far more memory than sampling ever will
+		if err := syscall.Mlockall(mclCurrent | mclFuture | mclOnfault); err != nil {
+			return fmt.Errorf("mlock: %s", err)
+		}
+	}
+
+	if p.Nice == 0 && p.RTPrio == 0 {
+		return nil
+	}
+	runtime.LockOSThread()
+	if p.Nice != 0 {
+		// on Linux, this is just the calling thread
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, p.Nice); err != nil {
+			return fmt.Errorf("setting nice to %d: %s", p.Nice, err)
+		}
+	}
+	if p.RTPrio != 0 {
+		param := struct{ priority int32 }{int32(p.RTPrio)}
+		_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETSCHEDULER, 0, schedFifo, uintptr(unsafe.Pointer(&param)))
+		if errno != 0 {
+			return fmt.Errorf("setting SCHED_FIFO priority %d: %s", p.RTPrio, errno)
+		}
+	}
+	return nil
+}
+
+// joinCgroup moves the process to a cgroup, with cgroup v2 if it is mounted, or else the v1
+// cpu controller, where weight is converted to cpu.shares
+func joinCgroup(name string, weight int) error {
+	root := "/sys/fs/cgroup"
+	v2 := true
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		root = filepath.Join(root, "cpu")
+		v2 = false
+	}
+	dir := name
+	if filepath.IsAbs(dir) == false {
+		dir = filepath.Join(root, name)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if weight != 0 {
+		file, value := "cpu.weight", weight
+		if v2 == false {
+			file, value = "cpu.shares", weight*1024/100
+		}
+		err := ioutil.WriteFile(filepath.Join(dir, file), []byte(strconv.Itoa(value)), 0644)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s has no %s, is the cpu controller enabled for it?", dir, file)
+		} else if err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644)
+}
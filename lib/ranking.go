@@ -0,0 +1,204 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Ranking of processes for the top N list. Each sort key is a single metric in a single
+// unit, so the order is predictable. Ties go to the higher average CPU, then the lower pid.
+
+package cpustat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SortKey selects the metric that processes are ranked by
+type SortKey int
+
+const (
+	SortCPUMax  SortKey = iota // highest usr+sys sample, percent of a CPU
+	SortCPUAvg                 // average usr+sys over the window, percent of a CPU
+	SortCPUP95                 // 95th percentile usr+sys sample, percent of a CPU
+	SortRunq                   // average time runnable but waiting for a CPU, percent of a CPU
+	SortIowait                 // average time blocked on disk IO, percent of a CPU
+	SortSwap                   // average time waiting for swap in, percent of a CPU
+	SortRSS                    // resident memory at the end of the window, bytes
+	SortCtxsw                  // voluntary plus involuntary context switches per second
+	SortIOBytes                // storage bytes read plus written per second
+	NumSortKeys
+)
+
+var sortKeyNames = [NumSortKeys]string{"cpumax", "cpuavg", "cpup95", "runq", "iowait", "swap", "rss", "ctxsw", "io"}
+var sortKeyUnits = [NumSortKeys]string{"%cpu", "%cpu", "%cpu", "%cpu", "%cpu", "%cpu", "bytes", "switches/s", "bytes/s"}
+
+func (k SortKey) String() string {
+	if k < 0 || k >= NumSortKeys {
+		return fmt.Sprintf("SortKey(%d)", int(k))
+	}
+	return sortKeyNames[k]
+}
+
+// Unit is the unit that scores for this key are in
+func (k SortKey) Unit() string {
+	if k < 0 || k >= NumSortKeys {
+		return ""
+	}
+	return sortKeyUnits[k]
+}
+
+// ParseSortKey converts a name like "cpumax" or "runq" into a SortKey
+func ParseSortKey(s string) (SortKey, error) {
+	for k, name := range sortKeyNames {
+		if s == name {
+			return SortKey(k), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sort key %q, must be one of %s", s, strings.Join(sortKeyNames[:], ","))
+}
+
+// Ranker orders processes by one SortKey. If Alpha is between 0 and 1, scores are smoothed
+// across windows with an exponentially weighted moving average so the top list doesn't
+// flicker, with Alpha being the weight of the newest window.
+type Ranker struct {
+	Key      SortKey
+	Alpha    float64
+	Jiffy    int // clock ticks per second
+	Interval int // sampling interval in ms
+	scores   map[int]float64
+}
+
+func NewRanker(key SortKey, alpha float64, jiffy, interval int) *Ranker {
+	return &Ranker{key, alpha, jiffy, interval, make(map[int]float64)}
+}
+
+// SetKey changes the sort key. Smoothed scores are in the old key's units, so they are dropped.
+func (r *Ranker) SetKey(key SortKey) {
+	r.Key = key
+	r.scores = make(map[int]float64)
+}
+
+func (r *Ranker) smoothing() bool {
+	return r.Alpha > 0 && r.Alpha < 1
+}
+
+// Score computes the unsmoothed score of one process over a window for key.
+// sum may be nil if we didn't get that data for this process.
+func (r *Ranker) Score(key SortKey, proc *ProcStatsHist, sum *ProcSample) float64 {
+	count := proc.Ustime.TotalCount()
+	if count == 0 {
+		return 0
+	}
+	tickPct := TicksPct(1, r.Jiffy, float64(r.Interval))
+	windowSec := float64(r.Interval) * float64(count) / 1000
+	nsPct := func(ns uint64) float64 {
+		return NsPct(float64(ns), windowSec*1000)
+	}
+
+	switch key {
+	case SortCPUMax:
+		return float64(proc.Ustime.Max()) * tickPct
+	case SortCPUAvg:
+		return proc.Ustime.Mean() * tickPct
+	case SortCPUP95:
+		return float64(proc.Ustime.ValueAtQuantile(95)) * tickPct
+	}
+
+	if sum == nil {
+		return 0
+	}
+	switch key {
+	case SortRunq:
+		return nsPct(sum.Task.Cpudelaytotal)
+	case SortIowait:
+		return nsPct(sum.Task.Blkiodelaytotal)
+	case SortSwap:
+		return nsPct(sum.Task.Swapindelaytotal)
+	case SortRSS:
+		return float64(sum.Proc.Rss * PageSize)
+	case SortCtxsw:
+		return float64(sum.Task.Nvcsw+sum.Task.Nivcsw) / windowSec
+	case SortIOBytes:
+		return float64(sum.Task.Readbytes+sum.Task.Writebytes) / windowSec
+	}
+	return 0
+}
+
+type rankEntry struct {
+	pid      int
+	score    float64
+	tiebreak float64
+}
+
+// byScore sorts by score, then tiebreak, both descending, then by pid
+type byScore []rankEntry
+
+func (m byScore) Len() int {
+	return len(m)
+}
+func (m byScore) Swap(i, j int) {
+	m[i], m[j] = m[j], m[i]
+}
+func (m byScore) Less(i, j int) bool {
+	if m[i].score != m[j].score {
+		return m[i].score > m[j].score
+	}
+	if m[i].tiebreak != m[j].tiebreak {
+		return m[i].tiebreak > m[j].tiebreak
+	}
+	return m[i].pid < m[j].pid
+}
+
+// Rank returns up to limit pids from procHist, best first
+func (r *Ranker) Rank(procHist ProcStatsHistMap, procSum ProcSampleMap, limit int) Pidlist {
+	tiebreakKey := SortCPUAvg
+	if r.Key == SortCPUAvg {
+		tiebreakKey = SortCPUMax
+	}
+
+	list := make([]rankEntry, 0, len(procHist))
+	for pid, hist := range procHist {
+		score := r.Score(r.Key, hist, procSum[pid])
+		if r.smoothing() {
+			if prev, ok := r.scores[pid]; ok {
+				score = r.Alpha*score + (1-r.Alpha)*prev
+			}
+		}
+		list = append(list, rankEntry{pid, score, r.Score(tiebreakKey, hist, procSum[pid])})
+	}
+
+	if r.smoothing() {
+		// forget processes that weren't seen in this window so the map doesn't grow forever
+		r.scores = make(map[int]float64, len(list))
+		for _, entry := range list {
+			r.scores[entry.pid] = entry.score
+		}
+	}
+
+	sort.Sort(byScore(list))
+
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	ret := make(Pidlist, len(list))
+	for i, entry := range list {
+		ret[i] = entry.pid
+	}
+	return ret
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// rankFixture builds a window with one usr+sys sample per element of ticks[pid],
+// and the sums from sums[pid]
+func rankFixture(ticks map[int][]int64, sums map[int]*ProcSample) (ProcStatsHistMap, ProcSampleMap) {
+	procHist := make(ProcStatsHistMap)
+	for pid, samples := range ticks {
+		hist := NewProcStatsHist()
+		for _, val := range samples {
+			hist.Ustime.RecordValue(val)
+		}
+		procHist[pid] = hist
+	}
+	procSum := make(ProcSampleMap)
+	for pid, sum := range sums {
+		procSum[pid] = sum
+	}
+	return procHist, procSum
+}
+
+func TestParseSortKey(t *testing.T) {
+	for k := SortKey(0); k < NumSortKeys; k++ {
+		parsed, err := ParseSortKey(k.String())
+		if err != nil || parsed != k {
+			t.Error("sort key", k, "did not round trip:", parsed, err)
+		}
+	}
+	if _, err := ParseSortKey("max"); err == nil {
+		t.Error("unknown sort key should be an error")
+	}
+}
+
+func TestScoreUnits(t *testing.T) {
+	r := NewRanker(SortCPUMax, 0, 100, 200)
+	procHist, procSum := rankFixture(
+		map[int][]int64{1: {10, 20, 10, 20}},
+		map[int]*ProcSample{1: {
+			Proc: ProcStats{Rss: 10},
+			Task: TaskStats{Cpudelaytotal: 200 * 1000 * 1000, Nvcsw: 30, Nivcsw: 10, Readbytes: 4096, Writebytes: 4096},
+		}},
+	)
+
+	// 20 ticks in 200ms with 100 ticks/s is 100% of a CPU
+	checks := []struct {
+		key  SortKey
+		want float64
+	}{
+		{SortCPUMax, 100},
+		{SortCPUAvg, 75},
+		{SortCPUP95, 100},
+		{SortRunq, 25}, // 200ms of delay over a 800ms window
+		{SortIowait, 0},
+		{SortRSS, float64(10 * PageSize)},
+		{SortCtxsw, 50},
+		{SortIOBytes, 10240},
+	}
+	for _, c := range checks {
+		got := r.Score(c.key, procHist[1], procSum[1])
+		if math.Abs(got-c.want) > 0.001 {
+			t.Errorf("score for %s = %f %s, want %f", c.key, got, c.key.Unit(), c.want)
+		}
+	}
+
+	if got := r.Score(SortRunq, procHist[1], nil); got != 0 {
+		t.Error("missing sums should score 0, got", got)
+	}
+}
+
+func TestRankOrderAndTiebreak(t *testing.T) {
+	procHist, procSum := rankFixture(
+		map[int][]int64{
+			1: {1, 1, 1},
+			2: {5, 0, 0},
+			3: {5, 5, 5},
+			4: {5, 5, 5},
+			5: {0, 0, 0},
+		},
+		map[int]*ProcSample{},
+	)
+
+	r := NewRanker(SortCPUMax, 0, 100, 200)
+	// 2, 3 and 4 tie on max, 3 and 4 have the higher average, 3 has the lower pid
+	if got := r.Rank(procHist, procSum, 4); !reflect.DeepEqual(got, Pidlist{3, 4, 2, 1}) {
+		t.Error("cpumax ranking wrong:", got)
+	}
+
+	r.SetKey(SortCPUAvg)
+	if got := r.Rank(procHist, procSum, 10); !reflect.DeepEqual(got, Pidlist{3, 4, 2, 1, 5}) {
+		t.Error("cpuavg ranking wrong:", got)
+	}
+}
+
+func TestRankEWMA(t *testing.T) {
+	r := NewRanker(SortCPUAvg, 0.5, 100, 200)
+
+	procHist, procSum := rankFixture(map[int][]int64{1: {10}, 2: {2}}, nil)
+	if got := r.Rank(procHist, procSum, 1); !reflect.DeepEqual(got, Pidlist{1}) {
+		t.Error("first window should rank 1 first:", got)
+	}
+
+	// a single quiet window for 1 shouldn't knock it out of the top spot
+	procHist, procSum = rankFixture(map[int][]int64{1: {0}, 2: {4}}, nil)
+	if got := r.Rank(procHist, procSum, 1); !reflect.DeepEqual(got, Pidlist{1}) {
+		t.Error("smoothed score should keep 1 first:", got)
+	}
+
+	procHist, procSum = rankFixture(map[int][]int64{1: {0}, 2: {4}}, nil)
+	if got := r.Rank(procHist, procSum, 1); !reflect.DeepEqual(got, Pidlist{2}) {
+		t.Error("2 should overtake 1 eventually:", got)
+	}
+
+	if len(r.scores) != 2 {
+		t.Error("should have smoothed scores for 2 pids, have", len(r.scores))
+	}
+	procHist, procSum = rankFixture(map[int][]int64{3: {1}}, nil)
+	r.Rank(procHist, procSum, 1)
+	if _, ok := r.scores[1]; ok {
+		t.Error("pids not seen in the last window should be forgotten")
+	}
+}
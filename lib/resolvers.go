@@ -0,0 +1,221 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Friendly name resolution. Each process's comm and cmdline are offered to a list of
+// resolvers in order, and the first one that claims the process picks its name.
+// User resolvers and rules from a file are tried before the built-in ones.
+
+package cpustat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Resolver picks a friendly name for a process. ok is false if this resolver doesn't
+// know anything about the process and the next one should be tried.
+type Resolver interface {
+	Resolve(comm string, cmdline []string) (name string, ok bool)
+}
+
+// ResolverFunc adapts a plain function to the Resolver interface
+type ResolverFunc func(comm string, cmdline []string) (string, bool)
+
+func (f ResolverFunc) Resolve(comm string, cmdline []string) (string, bool) {
+	return f(comm, cmdline)
+}
+
+// BasenameResolver applies fn to processes whose argv[0], minus any path, is one of names
+func BasenameResolver(fn func(cmdline []string) string, names ...string) Resolver {
+	return ResolverFunc(func(comm string, cmdline []string) (string, bool) {
+		base := basename(cmdline[0])
+		for _, name := range names {
+			if base == name {
+				return fn(cmdline), true
+			}
+		}
+		return "", false
+	})
+}
+
+// NameRule is a declarative resolver, usually loaded from a file by LoadNameRules.
+// A rule matches when both Comm and Argv0 regexps match, with an empty regexp matching
+// anything. The name is then built from the cmdline element at Arg, where a negative
+// index counts back from the end, optionally with the leading path removed.
+// If Template is set, it is a text/template that is run with .Comm, .Args and .Arg.
+type NameRule struct {
+	Comm      string `json:"comm"`
+	Argv0     string `json:"argv0"`
+	Arg       int    `json:"arg"`
+	StripPath bool   `json:"strip_path"`
+	Template  string `json:"template"`
+
+	commRe  *regexp.Regexp
+	argv0Re *regexp.Regexp
+	tmpl    *template.Template
+}
+
+type nameRuleData struct {
+	Comm string
+	Args []string
+	Arg  string
+}
+
+// Compile checks the rule and prepares its regexps and template. It must be called before Resolve.
+func (r *NameRule) Compile() error {
+	var err error
+	if r.Comm != "" {
+		if r.commRe, err = regexp.Compile(r.Comm); err != nil {
+			return fmt.Errorf("name rule comm %q: %s", r.Comm, err)
+		}
+	}
+	if r.Argv0 != "" {
+		if r.argv0Re, err = regexp.Compile(r.Argv0); err != nil {
+			return fmt.Errorf("name rule argv0 %q: %s", r.Argv0, err)
+		}
+	}
+	if r.Template != "" {
+		if r.tmpl, err = template.New("name").Parse(r.Template); err != nil {
+			return fmt.Errorf("name rule template %q: %s", r.Template, err)
+		}
+	}
+	return nil
+}
+
+func (r *NameRule) Resolve(comm string, cmdline []string) (string, bool) {
+	if r.commRe != nil && r.commRe.MatchString(comm) == false {
+		return "", false
+	}
+	if r.argv0Re != nil && r.argv0Re.MatchString(cmdline[0]) == false {
+		return "", false
+	}
+
+	pos := r.Arg
+	if pos < 0 {
+		pos += len(cmdline)
+	}
+	if pos < 0 || pos >= len(cmdline) {
+		return "", false
+	}
+	arg := cmdline[pos]
+	if r.StripPath {
+		arg = basename(arg)
+	}
+
+	if r.tmpl == nil {
+		return arg, len(arg) > 0
+	}
+	var out bytes.Buffer
+	if err := r.tmpl.Execute(&out, nameRuleData{comm, cmdline, arg}); err != nil {
+		return "", false
+	}
+	return out.String(), out.Len() > 0
+}
+
+// the built-in resolvers in the order they are tried. Process titles come first because
+// they're what the process wants to be called. This is filled in by init because some
+// resolvers hand the rest of their cmdline back to FriendlyName.
+var defaultResolvers []Resolver
+
+func init() {
+	defaultResolvers = append(defaultResolvers, titleResolvers...)
+	defaultResolvers = append(defaultResolvers,
+		BasenameResolver(resolveDocker, "docker"),
+		BasenameResolver(resolveSh, "sh", "bash"),
+		BasenameResolver(resolveXargs, "xargs"),
+		BasenameResolver(resolveNode, "node0.10", "node"),
+		BasenameResolver(resolveUwsgi, "uwsgi"),
+	)
+	defaultResolvers = append(defaultResolvers, runtimeResolvers...)
+}
+
+// resolvers added by users, which take precedence over the defaults.
+// These are not locked, so register them before sampling starts.
+var customResolvers []Resolver
+
+// RegisterResolver adds r ahead of the built-in resolvers and any previously registered ones
+func RegisterResolver(r Resolver) {
+	customResolvers = append([]Resolver{r}, customResolvers...)
+}
+
+// LoadNameRules reads a JSON list of NameRules from filename and registers them.
+// Rules in the file are tried in the order they appear.
+func LoadNameRules(filename string) error {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var rules []*NameRule
+	if err = json.Unmarshal(raw, &rules); err != nil {
+		return fmt.Errorf("parsing %s: %s", filename, err)
+	}
+	for i := range rules {
+		if err = rules[i].Compile(); err != nil {
+			return fmt.Errorf("%s rule %d: %s", filename, i, err)
+		}
+	}
+	for i := len(rules) - 1; i >= 0; i-- {
+		RegisterResolver(rules[i])
+	}
+	return nil
+}
+
+// FriendlyName runs the resolvers over a process and returns the first name picked.
+// cmdline must have at least one non-empty element, and empty ones are skipped.
+func FriendlyName(comm string, cmdline []string) string {
+	cmdline = skipEmpty(cmdline)
+	for _, r := range customResolvers {
+		if name, ok := r.Resolve(comm, cmdline); ok {
+			return name
+		}
+	}
+	for _, r := range defaultResolvers {
+		if name, ok := r.Resolve(comm, cmdline); ok {
+			return name
+		}
+	}
+	return resolveDefault(cmdline, comm)
+}
+
+// skipEmpty drops empty arguments, like from foo\0\0bar, and only copies cmdline if it has some
+func skipEmpty(cmdline []string) []string {
+	for i, arg := range cmdline {
+		if arg != "" {
+			continue
+		}
+		parts := append([]string{}, cmdline[:i]...)
+		for _, arg := range cmdline[i+1:] {
+			if arg != "" {
+				parts = append(parts, arg)
+			}
+		}
+		return parts
+	}
+	return cmdline
+}
+
+func basename(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
@@ -0,0 +1,356 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Resolvers for language runtimes and app servers. The interpreter name is rarely
+// interesting, so these dig through the options to find the jar, class, module, script
+// or app that is actually running.
+//
+// Many of these also rewrite their argv into a process title, which usually loses the
+// nulls between arguments. These titles are matched against the whole space joined
+// cmdline before any of the interpreter resolvers get a look.
+
+package cpustat
+
+import (
+	"regexp"
+	"strings"
+)
+
+// interpreterResolver applies fn to processes whose argv[0] basename matches pattern
+func interpreterResolver(pattern string, fn func(parts []string) string) Resolver {
+	re := regexp.MustCompile(pattern)
+	return ResolverFunc(func(comm string, cmdline []string) (string, bool) {
+		if re.MatchString(basename(cmdline[0])) {
+			return fn(cmdline), true
+		}
+		return "", false
+	})
+}
+
+// titleResolver applies fn to the submatches of pattern against the space joined cmdline
+func titleResolver(pattern string, fn func(match []string) string) Resolver {
+	re := regexp.MustCompile(pattern)
+	return ResolverFunc(func(comm string, cmdline []string) (string, bool) {
+		match := re.FindStringSubmatch(strings.Join(cmdline, " "))
+		if match == nil {
+			return "", false
+		}
+		return fn(match), true
+	})
+}
+
+var titleResolvers = []Resolver{
+	// gunicorn: master [myapp]
+	titleResolver(`^gunicorn: (?:master|worker) \[(.*)\]`, func(m []string) string {
+		return withApp("gunicorn", appModule(firstField(m[1])))
+	}),
+	// [celeryd: celery@host:MainProcess] -active- (worker -A proj)
+	titleResolver(`^\[celery(?:d|beat)?: .*`, func(m []string) string {
+		return resolveCelery(strings.Fields(strings.Map(StripSpecial, m[0])))
+	}),
+	// puma 3.12.0 (tcp://0.0.0.0:3000) [myapp] or puma: cluster worker 0: 1234 [myapp]
+	titleResolver(`^puma[ :].*?(?:\[([^\]]*)\])?$`, func(m []string) string {
+		return withApp("puma", m[1])
+	}),
+	// sidekiq 5.2.7 myapp [0 of 10 busy]
+	titleResolver(`^sidekiq \S+ (?:([^\s\[]+) )?\[\d+ of \d+ busy\]`, func(m []string) string {
+		return withApp("sidekiq", m[1])
+	}),
+	// php-fpm: pool www
+	titleResolver(`^php-fpm[0-9.]*: pool (\S+)`, func(m []string) string {
+		return "php-fpm " + m[1]
+	}),
+	// php-fpm: master process (/etc/php/7.0/fpm/php-fpm.conf)
+	titleResolver(`^php-fpm[0-9.]*: master`, func(m []string) string {
+		return "php-fpm master"
+	}),
+	// nginx: worker process
+	titleResolver(`^nginx: (master|worker|cache)`, func(m []string) string {
+		return "nginx " + m[1]
+	}),
+	// postgres: checkpointer, or postgres: main: checkpointer with a cluster name. Client
+	// backends are postgres: user db host, which would make a name for every user and db.
+	titleResolver(`^postgres: (?:\S+: )?(checkpointer|background|walwriter|walsender|walreceiver|`+
+		`autovacuum|stats|logical|archiver|startup)\b`, func(m []string) string {
+		return "postgres " + m[1]
+	}),
+	// anything else that looks like "name: what it's doing", e.g. sshd: alice [priv]. What
+	// it's doing is often a user or a client, so only the name is kept.
+	titleResolver(`^([^\s/:]+): `, func(m []string) string {
+		return m[1]
+	}),
+}
+
+var runtimeResolvers = []Resolver{
+	interpreterResolver(`^java$`, resolveJava),
+	interpreterResolver(`^python[0-9.]*$`, resolvePython),
+	interpreterResolver(`^gunicorn$`, resolveGunicorn),
+	interpreterResolver(`^celery$`, resolveCelery),
+	interpreterResolver(`^ruby[0-9.]*$`, resolveRuby),
+	interpreterResolver(`^bundle$`, resolveBundle),
+	interpreterResolver(`^php[0-9.]*$`, resolvePHP),
+}
+
+// withApp names a process after its server and the app it's running, when we know the app
+func withApp(server, app string) string {
+	if app == "" {
+		return server
+	}
+	return server + " " + app
+}
+
+func firstField(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// appModule turns a WSGI or celery style app reference like pkg.wsgi:application into pkg.wsgi
+func appModule(app string) string {
+	if pos := strings.Index(app, ":"); pos >= 0 {
+		app = app[:pos]
+	}
+	return basename(app)
+}
+
+// optionValue finds the value of any of names in parts, in either "-A proj", "--app proj"
+// or "--app=proj" form.
+func optionValue(parts []string, names ...string) (string, bool) {
+	for i := 1; i < len(parts); i++ {
+		for _, name := range names {
+			if parts[i] == name && i+1 < len(parts) {
+				return parts[i+1], true
+			}
+			if strings.HasPrefix(parts[i], name+"=") {
+				return parts[i][len(name)+1:], true
+			}
+		}
+	}
+	return "", false
+}
+
+// firstPositional returns the index of the first argument that isn't an option or
+// the value of one of the options in withValue, or -1 if there isn't one.
+func firstPositional(parts []string, withValue map[string]bool) int {
+	for i := 1; i < len(parts); i++ {
+		arg := parts[i]
+		switch {
+		case arg == "--":
+			if i+1 < len(parts) {
+				return i + 1
+			}
+			return -1
+		case withValue[arg]:
+			i++
+		case len(arg) > 1 && strings.HasPrefix(arg, "-"):
+		default:
+			return i
+		}
+	}
+	return -1
+}
+
+var javaOptsWithValue = map[string]bool{
+	"-cp":                   true,
+	"-classpath":            true,
+	"--class-path":          true,
+	"-p":                    true,
+	"--module-path":         true,
+	"--upgrade-module-path": true,
+	"--add-modules":         true,
+	"--limit-modules":       true,
+	"--add-reads":           true,
+	"--add-exports":         true,
+	"--add-opens":           true,
+	"--patch-module":        true,
+}
+
+// resolveJava finds the jar, module or main class, skipping JVM options
+func resolveJava(parts []string) string {
+	for i := 1; i < len(parts); i++ {
+		arg := parts[i]
+		switch {
+		case arg == "-jar" && i+1 < len(parts):
+			return strings.TrimSuffix(basename(parts[i+1]), ".jar")
+		case (arg == "-m" || arg == "--module") && i+1 < len(parts):
+			return javaModule(parts[i+1])
+		case strings.HasPrefix(arg, "--module="):
+			return javaModule(arg[len("--module="):])
+		case javaOptsWithValue[arg]:
+			i++
+		case strings.HasPrefix(arg, "-"):
+		default:
+			return arg
+		}
+	}
+	return "java"
+}
+
+// a module launch is module[/mainclass], and the module is the more useful half
+func javaModule(arg string) string {
+	if pos := strings.Index(arg, "/"); pos > 0 {
+		return arg[:pos]
+	}
+	return arg
+}
+
+var pythonOptsWithValue = map[string]bool{
+	"-W":                      true,
+	"-X":                      true,
+	"--check-hash-based-pycs": true,
+}
+
+// python scripts and modules that are servers for other code, so the app is the interesting part
+var pythonLaunchers = map[string]func([]string) string{
+	"gunicorn": resolveGunicorn,
+	"celery":   resolveCelery,
+}
+
+// resolvePython finds the module or script, and hands off to launchers like gunicorn
+func resolvePython(parts []string) string {
+	for i := 1; i < len(parts); i++ {
+		arg := parts[i]
+		switch {
+		case arg == "-m" && i+1 < len(parts):
+			module := parts[i+1]
+			if launcher, ok := pythonLaunchers[module]; ok {
+				return launcher(parts[i+1:])
+			}
+			return module
+		case arg == "-c":
+			return "python -c"
+		case pythonOptsWithValue[arg]:
+			i++
+		case len(arg) > 1 && strings.HasPrefix(arg, "-"):
+		default:
+			script := basename(arg)
+			if launcher, ok := pythonLaunchers[script]; ok {
+				return launcher(parts[i:])
+			}
+			if len(script) > 1 {
+				return script
+			}
+			return "python"
+		}
+	}
+	return "python"
+}
+
+var gunicornOptsWithValue = map[string]bool{
+	"-b": true, "--bind": true,
+	"-w": true, "--workers": true,
+	"-k": true, "--worker-class": true,
+	"-c": true, "--config": true,
+	"-t": true, "--timeout": true,
+	"-u": true, "--user": true,
+	"-g": true, "--group": true,
+	"-p": true, "--pid": true,
+	"-e": true, "--env": true,
+	"--threads": true, "--chdir": true, "--log-level": true, "--log-file": true,
+	"--access-logfile": true, "--error-logfile": true, "--max-requests": true,
+	"--keep-alive": true, "--graceful-timeout": true, "--worker-connections": true,
+}
+
+// resolveGunicorn uses the proc_name if there is one, otherwise the app module
+func resolveGunicorn(parts []string) string {
+	if name, ok := optionValue(parts, "-n", "--name"); ok {
+		return withApp("gunicorn", name)
+	}
+	if pos := firstPositional(parts, gunicornOptsWithValue); pos > 0 {
+		return withApp("gunicorn", appModule(parts[pos]))
+	}
+	return "gunicorn"
+}
+
+// resolveCelery uses the app name if there is one, otherwise the subcommand
+func resolveCelery(parts []string) string {
+	if app, ok := optionValue(parts, "-A", "--app"); ok {
+		return withApp("celery", appModule(app))
+	}
+	for _, arg := range parts[1:] {
+		switch arg {
+		case "worker", "beat", "flower", "events", "multi":
+			return "celery " + arg
+		}
+	}
+	return "celery"
+}
+
+var rubyOptsWithValue = map[string]bool{
+	"-I": true,
+	"-r": true,
+	"-C": true,
+	"-E": true,
+}
+
+// resolveRuby finds the script, looking through bundle exec
+func resolveRuby(parts []string) string {
+	for i := 1; i < len(parts); i++ {
+		arg := parts[i]
+		switch {
+		case arg == "-e":
+			return "ruby -e"
+		case rubyOptsWithValue[arg]:
+			i++
+		case len(arg) > 1 && strings.HasPrefix(arg, "-"):
+		default:
+			if basename(arg) == "bundle" {
+				return resolveBundle(parts[i:])
+			}
+			return basename(arg)
+		}
+	}
+	return "ruby"
+}
+
+// resolveBundle names bundle exec'd processes after the command they run
+func resolveBundle(parts []string) string {
+	if len(parts) > 2 && parts[1] == "exec" {
+		return FriendlyName(basename(parts[2]), parts[2:])
+	}
+	return "bundle"
+}
+
+var phpOptsWithValue = map[string]bool{
+	"-c": true,
+	"-d": true,
+	"-z": true,
+}
+
+// resolvePHP finds the script for the php cli
+func resolvePHP(parts []string) string {
+	for i := 1; i < len(parts); i++ {
+		arg := parts[i]
+		switch {
+		case arg == "-f" && i+1 < len(parts):
+			return basename(parts[i+1])
+		case arg == "-r":
+			return "php -r"
+		case phpOptsWithValue[arg]:
+			i++
+		case len(arg) > 1 && strings.HasPrefix(arg, "-"):
+		default:
+			return basename(arg)
+		}
+	}
+	return "php"
+}
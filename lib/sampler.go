@@ -0,0 +1,453 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// The sampling loop that cpustat and cpustat-agent are built on. A Sampler reads every process
+// and the system once per interval, on the schedule of a Scheduler, and hands each sample to
+// a callback or a channel as a Snapshot of what changed since the one before it.
+//
+//	sampler, err := cpustat.NewSampler(cpustat.WithInterval(200), cpustat.WithCallback(
+//		func(snap *cpustat.Snapshot) error {
+//			if window := summarizer.Add(snap); window != nil {
+//				...
+//			}
+//			return nil
+//		}))
+//	err = sampler.Start(ctx)
+
+package cpustat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Source is where a Sampler's samples come from, which is a LiveSource unless WithSource
+// replaces it, like with a capture being replayed
+type Source interface {
+	// Wait blocks until the next sample is due, which for live sampling is after sleep,
+	// or until ctx is done
+	Wait(ctx context.Context, sleep time.Duration)
+	// Read returns io.EOF when there are no more samples
+	Read(procs *ProcSampleList, sys *SystemStats, infoMap ProcInfoMap) error
+}
+
+// LiveSource reads the processes in /proc and the process collectors, then the system
+// collectors
+type LiveSource struct {
+	pids     Pidlist
+	maxProcs int
+	filters  Filters
+	procs    []ProcCollector
+	sys      []SystemCollector
+	metrics  Metrics
+	procAt   []int         // where the values of each process collector start in Values
+	sysAt    []int         // and of each system collector
+	views    [][]float64   // the values of one process collector for each process
+	tree     *ProcTree     // if set, only these processes are read
+	tiers    *TieredReader // if set, idle processes are read less often
+	cpus     PerCPUStats
+}
+
+func newLiveSource(maxProcs int, filters Filters, collectors []Collector, metrics Metrics,
+	tree *ProcTree) *LiveSource {
+
+	l := LiveSource{pids: make(Pidlist, 0, maxProcs), maxProcs: maxProcs, filters: filters, metrics: metrics,
+		tree: tree}
+	procAt, sysAt := 0, 0
+	for _, c := range collectors {
+		width := len(c.Metrics())
+		if proc, ok := c.(ProcCollector); ok {
+			l.procs = append(l.procs, proc)
+			l.procAt = append(l.procAt, procAt)
+			procAt += width
+		} else if sys, ok := c.(SystemCollector); ok {
+			l.sys = append(l.sys, sys)
+			l.sysAt = append(l.sysAt, sysAt)
+			sysAt += width
+		}
+	}
+	return &l
+}
+
+func (l *LiveSource) Wait(ctx context.Context, sleep time.Duration) {
+	timer := time.NewTimer(sleep)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+func (l *LiveSource) Read(procs *ProcSampleList, sys *SystemStats, infoMap ProcInfoMap) error {
+	GetPidList(&l.pids, l.maxProcs)
+	if l.tree != nil {
+		l.pids = l.tree.Filter(l.pids)
+	}
+	if l.tiers != nil {
+		return l.tiers.Read(l.pids, l.filters, procs, sys, infoMap)
+	}
+	if err := l.readProcs(l.pids, l.filters, procs, infoMap); err != nil {
+		return err
+	}
+	return l.readSystem(sys)
+}
+
+// readProcs gives each process a fresh slice of values, so that samples copied elsewhere
+// never share them with a later read
+func (l *LiveSource) readProcs(pids Pidlist, filter Filters, procs *ProcSampleList, infoMap ProcInfoMap) error {
+	ProcStatsReader(pids, filter, procs, infoMap)
+	n := len(l.metrics.Proc)
+	if n > 0 {
+		values := make([]float64, n*int(procs.Len))
+		for i := 0; i < int(procs.Len); i++ {
+			procs.Samples[i].Values = values[i*n : (i+1)*n : (i+1)*n]
+		}
+	}
+	for i, c := range l.procs {
+		l.views = l.views[:0]
+		if width := len(c.Metrics()); width > 0 {
+			for j := uint32(0); j < procs.Len; j++ {
+				l.views = append(l.views, procs.Samples[j].Values[l.procAt[i]:l.procAt[i]+width])
+			}
+		}
+		if err := c.CollectProcs(procs, l.views); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *LiveSource) readSystem(sys *SystemStats) error {
+	sys.CaptureTime = time.Now()
+	sys.Values = nil
+	if n := len(l.metrics.System); n > 0 {
+		sys.Values = make([]float64, n)
+	}
+	for i, c := range l.sys {
+		var values []float64
+		if width := len(c.Metrics()); width > 0 {
+			values = sys.Values[l.sysAt[i] : l.sysAt[i]+width]
+		}
+		if err := c.CollectSystem(sys, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pids is the list of processes found by the last Read
+func (l *LiveSource) Pids() Pidlist {
+	return l.pids
+}
+
+// PerCPU reads /proc/stat again for the times of each CPU, since only recording needs them
+func (l *LiveSource) PerCPU() PerCPUStats {
+	if err := PerCPUStatsReader(&l.cpus); err != nil {
+		return nil
+	}
+	return l.cpus
+}
+
+// Sampler takes a sample each interval, and delivers what changed since the last one
+type Sampler struct {
+	interval   int // ms
+	align      bool
+	maxProcs   int
+	jiffy      int
+	filters    Filters
+	collectors []Collector
+	metrics    Metrics
+	tierConf   *TierConfig
+	tree       *ProcTree
+	source     Source
+	replay     bool // the source isn't live, so there's no schedule to be late for
+	wrap       []func(Source) Source
+	infoMap    ProcInfoMap
+	infoLock   sync.Locker
+	procDeltas bool
+	callback   func(*Snapshot) error
+	out        chan<- *Snapshot
+	overhead   *Overhead
+
+	live  *LiveSource
+	tiers *TieredReader
+	sched *Scheduler
+	procs [2]ProcSampleList // the current and last samples, swapped each time
+	sys   [2]SystemStats
+}
+
+type SamplerOption func(*Sampler)
+
+// WithInterval sets the time between samples in ms, 200 by default
+func WithInterval(ms int) SamplerOption {
+	return func(s *Sampler) { s.interval = ms }
+}
+
+// WithAlign takes samples on multiples of the interval on the wall clock
+func WithAlign(align bool) SamplerOption {
+	return func(s *Sampler) { s.align = align }
+}
+
+// WithMaxProcs sets the most processes read in a sample, 2048 by default
+func WithMaxProcs(n int) SamplerOption {
+	return func(s *Sampler) { s.maxProcs = n }
+}
+
+// WithJiffy sets the length of a clock tick, 100 by default
+func WithJiffy(jiffy int) SamplerOption {
+	return func(s *Sampler) { s.jiffy = jiffy }
+}
+
+// WithFilters only reads the processes that match filters
+func WithFilters(filters Filters) SamplerOption {
+	return func(s *Sampler) { s.filters = filters }
+}
+
+// WithCollectors replaces the collectors, which are DefaultCollectors. To add to them,
+// append to DefaultCollectors, since cpustat's summaries need the fields they fill. The
+// Sampler closes them in Close.
+func WithCollectors(collectors ...Collector) SamplerOption {
+	return func(s *Sampler) { s.collectors = collectors }
+}
+
+// WithTiers reads idle processes less often
+func WithTiers(conf TierConfig) SamplerOption {
+	return func(s *Sampler) { s.tierConf = &conf }
+}
+
+// WithProcTree only reads the processes in tree
+func WithProcTree(tree *ProcTree) SamplerOption {
+	return func(s *Sampler) { s.tree = tree }
+}
+
+// WithSource reads samples from src instead of a LiveSource, like a capture being replayed.
+// Its samples aren't on the Sampler's schedule, so it doesn't know how late they were.
+func WithSource(src Source) SamplerOption {
+	return func(s *Sampler) { s.source, s.replay = src, true }
+}
+
+// WithSourceWrapper wraps the source, like to record each sample or end early. Wrappers
+// are applied in order, so the last one is the outermost.
+func WithSourceWrapper(wrap func(Source) Source) SamplerOption {
+	return func(s *Sampler) { s.wrap = append(s.wrap, wrap) }
+}
+
+// WithInfoMap shares infoMap, which each read adds new processes to, and holds lock, if it
+// isn't nil, while reading
+func WithInfoMap(infoMap ProcInfoMap, lock sync.Locker) SamplerOption {
+	return func(s *Sampler) { s.infoMap, s.infoLock = infoMap, lock }
+}
+
+// WithoutProcDeltas leaves out the per-process changes of each Snapshot, for a caller that
+// only keeps the raw samples
+func WithoutProcDeltas() SamplerOption {
+	return func(s *Sampler) { s.procDeltas = false }
+}
+
+// WithOverhead times each read as a cycle of overhead
+func WithOverhead(overhead *Overhead) SamplerOption {
+	return func(s *Sampler) { s.overhead = overhead }
+}
+
+// WithCallback calls fn with each Snapshot, on the goroutine running Start. Sampling stops
+// if it returns an error.
+func WithCallback(fn func(*Snapshot) error) SamplerOption {
+	return func(s *Sampler) { s.callback = fn }
+}
+
+// WithChannel sends each Snapshot to ch, and closes it when Start returns
+func WithChannel(ch chan<- *Snapshot) SamplerOption {
+	return func(s *Sampler) { s.out = ch }
+}
+
+// NewSampler makes a Sampler, which doesn't read anything until Start
+func NewSampler(opts ...SamplerOption) (*Sampler, error) {
+	s := Sampler{interval: 200, maxProcs: 2048, jiffy: 100, procDeltas: true}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	if s.interval < 10 {
+		return nil, errors.New("the minimum sampling interval is 10ms")
+	}
+	if s.maxProcs < 1 {
+		return nil, errors.New("the sampler has to read at least one process")
+	}
+	if s.source != nil && (s.tierConf != nil || s.tree != nil) {
+		return nil, errors.New("tiers and process trees only work with live sampling")
+	}
+	if s.infoMap == nil {
+		s.infoMap = make(ProcInfoMap)
+	}
+
+	if s.source == nil {
+		if s.collectors == nil {
+			collectors, err := DefaultCollectors()
+			if err != nil {
+				return nil, err
+			}
+			s.collectors = collectors
+		}
+		metrics, err := collectorMetrics(s.collectors)
+		if err != nil {
+			return nil, err
+		}
+		s.metrics = metrics
+		s.live = newLiveSource(s.maxProcs, s.filters, s.collectors, s.metrics, s.tree)
+		if s.tierConf != nil {
+			if s.tiers, err = NewTieredReader(*s.tierConf, nil, s.jiffy, s.interval); err != nil {
+				return nil, err
+			}
+			s.tiers.readProcs = s.live.readProcs
+			s.tiers.readSys = s.live.readSystem
+			s.live.tiers = s.tiers
+		}
+		s.source = s.live
+	}
+	for _, wrap := range s.wrap {
+		s.source = wrap(s.source)
+	}
+
+	for i := range s.procs {
+		s.procs[i] = NewProcSampleList(s.maxProcs)
+	}
+	return &s, nil
+}
+
+// InfoMap has every process that has been read
+func (s *Sampler) InfoMap() ProcInfoMap {
+	return s.infoMap
+}
+
+// Live is the LiveSource, or nil if WithSource replaced it
+func (s *Sampler) Live() *LiveSource {
+	return s.live
+}
+
+// Tiers is the tiered reader, or nil without WithTiers
+func (s *Sampler) Tiers() *TieredReader {
+	return s.tiers
+}
+
+// Metrics are the metrics of the collectors that keep their values in ProcSample.Values
+// and SystemStats.Values
+func (s *Sampler) Metrics() Metrics {
+	return s.metrics
+}
+
+// Interval is the time between samples in ms
+func (s *Sampler) Interval() int {
+	return s.interval
+}
+
+// SetInterval changes the time between samples, starting a new schedule. It can only be
+// called from the goroutine running Start, like in the callback.
+func (s *Sampler) SetInterval(ms int) {
+	s.interval = ms
+	s.sched = NewScheduler(time.Duration(ms)*time.Millisecond, s.align)
+}
+
+// Raw is the sample that the current Snapshot ended with, as it was read. It's reused for
+// a later sample, so it's only valid in the callback.
+func (s *Sampler) Raw() (*ProcSampleList, *SystemStats) {
+	return &s.procs[0], &s.sys[0]
+}
+
+// Start reads a first sample as a baseline, and then a sample each interval, until ctx is
+// done, the source runs out, or the callback returns an error. It returns nil for the first
+// two, unless the source ran out before the baseline, when it returns io.EOF. Sampling runs
+// on the calling goroutine, so that's the one to give a higher priority with Protect.
+func (s *Sampler) Start(ctx context.Context) error {
+	if s.out != nil {
+		defer close(s.out)
+	}
+	if err := s.read(1); err != nil {
+		return err
+	}
+	s.SetInterval(s.interval)
+
+	for {
+		s.source.Wait(ctx, s.sched.Sleep())
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		start := time.Now()
+		if err := s.read(0); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		late := time.Duration(-1)
+		if s.replay == false {
+			late = s.sched.Sampled(start)
+		}
+
+		procs, prevProcs := s.procs[0], s.procs[1]
+		if s.procDeltas == false {
+			procs, prevProcs = ProcSampleList{}, ProcSampleList{}
+		}
+		snap := NewSnapshot(uint32(s.interval), procs, prevProcs, &s.sys[0], &s.sys[1])
+		snap.Late = late
+		snap.recordMetrics(s.metrics, procs, prevProcs, &s.sys[0], &s.sys[1])
+
+		if s.callback != nil {
+			if err := s.callback(snap); err != nil {
+				return err
+			}
+		}
+		if s.out != nil {
+			select {
+			case s.out <- snap:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		s.procs[0], s.procs[1] = s.procs[1], s.procs[0]
+		s.sys[1] = s.sys[0]
+	}
+}
+
+// Close closes the collectors that are io.Closers, once Start has returned
+func (s *Sampler) Close() error {
+	var first error
+	for _, c := range s.collectors {
+		if closer, ok := c.(io.Closer); ok {
+			if err := closer.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// read reads a sample into slot i
+func (s *Sampler) read(i int) error {
+	if s.overhead != nil {
+		defer s.overhead.Cycle(time.Now())
+	}
+	if s.infoLock != nil {
+		s.infoLock.Lock()
+		defer s.infoLock.Unlock()
+	}
+	return s.source.Read(&s.procs[i], &s.sys[i], s.infoMap)
+}
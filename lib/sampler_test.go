@@ -0,0 +1,131 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// fakeSource has a process that uses 10 ticks each sample, with a gap of 2 missed samples
+// before the 3rd one
+type fakeSource struct {
+	now     time.Time
+	samples int // how many to return before io.EOF
+	read    int
+}
+
+func (f *fakeSource) Wait(ctx context.Context, sleep time.Duration) {}
+
+func (f *fakeSource) Read(procs *ProcSampleList, sys *SystemStats, infoMap ProcInfoMap) error {
+	if f.read == f.samples {
+		return io.EOF
+	}
+	f.read++
+	f.now = f.now.Add(100 * time.Millisecond)
+	if f.read == 3 {
+		f.now = f.now.Add(200 * time.Millisecond)
+	}
+	ticks := uint64(f.read * 10)
+	procs.Samples[0] = ProcSample{Pid: 7, Proc: ProcStats{CaptureTime: f.now, Utime: ticks, Rss: uint64(f.read)}}
+	procs.Len = 1
+	*sys = SystemStats{CaptureTime: f.now, Usr: ticks, ProcsRunning: uint64(f.read)}
+	return nil
+}
+
+func TestSampler(t *testing.T) {
+	src := &fakeSource{now: time.Unix(1500000000, 0), samples: 4}
+	var snaps []*Snapshot
+	var sampler *Sampler
+	sampler, err := NewSampler(WithInterval(100), WithMaxProcs(10), WithSource(src),
+		WithCallback(func(snap *Snapshot) error {
+			if procs, _ := sampler.Raw(); procs.Samples[0].Proc.CaptureTime.Equal(snap.End) == false {
+				t.Error("raw sample isn't the one the snapshot ends with")
+			}
+			snaps = append(snaps, snap)
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sampler.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 3 {
+		t.Fatalf("%d snapshots from 4 samples", len(snaps))
+	}
+
+	// snapshots aren't changed by later samples
+	if snaps[0].Procs[7].Proc.Utime != 10 || snaps[0].ProcTotals[7].Proc.Rss != 2 {
+		t.Errorf("first snapshot changed to %+v", snaps[0].Procs[7].Proc)
+	}
+	gap := snaps[1]
+	if gap.Missed != 2 || gap.Weight() != 3 || gap.Late != -1 {
+		t.Errorf("snapshot after a gap missed %d, late %s", gap.Missed, gap.Late)
+	}
+	// deltas are scaled to one interval, and totals aren't
+	if gap.Procs[7].Proc.Utime != 3 || gap.ProcTotals[7].Proc.Utime != 10 || gap.Procs[7].Weight != 3 {
+		t.Errorf("snapshot after a gap has %+v", gap.Procs[7])
+	}
+	if gap.Sys.Usr != 3 || gap.SysTotals.Usr != 10 || gap.SysTotals.ProcsRunning != 3 {
+		t.Errorf("system after a gap %+v", gap.Sys)
+	}
+}
+
+func TestSamplerStop(t *testing.T) {
+	// running out before the baseline is an error
+	sampler, err := NewSampler(WithSource(&fakeSource{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sampler.Start(context.Background()); err != io.EOF {
+		t.Errorf("empty source returned %v", err)
+	}
+
+	// the channel gets every snapshot until ctx is done, and is closed
+	ch := make(chan *Snapshot)
+	ctx, cancel := context.WithCancel(context.Background())
+	sampler, err = NewSampler(WithMaxProcs(10), WithSource(&fakeSource{samples: 100}), WithChannel(ch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- sampler.Start(ctx)
+	}()
+	<-ch
+	<-ch
+	cancel()
+	for range ch {
+	}
+	if err = <-done; err != nil {
+		t.Errorf("stopping returned %v", err)
+	}
+
+	if _, err = NewSampler(WithSource(&fakeSource{}), WithTiers(TierConfig{Every: 2})); err == nil {
+		t.Error("tiers for a replay")
+	}
+	if _, err = NewSampler(WithInterval(5)); err == nil {
+		t.Error("5ms interval")
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Keeping samples on schedule. Each deadline is a whole number of intervals after the first,
+// so the time a sample takes, or a late wakeup, doesn't push back every sample after it.
+// When sampling falls more than an interval behind, the deadlines it missed are skipped
+// and counted, rather than the next delta quietly covering a longer time.
+
+package cpustat
+
+import (
+	"math"
+	"time"
+
+	"github.com/codahale/hdrhistogram"
+)
+
+type Scheduler struct {
+	interval time.Duration
+	next     time.Time // deadline of the next sample
+	now      func() time.Time
+}
+
+// NewScheduler starts the schedule now. With align, deadlines are whole multiples of the
+// interval on the wall clock, so samples taken on different hosts line up.
+func NewScheduler(interval time.Duration, align bool) *Scheduler {
+	s := Scheduler{interval: interval, now: time.Now}
+	s.start(align)
+	return &s
+}
+
+func (s *Scheduler) start(align bool) {
+	now := s.now()
+	if align {
+		s.next = now.Truncate(s.interval).Add(s.interval)
+	} else {
+		s.next = now.Add(s.interval)
+	}
+}
+
+// Sleep returns how long to wait for the next deadline, which is 0 or less if it has
+// passed. Deadlines that passed more than an interval ago are skipped.
+func (s *Scheduler) Sleep() time.Duration {
+	now := s.now()
+	if late := now.Sub(s.next); late >= s.interval {
+		s.next = s.next.Add(late / s.interval * s.interval)
+	}
+	return s.next.Sub(now)
+}
+
+// Sampled moves on to the next deadline, and returns how late the sample taken at was
+func (s *Scheduler) Sampled(at time.Time) time.Duration {
+	late := at.Sub(s.next)
+	s.next = s.next.Add(s.interval)
+	return late
+}
+
+// MissedSamples is how many samples are missing between two that were taken at prev and
+// cur, interval ms apart, like when sampling fell behind or a capture has a hole
+func MissedSamples(prev, cur time.Time, interval int) int {
+	if prev.IsZero() {
+		return 0
+	}
+	missed := int(math.Round(float64(cur.Sub(prev))/float64(time.Duration(interval)*time.Millisecond))) - 1
+	if missed < 0 {
+		return 0
+	}
+	return missed
+}
+
+// SampleTiming is how well a window of samples kept to the schedule
+type SampleTiming struct {
+	Missed int64
+	Late   *hdrhistogram.Histogram // how late each sample was, in µs, if known
+}
+
+func NewSampleTiming() *SampleTiming {
+	return &SampleTiming{Late: hdrhistogram.New(histMin, histMax, histSigFigs)}
+}
+
+// Add counts a sample, with the samples missed before it. late is negative if unknown,
+// like for a replay.
+func (t *SampleTiming) Add(missed int, late time.Duration) {
+	t.Missed += int64(missed)
+	if late < 0 {
+		return
+	}
+	t.Late.RecordValue(int64(late / time.Microsecond))
+}
+
+func (t *SampleTiming) Merge(from *SampleTiming) {
+	t.Missed += from.Missed
+	t.Late.Merge(from.Late)
+}
+
+// SetTiming adds the missed samples and how late the others were to a summary
+func (s *Summary) SetTiming(t *SampleTiming) {
+	s.Missed = t.Missed
+	if t.Late.TotalCount() > 0 {
+		s.Late = tickStat(t.Late, func(val float64) float64 { return val / 1000 })
+	}
+}
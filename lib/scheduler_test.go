@@ -0,0 +1,82 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	now := time.Unix(1500000000, 30*int64(time.Millisecond))
+	s := Scheduler{interval: 100 * time.Millisecond, now: func() time.Time { return now }}
+	s.start(true)
+	if s.next != time.Unix(1500000000, 100*int64(time.Millisecond)) {
+		t.Fatalf("first aligned deadline %s", s.next)
+	}
+
+	// work that takes 20ms doesn't push the next deadline back
+	if sleep := s.Sleep(); sleep != 70*time.Millisecond {
+		t.Errorf("slept %s, want 70ms", sleep)
+	}
+	now = now.Add(72 * time.Millisecond)
+	if late := s.Sampled(now); late != 2*time.Millisecond {
+		t.Errorf("sample %s late, want 2ms", late)
+	}
+	now = now.Add(20 * time.Millisecond)
+	if sleep := s.Sleep(); sleep != 78*time.Millisecond {
+		t.Errorf("slept %s, want 78ms", sleep)
+	}
+
+	// falling 250ms behind skips the 2 deadlines that passed longest ago
+	now = now.Add(328 * time.Millisecond)
+	if sleep := s.Sleep(); sleep != -50*time.Millisecond {
+		t.Errorf("slept %s when behind, want -50ms", sleep)
+	}
+	if late := s.Sampled(now); late != 50*time.Millisecond {
+		t.Errorf("sample %s late, want 50ms", late)
+	}
+	if s.next != time.Unix(1500000000, 500*int64(time.Millisecond)) {
+		t.Errorf("next deadline %s after falling behind", s.next)
+	}
+}
+
+func TestMissedSamples(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	tests := []struct {
+		gap    time.Duration
+		missed int
+	}{
+		{200 * time.Millisecond, 0},
+		{260 * time.Millisecond, 0},
+		{310 * time.Millisecond, 1},
+		{1000 * time.Millisecond, 4},
+		{10 * time.Millisecond, 0},
+	}
+	for _, test := range tests {
+		if missed := MissedSamples(start, start.Add(test.gap), 200); missed != test.missed {
+			t.Errorf("%s gap missed %d, want %d", test.gap, missed, test.missed)
+		}
+	}
+	if MissedSamples(time.Time{}, start, 200) != 0 {
+		t.Error("missed samples before the first one")
+	}
+}
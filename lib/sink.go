@@ -0,0 +1,216 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Sinks send each summary window somewhere else, like a metrics pipeline. The network
+// sinks share a batcher, which packs lines into payloads and holds on to ones that failed
+// to send so they can be retried with the next window, up to a limit.
+
+package cpustat
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Sink receives every summary window
+type Sink interface {
+	Write(s *Summary) error
+	Close() error
+}
+
+// AsyncSink writes to another sink from its own goroutine, so a sink that waits on the
+// network never holds up sampling. When its queue is full, summaries are dropped instead.
+type AsyncSink struct {
+	sink    Sink
+	queue   chan *Summary
+	done    chan struct{}
+	onError func(error)
+
+	lock    sync.Mutex
+	dropped int
+	failed  int
+}
+
+// NewAsyncSink queues up to size summaries for sink, and calls onError, if it isn't nil,
+// from the sink's goroutine when a write fails
+func NewAsyncSink(sink Sink, size int, onError func(error)) *AsyncSink {
+	s := AsyncSink{sink: sink, queue: make(chan *Summary, size), done: make(chan struct{}), onError: onError}
+	go s.run()
+	return &s
+}
+
+func (s *AsyncSink) run() {
+	defer close(s.done)
+	for summary := range s.queue {
+		if err := s.sink.Write(summary); err != nil {
+			s.lock.Lock()
+			s.failed++
+			s.lock.Unlock()
+			if s.onError != nil {
+				s.onError(err)
+			}
+		}
+	}
+}
+
+// Write queues summary, which must not be changed afterwards, and returns an error if the
+// queue was full and it was dropped
+func (s *AsyncSink) Write(summary *Summary) error {
+	select {
+	case s.queue <- summary:
+		return nil
+	default:
+	}
+	s.lock.Lock()
+	s.dropped++
+	dropped := s.dropped
+	s.lock.Unlock()
+	return fmt.Errorf("%T is falling behind, dropped %d summaries so far", s.sink, dropped)
+}
+
+// Dropped is how many summaries didn't fit in the queue
+func (s *AsyncSink) Dropped() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dropped
+}
+
+// Close waits for the queued summaries to be written, then closes the sink
+func (s *AsyncSink) Close() error {
+	close(s.queue)
+	<-s.done
+	if err := s.sink.Close(); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.dropped > 0 || s.failed > 0 {
+		return fmt.Errorf("%T dropped %d summaries and failed to write %d", s.sink, s.dropped, s.failed)
+	}
+	return nil
+}
+
+// Field is one leaf value of a summary struct, named by its json path, like cpu_pct.max
+type Field struct {
+	Name  string
+	Value interface{}
+}
+
+// Fields flattens a SystemSummary, ProcSummary or any other struct of summary values
+// into its leaf fields, in order
+func Fields(v interface{}) []Field {
+	var fields []Field
+	walkFields("", reflect.ValueOf(v), &fields)
+	return fields
+}
+
+// walkFields skips maps and slices, like the collector metrics, which MetricFields flattens
+func walkFields(prefix string, v reflect.Value, fields *[]Field) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, val := t.Field(i), v.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		switch {
+		case val.Kind() == reflect.Map || val.Kind() == reflect.Slice:
+		case val.Kind() == reflect.Struct && field.Anonymous && name == "":
+			walkFields(prefix, val, fields)
+		case val.Kind() == reflect.Struct:
+			walkFields(prefix+name+".", val, fields)
+		default:
+			*fields = append(*fields, Field{prefix + name, val.Interface()})
+		}
+	}
+}
+
+// MetricFields flattens the metrics of collectors into a field for each stat of each one,
+// like metrics.rchar.avg, in the order of their names
+func MetricFields(metrics map[string]MetricStat) []Field {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var fields []Field
+	for _, name := range names {
+		fields = append(fields, MetricStatFields(name, metrics[name])...)
+	}
+	return fields
+}
+
+// MetricStatFields is the fields of one metric, without its unit, which doesn't change
+func MetricStatFields(name string, stat MetricStat) []Field {
+	var fields []Field
+	for _, field := range Fields(stat) {
+		if field.Name != "unit" {
+			fields = append(fields, Field{"metrics." + name + "." + field.Name, field.Value})
+		}
+	}
+	return fields
+}
+
+// batcher packs lines into payloads of up to maxPayload bytes and sends them in order.
+// Payloads that fail to send are kept for the next flush, and when more than maxBuffered
+// bytes are waiting, the oldest are dropped.
+type batcher struct {
+	maxPayload  int
+	maxBuffered int
+	send        func(payload []byte) error
+	pending     [][]byte
+	buffered    int
+	dropped     int // payloads dropped because the buffer was full
+}
+
+// flush queues lines and tries to send everything that is waiting
+func (b *batcher) flush(lines []string) error {
+	var payload []byte
+	for _, line := range lines {
+		if len(payload) > 0 && len(payload)+len(line)+1 > b.maxPayload {
+			b.queue(payload)
+			payload = nil
+		}
+		payload = append(payload, line...)
+		payload = append(payload, '\n')
+	}
+	if len(payload) > 0 {
+		b.queue(payload)
+	}
+
+	for len(b.pending) > 0 {
+		if err := b.send(b.pending[0]); err != nil {
+			return fmt.Errorf("%s, %d bytes waiting to retry", err, b.buffered)
+		}
+		b.buffered -= len(b.pending[0])
+		b.pending = b.pending[1:]
+	}
+	return nil
+}
+
+func (b *batcher) queue(payload []byte) {
+	b.pending = append(b.pending, payload)
+	b.buffered += len(payload)
+	for b.buffered > b.maxBuffered && len(b.pending) > 1 {
+		b.buffered -= len(b.pending[0])
+		b.pending = b.pending[1:]
+		b.dropped++
+	}
+}
@@ -0,0 +1,377 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func sinkFixture() *Summary {
+	return &Summary{
+		Version: SummaryVersion,
+		End:     time.Unix(1500000000, 0),
+		Window:  2000,
+		Samples: 10,
+		System:  SystemSummary{Usr: Stat{10, 20.5, 30}, ProcsStarted: 3},
+		Procs: []ProcSummary{
+			{Pid: 42, Name: "web server", Comm: "nginx", CPU: Stat{1, 2, 3}, RSS: 4096},
+			{Pid: 43, Name: "db", Comm: "postgres", Threads: 7},
+		},
+	}
+}
+
+// udpListener collects packets sent to it
+func udpListener(t *testing.T) (net.PacketConn, func(n int) []string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(n int) []string {
+		var packets []string
+		buf := make([]byte, 65536)
+		wait := 2 * time.Second
+		for i := 0; i < n; i++ {
+			// wait a while for the first packet, but not long for the rest
+			conn.SetReadDeadline(time.Now().Add(wait))
+			wait = 200 * time.Millisecond
+			size, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			packets = append(packets, string(buf[:size]))
+		}
+		return packets
+	}
+	return conn, read
+}
+
+func contains(t *testing.T, what, got string, want ...string) {
+	for _, w := range want {
+		if strings.Contains(got, w) == false {
+			t.Errorf("%s is missing %q:\n%s", what, w, got)
+		}
+	}
+}
+
+func TestStatsdSink(t *testing.T) {
+	conn, read := udpListener(t)
+	defer conn.Close()
+
+	sink, err := NewStatsdSink(conn.LocalAddr().String(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err = sink.Write(sinkFixture()); err != nil {
+		t.Fatal(err)
+	}
+	packets := read(100)
+	for _, packet := range packets {
+		if len(packet) > statsdMaxPacket || strings.HasSuffix(packet, "\n") {
+			t.Errorf("bad packet of %d bytes", len(packet))
+		}
+	}
+	got := strings.Join(packets, "\n")
+	contains(t, "statsd output", got,
+		"cpustat.system.usr_pct.avg:20.5|g\n",
+		"cpustat.system.procs_started:3|g\n",
+		"cpustat.proc.web_server.42.cpu_pct.max:3|g\n",
+		"cpustat.proc.db.43.threads:7|g\n",
+	)
+	if strings.Contains(got, "|#") {
+		t.Error("plain statsd shouldn't have tags")
+	}
+}
+
+func TestDogStatsdSink(t *testing.T) {
+	conn, read := udpListener(t)
+	defer conn.Close()
+
+	sink, err := NewStatsdSink(conn.LocalAddr().String(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	sink.DogStatsd = true
+	sink.Tags = map[string]string{"host": "web01", "env": "prod"}
+	if err = sink.Write(sinkFixture()); err != nil {
+		t.Fatal(err)
+	}
+	contains(t, "dogstatsd output", strings.Join(read(100), "\n"),
+		"cpustat.system.usr_pct.max:30|g|#env:prod,host:web01\n",
+		"cpustat.proc.cpu_pct.max:3|g|#env:prod,host:web01,name:web server,pid:42\n",
+	)
+}
+
+func TestInfluxSinkUDP(t *testing.T) {
+	conn, read := udpListener(t)
+	defer conn.Close()
+
+	sink, err := NewInfluxSink("udp://"+conn.LocalAddr().String(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	sink.Tags = map[string]string{"host": "web01"}
+	if err = sink.Write(sinkFixture()); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(read(10), "")
+	contains(t, "influx output", got,
+		"cpustat_system,host=web01 version=1i,window_ms=2000,samples=10i,usr_pct_min=10,usr_pct_avg=20.5,",
+		"cpustat_proc,host=web01,name=web\\ server,pid=42 ppid=0i,uid=0i,comm=\"nginx\",",
+		"rss_bytes=4096i,",
+		" 1500000000000000000\n",
+	)
+}
+
+func TestInfluxSinkHTTPRetry(t *testing.T) {
+	var lock sync.Mutex
+	var bodies []string
+	fail := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if fail {
+			http.Error(w, "database not found", http.StatusNotFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink, err := NewInfluxSink(server.URL+"/write?db=cpustat", 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	first := sinkFixture()
+	if err = sink.Write(first); err == nil || strings.Contains(err.Error(), "database not found") == false {
+		t.Error("failed write should return the server's error, got", err)
+	}
+
+	lock.Lock()
+	fail = false
+	lock.Unlock()
+	second := sinkFixture()
+	second.End = first.End.Add(2 * time.Second)
+	if err = sink.Write(second); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 2 {
+		t.Fatal("expected the retried and new batch, got", len(bodies))
+	}
+	if strings.HasSuffix(bodies[0], " 1500000000000000000\n") == false ||
+		strings.HasSuffix(bodies[1], " 1500000002000000000\n") == false {
+		t.Error("batches were sent out of order:", bodies)
+	}
+}
+
+func TestInfluxSinkFile(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "sink_test.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	sink, err := NewInfluxSink(tmpfile.Name(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Write(sinkFixture())
+	sink.Write(sinkFixture())
+	sink.Close()
+
+	contents, err := ioutil.ReadFile(tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(contents)), "\n"); len(lines) != 6 {
+		t.Error("expected 3 lines per window, got", len(lines))
+	}
+}
+
+// metricsFixture is sinkFixture with metrics from collectors
+func metricsFixture() *Summary {
+	s := sinkFixture()
+	s.System.Metrics = map[string]MetricStat{"ctxt": {Unit: "switches", Stat: Stat{1, 2, 3}, Value: 20}}
+	s.Procs[0].Metrics = map[string]MetricStat{"rchar": {Unit: "bytes", Stat: Stat{0, 5, 10}, Value: 50}}
+	return s
+}
+
+func TestInfluxLineMetrics(t *testing.T) {
+	s := metricsFixture()
+	sys := influxLine("cpustat_system", "", append(Fields(s.System), MetricFields(s.System.Metrics)...), 1)
+	proc := influxLine("cpustat_proc", "", append(Fields(s.Procs[0]), MetricFields(s.Procs[0].Metrics)...), 1)
+	for _, line := range []string{sys, proc} {
+		if strings.Contains(line, "map[") || strings.Contains(line, "omitempty") {
+			t.Error("maps should be written as fields:", line)
+		}
+	}
+	contains(t, "system line", sys, "metrics_ctxt_min=1,", "metrics_ctxt_avg=2,", "metrics_ctxt_value=20 ")
+	contains(t, "proc line", proc, "metrics_rchar_max=10,", "metrics_rchar_value=50 ")
+}
+
+func TestCSVSinkMetrics(t *testing.T) {
+	var out strings.Builder
+	metrics := Metrics{
+		Proc:   []Metric{{Name: "rchar", Unit: "bytes"}},
+		System: []Metric{{Name: "ctxt", Unit: "switches", Kind: Counter}},
+	}
+	sink, err := NewCSVSink(&out, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Write(metricsFixture()); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatal("expected a header, a system row and 2 proc rows, got", lines)
+	}
+	header := strings.Split(lines[0], ",")
+	column := make(map[string]int)
+	for i, name := range header {
+		column[name] = i
+	}
+	for _, name := range []string{"system.metrics.ctxt.avg", "proc.metrics.rchar.value"} {
+		if _, ok := column[name]; ok == false {
+			t.Error("no column", name, "in", header)
+		}
+	}
+	if strings.Contains(out.String(), "map[") || strings.Contains(lines[0], "omitempty") {
+		t.Error("maps should be written as columns:", lines[0])
+	}
+	rows := make([][]string, len(lines))
+	for i, line := range lines {
+		if rows[i] = strings.Split(line, ","); len(rows[i]) != len(header) {
+			t.Fatal("row", i, "has", len(rows[i]), "columns, the header has", len(header))
+		}
+	}
+	if got := rows[1][column["system.metrics.ctxt.avg"]]; got != "2.000" {
+		t.Error("system ctxt avg", got)
+	}
+	if got := rows[2][column["proc.metrics.rchar.value"]]; got != "50.000" {
+		t.Error("proc rchar value", got)
+	}
+	// a process without the metric leaves it blank
+	if got := rows[3][column["proc.metrics.rchar.value"]]; got != "" {
+		t.Error("missing rchar value", got)
+	}
+}
+
+func TestNewInfluxSinkBadScheme(t *testing.T) {
+	if _, err := NewInfluxSink("tcp://localhost:8089", 1024); err == nil {
+		t.Error("unknown scheme should be an error")
+	}
+}
+
+func TestBatcherBuffering(t *testing.T) {
+	var sent []string
+	down := true
+	b := batcher{maxPayload: 10, maxBuffered: 20, send: func(payload []byte) error {
+		if down {
+			return errors.New("down")
+		}
+		sent = append(sent, string(payload))
+		return nil
+	}}
+
+	if err := b.flush([]string{"aaaa", "bbbb", "cccc"}); err == nil {
+		t.Error("flush should fail while sends fail")
+	}
+	if len(b.pending) != 2 || b.buffered != 15 {
+		t.Error("lines should be packed into 2 payloads, have", len(b.pending), b.buffered)
+	}
+	b.flush([]string{"dddd", "eeee"})
+	if b.buffered > 20 || b.dropped != 1 {
+		t.Error("oldest payload should have been dropped to stay under the limit", b.buffered, b.dropped)
+	}
+
+	down = false
+	if err := b.flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(sent, "|") != "cccc\n|dddd\neeee\n" || b.buffered != 0 {
+		t.Error("wrong payloads sent after recovery:", sent)
+	}
+}
+
+// slowSink blocks each write until it's released
+type slowSink struct {
+	release chan struct{}
+	written int
+	closed  bool
+}
+
+func (s *slowSink) Write(summary *Summary) error {
+	<-s.release
+	s.written++
+	return nil
+}
+
+func (s *slowSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestAsyncSink(t *testing.T) {
+	slow := &slowSink{release: make(chan struct{})}
+	sink := NewAsyncSink(slow, 2, nil)
+
+	// one write is stuck in the sink and two are queued, so the fourth is dropped
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 4; i++ {
+			sink.Write(sinkFixture())
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("writes blocked on a slow sink")
+	}
+	if sink.Dropped() < 1 {
+		t.Errorf("dropped %d summaries", sink.Dropped())
+	}
+
+	close(slow.release)
+	if err := sink.Close(); err == nil {
+		t.Error("close didn't report the dropped summaries")
+	}
+	if slow.closed == false || slow.written+sink.Dropped() != 4 {
+		t.Errorf("wrote %d and dropped %d of 4 summaries", slow.written, sink.Dropped())
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Profiles of made up call stacks, for looking at where CPU time went with tools built for
+// code profiles. The frames are usually the ancestry of a process, so a flame graph of one
+// groups processes by what started them.
+
+package cpustat
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StackProfile adds up values, all in nanoseconds, for each distinct stack
+type StackProfile struct {
+	Types  []string // name of each value, like cpu or runq
+	stacks map[string]*profileStack
+}
+
+type profileStack struct {
+	frames []string // root first
+	values []int64
+}
+
+func NewStackProfile(types ...string) *StackProfile {
+	return &StackProfile{types, make(map[string]*profileStack)}
+}
+
+// Add adds values, one for each of Types, to the stack made of frames, root first
+func (p *StackProfile) Add(frames []string, values ...int64) {
+	key := strings.Join(frames, "\x00")
+	stack, ok := p.stacks[key]
+	if ok == false {
+		stack = &profileStack{frames, make([]int64, len(p.Types))}
+		p.stacks[key] = stack
+	}
+	for i, v := range values {
+		stack.values[i] += v
+	}
+}
+
+type byFrames []*profileStack
+
+func (s byFrames) Len() int {
+	return len(s)
+}
+func (s byFrames) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s byFrames) Less(i, j int) bool {
+	a, b := s[i].frames, s[j].frames
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] != b[k] {
+			return a[k] < b[k]
+		}
+	}
+	return len(a) < len(b)
+}
+
+func (p *StackProfile) sorted() []*profileStack {
+	list := make([]*profileStack, 0, len(p.stacks))
+	for _, stack := range p.stacks {
+		list = append(list, stack)
+	}
+	sort.Sort(byFrames(list))
+	return list
+}
+
+// WriteFolded writes one value of each stack in the folded format used by flamegraph.pl,
+// which is the frames separated by semicolons, a space and the value divided by unit.
+// Stacks that round down to 0 are left out.
+func (p *StackProfile) WriteFolded(w io.Writer, index int, unit int64) error {
+	out := bufio.NewWriter(w)
+	clean := strings.NewReplacer(";", ":", "\n", " ")
+	for _, stack := range p.sorted() {
+		value := stack.values[index] / unit
+		if value == 0 {
+			continue
+		}
+		frames := make([]string, len(stack.frames))
+		for i, frame := range stack.frames {
+			frames[i] = clean.Replace(frame)
+		}
+		fmt.Fprintf(out, "%s %d\n", strings.Join(frames, ";"), value)
+	}
+	return out.Flush()
+}
+
+// WritePprof writes a gzipped pprof profile, with a sample for each stack and a function
+// and location for each distinct frame
+func (p *StackProfile) WritePprof(w io.Writer, start time.Time, duration time.Duration) error {
+	strs := map[string]uint64{"": 0}
+	strList := []string{""}
+	str := func(s string) uint64 {
+		id, ok := strs[s]
+		if ok == false {
+			id = uint64(len(strList))
+			strs[s] = id
+			strList = append(strList, s)
+		}
+		return id
+	}
+	// functions and locations are the same thing here, and share ids
+	frameIDs := make(map[string]uint64)
+	var frameList []string
+
+	var b protoBuf
+	for _, name := range p.Types {
+		b.message(1, func(vt *protoBuf) {
+			vt.uint(1, str(name))
+			vt.uint(2, str("nanoseconds"))
+		})
+	}
+	for _, stack := range p.sorted() {
+		b.message(2, func(sample *protoBuf) {
+			var ids protoBuf
+			for i := len(stack.frames) - 1; i >= 0; i-- {
+				id, ok := frameIDs[stack.frames[i]]
+				if ok == false {
+					frameList = append(frameList, stack.frames[i])
+					id = uint64(len(frameList))
+					frameIDs[stack.frames[i]] = id
+				}
+				ids.varint(id)
+			}
+			sample.bytes(1, ids)
+			var values protoBuf
+			for _, v := range stack.values {
+				values.varint(uint64(v))
+			}
+			sample.bytes(2, values)
+		})
+	}
+	for i, frame := range frameList {
+		id := uint64(i + 1)
+		b.message(4, func(loc *protoBuf) {
+			loc.uint(1, id)
+			loc.message(4, func(line *protoBuf) {
+				line.uint(1, id)
+			})
+		})
+		b.message(5, func(fn *protoBuf) {
+			fn.uint(1, id)
+			fn.uint(2, str(frame))
+		})
+	}
+	b.message(11, func(vt *protoBuf) {
+		vt.uint(1, str("wall"))
+		vt.uint(2, str("nanoseconds"))
+	})
+	for _, s := range strList {
+		b.string(6, s)
+	}
+	b.uint(9, uint64(start.UnixNano()))
+	b.uint(10, uint64(duration))
+
+	out := gzip.NewWriter(w)
+	if _, err := out.Write(b); err != nil {
+		return err
+	}
+	return out.Close()
+}
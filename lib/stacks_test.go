@@ -0,0 +1,113 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func stackFixture() *StackProfile {
+	p := NewStackProfile("cpu", "runq")
+	p.Add([]string{"init", "sshd", "bash"}, 3e6, 1e6)
+	p.Add([]string{"init", "nginx"}, 5e6, 0)
+	p.Add([]string{"init", "sshd", "bash"}, 2e6, 4e5)
+	p.Add([]string{"init", "cron;x"}, 1e5, 0)
+	return p
+}
+
+func TestWriteFolded(t *testing.T) {
+	var out bytes.Buffer
+	if err := stackFixture().WriteFolded(&out, 0, 1e6); err != nil {
+		t.Fatal(err)
+	}
+	want := "init;nginx 5\ninit;sshd;bash 5\n"
+	if out.String() != want {
+		t.Errorf("folded cpu = %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	stackFixture().WriteFolded(&out, 1, 1e5)
+	want = "init;sshd;bash 14\n"
+	if out.String() != want {
+		t.Errorf("folded runq = %q, want %q", out.String(), want)
+	}
+}
+
+func TestWritePprof(t *testing.T) {
+	var out bytes.Buffer
+	start := time.Unix(1500000000, 0)
+	if err := stackFixture().WritePprof(&out, start, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	in, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := decodeProto(t, raw)
+
+	var strs []string
+	for _, s := range profile[6] {
+		strs = append(strs, string(s.raw))
+	}
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("string table = %q, must start with an empty string", strs)
+	}
+	if len(profile[1]) != 2 || strs[decodeProto(t, profile[1][1].raw)[1][0].num] != "runq" {
+		t.Errorf("sample types are wrong")
+	}
+	if profile[9][0].num != uint64(start.UnixNano()) || profile[10][0].num != uint64(time.Minute) {
+		t.Errorf("time = %d %d", profile[9][0].num, profile[10][0].num)
+	}
+
+	funcs := make(map[uint64]string)
+	for _, f := range profile[5] {
+		fn := decodeProto(t, f.raw)
+		funcs[fn[1][0].num] = strs[fn[2][0].num]
+	}
+	if len(funcs) != 5 || len(profile[4]) != 5 {
+		t.Errorf("got %d functions and %d locations, want 5", len(funcs), len(profile[4]))
+	}
+
+	// samples are sorted by stack, and their locations are leaf first
+	if len(profile[2]) != 3 {
+		t.Fatalf("got %d samples, want 3", len(profile[2]))
+	}
+	sample := decodeProto(t, profile[2][2].raw)
+	var stack []string
+	for ids := sample[1][0].raw; len(ids) > 0; ids = ids[1:] {
+		stack = append(stack, funcs[uint64(ids[0])])
+	}
+	values := sample[2][0].raw
+	if len(stack) != 3 || stack[0] != "bash" || stack[2] != "init" {
+		t.Errorf("stack = %q, want bash, sshd, init", stack)
+	}
+	if len(values) == 0 {
+		t.Error("sample has no values")
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// StatsD output over UDP. Every numeric summary value is sent as a gauge. Plain StatsD has
+// no tags, so process metrics have the name and pid in the metric name. With DogStatsD
+// they are tags instead, along with any extra tags.
+
+package cpustat
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// keep packets small enough to not be fragmented on a typical network
+const statsdMaxPacket = 1432
+
+type StatsdSink struct {
+	Prefix    string            // prepended to every metric name, like "cpustat."
+	DogStatsd bool              // send tags in the DogStatsD format
+	Tags      map[string]string // extra tags for every metric, only with DogStatsd
+	conn      net.Conn
+	batch     batcher
+}
+
+// NewStatsdSink sends to a StatsD server at addr, buffering up to maxBuffered bytes
+// of metrics when sends fail
+func NewStatsdSink(addr string, maxBuffered int) (*StatsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := StatsdSink{Prefix: "cpustat.", conn: conn}
+	s.batch = batcher{maxPayload: statsdMaxPacket, maxBuffered: maxBuffered, send: s.send}
+	return &s, nil
+}
+
+func (s *StatsdSink) send(payload []byte) error {
+	// statsd servers accept several metrics per packet, but not a trailing newline
+	_, err := s.conn.Write(payload[:len(payload)-1])
+	return err
+}
+
+func (s *StatsdSink) Write(summary *Summary) error {
+	var lines []string
+	globalTags := s.tagList(nil)
+
+	lines = append(lines, s.gauge("system.samples", float64(summary.Samples), globalTags))
+	lines = append(lines, s.gauge("system.window_ms", summary.Window, globalTags))
+	for _, field := range append(Fields(summary.System), MetricFields(summary.System.Metrics)...) {
+		if val, ok := numericValue(field.Value); ok {
+			lines = append(lines, s.gauge("system."+field.Name, val, globalTags))
+		}
+	}
+
+	for _, proc := range summary.Procs {
+		prefix := "proc."
+		tags := globalTags
+		if s.DogStatsd {
+			tags = s.tagList(map[string]string{"name": proc.Name, "pid": fmt.Sprint(proc.Pid)})
+		} else {
+			prefix = fmt.Sprintf("proc.%s.%d.", statsdName(proc.Name), proc.Pid)
+		}
+		for _, field := range append(Fields(proc), MetricFields(proc.Metrics)...) {
+			if field.Name == "pid" {
+				continue
+			}
+			if val, ok := numericValue(field.Value); ok {
+				lines = append(lines, s.gauge(prefix+field.Name, val, tags))
+			}
+		}
+	}
+	return s.batch.flush(lines)
+}
+
+func (s *StatsdSink) Close() error {
+	return s.conn.Close()
+}
+
+func (s *StatsdSink) gauge(name string, val float64, tags string) string {
+	return s.Prefix + name + ":" + strconv.FormatFloat(val, 'f', -1, 64) + "|g" + tags
+}
+
+// tagList formats the extra tags plus more as a DogStatsD tag suffix, sorted so the
+// output is stable
+func (s *StatsdSink) tagList(more map[string]string) string {
+	if s.DogStatsd == false {
+		return ""
+	}
+	var tags []string
+	for k, v := range s.Tags {
+		if _, ok := more[k]; ok == false {
+			tags = append(tags, statsdTag(k)+":"+statsdTag(v))
+		}
+	}
+	for k, v := range more {
+		tags = append(tags, statsdTag(k)+":"+statsdTag(v))
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	sort.Strings(tags)
+	return "|#" + strings.Join(tags, ",")
+}
+
+// statsdName makes a process name safe to use as one part of a metric name
+func statsdName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', ',', ' ', '/':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func statsdTag(tag string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '|', ',', '#', ':', '\n':
+			return '_'
+		}
+		return r
+	}, tag)
+}
+
+// numericValue converts the number types used in summaries to float64
+func numericValue(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case int:
+		return float64(val), true
+	case int64:
+		return float64(val), true
+	case uint32:
+		return float64(val), true
+	case uint64:
+		return float64(val), true
+	}
+	return 0, false
+}
@@ -0,0 +1,295 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Snapshots of what changed between two samples, and windows that add them up, which is what
+// cpustat prints every -s samples and the agent serves for each scrape.
+
+package cpustat
+
+import "time"
+
+// Snapshot is what changed between two samples. It isn't changed after it's made, so it can
+// be kept or handed to another goroutine.
+type Snapshot struct {
+	Start, End time.Time     // when the two samples were taken
+	Interval   uint32        // ms, which the deltas are scaled to
+	Missed     int           // samples that should have been between the two, but weren't taken
+	Late       time.Duration // how far behind schedule the second sample was, or -1 if unknown
+	Procs      ProcSampleMap // the change of each process in one interval, with its Weight
+	ProcTotals ProcSampleMap // the change of each process, unscaled, with its latest RSS and threads
+	Carried    Pidlist       // processes in the slow tier that weren't read again, so have no change
+	Sys        *SystemStats  // the change of the system in one interval
+	SysTotals  *SystemStats  // the change of the system, unscaled
+	Metrics    Metrics       // what the Values of the deltas and totals are
+}
+
+// NewSnapshot diffs a sample against the one before it, which like for ProcStatsRecord have
+// to be sorted by pid
+func NewSnapshot(interval uint32, procs, prevProcs ProcSampleList, sys, prevSys *SystemStats) *Snapshot {
+	s := Snapshot{
+		Start:      prevSys.CaptureTime,
+		End:        sys.CaptureTime,
+		Interval:   interval,
+		Missed:     MissedSamples(prevSys.CaptureTime, sys.CaptureTime, int(interval)),
+		Late:       -1,
+		Procs:      make(ProcSampleMap, procs.Len),
+		ProcTotals: make(ProcSampleMap, procs.Len),
+		SysTotals:  &SystemStats{},
+		Carried:    carriedPids(procs, prevProcs),
+	}
+	ProcStatsRecord(interval, procs, prevProcs, s.ProcTotals, s.Procs)
+	TaskStatsRecord(interval, procs, prevProcs, s.ProcTotals, s.Procs)
+	s.Sys = SystemStatsRecord(interval, sys, prevSys, s.SysTotals)
+	return &s
+}
+
+// carriedPids lists the processes that have the same sample in both lists, which is how a
+// TieredReader carries the slow ones that it didn't read
+func carriedPids(procs, prevProcs ProcSampleList) Pidlist {
+	var carried Pidlist
+	curPos, prevPos := uint32(0), uint32(0)
+	for curPos < procs.Len && prevPos < prevProcs.Len {
+		cur, prev := &procs.Samples[curPos], &prevProcs.Samples[prevPos]
+		if cur.Pid < prev.Pid {
+			curPos++
+		} else if cur.Pid > prev.Pid {
+			prevPos++
+		} else {
+			if cur.Proc.CaptureTime.Equal(prev.Proc.CaptureTime) {
+				carried = append(carried, cur.Pid)
+			}
+			curPos++
+			prevPos++
+		}
+	}
+	return carried
+}
+
+// recordMetrics diffs the Values that collectors read, which the Sampler does after
+// NewSnapshot since a sample alone doesn't say what they are
+func (s *Snapshot) recordMetrics(metrics Metrics, procs, prevProcs ProcSampleList, sys, prevSys *SystemStats) {
+	s.Metrics = metrics
+	if len(metrics.Proc) > 0 {
+		ProcMetricsRecord(s.Interval, metrics.Proc, procs, prevProcs, s.ProcTotals, s.Procs)
+	}
+	if len(metrics.System) > 0 {
+		SystemMetricsRecord(s.Interval, metrics.System, sys, prevSys, s.SysTotals, s.Sys)
+	}
+}
+
+// Weight is how many intervals the snapshot covers
+func (s *Snapshot) Weight() int64 {
+	return int64(s.Missed + 1)
+}
+
+// Window adds up snapshots, into the sums and histograms that a Summary is made from
+type Window struct {
+	Start, End time.Time
+	Samples    int // intervals covered, including missed samples
+	ProcSum    ProcSampleMap
+	ProcHist   ProcStatsHistMap
+	TaskHist   TaskStatsHistMap
+	SysSum     *SystemStats
+	SysHist    *SystemStatsHist
+	Timing     *SampleTiming
+	Metrics    Metrics                 // of the Values in the sums and histograms below
+	ValueHist  map[int][]*ExpHistogram // for each process, in the order of Metrics.Proc
+	SysValues  []*ExpHistogram
+}
+
+func NewWindow() *Window {
+	return &Window{
+		ProcSum:   make(ProcSampleMap),
+		ProcHist:  make(ProcStatsHistMap),
+		TaskHist:  make(TaskStatsHistMap),
+		SysSum:    &SystemStats{},
+		SysHist:   NewSysStatsHist(),
+		Timing:    NewSampleTiming(),
+		ValueHist: make(map[int][]*ExpHistogram),
+	}
+}
+
+func (w *Window) Add(snap *Snapshot) {
+	if w.Samples == 0 {
+		w.Start = snap.Start
+	}
+	w.End = snap.End
+	w.Samples += int(snap.Weight())
+	if snap.Metrics.Proc != nil || snap.Metrics.System != nil {
+		w.Metrics = snap.Metrics
+	}
+
+	UpdateProcStatsHist(w.ProcHist, snap.Procs)
+	UpdateTaskStatsHist(w.TaskHist, snap.Procs)
+	for pid, change := range snap.ProcTotals {
+		sum, ok := w.ProcSum[pid]
+		if ok == false {
+			sum = &ProcSample{}
+			w.ProcSum[pid] = sum
+		}
+		addProcTotals(sum, change)
+		sum.Values = addValues(w.Metrics.Proc, sum.Values, change.Values)
+	}
+	UpdateSysStatsHistWeighted(w.SysHist, snap.Sys, snap.Weight())
+	addSysTotals(w.SysSum, snap.SysTotals)
+	w.SysSum.Values = addValues(w.Metrics.System, w.SysSum.Values, snap.SysTotals.Values)
+	w.Timing.Add(snap.Missed, snap.Late)
+
+	for pid, delta := range snap.Procs {
+		if len(delta.Values) == 0 {
+			continue
+		}
+		hists, ok := w.ValueHist[pid]
+		if ok == false {
+			hists = newValueHists(len(delta.Values))
+			w.ValueHist[pid] = hists
+		}
+		recordValueHists(hists, delta.Values, delta.weight())
+	}
+	if len(snap.Sys.Values) > 0 {
+		if w.SysValues == nil {
+			w.SysValues = newValueHists(len(snap.Sys.Values))
+		}
+		recordValueHists(w.SysValues, snap.Sys.Values, snap.Weight())
+	}
+}
+
+// valueHistScale starts the histograms of Values at about 4% error, which they lower if
+// the values are spread too far apart
+const valueHistScale = 4
+
+func newValueHists(n int) []*ExpHistogram {
+	hists := make([]*ExpHistogram, n)
+	for i := range hists {
+		hists[i] = NewExpHistogram(valueHistScale)
+	}
+	return hists
+}
+
+// recordValueHists records each value once per interval it covers, like the weighted
+// histograms of the built in fields
+func recordValueHists(hists []*ExpHistogram, values []float64, weight int64) {
+	if weight < 1 {
+		return
+	}
+	for i, val := range values {
+		hists[i].RecordN(val, uint64(weight))
+	}
+}
+
+// Summary makes a Summary of the window, with the processes in list
+func (w *Window) Summary(infoMap ProcInfoMap, list Pidlist, jiffy, interval int) *Summary {
+	summary := NewSummary(w.Start, w.End, infoMap, list, w.ProcSum, w.ProcHist, w.TaskHist, w.SysSum, w.SysHist,
+		jiffy, interval)
+	summary.SetTiming(w.Timing)
+
+	if len(w.Metrics.System) > 0 && len(w.SysValues) == len(w.Metrics.System) {
+		summary.System.Metrics = metricStats(w.Metrics.System, w.SysSum.Values, w.SysValues)
+	}
+	if len(w.Metrics.Proc) > 0 {
+		for i := range summary.Procs {
+			pid := summary.Procs[i].Pid
+			hists, ok := w.ValueHist[pid]
+			if ok == false || w.ProcSum[pid] == nil {
+				continue
+			}
+			summary.Procs[i].Metrics = metricStats(w.Metrics.Proc, w.ProcSum[pid].Values, hists)
+		}
+	}
+	return summary
+}
+
+// addProcTotals adds the counters of change to sum, and takes its gauges
+func addProcTotals(sum, change *ProcSample) {
+	s, c := &sum.Proc, &change.Proc
+	s.CaptureTime = c.CaptureTime
+	s.Utime += c.Utime
+	s.Stime += c.Stime
+	s.Cutime += c.Cutime
+	s.Cstime += c.Cstime
+	s.Numthreads = c.Numthreads
+	s.Rss = c.Rss
+	s.Guesttime += c.Guesttime
+	s.Cguesttime += c.Cguesttime
+
+	st, ct := &sum.Task, &change.Task
+	st.Capturetime = ct.Capturetime
+	st.Cpudelaycount += ct.Cpudelaycount
+	st.Cpudelaytotal += ct.Cpudelaytotal
+	st.Blkiodelaycount += ct.Blkiodelaycount
+	st.Blkiodelaytotal += ct.Blkiodelaytotal
+	st.Swapindelaycount += ct.Swapindelaycount
+	st.Swapindelaytotal += ct.Swapindelaytotal
+	st.Nvcsw += ct.Nvcsw
+	st.Nivcsw += ct.Nivcsw
+	st.Freepagesdelaycount += ct.Freepagesdelaycount
+	st.Freepagesdelaytotal += ct.Freepagesdelaytotal
+	st.Readbytes += ct.Readbytes
+	st.Writebytes += ct.Writebytes
+}
+
+func addSysTotals(sum, change *SystemStats) {
+	sum.CaptureTime = change.CaptureTime
+	sum.Usr += change.Usr
+	sum.Nice += change.Nice
+	sum.Sys += change.Sys
+	sum.Idle += change.Idle
+	sum.Iowait += change.Iowait
+	sum.Irq += change.Irq
+	sum.Softirq += change.Softirq
+	sum.Steal += change.Steal
+	sum.Guest += change.Guest
+	sum.GuestNice += change.GuestNice
+	sum.Ctxt += change.Ctxt
+	sum.ProcsTotal += change.ProcsTotal
+	sum.ProcsRunning = change.ProcsRunning
+	sum.ProcsBlocked = change.ProcsBlocked
+}
+
+// Summarizer adds up snapshots into windows of a number of samples, like cpustat -s. Missed
+// samples count towards a window, so each one covers the same time.
+type Summarizer struct {
+	samples int
+	window  *Window
+}
+
+func NewSummarizer(samples int) *Summarizer {
+	return &Summarizer{samples: samples, window: NewWindow()}
+}
+
+// Add adds snap to the current window, and returns the window once it's full
+func (s *Summarizer) Add(snap *Snapshot) *Window {
+	s.window.Add(snap)
+	if s.window.Samples < s.samples {
+		return nil
+	}
+	return s.Flush()
+}
+
+// Flush returns the current window even if it isn't full, or nil if it's empty, and starts
+// a new one
+func (s *Summarizer) Flush() *Window {
+	w := s.window
+	s.window = NewWindow()
+	if w.Samples == 0 {
+		return nil
+	}
+	return w
+}
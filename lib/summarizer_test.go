@@ -0,0 +1,81 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"testing"
+	"time"
+)
+
+func testSnapshot(start time.Time, missed int, utime, rss uint64) *Snapshot {
+	end := start.Add(time.Duration(missed+1) * 100 * time.Millisecond)
+	return &Snapshot{
+		Start:      start,
+		End:        end,
+		Interval:   100,
+		Missed:     missed,
+		Late:       time.Millisecond,
+		Procs:      ProcSampleMap{7: &ProcSample{Pid: 7, Proc: ProcStats{Utime: utime}, Weight: int64(missed + 1)}},
+		ProcTotals: ProcSampleMap{7: &ProcSample{Proc: ProcStats{CaptureTime: end, Utime: utime, Rss: rss}}},
+		Sys:        &SystemStats{CaptureTime: end, Usr: utime},
+		SysTotals:  &SystemStats{CaptureTime: end, Usr: utime, ProcsRunning: rss},
+	}
+}
+
+func TestSummarizer(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	s := NewSummarizer(4)
+	if w := s.Add(testSnapshot(start, 0, 5, 1)); w != nil {
+		t.Fatal("window after 1 of 4 samples")
+	}
+	// the missed samples fill the window
+	w := s.Add(testSnapshot(start.Add(100*time.Millisecond), 2, 6, 2))
+	if w == nil {
+		t.Fatal("no window after 4 samples")
+	}
+	if w.Samples != 4 || w.Start != start || w.End != start.Add(400*time.Millisecond) {
+		t.Errorf("window of %d samples from %s to %s", w.Samples, w.Start, w.End)
+	}
+	sum := w.ProcSum[7].Proc
+	if sum.Utime != 11 || sum.Rss != 2 || w.SysSum.Usr != 11 || w.SysSum.ProcsRunning != 2 {
+		t.Errorf("window sums %+v %+v", sum, w.SysSum)
+	}
+	if w.ProcHist[7].Utime.TotalCount() != 4 || w.SysHist.Usr.TotalCount() != 4 {
+		t.Errorf("histograms counted %d and %d samples", w.ProcHist[7].Utime.TotalCount(),
+			w.SysHist.Usr.TotalCount())
+	}
+	if w.Timing.Missed != 2 || w.Timing.Late.TotalCount() != 2 {
+		t.Errorf("window timing missed %d", w.Timing.Missed)
+	}
+
+	summary := w.Summary(ProcInfoMap{7: &ProcInfo{Comm: "seven"}}, Pidlist{7}, 100, 100)
+	if summary.Samples != 4 || summary.Missed != 2 || len(summary.Procs) != 1 {
+		t.Errorf("summary of %d samples, %d missed, %d procs", summary.Samples, summary.Missed, len(summary.Procs))
+	}
+
+	if s.Flush() != nil {
+		t.Error("flushed an empty window")
+	}
+	s.Add(testSnapshot(start.Add(400*time.Millisecond), 0, 1, 3))
+	if w = s.Flush(); w == nil || w.Samples != 1 || w.Start != start.Add(400*time.Millisecond) {
+		t.Error("partial window wasn't flushed")
+	}
+}
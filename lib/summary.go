@@ -0,0 +1,237 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// A Summary is everything we know about one summary window, in explicit units, so that
+// output formats and sinks don't each have to redo the tick and ns math. The json names
+// are the stable schema for machine readable output. Add fields freely, but if the meaning
+// or unit of an existing one changes, bump SummaryVersion.
+
+package cpustat
+
+import (
+	"strings"
+	"time"
+
+	"github.com/codahale/hdrhistogram"
+)
+
+// SummaryVersion is the version of the Summary schema
+const SummaryVersion = 1
+
+// Stat is the per-sample distribution of a metric over a summary window
+type Stat struct {
+	Min float64 `json:"min"`
+	Avg float64 `json:"avg"`
+	Max float64 `json:"max"`
+}
+
+// MetricStat is a metric that a collector read, over a summary window
+type MetricStat struct {
+	Unit  string  `json:"unit"`
+	Stat          // per interval, which for a counter is how much it went up
+	Value float64 `json:"value"` // a counter's change during the window, or a gauge's latest value
+}
+
+type SystemSummary struct {
+	Usr          Stat    `json:"usr_pct"`    // percent of a CPU, so up to 100 * number of CPUs
+	Nice         Stat    `json:"nice_pct"`   // percent of a CPU
+	Sys          Stat    `json:"sys_pct"`    // percent of a CPU
+	Idle         Stat    `json:"idle_pct"`   // percent of a CPU
+	Iowait       Stat    `json:"iowait_pct"` // percent of a CPU
+	Irq          float64 `json:"irq_pct"`    // average percent of a CPU
+	Softirq      float64 `json:"softirq_pct"`
+	Steal        float64 `json:"steal_pct"`
+	Ctxsw        float64 `json:"ctxsw_per_sec"`
+	ProcsStarted uint64  `json:"procs_started"` // processes created during the window
+	ProcsRunning Stat    `json:"procs_running"`
+	ProcsBlocked Stat    `json:"procs_blocked"`
+
+	// from collectors other than the built in ones
+	Metrics map[string]MetricStat `json:"metrics,omitempty"`
+}
+
+type ProcSummary struct {
+	Pid        int     `json:"pid"`
+	Ppid       uint64  `json:"ppid"`
+	UID        uint32  `json:"uid"`
+	Name       string  `json:"name"`
+	Comm       string  `json:"comm"`
+	Cmdline    string  `json:"cmdline"`
+	Nice       int64   `json:"nice"`
+	Samples    int64   `json:"samples"`
+	CPU        Stat    `json:"cpu_pct"` // usr+sys per sample, percent of a CPU
+	CPUP95     float64 `json:"cpu_p95_pct"`
+	Usr        float64 `json:"usr_pct"` // averages over the window, percent of a CPU
+	Sys        float64 `json:"sys_pct"`
+	Ctime      float64 `json:"ctime_pct"` // usr+sys of children that exited
+	Runq       float64 `json:"runq_pct"`
+	Iowait     float64 `json:"iowait_pct"`
+	Swap       float64 `json:"swap_pct"`
+	Vcsw       uint64  `json:"vcsw"` // context switches during the window
+	Ivcsw      uint64  `json:"ivcsw"`
+	RSS        uint64  `json:"rss_bytes"` // at the end of the window
+	Threads    uint64  `json:"threads"`
+	ReadBytes  uint64  `json:"read_bytes"` // storage IO during the window
+	WriteBytes uint64  `json:"write_bytes"`
+
+	// from collectors other than the built in ones
+	Metrics map[string]MetricStat `json:"metrics,omitempty"`
+}
+
+type Summary struct {
+	Version  int           `json:"version"`
+	Start    time.Time     `json:"start"`
+	End      time.Time     `json:"end"`
+	Window   float64       `json:"window_ms"` // measured length of the window
+	Interval int           `json:"interval_ms"`
+	Samples  int64         `json:"samples"`
+	Missed   int64         `json:"missed_samples"`  // counted in samples, but not taken
+	Late     Stat          `json:"late_ms"`         // how late samples were, if known
+	Final    bool          `json:"final,omitempty"` // the whole run, at the end
+	Tiers    *TierStats    `json:"tiers,omitempty"` // with tiered sampling, what each tier cost
+	System   SystemSummary `json:"system"`
+	Procs    []ProcSummary `json:"procs"`
+}
+
+// NewSummary converts the sums and histograms of a window into a Summary, with a
+// ProcSummary for each process in list that we have data for.
+func NewSummary(start, end time.Time, infoMap ProcInfoMap, list Pidlist, procSum ProcSampleMap,
+	procHist ProcStatsHistMap, taskHist TaskStatsHistMap, sysSum *SystemStats, sysHist *SystemStatsHist,
+	jiffy, interval int) *Summary {
+
+	s := Summary{
+		Version:  SummaryVersion,
+		Start:    start,
+		End:      end,
+		Window:   float64(end.Sub(start)) / float64(time.Millisecond),
+		Interval: interval,
+		Samples:  sysHist.Usr.TotalCount(),
+		Procs:    make([]ProcSummary, 0, len(list)),
+	}
+
+	// percent of a CPU for a single sample measured in clock ticks
+	tickPct := func(val float64) float64 {
+		return TicksPct(val, jiffy, float64(interval))
+	}
+	windowMs := func(count int64) float64 {
+		return float64(interval) * float64(count)
+	}
+
+	sysMs := windowMs(s.Samples)
+	if sysMs > 0 {
+		sysAvg := func(total uint64) float64 {
+			return TicksPct(float64(total), jiffy, sysMs)
+		}
+		s.System = SystemSummary{
+			Usr:          tickStat(sysHist.Usr, tickPct),
+			Nice:         tickStat(sysHist.Nice, tickPct),
+			Sys:          tickStat(sysHist.Sys, tickPct),
+			Idle:         tickStat(sysHist.Idle, tickPct),
+			Iowait:       tickStat(sysHist.Iowait, tickPct),
+			Irq:          sysAvg(sysSum.Irq),
+			Softirq:      sysAvg(sysSum.Softirq),
+			Steal:        sysAvg(sysSum.Steal),
+			Ctxsw:        float64(sysSum.Ctxt) / (sysMs / 1000),
+			ProcsStarted: sysSum.ProcsTotal,
+			ProcsRunning: histStat(sysHist.ProcsRunning),
+			ProcsBlocked: histStat(sysHist.ProcsBlocked),
+		}
+	}
+
+	for _, pid := range list {
+		info, ok := infoMap[pid]
+		if ok == false {
+			continue
+		}
+		sum, ok := procSum[pid]
+		if ok == false {
+			continue
+		}
+		hist, ok := procHist[pid]
+		if ok == false {
+			continue
+		}
+		count := hist.Ustime.TotalCount()
+		ms := windowMs(count)
+		if ms == 0 {
+			continue
+		}
+		tickAvg := func(total uint64) float64 {
+			return TicksPct(float64(total), jiffy, ms)
+		}
+		nsAvg := func(total uint64) float64 {
+			return NsPct(float64(total), ms)
+		}
+
+		cmdline := info.Comm
+		if len(info.Cmdline) > 0 {
+			cmdline = strings.Join(info.Cmdline, " ")
+		}
+		s.Procs = append(s.Procs, ProcSummary{
+			Pid:        pid,
+			Ppid:       info.Ppid,
+			UID:        info.UID,
+			Name:       info.Friendly,
+			Comm:       info.Comm,
+			Cmdline:    cmdline,
+			Nice:       info.Nice,
+			Samples:    count,
+			CPU:        tickStat(hist.Ustime, tickPct),
+			CPUP95:     tickPct(float64(hist.Ustime.ValueAtQuantile(95))),
+			Usr:        tickAvg(sum.Proc.Utime),
+			Sys:        tickAvg(sum.Proc.Stime),
+			Ctime:      tickAvg(sum.Proc.Cutime + sum.Proc.Cstime),
+			Runq:       nsAvg(sum.Task.Cpudelaytotal),
+			Iowait:     nsAvg(sum.Task.Blkiodelaytotal),
+			Swap:       nsAvg(sum.Task.Swapindelaytotal),
+			Vcsw:       sum.Task.Nvcsw,
+			Ivcsw:      sum.Task.Nivcsw,
+			RSS:        sum.Proc.Rss * PageSize,
+			Threads:    sum.Proc.Numthreads,
+			ReadBytes:  sum.Task.Readbytes,
+			WriteBytes: sum.Task.Writebytes,
+		})
+	}
+	return &s
+}
+
+// metricStats summarizes the Values of a window, from their sums and histograms
+func metricStats(metrics []Metric, sums []float64, hists []*ExpHistogram) map[string]MetricStat {
+	stats := make(map[string]MetricStat, len(metrics))
+	for i, m := range metrics {
+		stat := MetricStat{Unit: m.Unit}
+		if i < len(sums) {
+			stat.Value = sums[i]
+		}
+		if h := hists[i]; h.Count > 0 {
+			stat.Stat = Stat{h.Min, h.Sum / float64(h.Count), h.Max}
+		}
+		stats[m.Name] = stat
+	}
+	return stats
+}
+
+func tickStat(hist *hdrhistogram.Histogram, scale func(float64) float64) Stat {
+	return Stat{scale(float64(hist.Min())), scale(hist.Mean()), scale(float64(hist.Max()))}
+}
+
+func histStat(hist *hdrhistogram.Histogram) Stat {
+	return Stat{float64(hist.Min()), hist.Mean(), float64(hist.Max())}
+}
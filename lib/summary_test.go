@@ -0,0 +1,127 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNewSummary(t *testing.T) {
+	procHist, procSum := rankFixture(
+		map[int][]int64{1: {10, 20, 10, 20}, 2: {1}},
+		map[int]*ProcSample{1: {
+			Proc: ProcStats{Utime: 40, Stime: 20, Rss: 10},
+			Task: TaskStats{Cpudelaytotal: 400 * 1000 * 1000, Nvcsw: 3, Readbytes: 4096},
+		}},
+	)
+	infoMap := ProcInfoMap{
+		1: &ProcInfo{Comm: "burnP6", Cmdline: []string{"/usr/bin/burnP6", "-x"}, Friendly: "burnP6", Ppid: 7},
+		2: &ProcInfo{Comm: "gone"},
+	}
+	sysHist := NewSysStatsHist()
+	for _, val := range []int64{50, 150, 100, 100} {
+		sysHist.Usr.RecordValue(val)
+	}
+	sysSum := &SystemStats{Usr: 400, Ctxt: 1600, ProcsTotal: 3}
+
+	start := time.Unix(1000, 0)
+	end := start.Add(801 * time.Millisecond)
+	s := NewSummary(start, end, infoMap, Pidlist{1, 2, 3}, procSum, procHist, nil, sysSum, sysHist, 100, 200)
+
+	if s.Version != SummaryVersion || s.Window != 801 || s.Interval != 200 || s.Samples != 4 {
+		t.Errorf("bad window info %+v", s)
+	}
+	// 100 ticks in 200ms with 100 ticks/s is 500% of a CPU
+	if s.System.Usr != (Stat{250, 500, 750}) {
+		t.Error("bad system usr", s.System.Usr)
+	}
+	if s.System.Ctxsw != 2000 || s.System.ProcsStarted != 3 {
+		t.Error("bad system counters", s.System)
+	}
+
+	// pid 2 has no sums and pid 3 has nothing at all
+	if len(s.Procs) != 1 {
+		t.Fatal("expected 1 process, got", len(s.Procs))
+	}
+	p := s.Procs[0]
+	checks := []struct {
+		name      string
+		got, want float64
+	}{
+		{"cpu min", p.CPU.Min, 50},
+		{"cpu max", p.CPU.Max, 100},
+		{"usr", p.Usr, 50}, // 40 ticks over 800ms
+		{"sys", p.Sys, 25},
+		{"runq", p.Runq, 50}, // 400ms over 800ms
+		{"rss", float64(p.RSS), float64(10 * PageSize)},
+	}
+	for _, c := range checks {
+		if math.Abs(c.got-c.want) > 0.001 {
+			t.Errorf("%s = %f, want %f", c.name, c.got, c.want)
+		}
+	}
+	if p.Cmdline != "/usr/bin/burnP6 -x" || p.Ppid != 7 || p.Samples != 4 {
+		t.Errorf("bad process info %+v", p)
+	}
+}
+
+// downstream consumers depend on these names, so changing them needs a new SummaryVersion
+func TestPct(t *testing.T) {
+	// 5 ticks at 100Hz in 200ms is a quarter of a CPU
+	if got := TicksPct(5, 100, 200); math.Abs(got-25) > 1e-9 {
+		t.Error("TicksPct", got)
+	}
+	// 1.5s of delay in 2s
+	if got := NsPct(1.5e9, 2000); math.Abs(got-75) > 1e-9 {
+		t.Error("NsPct", got)
+	}
+}
+
+func TestSummarySchema(t *testing.T) {
+	b, err := json.Marshal(Summary{Procs: []ProcSummary{{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err = json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"version", "start", "end", "window_ms", "interval_ms", "samples", "system", "procs"} {
+		if _, ok := decoded[key]; ok == false {
+			t.Error("summary is missing", key)
+		}
+	}
+	system := decoded["system"].(map[string]interface{})
+	for _, key := range []string{"usr_pct", "sys_pct", "iowait_pct", "ctxsw_per_sec", "procs_running"} {
+		if _, ok := system[key]; ok == false {
+			t.Error("system summary is missing", key)
+		}
+	}
+	proc := decoded["procs"].([]interface{})[0].(map[string]interface{})
+	for _, key := range []string{"pid", "name", "cpu_pct", "usr_pct", "runq_pct", "rss_bytes", "read_bytes"} {
+		if _, ok := proc[key]; ok == false {
+			t.Error("process summary is missing", key)
+		}
+	}
+}
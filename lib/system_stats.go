@@ -24,6 +24,7 @@ package cpustat
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -47,6 +48,70 @@ type SystemStats struct {
 	ProcsTotal   uint64
 	ProcsRunning uint64
 	ProcsBlocked uint64
+	Values       []float64 // from collectors other than the built in ones, in the order of Metrics.System
+}
+
+// CPUTimes are the clock ticks one CPU has spent in each state
+type CPUTimes struct {
+	Usr     uint64
+	Nice    uint64
+	Sys     uint64
+	Idle    uint64
+	Iowait  uint64
+	Irq     uint64
+	Softirq uint64
+	Steal   uint64
+}
+
+// PerCPUStats is indexed by CPU number. CPUs that are offline are all 0.
+type PerCPUStats []CPUTimes
+
+// BusyPct is how much of the time between prev and c was not idle or waiting for IO
+func (c *CPUTimes) BusyPct(prev *CPUTimes) float64 {
+	idle := SafeSub(c.Idle, prev.Idle) + SafeSub(c.Iowait, prev.Iowait)
+	busy := SafeSub(c.Usr, prev.Usr) + SafeSub(c.Nice, prev.Nice) + SafeSub(c.Sys, prev.Sys) +
+		SafeSub(c.Irq, prev.Irq) + SafeSub(c.Softirq, prev.Softirq) + SafeSub(c.Steal, prev.Steal)
+	if busy+idle == 0 {
+		return 0
+	}
+	return float64(busy) / float64(busy+idle) * 100
+}
+
+// PerCPUStatsReader reads the cpuN lines of /proc/stat, which SystemStatsReader skips
+func PerCPUStatsReader(cur *PerCPUStats) error {
+	lines, err := ReadFileLines(StatsPath)
+	if err != nil {
+		return fmt.Errorf("reading %s: %s", StatsPath, err)
+	}
+	PerCPUStatsFromLines(cur, lines)
+	return nil
+}
+
+func PerCPUStatsFromLines(cur *PerCPUStats, lines []string) {
+	*cur = (*cur)[:0]
+	for _, line := range lines {
+		parts := strings.Fields(line)
+		if len(parts) < 9 || len(parts[0]) <= 3 || strings.HasPrefix(parts[0], "cpu") == false {
+			continue
+		}
+		num, err := strconv.Atoi(parts[0][3:])
+		if err != nil {
+			continue
+		}
+		for len(*cur) <= num {
+			*cur = append(*cur, CPUTimes{})
+		}
+		(*cur)[num] = CPUTimes{
+			Usr:     ReadUInt(parts[1]),
+			Nice:    ReadUInt(parts[2]),
+			Sys:     ReadUInt(parts[3]),
+			Idle:    ReadUInt(parts[4]),
+			Iowait:  ReadUInt(parts[5]),
+			Irq:     ReadUInt(parts[6]),
+			Softirq: ReadUInt(parts[7]),
+			Steal:   ReadUInt(parts[8]),
+		}
+	}
 }
 
 func SystemStatsReader(cur *SystemStats) error {
@@ -23,6 +23,7 @@ package cpustat
 import (
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -194,3 +195,24 @@ func TestLinuxPost2633(t *testing.T) {
 		t.Error("procsBlocked should be 3 but is", stats.ProcsBlocked)
 	}
 }
+
+func TestPerCPUStats(t *testing.T) {
+	var cpus PerCPUStats
+	PerCPUStatsFromLines(&cpus, strings.Split(pre2633, "\n"))
+	if len(cpus) != 4 {
+		t.Fatalf("got %d CPUs, want 4", len(cpus))
+	}
+	want := CPUTimes{Usr: 36, Sys: 170, Idle: 2565, Iowait: 90, Softirq: 4}
+	if cpus[3] != want {
+		t.Errorf("cpu3 = %+v, want %+v", cpus[3], want)
+	}
+
+	// an offline CPU leaves a hole, and reading again reuses the slice
+	PerCPUStatsFromLines(&cpus, []string{"cpu  1 1 1 1 1 1 1 1", "cpu2 2 0 2 4 0 0 0 0 0"})
+	if len(cpus) != 3 || cpus[0] != (CPUTimes{}) || cpus[2].Usr != 2 {
+		t.Errorf("cpus = %+v, want cpu2 only", cpus)
+	}
+	if busy := cpus[2].BusyPct(&CPUTimes{}); busy != 50 {
+		t.Errorf("busy = %v, want 50", busy)
+	}
+}
@@ -36,20 +36,23 @@ type TaskStats struct {
 	Nivcsw              uint64 // involuntary context switches
 	Freepagesdelaycount uint64 // delay count waiting for memory reclaim
 	Freepagesdelaytotal uint64 // delay time waiting for memory reclaim in unknown units
+	Readbytes           uint64 // bytes of storage IO read by this process
+	Writebytes          uint64 // bytes of storage IO written by this process
 }
 
 // TaskStatsMap maps pid to TaskStats, suually representing a sample of all pids
 type TaskStatsMap map[int]*TaskStats
 
-// TaskStatsReader uses conn to build a TaskStatsMap for all pids.
-func TaskStatsReader(conn *NLConn, pids Pidlist, cur *ProcSampleList) {
+// TaskStatsReader reads the taskstats of every process in cur. Processes that can't be read,
+// like ones that just exited, are skipped, but without permission it gives up.
+func TaskStatsReader(conn *NLConn, cur *ProcSampleList) error {
 	for i := uint32(0); i < cur.Len; i++ {
 		err := TaskStatsLookupPid(conn, &cur.Samples[i])
-		// it would be better to check for other errors here
-		if err != nil {
-			continue
+		if err == ErrTaskStatsPermission {
+			return err
 		}
 	}
+	return nil
 }
 
 // TaskStatsRecord computes the delta between Task elements of two ProcSampleLists
@@ -66,7 +69,14 @@ func TaskStatsRecord(interval uint32, curList, prevList ProcSampleList, sumMap,
 			prev := &(prevList.Samples[prevPos].Task)
 			pid := curList.Samples[curPos].Pid
 
-			delta := &(deltaMap[pid].Task)
+			// ProcStatsRecord leaves out processes that weren't read again
+			deltaSample, ok := deltaMap[pid]
+			if ok == false {
+				curPos++
+				prevPos++
+				continue
+			}
+			delta := &deltaSample.Task
 
 			delta.Capturetime = cur.Capturetime
 			duration := float64(cur.Capturetime.Sub(prev.Capturetime) / time.Millisecond)
@@ -97,6 +107,10 @@ func TaskStatsRecord(interval uint32, curList, prevList ProcSampleList, sumMap,
 			sum.Freepagesdelaycount += SafeSub(cur.Freepagesdelaycount, prev.Freepagesdelaycount)
 			delta.Freepagesdelaytotal = ScaledSub(cur.Freepagesdelaytotal, prev.Freepagesdelaytotal, scale)
 			sum.Freepagesdelaytotal += SafeSub(cur.Freepagesdelaytotal, prev.Freepagesdelaytotal)
+			delta.Readbytes = ScaledSub(cur.Readbytes, prev.Readbytes, scale)
+			sum.Readbytes += SafeSub(cur.Readbytes, prev.Readbytes)
+			delta.Writebytes = ScaledSub(cur.Writebytes, prev.Writebytes, scale)
+			sum.Writebytes += SafeSub(cur.Writebytes, prev.Writebytes)
 			curPos++
 			prevPos++
 		} else {
@@ -0,0 +1,355 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Reading /proc/[pid]/stat and taskstats for every process each interval costs the most
+// on hosts with thousands of processes that are almost all asleep. Tiered sampling reads
+// processes that have been idle for a while only every few intervals, which is enough to
+// see them wake up, and keeps reading the busy ones every interval.
+
+package cpustat
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TierConfig says when processes move between the fast tier, read every interval, and the
+// slow tier, read every Every intervals
+type TierConfig struct {
+	Every     int     // the slow tier is read once every this many intervals
+	IdleAfter int     // intervals without any CPU or delay before a process can be slow
+	TopN      int     // the processes that were busiest lately always stay fast
+	MinPct    float64 // and so do processes that lately used more than this percent of a CPU
+	SpikePct  float64 // while all CPUs are busier than this percent, every process is fast, 0 to turn off
+}
+
+// TierStat is what one tier cost
+type TierStat struct {
+	Procs  int     `json:"procs"` // processes in the tier after the last sample
+	Reads  int64   `json:"reads"`
+	ReadMs float64 `json:"read_ms"` // time spent reading them
+}
+
+// TierStats is what reading each tier cost, and how many reads the slow tier saved
+type TierStats struct {
+	Fast    TierStat `json:"fast"`
+	Slow    TierStat `json:"slow"`
+	Skipped int64    `json:"skipped"` // slow tier processes that weren't read in a sample
+}
+
+// Since is the reads and time since prev, which was from the same TieredReader
+func (s TierStats) Since(prev TierStats) TierStats {
+	s.Fast.Reads -= prev.Fast.Reads
+	s.Fast.ReadMs = roundMs(s.Fast.ReadMs - prev.Fast.ReadMs)
+	s.Slow.Reads -= prev.Slow.Reads
+	s.Slow.ReadMs = roundMs(s.Slow.ReadMs - prev.Slow.ReadMs)
+	s.Skipped -= prev.Skipped
+	return s
+}
+
+func roundMs(ms float64) float64 {
+	return math.Round(ms*1000) / 1000
+}
+
+// tierProc is what the reader knows about a process
+type tierProc struct {
+	pid    int
+	slow   bool
+	idle   int     // intervals in a row without CPU or delay
+	pct    float64 // moving average of CPU percent
+	listed int     // the last sample the pid was in /proc
+}
+
+type tierRank []*tierProc
+
+func (r tierRank) Len() int           { return len(r) }
+func (r tierRank) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r tierRank) Less(i, j int) bool { return r[i].pct > r[j].pct }
+
+// TieredReader reads processes in tiers. The samples it returns still have every process,
+// with the last sample of the slow ones that weren't read this time. ProcStatsRecord skips
+// those, and the next delta of a slow process has a Weight of the intervals it covers.
+type TieredReader struct {
+	conf     TierConfig
+	jiffy    int
+	interval int
+	alpha    float64 // moving average weight of a new interval
+	count    int
+	procs    map[int]*tierProc
+	sys      SystemStats
+	last     ProcSampleList
+	fast     ProcSampleList
+	slow     ProcSampleList
+	fastPids Pidlist
+	slowPids Pidlist
+
+	readProcs func(pids Pidlist, filter Filters, list *ProcSampleList, infoMap ProcInfoMap) error
+	readSys   func(sys *SystemStats) error
+
+	// Stats can be called while Read is running
+	statsLock sync.Mutex
+	stats     TierStats
+	readTime  [2]time.Duration // fast and slow
+}
+
+// Validate checks that the slow tier is read less often than every interval, and that a
+// process has to be idle for at least an interval to get there
+func (c TierConfig) Validate() error {
+	if c.Every < 2 {
+		return fmt.Errorf("the slow tier has to be read every 2 or more intervals, not %d", c.Every)
+	}
+	if c.IdleAfter < 1 {
+		return fmt.Errorf("processes have to be idle for at least 1 interval to be slow, not %d", c.IdleAfter)
+	}
+	return nil
+}
+
+func NewTieredReader(conf TierConfig, conn *NLConn, jiffy, interval int) (*TieredReader, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return &TieredReader{
+		conf:     conf,
+		jiffy:    jiffy,
+		interval: interval,
+		alpha:    2 / float64(conf.IdleAfter+1),
+		procs:    make(map[int]*tierProc),
+		readProcs: func(pids Pidlist, filter Filters, list *ProcSampleList, infoMap ProcInfoMap) error {
+			ProcStatsReader(pids, filter, list, infoMap)
+			return TaskStatsReader(conn, list)
+		},
+		readSys: SystemStatsReader,
+	}, nil
+}
+
+// Stats returns the totals since the reader was made
+func (t *TieredReader) Stats() TierStats {
+	t.statsLock.Lock()
+	defer t.statsLock.Unlock()
+	stats := t.stats
+	stats.Fast.ReadMs = roundMs(t.readTime[0].Seconds() * 1000)
+	stats.Slow.ReadMs = roundMs(t.readTime[1].Seconds() * 1000)
+	return stats
+}
+
+// Read takes a sample of pids and the system, like ProcStatsReader, TaskStatsReader and
+// SystemStatsReader together. The system is read first, so a spike promotes every process
+// in time to read them all in the same sample.
+func (t *TieredReader) Read(pids Pidlist, filter Filters, procs *ProcSampleList, sys *SystemStats,
+	infoMap ProcInfoMap) error {
+
+	if err := t.readSys(sys); err != nil {
+		return err
+	}
+	if t.conf.SpikePct > 0 && t.sys.CaptureTime.IsZero() == false {
+		var sum SystemStats
+		if BusyPct(SystemStatsRecord(uint32(t.interval), sys, &t.sys, &sum)) >= t.conf.SpikePct {
+			for _, p := range t.procs {
+				p.slow = false
+				p.idle = 0
+			}
+		}
+	}
+	t.sys = *sys
+	t.count++
+
+	t.fastPids, t.slowPids = t.fastPids[:0], t.slowPids[:0]
+	for _, pid := range pids {
+		p, ok := t.procs[pid]
+		if ok == false {
+			p = &tierProc{pid: pid}
+			t.procs[pid] = p
+		}
+		p.listed = t.count
+		if p.slow == false {
+			t.fastPids = append(t.fastPids, pid)
+		} else if t.due(pid) {
+			t.slowPids = append(t.slowPids, pid)
+		}
+	}
+
+	fastTime, err := t.read(t.fastPids, filter, &t.fast, len(procs.Samples), infoMap)
+	if err != nil {
+		return err
+	}
+	slowTime, err := t.read(t.slowPids, filter, &t.slow, len(procs.Samples), infoMap)
+	if err != nil {
+		return err
+	}
+	skipped := t.merge(procs)
+	t.update(procs)
+	if t.count%t.conf.Every == 0 {
+		t.demote()
+	}
+
+	t.last.Samples = append(t.last.Samples[:0], procs.Samples[:procs.Len]...)
+	t.last.Len = procs.Len
+
+	fastProcs, slowProcs := 0, 0
+	for pid, p := range t.procs {
+		if p.listed != t.count {
+			delete(t.procs, pid)
+		} else if p.slow {
+			slowProcs++
+		} else {
+			fastProcs++
+		}
+	}
+
+	t.statsLock.Lock()
+	t.stats.Fast.Procs = fastProcs
+	t.stats.Fast.Reads += int64(t.fast.Len)
+	t.readTime[0] += fastTime
+	t.stats.Slow.Procs = slowProcs
+	t.stats.Slow.Reads += int64(t.slow.Len)
+	t.readTime[1] += slowTime
+	t.stats.Skipped += int64(skipped)
+	t.statsLock.Unlock()
+	return nil
+}
+
+// due says if a slow process is read this time. Each is read on a different interval
+// depending on its pid, so the reads are spread out instead of all landing on one sample.
+func (t *TieredReader) due(pid int) bool {
+	return (t.count+pid)%t.conf.Every == 0
+}
+
+func (t *TieredReader) read(pids Pidlist, filter Filters, list *ProcSampleList, size int,
+	infoMap ProcInfoMap) (time.Duration, error) {
+
+	if len(list.Samples) < size {
+		*list = NewProcSampleList(size)
+	}
+	list.Len = 0
+	if len(pids) == 0 {
+		return 0, nil
+	}
+	start := time.Now()
+	err := t.readProcs(pids, filter, list, infoMap)
+	return time.Since(start), err
+}
+
+// carried says if a process in the last sample is slow and wasn't read this time
+func (t *TieredReader) carried(pid int) bool {
+	p, ok := t.procs[pid]
+	return ok && p.listed == t.count && p.slow && t.due(pid) == false
+}
+
+// merge puts the fast and slow samples, and the last sample of the slow processes that
+// weren't read, into procs, in pid order, and returns how many were carried over
+func (t *TieredReader) merge(procs *ProcSampleList) int {
+	n, f, s, l, carried := 0, uint32(0), uint32(0), uint32(0), 0
+	for {
+		for l < t.last.Len && t.carried(t.last.Samples[l].Pid) == false {
+			l++
+		}
+		var next *ProcSample
+		if f < t.fast.Len {
+			next = &t.fast.Samples[f]
+		}
+		if s < t.slow.Len && (next == nil || t.slow.Samples[s].Pid < next.Pid) {
+			next = &t.slow.Samples[s]
+		}
+		if l < t.last.Len && (next == nil || t.last.Samples[l].Pid < next.Pid) {
+			next = &t.last.Samples[l]
+		}
+		if next == nil {
+			break
+		}
+
+		// the three lists have different pids, so only one of these matches
+		if f < t.fast.Len && next == &t.fast.Samples[f] {
+			f++
+		} else if s < t.slow.Len && next == &t.slow.Samples[s] {
+			s++
+		} else {
+			l++
+			carried++
+		}
+		procs.Samples[n] = *next
+		n++
+	}
+	procs.Len = uint32(n)
+	return carried
+}
+
+// update follows the activity of each process that was read, and moves slow processes
+// that did anything back to the fast tier
+func (t *TieredReader) update(procs *ProcSampleList) {
+	curPos, prevPos := uint32(0), uint32(0)
+	for curPos < procs.Len && prevPos < t.last.Len {
+		cur, prev := &procs.Samples[curPos], &t.last.Samples[prevPos]
+		if cur.Pid < prev.Pid {
+			curPos++
+			continue
+		} else if cur.Pid > prev.Pid {
+			prevPos++
+			continue
+		}
+		curPos++
+		prevPos++
+
+		p, ok := t.procs[cur.Pid]
+		if ok == false || cur.Proc.CaptureTime.Equal(prev.Proc.CaptureTime) {
+			continue
+		}
+		ticks := SafeSub(cur.Proc.Utime+cur.Proc.Stime+cur.Proc.Cutime+cur.Proc.Cstime,
+			prev.Proc.Utime+prev.Proc.Stime+prev.Proc.Cutime+prev.Proc.Cstime)
+		delay := SafeSub(cur.Task.Cpudelaytotal+cur.Task.Blkiodelaytotal,
+			prev.Task.Cpudelaytotal+prev.Task.Blkiodelaytotal)
+
+		duration := cur.Proc.CaptureTime.Sub(prev.Proc.CaptureTime)
+		intervals := math.Max(1, math.Round(float64(duration)/float64(time.Duration(t.interval)*time.Millisecond)))
+		pct := TicksPct(float64(ticks), t.jiffy, duration.Seconds()*1000)
+		decay := math.Pow(1-t.alpha, intervals)
+		p.pct = p.pct*decay + pct*(1-decay)
+
+		if ticks > 0 || delay > 0 {
+			p.idle = 0
+			p.slow = false
+		} else {
+			p.idle += int(intervals)
+		}
+	}
+}
+
+// demote moves processes that have been idle for long enough to the slow tier, unless they
+// were busy lately
+func (t *TieredReader) demote() {
+	rank := make(tierRank, 0, len(t.procs))
+	for _, p := range t.procs {
+		if p.listed == t.count {
+			rank = append(rank, p)
+		}
+	}
+	sort.Sort(rank)
+	for i, p := range rank {
+		if i < t.conf.TopN || p.slow || p.idle < t.conf.IdleAfter {
+			continue
+		}
+		if t.conf.MinPct > 0 && p.pct >= t.conf.MinPct {
+			continue
+		}
+		p.slow = true
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeHost is a few processes and a system to read with a TieredReader
+type fakeHost struct {
+	now   time.Time
+	ticks map[int]uint64 // CPU time of each process so far
+	busy  uint64         // system usr ticks per interval
+	sys   SystemStats
+	reads map[int]int
+}
+
+func newFakeTiers(t *testing.T, host *fakeHost, conf TierConfig) *TieredReader {
+	tiers, err := NewTieredReader(conf, nil, 100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiers.readProcs = func(pids Pidlist, filter Filters, list *ProcSampleList, infoMap ProcInfoMap) error {
+		for i, pid := range pids {
+			list.Samples[i] = ProcSample{Pid: pid, Proc: ProcStats{CaptureTime: host.now, Utime: host.ticks[pid]}}
+			host.reads[pid]++
+		}
+		list.Len = uint32(len(pids))
+		return nil
+	}
+	tiers.readSys = func(sys *SystemStats) error {
+		host.sys.CaptureTime = host.now
+		host.sys.Usr += host.busy
+		host.sys.Idle += 10 - host.busy
+		*sys = host.sys
+		return nil
+	}
+	return tiers
+}
+
+func TestTieredReader(t *testing.T) {
+	host := &fakeHost{now: time.Unix(1500000000, 0), ticks: map[int]uint64{}, reads: map[int]int{}}
+	tiers := newFakeTiers(t, host, TierConfig{Every: 4, IdleAfter: 3, SpikePct: 80})
+	pids := Pidlist{1, 2, 3}
+
+	procs := NewProcSampleList(10)
+	prev := NewProcSampleList(10)
+	sum := make(ProcSampleMap)
+	weights := map[int]int64{}
+	var sys SystemStats
+	sample := func() {
+		host.now = host.now.Add(100 * time.Millisecond)
+		host.ticks[1] += 5
+		if err := tiers.Read(pids, Filters{}, &procs, &sys, nil); err != nil {
+			t.Fatal(err)
+		}
+		if procs.Len != 3 || procs.Samples[0].Pid != 1 || procs.Samples[1].Pid != 2 || procs.Samples[2].Pid != 3 {
+			t.Fatalf("sample has %d processes, want 1, 2 and 3 in order", procs.Len)
+		}
+		delta := make(ProcSampleMap)
+		ProcStatsRecord(100, procs, prev, sum, delta)
+		TaskStatsRecord(100, procs, prev, sum, delta)
+		for pid, d := range delta {
+			weights[pid] += d.weight()
+		}
+		prev.Samples = append(prev.Samples[:0], procs.Samples[:procs.Len]...)
+		prev.Len = procs.Len
+	}
+
+	for i := 0; i < 40; i++ {
+		sample()
+	}
+	stats := tiers.Stats()
+	if stats.Fast.Procs != 1 || stats.Slow.Procs != 2 {
+		t.Errorf("%d fast and %d slow processes, want 1 and 2", stats.Fast.Procs, stats.Slow.Procs)
+	}
+	if host.reads[1] != 40 || host.reads[2] > 15 || host.reads[3] > 15 {
+		t.Errorf("read the processes %v times, want 40 for the busy one and less for the others", host.reads)
+	}
+	if stats.Fast.Reads+stats.Slow.Reads+stats.Skipped != 120 {
+		t.Errorf("%d reads and %d skipped, want 120 in all", stats.Fast.Reads+stats.Slow.Reads, stats.Skipped)
+	}
+
+	// every interval after the first is counted once, however often it was read
+	for pid := 1; pid <= 3; pid++ {
+		last := tiers.last.Samples[pid-1].Proc.CaptureTime
+		intervals := int64(last.Sub(time.Unix(1500000000, 100000000)) / (100 * time.Millisecond))
+		if weights[pid] != intervals {
+			t.Errorf("pid %d deltas cover %d intervals, want %d", pid, weights[pid], intervals)
+		}
+	}
+
+	// a slow process that wakes up is fast from its next read
+	host.ticks[2] += 3
+	for i := 0; i < 4; i++ {
+		sample()
+	}
+	if tiers.procs[2].slow || tiers.procs[3].slow == false {
+		t.Error("process 2 woke up and should be fast, and 3 slow")
+	}
+
+	// a busy system reads everything
+	host.busy = 9
+	reads := host.reads[3]
+	sample()
+	sample()
+	if host.reads[3] != reads+2 || tiers.Stats().Slow.Procs != 0 {
+		t.Errorf("read process 3 %d times in 2 busy samples, want 2", host.reads[3]-reads)
+	}
+}
+
+func TestTieredReaderTopN(t *testing.T) {
+	host := &fakeHost{now: time.Unix(1500000000, 0), ticks: map[int]uint64{}, reads: map[int]int{}}
+	tiers := newFakeTiers(t, host, TierConfig{Every: 2, IdleAfter: 2, TopN: 1})
+	pids := Pidlist{1, 2}
+	procs := NewProcSampleList(10)
+	var sys SystemStats
+
+	// 1 was busy and 2 wasn't, then both are idle, but 1 is still the busiest lately
+	for i := 0; i < 20; i++ {
+		host.now = host.now.Add(100 * time.Millisecond)
+		if i < 5 {
+			host.ticks[1] += 5
+		}
+		if err := tiers.Read(pids, Filters{}, &procs, &sys, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tiers.procs[1].slow || tiers.procs[2].slow == false {
+		t.Error("the busiest process should stay fast, and the other be slow")
+	}
+}
+
+func TestTierConfigValidate(t *testing.T) {
+	for _, conf := range []TierConfig{{}, {Every: 1, IdleAfter: 3}, {Every: 4}} {
+		if _, err := NewTieredReader(conf, nil, 100, 100); err == nil {
+			t.Errorf("tiers with %+v", conf)
+		}
+	}
+}
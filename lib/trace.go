@@ -0,0 +1,201 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Sample timelines in the Chrome Trace Event format, which Perfetto and chrome://tracing
+// can open and zoom into. Events are written as a JSON array as they come in, since both
+// viewers accept an array that was cut off without its closing bracket.
+//
+// Timestamps are microseconds since the Unix epoch, so a trace can be lined up with
+// application traces of the same time that also use the wall clock.
+
+package cpustat
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the system counters go on their own track, which no real process can have
+const traceSystemPid = 0
+
+type traceEvent struct {
+	Name  string                 `json:"name"`
+	Phase string                 `json:"ph"`
+	Time  int64                  `json:"ts"`
+	Pid   int                    `json:"pid"`
+	Tid   int                    `json:"tid"`
+	Scope string                 `json:"s,omitempty"`
+	Args  map[string]interface{} `json:"args,omitempty"`
+}
+
+// TraceWriter turns the deltas of each sample into counter tracks for the system and each
+// process, and instant events when processes start and exit. It is safe to Close from
+// another goroutine, and samples written after that are ignored.
+type TraceWriter struct {
+	lock     sync.Mutex
+	out      *bufio.Writer
+	closer   io.Closer
+	jiffy    int
+	interval int
+	events   int
+	live     map[int]bool       // pids in the last sample
+	last     map[int][2]float64 // last cpu and runq written for each pid, to skip repeats
+	lastTime time.Time
+	closed   bool
+}
+
+// NewTraceWriter starts a trace on w, which is closed by Close if it is an io.Closer
+func NewTraceWriter(w io.Writer, jiffy, interval int) *TraceWriter {
+	t := TraceWriter{
+		out:      bufio.NewWriter(w),
+		jiffy:    jiffy,
+		interval: interval,
+		live:     make(map[int]bool),
+		last:     make(map[int][2]float64),
+	}
+	t.closer, _ = w.(io.Closer)
+	t.out.WriteString("[\n")
+	t.write(traceEvent{Name: "process_name", Phase: "M", Pid: traceSystemPid,
+		Args: map[string]interface{}{"name": "system"}})
+	return &t
+}
+
+func (t *TraceWriter) write(e traceEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if t.events > 0 {
+		t.out.WriteString(",\n")
+	}
+	t.events++
+	_, err = t.out.Write(b)
+	return err
+}
+
+func traceTime(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+// WriteSample adds the deltas from one sample, as made by ProcStatsRecord, TaskStatsRecord
+// and SystemStatsRecord
+func (t *TraceWriter) WriteSample(procDelta ProcSampleMap, sysDelta *SystemStats, infoMap ProcInfoMap) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return nil
+	}
+
+	tickPct := func(ticks uint64) float64 {
+		return TicksPct(float64(ticks), t.jiffy, float64(t.interval))
+	}
+	nsPct := func(ns uint64) float64 {
+		return NsPct(float64(ns), float64(t.interval))
+	}
+
+	now := traceTime(sysDelta.CaptureTime)
+	t.write(traceEvent{Name: "cpu", Phase: "C", Time: now, Pid: traceSystemPid, Args: map[string]interface{}{
+		"usr": tickPct(sysDelta.Usr + sysDelta.Nice), "sys": tickPct(sysDelta.Sys), "iowait": tickPct(sysDelta.Iowait),
+	}})
+	t.write(traceEvent{Name: "procs", Phase: "C", Time: now, Pid: traceSystemPid, Args: map[string]interface{}{
+		"running": sysDelta.ProcsRunning, "blocked": sysDelta.ProcsBlocked,
+	}})
+
+	// sorted so the same samples always make the same file
+	pids := make(Pidlist, 0, len(procDelta))
+	for pid := range procDelta {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+
+	for _, pid := range pids {
+		delta := procDelta[pid]
+		if t.live[pid] == false {
+			t.startProc(pid, infoMap, now)
+		}
+		vals := [2]float64{tickPct(delta.Proc.Utime + delta.Proc.Stime), nsPct(delta.Task.Cpudelaytotal)}
+		if last, ok := t.last[pid]; ok && last == vals {
+			continue
+		}
+		t.last[pid] = vals
+		t.write(traceEvent{Name: "cpu", Phase: "C", Time: now, Pid: pid, Tid: pid,
+			Args: map[string]interface{}{"cpu": vals[0]}})
+		t.write(traceEvent{Name: "runq", Phase: "C", Time: now, Pid: pid, Tid: pid,
+			Args: map[string]interface{}{"runq": vals[1]}})
+	}
+
+	// anything that was in the last sample and isn't now has exited
+	exited := make(Pidlist, 0)
+	for pid := range t.live {
+		if _, ok := procDelta[pid]; ok == false {
+			exited = append(exited, pid)
+		}
+	}
+	sort.Ints(exited)
+	for _, pid := range exited {
+		t.write(traceEvent{Name: "exit", Phase: "i", Time: traceTime(t.lastTime), Pid: pid, Tid: pid, Scope: "p"})
+		delete(t.live, pid)
+		delete(t.last, pid)
+	}
+	t.lastTime = sysDelta.CaptureTime
+	return t.out.Flush()
+}
+
+// startProc names the process track, and marks when it started unless it was already
+// running in the first sample
+func (t *TraceWriter) startProc(pid int, infoMap ProcInfoMap, now int64) {
+	t.live[pid] = true
+	name := fmt.Sprint(pid)
+	args := map[string]interface{}{}
+	if info, ok := infoMap[pid]; ok {
+		name = fmt.Sprintf("%s (%d)", info.Friendly, pid)
+		args["comm"] = info.Comm
+		args["ppid"] = info.Ppid
+		args["uid"] = info.UID
+	}
+	t.write(traceEvent{Name: "process_name", Phase: "M", Pid: pid, Args: map[string]interface{}{"name": name}})
+	if t.lastTime.IsZero() {
+		return
+	}
+	t.write(traceEvent{Name: "start", Phase: "i", Time: now, Pid: pid, Tid: pid, Scope: "p", Args: args})
+}
+
+// Close finishes the JSON array
+func (t *TraceWriter) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	t.out.WriteString("\n]\n")
+	err := t.out.Flush()
+	if t.closer != nil {
+		if cerr := t.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTraceWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := NewTraceWriter(&out, 100, 1000)
+	infoMap := ProcInfoMap{
+		10: &ProcInfo{Friendly: "nginx", Comm: "nginx", Ppid: 1},
+		20: &ProcInfo{Friendly: "cron", Comm: "cron", Ppid: 1},
+		30: &ProcInfo{Friendly: "make", Comm: "make", Ppid: 20},
+	}
+	start := time.Unix(1500000000, 0)
+	samples := []ProcSampleMap{
+		{10: &ProcSample{Proc: ProcStats{Utime: 50}}, 20: &ProcSample{}},
+		{10: &ProcSample{Proc: ProcStats{Utime: 50}}, 30: &ProcSample{Proc: ProcStats{Stime: 100}}},
+	}
+	for i, delta := range samples {
+		sys := SystemStats{CaptureTime: start.Add(time.Duration(i) * time.Second), Usr: 150, Iowait: 10}
+		if err := w.WriteSample(delta, &sys, infoMap); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	// samples after closing are ignored, and don't break the JSON
+	w.WriteSample(samples[0], &SystemStats{}, infoMap)
+
+	var events []traceEvent
+	if err := json.Unmarshal(out.Bytes(), &events); err != nil {
+		t.Fatalf("trace is not valid JSON: %s\n%s", err, out.String())
+	}
+
+	var names, starts, exits []int
+	counters := make(map[int]int)
+	for _, e := range events {
+		switch {
+		case e.Phase == "M":
+			names = append(names, e.Pid)
+		case e.Name == "start":
+			starts = append(starts, e.Pid)
+		case e.Name == "exit":
+			exits = append(exits, e.Pid)
+			if e.Time != traceTime(start) {
+				t.Errorf("exit of %d at %d, want the time of the last sample it was in", e.Pid, e.Time)
+			}
+		case e.Phase == "C":
+			counters[e.Pid]++
+		}
+	}
+	if len(names) != 4 {
+		t.Errorf("named tracks %v, want system and 3 processes", names)
+	}
+	// processes that were there from the start didn't start during the trace
+	if len(starts) != 1 || starts[0] != 30 {
+		t.Errorf("start events for %v, want 30", starts)
+	}
+	if len(exits) != 1 || exits[0] != 20 {
+		t.Errorf("exit events for %v, want 20", exits)
+	}
+	// nginx used the same CPU both times, so its second sample is left out
+	if counters[traceSystemPid] != 4 || counters[10] != 2 || counters[30] != 2 {
+		t.Errorf("counter events by pid = %v", counters)
+	}
+
+	for _, e := range events {
+		if e.Pid == traceSystemPid && e.Name == "cpu" {
+			if usr := e.Args["usr"].(float64); usr != 150 {
+				t.Errorf("system usr = %v, want 150", usr)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,492 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Triggers run a command when a process misbehaves, so that a profile or a dump can be
+// taken while it is happening instead of after. A rule is a list of conditions on the
+// summary of each process, like
+//
+//	name=api && cpu_max>90% for 3 windows
+//	runq p95>20ms
+//
+// and fires for a process when all of them hold for that many summaries in a row.
+
+package cpustat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Trigger is one rule, usually loaded from a file by LoadTriggers
+type Trigger struct {
+	Name       string `json:"name"`
+	When       string `json:"when"`
+	Run        string `json:"run"`         // run with sh -c
+	Cooldown   string `json:"cooldown"`    // least time between runs, like 5m
+	Timeout    string `json:"timeout"`     // kill the command after this long, 1m by default
+	MaxRunning int    `json:"max_running"` // runs at the same time, 1 by default
+
+	conds    []triggerCond
+	windows  int
+	cooldown time.Duration
+	timeout  time.Duration
+
+	streaks    map[int]int // windows in a row that each pid has matched
+	running    int
+	lastRun    time.Time
+	suppressed int // matches since the last run that didn't run because of the limits
+}
+
+type metricKind int
+
+const (
+	kindPct   metricKind = iota // percent of a CPU
+	kindMs                      // ms per sample
+	kindBytes                   // bytes, or bytes per second
+	kindCount                   // plain numbers
+)
+
+// triggerMetric is a number a rule can test, taken from the summary of a process
+type triggerMetric struct {
+	kind  metricKind
+	value func(p *ProcSummary, task *TaskStatsHist, sec float64) float64
+}
+
+func delayMs(h *TaskStatsHist, get func(h *TaskStatsHist) int64) float64 {
+	if h == nil {
+		return 0
+	}
+	return float64(get(h)) / 1e6
+}
+
+var triggerMetrics = map[string]triggerMetric{
+	"cpu_avg": {kindPct, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 { return p.CPU.Avg }},
+	"cpu_max": {kindPct, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 { return p.CPU.Max }},
+	"cpu_p95": {kindPct, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 { return p.CPUP95 }},
+	"usr":     {kindPct, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 { return p.Usr }},
+	"sys":     {kindPct, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 { return p.Sys }},
+	"runq":    {kindPct, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 { return p.Runq }},
+	"iowait":  {kindPct, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 { return p.Iowait }},
+	"swap":    {kindPct, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 { return p.Swap }},
+	"runq_p95": {kindMs, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 {
+		return delayMs(t, func(h *TaskStatsHist) int64 { return h.Cpudelay.ValueAtQuantile(95) })
+	}},
+	"runq_max": {kindMs, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 {
+		return delayMs(t, func(h *TaskStatsHist) int64 { return h.Cpudelay.Max() })
+	}},
+	"iowait_p95": {kindMs, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 {
+		return delayMs(t, func(h *TaskStatsHist) int64 { return h.Iowait.ValueAtQuantile(95) })
+	}},
+	"iowait_max": {kindMs, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 {
+		return delayMs(t, func(h *TaskStatsHist) int64 { return h.Iowait.Max() })
+	}},
+	"rss":     {kindBytes, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 { return float64(p.RSS) }},
+	"threads": {kindCount, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 { return float64(p.Threads) }},
+	"ctxsw": {kindCount, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 {
+		return float64(p.Vcsw+p.Ivcsw) / sec
+	}},
+	"io": {kindBytes, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 {
+		return float64(p.ReadBytes+p.WriteBytes) / sec
+	}},
+	"pid": {kindCount, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 { return float64(p.Pid) }},
+	"uid": {kindCount, func(p *ProcSummary, t *TaskStatsHist, sec float64) float64 { return float64(p.UID) }},
+}
+
+// the strings a rule can test
+var triggerStrings = map[string]func(p *ProcSummary, info *ProcInfo) string{
+	"name":    func(p *ProcSummary, info *ProcInfo) string { return p.Name },
+	"comm":    func(p *ProcSummary, info *ProcInfo) string { return p.Comm },
+	"cmdline": func(p *ProcSummary, info *ProcInfo) string { return p.Cmdline },
+	"cgroup": func(p *ProcSummary, info *ProcInfo) string {
+		if info == nil {
+			return ""
+		}
+		return info.Cgroup
+	},
+}
+
+var triggerAliases = map[string]string{"friendly": "name", "cpu": "cpu_avg"}
+
+type triggerCond struct {
+	field  string
+	op     string
+	number float64
+	str    string
+	re     *regexp.Regexp
+}
+
+var (
+	triggerForRe  = regexp.MustCompile(`^(.*?)\s+for\s+(\d+)\s+windows?\s*$`)
+	triggerCondRe = regexp.MustCompile(`^([a-z_]+(?:\s+(?:p95|max|avg))?)\s*(<=|>=|!=|=|<|>|~)\s*(.+)$`)
+	byteUnits     = map[string]float64{"": 1, "b": 1, "k": 1 << 10, "kb": 1 << 10, "m": 1 << 20, "mb": 1 << 20,
+		"g": 1 << 30, "gb": 1 << 30}
+	numberRe = regexp.MustCompile(`^([0-9.]+)\s*([a-zA-Z%]*)$`)
+)
+
+// Compile checks the rule and parses When. It must be called before the rule is used.
+func (t *Trigger) Compile() error {
+	if t.When == "" || t.Run == "" {
+		return errors.New("trigger needs when and run")
+	}
+	if t.Name == "" {
+		t.Name = t.When
+	}
+	when := strings.TrimSpace(t.When)
+	t.windows = 1
+	if m := triggerForRe.FindStringSubmatch(when); m != nil {
+		when = m[1]
+		t.windows, _ = strconv.Atoi(m[2])
+		if t.windows < 1 {
+			return fmt.Errorf("trigger %q must hold for at least 1 window", t.Name)
+		}
+	}
+	t.conds = nil
+	for _, part := range strings.Split(when, "&&") {
+		cond, err := parseTriggerCond(strings.TrimSpace(part))
+		if err != nil {
+			return fmt.Errorf("trigger %q: %s", t.Name, err)
+		}
+		t.conds = append(t.conds, cond)
+	}
+
+	var err error
+	t.timeout = time.Minute
+	if t.Timeout != "" {
+		if t.timeout, err = time.ParseDuration(t.Timeout); err != nil {
+			return fmt.Errorf("trigger %q timeout: %s", t.Name, err)
+		}
+	}
+	if t.Cooldown != "" {
+		if t.cooldown, err = time.ParseDuration(t.Cooldown); err != nil {
+			return fmt.Errorf("trigger %q cooldown: %s", t.Name, err)
+		}
+	}
+	if t.MaxRunning <= 0 {
+		t.MaxRunning = 1
+	}
+	t.streaks = make(map[int]int)
+	return nil
+}
+
+func parseTriggerCond(s string) (triggerCond, error) {
+	m := triggerCondRe.FindStringSubmatch(s)
+	if m == nil {
+		return triggerCond{}, fmt.Errorf("can't parse %q, conditions look like cpu_max>90%%", s)
+	}
+	cond := triggerCond{field: strings.Join(strings.Fields(m[1]), "_"), op: m[2]}
+	if alias, ok := triggerAliases[cond.field]; ok {
+		cond.field = alias
+	}
+	value := strings.TrimSpace(m[3])
+
+	if _, ok := triggerStrings[cond.field]; ok {
+		switch cond.op {
+		case "=", "!=":
+			cond.str = value
+		case "~":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return cond, fmt.Errorf("%s: %s", s, err)
+			}
+			cond.re = re
+		default:
+			return cond, fmt.Errorf("%s can only be tested with =, != or ~", cond.field)
+		}
+		return cond, nil
+	}
+
+	metric, ok := triggerMetrics[cond.field]
+	if ok == false {
+		return cond, fmt.Errorf("unknown field %q", cond.field)
+	}
+	if cond.op == "~" {
+		return cond, fmt.Errorf("%s is a number, and can't be tested with ~", cond.field)
+	}
+	var err error
+	cond.number, err = parseTriggerValue(metric.kind, value)
+	if err != nil {
+		return cond, fmt.Errorf("%s: %s", s, err)
+	}
+	return cond, nil
+}
+
+// parseTriggerValue converts a number with an optional unit into the unit of kind
+func parseTriggerValue(kind metricKind, s string) (float64, error) {
+	m := numberRe.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	num, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	unit := strings.ToLower(m[2])
+	switch kind {
+	case kindPct:
+		if unit == "" || unit == "%" {
+			return num, nil
+		}
+	case kindMs:
+		if unit == "" {
+			return num, nil
+		}
+		if d, err := time.ParseDuration(m[1] + unit); err == nil {
+			return float64(d) / float64(time.Millisecond), nil
+		}
+	case kindBytes:
+		if scale, ok := byteUnits[unit]; ok {
+			return num * scale, nil
+		}
+	case kindCount:
+		if unit == "" {
+			return num, nil
+		}
+	}
+	return 0, fmt.Errorf("%q has the wrong unit", s)
+}
+
+func (c *triggerCond) match(p *ProcSummary, info *ProcInfo, task *TaskStatsHist, sec float64) bool {
+	if get, ok := triggerStrings[c.field]; ok {
+		val := get(p, info)
+		switch c.op {
+		case "=":
+			return val == c.str
+		case "!=":
+			return val != c.str
+		}
+		return c.re.MatchString(val)
+	}
+	val := triggerMetrics[c.field].value(p, task, sec)
+	switch c.op {
+	case "<":
+		return val < c.number
+	case "<=":
+		return val <= c.number
+	case ">":
+		return val > c.number
+	case ">=":
+		return val >= c.number
+	case "=":
+		return val == c.number
+	}
+	return val != c.number
+}
+
+// LoadTriggers reads a JSON list of Triggers from filename and compiles them
+func LoadTriggers(filename string) ([]*Trigger, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var triggers []*Trigger
+	if err = json.Unmarshal(raw, &triggers); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", filename, err)
+	}
+	for i := range triggers {
+		if err = triggers[i].Compile(); err != nil {
+			return nil, fmt.Errorf("%s rule %d: %s", filename, i, err)
+		}
+	}
+	return triggers, nil
+}
+
+// TriggerEvent is a line of the trigger log, written as JSON when a trigger fires and
+// when its command finishes
+type TriggerEvent struct {
+	Time       time.Time    `json:"time"`
+	Event      string       `json:"event"` // fire or exit
+	Trigger    string       `json:"trigger"`
+	Pid        int          `json:"pid"`
+	When       string       `json:"when,omitempty"`
+	Run        string       `json:"run,omitempty"`
+	Suppressed int          `json:"suppressed,omitempty"` // matches skipped by cooldown or max_running since the last run
+	Proc       *ProcSummary `json:"proc,omitempty"`       // the summary that fired it
+	Status     string       `json:"status,omitempty"`
+	Seconds    float64      `json:"seconds,omitempty"`
+	Output     string       `json:"output,omitempty"` // the end of stdout and stderr
+}
+
+// the most command output kept for the log
+const triggerOutputMax = 4096
+
+// triggerWaitDelay is how long a command's output can stay open after it exits or is killed
+const triggerWaitDelay = 5 * time.Second
+
+// TriggerEngine checks every process in each summary window against a list of triggers
+// and runs their commands. It is safe to call Wait from another goroutine than Check.
+type TriggerEngine struct {
+	triggers []*Trigger
+	jiffy    int
+	interval int
+	lock     sync.Mutex
+	log      *json.Encoder
+	wg       sync.WaitGroup
+}
+
+// NewTriggerEngine writes its log as JSON lines to log
+func NewTriggerEngine(triggers []*Trigger, log io.Writer, jiffy, interval int) *TriggerEngine {
+	enc := json.NewEncoder(log)
+	enc.SetEscapeHTML(false)
+	return &TriggerEngine{triggers: triggers, log: enc, jiffy: jiffy, interval: interval}
+}
+
+// Check tests every process in a summary window, the same data that NewSummary takes
+func (e *TriggerEngine) Check(start, end time.Time, infoMap ProcInfoMap, procSum ProcSampleMap,
+	procHist ProcStatsHistMap, taskHist TaskStatsHistMap, sysSum *SystemStats, sysHist *SystemStatsHist) {
+
+	pids := make(Pidlist, 0, len(procSum))
+	for pid := range procSum {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	summary := NewSummary(start, end, infoMap, pids, procSum, procHist, taskHist, sysSum, sysHist,
+		e.jiffy, e.interval)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, t := range e.triggers {
+		streaks := make(map[int]int)
+		for i := range summary.Procs {
+			p := &summary.Procs[i]
+			sec := float64(p.Samples) * float64(e.interval) / 1000
+			matched := true
+			for j := range t.conds {
+				if t.conds[j].match(p, infoMap[p.Pid], taskHist[p.Pid], sec) == false {
+					matched = false
+					break
+				}
+			}
+			if matched == false {
+				continue
+			}
+			streaks[p.Pid] = t.streaks[p.Pid] + 1
+			if streaks[p.Pid] >= t.windows {
+				e.fire(t, p, infoMap[p.Pid], taskHist[p.Pid], sec, end)
+				streaks[p.Pid] = 0
+			}
+		}
+		t.streaks = streaks
+	}
+}
+
+// fire runs the command of t for p, unless it is cooling down or already running too many
+// times. Called with the lock held.
+func (e *TriggerEngine) fire(t *Trigger, p *ProcSummary, info *ProcInfo, task *TaskStatsHist, sec float64,
+	now time.Time) {
+
+	if t.running >= t.MaxRunning || (t.lastRun.IsZero() == false && now.Sub(t.lastRun) < t.cooldown) {
+		t.suppressed++
+		return
+	}
+	t.running++
+	t.lastRun = now
+	proc := *p
+	e.log.Encode(TriggerEvent{Time: now, Event: "fire", Trigger: t.Name, Pid: p.Pid, When: t.When, Run: t.Run,
+		Suppressed: t.suppressed, Proc: &proc})
+	t.suppressed = 0
+
+	env := append(os.Environ(),
+		"CPUSTAT_TRIGGER="+t.Name,
+		fmt.Sprintf("CPUSTAT_PID=%d", p.Pid),
+		fmt.Sprintf("CPUSTAT_PPID=%d", p.Ppid),
+		"CPUSTAT_NAME="+p.Name,
+		"CPUSTAT_COMM="+p.Comm,
+	)
+	if info != nil {
+		env = append(env, "CPUSTAT_CGROUP="+info.Cgroup)
+	}
+	for name, metric := range triggerMetrics {
+		val := math.Round(metric.value(p, task, sec)*100) / 100
+		env = append(env, "CPUSTAT_"+strings.ToUpper(name)+"="+strconv.FormatFloat(val, 'f', -1, 64))
+	}
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+		defer cancel()
+		out := tailWriter{max: triggerOutputMax}
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", t.Run)
+		cmd.Env = env
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		// the shell gets its own process group, so a timeout also kills what it started,
+		// which could otherwise hold the output open and keep Run from returning
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Cancel = func() error {
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+		cmd.WaitDelay = triggerWaitDelay
+		started := time.Now()
+		err := cmd.Run()
+
+		status := "exit 0"
+		if ctx.Err() == context.DeadlineExceeded {
+			status = fmt.Sprintf("killed after %s", t.timeout)
+		} else if err != nil {
+			status = err.Error()
+		}
+		output := string(out.buf)
+
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		t.running--
+		e.log.Encode(TriggerEvent{Time: time.Now(), Event: "exit", Trigger: t.Name, Pid: proc.Pid, Status: status,
+			Seconds: time.Since(started).Seconds(), Output: output})
+	}()
+}
+
+// tailWriter keeps the last max bytes written to it
+type tailWriter struct {
+	buf []byte
+	max int
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) >= w.max {
+		w.buf = append(w.buf[:0], p[len(p)-w.max:]...)
+		return n, nil
+	}
+	if over := len(w.buf) + len(p) - w.max; over > 0 {
+		w.buf = append(w.buf[:0], w.buf[over:]...)
+	}
+	w.buf = append(w.buf, p...)
+	return n, nil
+}
+
+// Wait waits for the commands that are running to finish
+func (e *TriggerEngine) Wait() {
+	e.wg.Wait()
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cpustat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTriggerCompile(t *testing.T) {
+	good := []struct {
+		when    string
+		windows int
+		conds   int
+	}{
+		{"name=api && cpu_max>90% for 3 windows", 3, 2},
+		{"runq p95>20ms", 1, 1},
+		{"friendly~^api && rss>=2GB && io>10MB for 1 window", 1, 3},
+		{"cgroup=/system.slice/db.service && iowait_max > 0.5s", 1, 2},
+	}
+	for _, g := range good {
+		tr := Trigger{When: g.when, Run: "true"}
+		if err := tr.Compile(); err != nil {
+			t.Errorf("%q: %s", g.when, err)
+			continue
+		}
+		if tr.windows != g.windows || len(tr.conds) != g.conds {
+			t.Errorf("%q: %d windows and %d conditions, want %d and %d", g.when, tr.windows, len(tr.conds),
+				g.windows, g.conds)
+		}
+	}
+
+	bad := []string{
+		"bogus>1",
+		"runq>20ms",    // runq is a percent, runq p95 is a time
+		"cpu_max~90",   // not a string
+		"name>api",     // not a number
+		"name~(",       // bad regexp
+		"cpu_max>lots", // not a number
+		"cpu_max>90 for 0 windows",
+	}
+	for _, when := range bad {
+		tr := Trigger{When: when, Run: "true"}
+		if err := tr.Compile(); err == nil {
+			t.Errorf("%q compiled", when)
+		}
+	}
+	if err := (&Trigger{When: "cpu_max>90"}).Compile(); err == nil {
+		t.Error("trigger without run compiled")
+	}
+}
+
+func TestParseTriggerValue(t *testing.T) {
+	tests := []struct {
+		kind metricKind
+		in   string
+		want float64
+	}{
+		{kindPct, "90%", 90},
+		{kindPct, "12.5", 12.5},
+		{kindMs, "20ms", 20},
+		{kindMs, "1.5s", 1500},
+		{kindMs, "250us", 0.25},
+		{kindMs, "7", 7},
+		{kindBytes, "2GB", 2 << 30},
+		{kindBytes, "512k", 512 << 10},
+		{kindCount, "100", 100},
+	}
+	for _, test := range tests {
+		got, err := parseTriggerValue(test.kind, test.in)
+		if err != nil || got != test.want {
+			t.Errorf("%q = %v %v, want %v", test.in, got, err, test.want)
+		}
+	}
+}
+
+func TestTriggerEngine(t *testing.T) {
+	tr := Trigger{Name: "hot api", When: "name=api && cpu_max>50% for 2 windows",
+		Run: `echo "$CPUSTAT_PID $CPUSTAT_NAME $CPUSTAT_CPU_MAX"`}
+	if err := tr.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	var log bytes.Buffer
+	e := NewTriggerEngine([]*Trigger{&tr}, &log, 100, 100)
+
+	infoMap := ProcInfoMap{
+		1: &ProcInfo{Friendly: "api", Comm: "api"},
+		2: &ProcInfo{Friendly: "db", Comm: "db"},
+	}
+	start := time.Unix(1500000000, 0)
+	// api is hot in every window, and db is hot too but never matches the name
+	for w := 0; w < 4; w++ {
+		procSum := make(ProcSampleMap)
+		procHist := make(ProcStatsHistMap)
+		taskHist := make(TaskStatsHistMap)
+		sysHist := NewSysStatsHist()
+		for s := 0; s < 5; s++ {
+			delta := ProcSampleMap{
+				1: &ProcSample{Proc: ProcStats{Utime: 8}},
+				2: &ProcSample{Proc: ProcStats{Utime: 9}},
+			}
+			for pid, d := range delta {
+				if _, ok := procSum[pid]; ok == false {
+					procSum[pid] = &ProcSample{}
+				}
+				procSum[pid].Proc.Utime += d.Proc.Utime
+			}
+			UpdateProcStatsHist(procHist, delta)
+			UpdateTaskStatsHist(taskHist, delta)
+			UpdateSysStatsHist(sysHist, &SystemStats{})
+		}
+		end := start.Add(time.Duration(w+1) * time.Second)
+		e.Check(end.Add(-time.Second), end, infoMap, procSum, procHist, taskHist, &SystemStats{}, sysHist)
+		e.Wait() // so max_running doesn't get in the way
+	}
+
+	var fires, exits int
+	lines := bufio.NewScanner(&log)
+	for lines.Scan() {
+		var ev TriggerEvent
+		if err := json.Unmarshal(lines.Bytes(), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Pid != 1 || ev.Trigger != "hot api" {
+			t.Errorf("event for pid %d of %q, want pid 1 of hot api", ev.Pid, ev.Trigger)
+		}
+		switch ev.Event {
+		case "fire":
+			fires++
+			if ev.Proc == nil || ev.Proc.CPU.Max != 80 {
+				t.Errorf("fire event has summary %+v, want one with cpu max 80", ev.Proc)
+			}
+		case "exit":
+			exits++
+			if ev.Status != "exit 0" || strings.TrimSpace(ev.Output) != "1 api 80" {
+				t.Errorf("exit event status %q output %q", ev.Status, ev.Output)
+			}
+		}
+	}
+	// windows 2 and 4, since the streak starts over after firing
+	if fires != 2 || exits != 2 {
+		t.Errorf("%d fires and %d exits, want 2 and 2", fires, exits)
+	}
+}
+
+func TestTriggerCooldown(t *testing.T) {
+	tr := Trigger{When: "cpu_max>0", Run: "true", Cooldown: "10s"}
+	if err := tr.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	e := NewTriggerEngine([]*Trigger{&tr}, &bytes.Buffer{}, 100, 100)
+	p := ProcSummary{Pid: 1}
+	now := time.Unix(1500000000, 0)
+
+	e.lock.Lock()
+	e.fire(&tr, &p, nil, nil, 1, now)
+	e.fire(&tr, &p, nil, nil, 1, now.Add(time.Second)) // running and cooling down
+	e.lock.Unlock()
+	e.Wait()
+	e.lock.Lock()
+	e.fire(&tr, &p, nil, nil, 1, now.Add(5*time.Second)) // still cooling down
+	e.fire(&tr, &p, nil, nil, 1, now.Add(11*time.Second))
+	e.lock.Unlock()
+	e.Wait()
+
+	if tr.lastRun != now.Add(11*time.Second) {
+		t.Errorf("last run at %s, want 11s in", tr.lastRun.Sub(now))
+	}
+	if tr.suppressed != 0 {
+		t.Errorf("%d suppressed after running, want 0", tr.suppressed)
+	}
+}
+
+func TestTriggerTimeout(t *testing.T) {
+	// the background sleep holds the output open after the shell is killed
+	tr := Trigger{When: "cpu_max>0", Run: "sleep 30 & sleep 30", Timeout: "200ms"}
+	if err := tr.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	e := NewTriggerEngine([]*Trigger{&tr}, &bytes.Buffer{}, 100, 100)
+	started := time.Now()
+	e.lock.Lock()
+	e.fire(&tr, &ProcSummary{Pid: 1}, nil, nil, 1, started)
+	e.lock.Unlock()
+	e.Wait()
+
+	if took := time.Since(started); took > 3*time.Second {
+		t.Errorf("command took %s to be killed", took)
+	}
+	if tr.running != 0 {
+		t.Errorf("%d still running after the timeout", tr.running)
+	}
+}
+
+func TestTailWriter(t *testing.T) {
+	w := tailWriter{max: 4}
+	w.Write([]byte("ab"))
+	w.Write([]byte("cde"))
+	if string(w.buf) != "bcde" {
+		t.Errorf("kept %q, want bcde", w.buf)
+	}
+	w.Write([]byte("fghij"))
+	if string(w.buf) != "ghij" {
+		t.Errorf("kept %q, want ghij", w.buf)
+	}
+}
@@ -49,6 +49,17 @@ func ScaledSub(cur, prev uint64, scale float64) uint64 {
 	return uint64((float64(SafeSub(cur, prev)) * scale) + 0.5)
 }
 
+// TicksPct converts clock ticks over ms milliseconds, like a sampling interval, to percent of
+// a CPU
+func TicksPct(ticks float64, jiffy int, ms float64) float64 {
+	return ticks / float64(jiffy) / (ms / 1000) * 100
+}
+
+// NsPct converts ns of CPU time or delay over ms milliseconds to percent of a CPU
+func NsPct(ns float64, ms float64) float64 {
+	return ns / 1e9 / (ms / 1000) * 100
+}
+
 // note that this is not thread safe
 var buf *bytes.Buffer
 
@@ -0,0 +1,104 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	lib "github.com/uber-common/cpustat/lib"
+)
+
+type sinkConfig struct {
+	format    string // text, jsonl or csv
+	statsd    string // host:port
+	dogstatsd bool
+	influx    string // udp://, http:// or file destination
+	tags      string // k=v,k=v
+	buffer    int    // bytes to buffer for each network sink while it is failing
+}
+
+// sinkQueue is how many summaries a network sink can fall behind by before they're dropped
+const sinkQueue = 16
+
+// parseTags turns "host=web01,env=prod" into a map
+func parseTags(spec string) (map[string]string, error) {
+	tags := make(map[string]string)
+	if spec == "" {
+		return tags, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("bad tag %q, must be key=value", pair)
+		}
+		tags[parts[0]] = parts[1]
+	}
+	return tags, nil
+}
+
+// initSinks sets up everything that gets a summary of each window, other than text mode
+// and termui, which display more than the summary has
+func initSinks(conf sinkConfig) ([]lib.Sink, error) {
+	var sinks []lib.Sink
+
+	tags, err := parseTags(conf.tags)
+	if err != nil {
+		return nil, err
+	}
+
+	switch conf.format {
+	case "jsonl":
+		sinks = append(sinks, newJSONLSink())
+	case "csv":
+		// cpustat only has the default collectors, so there are no metric columns
+		sink, err := lib.NewCSVSink(os.Stdout, lib.Metrics{})
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if conf.statsd != "" {
+		sink, err := lib.NewStatsdSink(conf.statsd, conf.buffer)
+		if err != nil {
+			return nil, err
+		}
+		sink.DogStatsd = conf.dogstatsd
+		sink.Tags = tags
+		sinks = append(sinks, lib.NewAsyncSink(sink, sinkQueue, logSinkError))
+	}
+	if conf.influx != "" {
+		sink, err := lib.NewInfluxSink(conf.influx, conf.buffer)
+		if err != nil {
+			return nil, err
+		}
+		sink.Tags = tags
+		sinks = append(sinks, lib.NewAsyncSink(sink, sinkQueue, logSinkError))
+	}
+	return sinks, nil
+}
+
+func logSinkError(err error) {
+	log.Println(err)
+}
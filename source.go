@@ -0,0 +1,202 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Where samples come from, other than the live sampling that lib does. With -r they are read
+// back from a capture file written with -w, and paced to look like the original run.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lib "github.com/uber-common/cpustat/lib"
+)
+
+// perCPUSource can also give the times of each CPU for the last sample, which recording needs
+type perCPUSource interface {
+	PerCPU() lib.PerCPUStats
+}
+
+// commandSource samples a wrapped command and its descendants, until it exits
+type commandSource struct {
+	lib.Source
+	cmd  *command
+	read int
+}
+
+func newCommandSource(src lib.Source, cmd *command) *commandSource {
+	return &commandSource{Source: src, cmd: cmd}
+}
+
+// Wait ends early if the command exits, so short commands don't wait for a whole interval
+func (c *commandSource) Wait(ctx context.Context, sleep time.Duration) {
+	timer := time.NewTimer(sleep)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.cmd.exited:
+	case <-ctx.Done():
+	}
+}
+
+// Read returns io.EOF once the command has exited, except for the first sample, which is
+// the baseline
+func (c *commandSource) Read(procs *lib.ProcSampleList, sys *lib.SystemStats, infoMap lib.ProcInfoMap) error {
+	if c.read > 0 {
+		select {
+		case <-c.cmd.exited:
+			return io.EOF
+		default:
+		}
+	}
+	c.read++
+	return c.Source.Read(procs, sys, infoMap)
+}
+
+type replaySource struct {
+	capture  *lib.CaptureReader
+	filters  lib.Filters
+	from, to time.Time
+	speed    float64     // 1 is the original speed, 0 is as fast as possible
+	step     chan string // if set, each summary waits for a message here
+	samples  int         // samples per summary, for stepping
+	read     int
+	anchor   time.Time // capture time that lines up with wall
+	wall     time.Time
+}
+
+func newReplaySource(capture *lib.CaptureReader, filters lib.Filters, from, to time.Time, speed float64,
+	step chan string, samples int, infoMap lib.ProcInfoMap) (*replaySource, error) {
+
+	if from.IsZero() == false {
+		if err := capture.Seek(from, infoMap); err != nil {
+			return nil, err
+		}
+	}
+	return &replaySource{capture: capture, filters: filters, from: from, to: to, speed: speed, step: step,
+		samples: samples}, nil
+}
+
+// stepLines turns each line typed on stdin into a step, for -step in text mode
+func stepLines(step chan string) {
+	in := bufio.NewScanner(os.Stdin)
+	for in.Scan() {
+		step <- strings.TrimSpace(in.Text())
+	}
+}
+
+func (r *replaySource) Wait(ctx context.Context, sleep time.Duration) {
+	if r.step != nil && (r.read-1)%r.samples == 0 {
+		select {
+		case <-r.step:
+		case <-ctx.Done():
+		}
+		r.anchor = time.Time{}
+	}
+}
+
+// Read returns the next sample at or after -from, sleeping until it is due if replaying at
+// a given speed. At the end of the capture or after -to, it returns io.EOF.
+func (r *replaySource) Read(procs *lib.ProcSampleList, sys *lib.SystemStats, infoMap lib.ProcInfoMap) error {
+	for {
+		if err := r.capture.Next(procs, sys, infoMap); err != nil {
+			return err
+		}
+		if sys.CaptureTime.Before(r.from) == false {
+			break
+		}
+	}
+	if r.to.IsZero() == false && sys.CaptureTime.After(r.to) {
+		return io.EOF
+	}
+	r.filter(procs, infoMap)
+	r.read++
+
+	if r.speed > 0 && r.step == nil {
+		if r.anchor.IsZero() {
+			r.anchor, r.wall = sys.CaptureTime, time.Now()
+		}
+		due := r.wall.Add(time.Duration(float64(sys.CaptureTime.Sub(r.anchor)) / r.speed))
+		time.Sleep(due.Sub(time.Now()))
+	}
+	return nil
+}
+
+func (r *replaySource) PerCPU() lib.PerCPUStats {
+	return r.capture.PerCPU()
+}
+
+// filter applies -p and -u, which the capture was not necessarily written with
+func (r *replaySource) filter(procs *lib.ProcSampleList, infoMap lib.ProcInfoMap) {
+	kept := uint32(0)
+	for i := uint32(0); i < procs.Len; i++ {
+		pid := procs.Samples[i].Pid
+		if r.filters.PidMatch(pid) == false {
+			continue
+		}
+		if info, ok := infoMap[pid]; ok && r.filters.UserMatch(int(info.UID)) == false {
+			continue
+		}
+		procs.Samples[kept] = procs.Samples[i]
+		kept++
+	}
+	procs.Len = kept
+}
+
+// recordingSource writes every sample it reads to a capture file, for -w. Close is called
+// from the exit handler, so it can't happen in the middle of writing a sample.
+type recordingSource struct {
+	lib.Source // set by wrap
+	lock       sync.Mutex
+	capture    *lib.CaptureWriter
+}
+
+// wrap records the samples of src, which is a live source or a replay
+func (r *recordingSource) wrap(src lib.Source) lib.Source {
+	r.Source = src
+	return r
+}
+
+func (r *recordingSource) Read(procs *lib.ProcSampleList, sys *lib.SystemStats, infoMap lib.ProcInfoMap) error {
+	if err := r.Source.Read(procs, sys, infoMap); err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if src, ok := r.Source.(perCPUSource); ok {
+		if cpus := src.PerCPU(); cpus != nil {
+			if err := r.capture.WritePerCPU(cpus); err != nil {
+				return err
+			}
+		}
+	}
+	return r.capture.WriteSample(procs, sys, infoMap)
+}
+
+func (r *recordingSource) Close() error {
+	r.lock.Lock()
+	return r.capture.Close()
+}
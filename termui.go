@@ -70,7 +70,7 @@ var colorList []termui.Attribute
 var graphColors map[string]termui.Attribute
 var dataLabels []string
 
-func tuiInit(ch chan string, interval int) {
+func tuiInit(ch chan string, interval int, sortKey lib.SortKey, sortChan chan lib.SortKey, stepChan chan string) {
 	defer func() {
 		if r := recover(); r != nil {
 			buf := make([]byte, 4096)
@@ -124,7 +124,7 @@ func tuiInit(ch chan string, interval int) {
 	procChart = termui.NewLineChart()
 	procChart.Name = "procChart"
 	procChart.Border = false
-	procChart.BorderLabel = "       top procs"
+	procChart.BorderLabel = fmt.Sprintf("       top procs by %s (s to change)", sortKey)
 	procChart.Height = termui.TermHeight() / 2
 	procChart.YFloor = 0.0
 
@@ -150,6 +150,28 @@ func tuiInit(ch chan string, interval int) {
 		tuiFatal("closing from keyboard")
 	})
 
+	// the main loop picks up the new key at the next summary
+	termui.Handle("/sys/kbd/s", func(termui.Event) {
+		sortKey = (sortKey + 1) % lib.NumSortKeys
+		select {
+		case <-sortChan:
+		default:
+		}
+		sortChan <- sortKey
+		procChart.BorderLabel = fmt.Sprintf("       top procs by %s (changing)", sortKey)
+		termui.Render(procChart)
+	})
+
+	// stepping through a replay, the main loop waits for this before each summary
+	if stepChan != nil {
+		termui.Handle("/sys/kbd/n", func(termui.Event) {
+			select {
+			case stepChan <- "n":
+			default:
+			}
+		})
+	}
+
 	termui.Handle("/sys/wnd/resize", func(e termui.Event) {
 		mainList.Height = termui.TermHeight() / 2
 		procChart.Height = termui.TermHeight() / 2
@@ -162,10 +184,10 @@ func tuiInit(ch chan string, interval int) {
 	termui.Loop()
 }
 
-// this is a lot of copy/paste from dumpStats. Would be good to refactor this to share.
 func tuiListUpdate(infoMap lib.ProcInfoMap, list lib.Pidlist, procSum lib.ProcSampleMap,
 	procHist lib.ProcStatsHistMap, taskHist lib.TaskStatsHistMap,
-	sysSum *lib.SystemStats, sysHist *lib.SystemStatsHist, jiffy, interval, samples int) {
+	sysSum *lib.SystemStats, sysHist *lib.SystemStatsHist, cols []*column, sortKey lib.SortKey,
+	jiffy, interval, samples int) {
 
 	// if something in here panics, the output goes to the screen, which conflicts with termbox mode.
 	// try to capture this and quit termbox before we print the crash.
@@ -175,62 +197,36 @@ func tuiListUpdate(infoMap lib.ProcInfoMap, list lib.Pidlist, procSum lib.ProcSa
 		}
 	}()
 
-	scale := func(val float64) float64 {
-		return val / float64(jiffy) / float64(interval) * 1000 * 100
-	}
-	scaleSum := func(val float64, count int64) float64 {
-		valSec := val / float64(jiffy)
-		sampleSec := float64(interval) * float64(count) / 1000.0
-		ret := (valSec / sampleSec) * 100
-		return ret
-	}
-	scaleSumUs := func(val float64, count int64) float64 {
-		valSec := val / 1000 / 1000 / float64(interval)
-		sampleSec := float64(interval) * float64(count) / 1000.0
-		return (valSec / sampleSec) * 100
-	}
-
+	procChart.BorderLabel = fmt.Sprintf("       top procs by %s (s to change)", sortKey)
 	graphColors = make(map[string]termui.Attribute)
-	mainList.Items = make([]string, len(list)+1)
+	mainList.Items = make([]string, 1, len(list)+1)
 	colorPos := 0
 
-	mainList.Items[0] = fmt.Sprint("                      name    pid     min     max     usr     sys    runq     iow    swap   vcx   icx   ctime   rss nice thrd  sam\n")
-
-	for i, pid := range list {
-		sampleCount := procHist[pid].Ustime.TotalCount()
-
-		var cpuDelay, blockDelay, swapDelay, nvcsw, nivcsw string
+	widths := layout(cols, termui.TermWidth())
+	mainList.Items[0] = strings.Join(formatHeader(cols, widths), " ")
 
-		if proc, ok := procSum[pid]; ok == true {
-			cpuDelay = trim(scaleSumUs(float64(proc.Task.Cpudelaytotal), sampleCount), 7)
-			blockDelay = trim(scaleSumUs(float64(proc.Task.Blkiodelaytotal), sampleCount), 7)
-			swapDelay = trim(scaleSumUs(float64(proc.Task.Swapindelaytotal), sampleCount), 7)
-			nvcsw = formatNum(proc.Task.Nvcsw)
-			nivcsw = formatNum(proc.Task.Nivcsw)
-		} // silently ignore missing data in fancy mode
+	for _, pid := range list {
+		row, ok := newProcRow(pid, infoMap, procSum, procHist, taskHist, jiffy, interval)
+		if ok == false { // silently ignore missing data in fancy mode
+			continue
+		}
 
 		strPid := fmt.Sprint(pid)
 		graphColors[strPid] = colorList[colorPos]
 
-		mainList.Items[i+1] = fmt.Sprintf("[%26s %6d](fg-color%d) %7s %7s %7s %7s %7s %7s %7s %5s %5s %7s %5s %4d %4d %4d",
-			trunc(infoMap[pid].Friendly, 26),
-			pid,
-			colorPos,
-			trim(scale(float64(procHist[pid].Ustime.Min())), 7),
-			trim(scale(float64(procHist[pid].Ustime.Max())), 7),
-			trim(scaleSum(float64(procSum[pid].Proc.Utime), sampleCount), 7),
-			trim(scaleSum(float64(procSum[pid].Proc.Stime), sampleCount), 7),
-			cpuDelay,
-			blockDelay,
-			swapDelay,
-			nvcsw,
-			nivcsw,
-			trim(scaleSum(float64(procSum[pid].Proc.Cutime+procSum[pid].Proc.Cstime), sampleCount), 7),
-			formatMem(procSum[pid].Proc.Rss),
-			infoMap[pid].Nice,
-			procSum[pid].Proc.Numthreads,
-			sampleCount,
-		)
+		cells := formatCells(cols, widths, row)
+		for i, col := range cols {
+			if col.text {
+				cells[i] = strings.Map(lib.StripSpecial, cells[i])
+			}
+		}
+		fitFlex(cols, widths, cells)
+		for i, col := range cols {
+			if col.ident {
+				cells[i] = fmt.Sprintf("[%s](fg-color%d)", cells[i], colorPos)
+			}
+		}
+		mainList.Items = append(mainList.Items, strings.Join(cells, " "))
 		colorPos = (colorPos + 1) % len(colorList)
 	}
 
@@ -28,10 +28,14 @@ import (
 	lib "github.com/uber-common/cpustat/lib"
 )
 
+// formatMem formats a number of pages, like rss in /proc/[pid]/stat
 func formatMem(num uint64) string {
+	return formatKB(num * lib.PageSize / 1024)
+}
+
+func formatKB(num uint64) string {
 	letter := string("K")
 
-	num = num * 4
 	if num >= 1000 {
 		num = (num + 512) / 1024
 		letter = "M"
@@ -73,17 +77,15 @@ func trim(num float64, max int) string {
 }
 
 func trunc(str string, length int) string {
-	if len(str) <= length {
-		return str
-	}
-	return str[:length]
+	str, _ = cutRunes(str, length)
+	return str
 }
 
-func textInit(interval, samples, topN int, filters lib.Filters) {
-	fmt.Printf("sampling interval:%s, summary interval:%s (%d samples), showing top %d procs,",
+func textInit(interval, samples, topN int, sortKey lib.SortKey, filters lib.Filters) {
+	fmt.Printf("sampling interval:%s, summary interval:%s (%d samples), showing top %d procs by %s,",
 		time.Duration(interval)*time.Millisecond,
 		time.Duration(interval*samples)*time.Millisecond,
-		samples, topN)
+		samples, topN, sortKey)
 	fmt.Print(" user filter:")
 	if len(filters.User) == 0 {
 		fmt.Print("all")
@@ -101,22 +103,12 @@ func textInit(interval, samples, topN int, filters lib.Filters) {
 
 func dumpStats(infoMap lib.ProcInfoMap, list lib.Pidlist, procSum lib.ProcSampleMap,
 	procHist lib.ProcStatsHistMap, taskHist lib.TaskStatsHistMap,
-	sysSum *lib.SystemStats, sysHist *lib.SystemStatsHist, jiffy, interval, samples int) {
+	sysSum *lib.SystemStats, sysHist *lib.SystemStatsHist, cols []*column, wrap bool,
+	jiffy, interval, samples int) {
 
 	scale := func(val float64) float64 {
 		return val / float64(jiffy) / float64(interval) * 1000 * 100
 	}
-	scaleSum := func(val float64, count int64) float64 {
-		valSec := val / float64(jiffy)
-		sampleSec := float64(interval) * float64(count) / 1000.0
-		ret := (valSec / sampleSec) * 100
-		return ret
-	}
-	scaleSumUs := func(val float64, count int64) float64 {
-		valSec := val / 1000 / 1000 / float64(interval)
-		sampleSec := float64(interval) * float64(count) / 1000.0
-		return (valSec / sampleSec) * 100
-	}
 
 	fmt.Printf("usr:    %4s/%4s/%4s   sys:%4s/%4s/%4s    nice:%4s/%4s/%4s  idle:%4s/%4s/%4s\n",
 		trim(scale(float64(sysHist.Usr.Min())), 4),
@@ -151,40 +143,44 @@ func dumpStats(infoMap lib.ProcInfoMap, list lib.Pidlist, procSum lib.ProcSample
 		sysSum.ProcsTotal,
 	)
 
-	fmt.Print("                      name    pid     min     max     usr     sys    runq     iow    swap   vcx   icx   ctime   rss nice thrd  sam\n")
+	widths := layout(cols, termWidth())
+	fmt.Println(strings.TrimRight(strings.Join(formatHeader(cols, widths), " "), " "))
 	for _, pid := range list {
-		sampleCount := procHist[pid].Ustime.TotalCount()
-
-		var cpuDelay, blockDelay, swapDelay, nvcsw, nivcsw string
-
-		if proc, ok := procSum[pid]; ok == true {
-			cpuDelay = trim(scaleSumUs(float64(proc.Task.Cpudelaytotal), sampleCount), 7)
-			blockDelay = trim(scaleSumUs(float64(proc.Task.Blkiodelaytotal), sampleCount), 7)
-			swapDelay = trim(scaleSumUs(float64(proc.Task.Swapindelaytotal), sampleCount), 7)
-			nvcsw = formatNum(proc.Task.Nvcsw)
-			nivcsw = formatNum(proc.Task.Nivcsw)
-		} else {
+		row, ok := newProcRow(pid, infoMap, procSum, procHist, taskHist, jiffy, interval)
+		if ok == false {
 			fmt.Println("pid", pid, "missing at sum time")
 			continue
 		}
+		for _, line := range fitLines(cols, widths, formatCells(cols, widths, row), wrap) {
+			fmt.Println(line)
+		}
+	}
+}
 
-		fmt.Printf("%26s %6d %7s %7s %7s %7s %7s %7s %7s %5s %5s %7s %5s %4d %4d %4d\n",
-			trunc(infoMap[pid].Friendly, 26),
-			pid,
-			trim(scale(float64(procHist[pid].Ustime.Min())), 7),
-			trim(scale(float64(procHist[pid].Ustime.Max())), 7),
-			trim(scaleSum(float64(procSum[pid].Proc.Utime), sampleCount), 7),
-			trim(scaleSum(float64(procSum[pid].Proc.Stime), sampleCount), 7),
-			cpuDelay,
-			blockDelay,
-			swapDelay,
-			nvcsw,
-			nivcsw,
-			trim(scaleSum(float64(procSum[pid].Proc.Cutime+procSum[pid].Proc.Cstime), sampleCount), 7),
-			formatMem(procSum[pid].Proc.Rss),
-			infoMap[pid].Nice,
-			procSum[pid].Proc.Numthreads,
-			sampleCount,
-		)
+// dumpBursts lists the bursts that ended during the last summary
+func dumpBursts(bursts []lib.Burst) {
+	for _, b := range bursts {
+		fmt.Printf("burst %s-%s %6sms %7d %-16s peak:%5s%% avg:%5s%% baseline:%5s%%\n",
+			b.Start.Format("15:04:05.000"), b.End.Format("15:04:05.000"), trim(b.Duration, 6),
+			b.Pid, trunc(b.Name, 16), trim(b.Peak, 5), trim(b.Avg, 5), trim(b.Baseline, 5))
 	}
 }
+
+// dumpTiers shows how many processes each tier has, and what reading them cost
+func dumpTiers(stats lib.TierStats) {
+	fmt.Printf("tiers: fast %d procs, %d reads in %sms; slow %d procs, %d reads in %sms, %d skipped\n",
+		stats.Fast.Procs, stats.Fast.Reads, trim(stats.Fast.ReadMs, 6),
+		stats.Slow.Procs, stats.Slow.Reads, trim(stats.Slow.ReadMs, 6), stats.Skipped)
+}
+
+// dumpTiming says if samples were missed, which the averages above were filled in across
+func dumpTiming(timing *lib.SampleTiming) {
+	if timing.Missed == 0 {
+		return
+	}
+	fmt.Printf("missed %d samples", timing.Missed)
+	if timing.Late.TotalCount() > 0 {
+		fmt.Printf(", others up to %sms late", trim(float64(timing.Late.Max())/1000, 6))
+	}
+	fmt.Println()
+}
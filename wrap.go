@@ -0,0 +1,144 @@
+// Copyright (c) 2016 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Wrapping a command, like cpustat -- make -j32. Only the command and what it starts are
+// sampled, and when it exits there's a report like time(1) with a lot more in it.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	lib "github.com/uber-common/cpustat/lib"
+)
+
+type command struct {
+	cmd     *exec.Cmd
+	exited  chan struct{} // closed once the command has been reaped
+	started time.Time
+	ended   time.Time
+}
+
+// newCommand runs -run with sh, or else args, sharing our terminal
+func newCommand(run string, args []string) *command {
+	var cmd *exec.Cmd
+	if run != "" {
+		cmd = exec.Command("/bin/sh", "-c", run)
+	} else {
+		cmd = exec.Command(args[0], args[1:]...)
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return &command{cmd: cmd, exited: make(chan struct{})}
+}
+
+// start starts the command. From then on, SIGTERM is passed on to it and SIGINT is ignored,
+// since a ^C in the terminal goes to the command too, so that neither stops us before it.
+func (c *command) start() error {
+	c.started = time.Now()
+	if err := c.cmd.Start(); err != nil {
+		return err
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range sigChan {
+			if sig == syscall.SIGTERM {
+				c.cmd.Process.Signal(sig)
+			}
+		}
+	}()
+
+	go func() {
+		c.cmd.Wait()
+		c.ended = time.Now()
+		close(c.exited)
+	}()
+	return nil
+}
+
+// status is what a shell would say the command exited with
+func (c *command) status() int {
+	state := c.cmd.ProcessState
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if ok == false {
+		if state.Success() {
+			return 0
+		}
+		return 1
+	}
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// report describes the whole run once the command has exited. The first line is from the
+// kernel, so it includes processes too short to be sampled.
+func (c *command) report(out io.Writer, stats *lib.TreeStats, topN, interval int) {
+	state := c.cmd.ProcessState
+	real := c.ended.Sub(c.started).Seconds()
+	usr, sys := state.UserTime().Seconds(), state.SystemTime().Seconds()
+
+	fmt.Fprintf(out, "\n%s exited with status %d\n", strings.Join(c.cmd.Args, " "), c.status())
+	fmt.Fprintf(out, "real: %.2fs  usr: %.2fs  sys: %.2fs  cpu: %.0f%%", real, usr, sys, (usr+sys)/real*100)
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		fmt.Fprintf(out, "  largest rss: %s", formatKB(uint64(rusage.Maxrss)))
+	}
+	fmt.Fprintln(out)
+
+	if stats.Samples == 0 {
+		fmt.Fprintln(out, "exited before the first sample")
+		return
+	}
+	fmt.Fprintf(out, "%d samples every %dms, %d processes, at most %d at once with %d threads\n",
+		stats.Samples, interval, len(stats.Procs), stats.PeakProcs, stats.PeakThreads)
+	fmt.Fprintf(out, "peak rss: %s at %.1fs\n\n", formatKB(stats.PeakRSS/1024),
+		stats.PeakRSSTime.Sub(stats.Start).Seconds())
+
+	fmt.Fprintf(out, "%-10s %7s %7s %7s %7s %7s %7s\n", "% of a cpu", "min", "avg", "p50", "p90", "p99", "max")
+	for _, row := range []struct {
+		name string
+		hist interface {
+			Min() int64
+			Max() int64
+			Mean() float64
+			ValueAtQuantile(float64) int64
+		}
+	}{{"cpu", stats.Tree.CPU}, {"runq", stats.Tree.Runq}, {"iowait", stats.Tree.Iowait}} {
+		fmt.Fprintf(out, "%-10s %7s %7s %7s %7s %7s %7s\n", row.name,
+			trim(float64(row.hist.Min())/100, 7), trim(row.hist.Mean()/100, 7),
+			trim(float64(row.hist.ValueAtQuantile(50))/100, 7), trim(float64(row.hist.ValueAtQuantile(90))/100, 7),
+			trim(float64(row.hist.ValueAtQuantile(99))/100, 7), trim(float64(row.hist.Max())/100, 7))
+	}
+
+	fmt.Fprintf(out, "\n%7s %-16s %7s %7s %7s %7s %7s\n", "pid", "name", "usr", "sys", "runq", "iowait", "rss")
+	for _, p := range stats.Top(topN) {
+		fmt.Fprintf(out, "%7d %-16s %6ss %6ss %6ss %6ss %7s\n", p.Pid, trunc(p.Name, 16),
+			trim(p.Usr, 6), trim(p.Sys, 6), trim(p.Runq, 6), trim(p.Iowait, 6), formatKB(p.PeakRSS/1024))
+	}
+}